@@ -3,8 +3,14 @@ package config
 import (
 	"github.com/golang-jwt/jwt/v5"
 
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
+	"net/http"
+	"net/url"
+	"slices"
 	"strconv"
+	"strings"
 	"os"
 )
 
@@ -17,7 +23,72 @@ type Config struct {
 	RefreshTokenExp int
 	AuthCodeExp int
 	SessionExp int
+	SessionIdleTimeout int
+	RememberMeExp int
+	RememberMeIdleTimeout int
+	// PasswordHashAlgorithm hashes new passwords, argon2id or bcrypt. Stored hashes of the other
+	// algorithm keep working and are rehashed on login
+	PasswordHashAlgorithm string
 	HashCost int
+	// Argon2Memory is in KiB
+	Argon2Memory uint32
+	Argon2Iterations uint32
+	Argon2Parallelism uint8
+	// PasswordPepper keys the argon2id hashes, it is kept out of the database so a leaked
+	// dump alone cannot be cracked
+	PasswordPepper []byte
+	AdminAPIKey string
+
+	SessionCookieDomain string
+	SessionCookiePath string
+	SessionCookieLifetime int
+	SessionCookieSecure bool
+	SessionCookieSameSite http.SameSite
+
+	TemplatesDir string
+
+	// PublicURL is where the sso is reachable, e.g. https://sso.example.com
+	PublicURL string
+	SAMLEntityID string
+	SAMLAssertionExp int
+
+	// CredentialEncryptionKey is the AES-256 key of the stored totp secrets
+	CredentialEncryptionKey []byte
+	// TOTPIssuer names the sso in authenticator apps
+	TOTPIssuer string
+	WebAuthnRPID string
+	WebAuthnRPName string
+	WebAuthnOrigins []string
+
+	// SMTPAddr is the host:port of the mail relay, the flows that mail users are disabled without it
+	SMTPAddr string
+	SMTPUsername string
+	SMTPPassword string
+	MailFrom string
+	// EmailTokenKey signs the tokens of the links mailed to users
+	EmailTokenKey []byte
+
+	PasswordMinLength int
+	PasswordMaxLength int
+	PasswordMinClasses int
+	PasswordBlocklist []string
+	// LoginMaxFailures locks an account out for LoginLockoutDuration seconds, zero disables the lockout
+	LoginMaxFailures int
+	LoginIPMaxFailures int
+	LoginLockoutDuration int
+	// LoginFailureWindow is how long failed logins are remembered since the last one, in seconds
+	LoginFailureWindow int
+	// RateLimitBackend keeps the buckets in memory of each instance, or in postgres where every instance shares them
+	RateLimitBackend string
+	// RateLimitIP, RateLimitClient and RateLimitAccount limit the login, registration, token and
+	// password reset endpoints per address, client_id and account
+	RateLimitIP RateLimit
+	RateLimitClient RateLimit
+	RateLimitAccount RateLimit
+	// BreachedPasswordsDir holds the Pwned Passwords range files, the breached check is off without it
+	BreachedPasswordsDir string
+
+	IdentityProviders []IdentityProviderConfig
 }
 
 func GetConfig() (*Config, error) {
@@ -67,7 +138,267 @@ func GetConfig() (*Config, error) {
 		return nil, err
 	}
 
-	hashCost := 10
+	sessionIdleTimeout, err := intFromEnv("SESSION_IDLE_TIMEOUT", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	rememberMeExp, err := intFromEnv("REMEMBER_ME_EXPIRATION", 30*24*60*60)
+	if err != nil {
+		return nil, err
+	}
+
+	rememberMeIdleTimeout, err := intFromEnv("REMEMBER_ME_IDLE_TIMEOUT", 7*24*60*60)
+	if err != nil {
+		return nil, err
+	}
+
+	passwordHashAlgorithm := os.Getenv("PASSWORD_HASH_ALGORITHM")
+	if passwordHashAlgorithm == "" {
+		passwordHashAlgorithm = "argon2id"
+	}
+	if passwordHashAlgorithm != "argon2id" && passwordHashAlgorithm != "bcrypt" {
+		return nil, errors.New("PASSWORD_HASH_ALGORITHM must be argon2id or bcrypt")
+	}
+
+	hashCost, err := intFromEnv("BCRYPT_COST", 10)
+	if err != nil {
+		return nil, err
+	}
+	if hashCost < 4 || hashCost > 31 {
+		return nil, errors.New("BCRYPT_COST must be between 4 and 31")
+	}
+
+	// the second recommended option of RFC 9106
+	argon2Memory, err := intFromEnv("ARGON2_MEMORY", 64*1024)
+	if err != nil {
+		return nil, err
+	}
+	argon2Iterations, err := intFromEnv("ARGON2_ITERATIONS", 3)
+	if err != nil {
+		return nil, err
+	}
+	argon2Parallelism, err := intFromEnv("ARGON2_PARALLELISM", 4)
+	if err != nil {
+		return nil, err
+	}
+	if argon2Memory < 8*argon2Parallelism || argon2Iterations < 1 || argon2Parallelism < 1 || argon2Parallelism > 255 {
+		return nil, errors.New("ARGON2_MEMORY, ARGON2_ITERATIONS and ARGON2_PARALLELISM are out of range")
+	}
+
+	// changing the pepper locks out every account hashed with the old one until its password is reset
+	var passwordPepper []byte
+	if pepperStr := os.Getenv("PASSWORD_PEPPER"); pepperStr != "" {
+		passwordPepper, err = base64.StdEncoding.DecodeString(pepperStr)
+		if err != nil || len(passwordPepper) < 16 {
+			return nil, errors.New("PASSWORD_PEPPER must be at least 16 bytes in base64")
+		}
+		if passwordHashAlgorithm != "argon2id" {
+			return nil, errors.New("PASSWORD_PEPPER requires PASSWORD_HASH_ALGORITHM=argon2id")
+		}
+	}
+
+	// admin endpoints are disabled unless the key is set
+	adminAPIKey := os.Getenv("ADMIN_API_KEY")
+
+	cookieDomain := os.Getenv("SESSION_COOKIE_DOMAIN")
+
+	cookiePath := os.Getenv("SESSION_COOKIE_PATH")
+	if cookiePath == "" {
+		cookiePath = "/"
+	}
+
+	// zero keeps the cookie as long as the session it carries
+	cookieLifetime, err := intFromEnv("SESSION_COOKIE_LIFETIME", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	cookieSecure := true
+	if cookieSecureStr := os.Getenv("SESSION_COOKIE_SECURE"); cookieSecureStr != "" {
+		cookieSecure, err = strconv.ParseBool(cookieSecureStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var cookieSameSite http.SameSite
+	switch strings.ToLower(os.Getenv("SESSION_COOKIE_SAMESITE")) {
+	case "", "lax":
+		cookieSameSite = http.SameSiteLaxMode
+	case "strict":
+		cookieSameSite = http.SameSiteStrictMode
+	case "none":
+		if !cookieSecure {
+			return nil, errors.New("SESSION_COOKIE_SAMESITE=none requires a secure cookie")
+		}
+		cookieSameSite = http.SameSiteNoneMode
+	default:
+		return nil, errors.New("SESSION_COOKIE_SAMESITE must be one of lax, strict, none")
+	}
+
+	// optional directory with *.html files overriding the embedded login pages
+	templatesDir := os.Getenv("TEMPLATES_DIR")
+
+	publicURL := strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/")
+	if publicURL == "" {
+		publicURL = "http://localhost:8080"
+	}
+
+	// the metadata url is the conventional entity id of a saml identity provider
+	samlEntityID := os.Getenv("SAML_ENTITY_ID")
+	if samlEntityID == "" {
+		samlEntityID = publicURL + "/saml/metadata"
+	}
+
+	samlAssertionExp, err := intFromEnv("SAML_ASSERTION_EXPIRATION", 5*60)
+	if err != nil {
+		return nil, err
+	}
+
+	// the key must survive restarts or enrolled authenticators stop working, so without one
+	// it is derived from the signing key
+	derivedKey := sha256.Sum256([]byte(signingKey))
+	credentialKey := derivedKey[:]
+	if keyStr := os.Getenv("CREDENTIAL_ENCRYPTION_KEY"); keyStr != "" {
+		credentialKey, err = base64.StdEncoding.DecodeString(keyStr)
+		if err != nil || len(credentialKey) != 32 {
+			return nil, errors.New("CREDENTIAL_ENCRYPTION_KEY must be 32 bytes in base64")
+		}
+	}
+
+	parsedPublicURL, err := url.Parse(publicURL)
+	if err != nil {
+		return nil, errors.New("PUBLIC_URL must be a url")
+	}
+
+	totpIssuer := os.Getenv("TOTP_ISSUER")
+	if totpIssuer == "" {
+		totpIssuer = parsedPublicURL.Hostname()
+	}
+
+	// passkeys are bound to the relying party id, changing it makes every registered passkey unusable
+	webAuthnRPID := os.Getenv("WEBAUTHN_RP_ID")
+	if webAuthnRPID == "" {
+		webAuthnRPID = parsedPublicURL.Hostname()
+	}
+
+	webAuthnRPName := os.Getenv("WEBAUTHN_RP_NAME")
+	if webAuthnRPName == "" {
+		webAuthnRPName = webAuthnRPID
+	}
+
+	// origins the browser may run the ceremonies on, comma separated
+	webAuthnOrigins := []string{publicURL}
+	if origins := os.Getenv("WEBAUTHN_ORIGINS"); origins != "" {
+		webAuthnOrigins = strings.Split(origins, ",")
+	}
+
+	smtpAddr := os.Getenv("SMTP_ADDR")
+
+	mailFrom := os.Getenv("MAIL_FROM")
+	if mailFrom == "" {
+		mailFrom = "no-reply@" + parsedPublicURL.Hostname()
+	}
+
+	// the key is derived from the signing key, so every instance accepts the links mailed by the others
+	emailTokenKey := sha256.Sum256([]byte("email tokens " + signingKey))
+
+	loginMaxFailures, err := intFromEnv("LOGIN_MAX_FAILURES", 10)
+	if err != nil {
+		return nil, err
+	}
+
+	// an address is shared by the users behind a nat, it gets more attempts than one account
+	loginIPMaxFailures, err := intFromEnv("LOGIN_IP_MAX_FAILURES", 100)
+	if err != nil {
+		return nil, err
+	}
+
+	loginLockoutDuration, err := intFromEnv("LOGIN_LOCKOUT_DURATION", 15*60)
+	if err != nil {
+		return nil, err
+	}
+
+	loginFailureWindow, err := intFromEnv("LOGIN_FAILURE_WINDOW", 60*60)
+	if err != nil {
+		return nil, err
+	}
+
+	rateLimitBackend := os.Getenv("RATE_LIMIT_BACKEND")
+	if rateLimitBackend == "" {
+		rateLimitBackend = "memory"
+	}
+	if rateLimitBackend != "memory" && rateLimitBackend != "postgres" {
+		return nil, errors.New("RATE_LIMIT_BACKEND must be memory or postgres")
+	}
+
+	rateLimitIP, err := rateLimitFromEnv("RATE_LIMIT_IP", 60, 30)
+	if err != nil {
+		return nil, err
+	}
+
+	// a client signs in all of its users, it gets the most
+	rateLimitClient, err := rateLimitFromEnv("RATE_LIMIT_CLIENT", 600, 100)
+	if err != nil {
+		return nil, err
+	}
+
+	rateLimitAccount, err := rateLimitFromEnv("RATE_LIMIT_ACCOUNT", 10, 10)
+	if err != nil {
+		return nil, err
+	}
+
+	passwordMinLength, err := intFromEnv("PASSWORD_MIN_LENGTH", 8)
+	if err != nil {
+		return nil, err
+	}
+
+	// bcrypt only hashes the first 72 bytes, anything past them would be ignored
+	passwordMaxLength, err := intFromEnv("PASSWORD_MAX_LENGTH", 72)
+	if err != nil {
+		return nil, err
+	}
+
+	// length beats composition rules, so mixing character classes is not required by default
+	passwordMinClasses, err := intFromEnv("PASSWORD_MIN_CLASSES", 0)
+	if err != nil {
+		return nil, err
+	}
+	if passwordMinClasses < 0 || passwordMinClasses > 4 {
+		return nil, errors.New("PASSWORD_MIN_CLASSES must be between 0 and 4")
+	}
+
+	passwordBlocklist, err := LoadPasswordBlocklist(os.Getenv("PASSWORD_BLOCKLIST_FILE"))
+	if err != nil {
+		return nil, err
+	}
+
+	// upstream identity providers, see IdentityProviderConfig for the file format
+	var identityProviders []IdentityProviderConfig
+	if path := os.Getenv("IDENTITY_PROVIDERS_FILE"); path != "" {
+		identityProviders, err = LoadIdentityProviders(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// GOOGLE_* variables predate the providers file and still configure google when it does not
+	if googleClientID := os.Getenv("GOOGLE_CLIENT_ID"); googleClientID != "" && !slices.ContainsFunc(identityProviders, func(p IdentityProviderConfig) bool { return p.Name == "google" }) {
+		google := IdentityProviderConfig{
+			Name: "google",
+			Type: "google",
+			ClientID: googleClientID,
+			ClientSecret: os.Getenv("GOOGLE_CLIENT_SECRET"),
+			RedirectURL: os.Getenv("GOOGLE_REDIRECT_URL"),
+			JWKSURL: os.Getenv("GOOGLE_JWKS_URL"),
+		}
+		if err := google.withDefaults(); err != nil {
+			return nil, err
+		}
+
+		identityProviders = append(identityProviders, google)
+	}
 
 	conf := Config{
 		PostgresURL: dsn,
@@ -78,8 +409,64 @@ func GetConfig() (*Config, error) {
 		RefreshTokenExp: refreshTokenExpiration,
 		AuthCodeExp: authCodeExp,
 		SessionExp: sessionExp,
+		SessionIdleTimeout: sessionIdleTimeout,
+		RememberMeExp: rememberMeExp,
+		RememberMeIdleTimeout: rememberMeIdleTimeout,
+		PasswordHashAlgorithm: passwordHashAlgorithm,
 		HashCost: hashCost,
+		Argon2Memory: uint32(argon2Memory),
+		Argon2Iterations: uint32(argon2Iterations),
+		Argon2Parallelism: uint8(argon2Parallelism),
+		PasswordPepper: passwordPepper,
+		AdminAPIKey: adminAPIKey,
+		SessionCookieDomain: cookieDomain,
+		SessionCookiePath: cookiePath,
+		SessionCookieLifetime: cookieLifetime,
+		SessionCookieSecure: cookieSecure,
+		SessionCookieSameSite: cookieSameSite,
+		TemplatesDir: templatesDir,
+		PublicURL: publicURL,
+		SAMLEntityID: samlEntityID,
+		SAMLAssertionExp: samlAssertionExp,
+		CredentialEncryptionKey: credentialKey,
+		TOTPIssuer: totpIssuer,
+		WebAuthnRPID: webAuthnRPID,
+		WebAuthnRPName: webAuthnRPName,
+		WebAuthnOrigins: webAuthnOrigins,
+		SMTPAddr: smtpAddr,
+		SMTPUsername: os.Getenv("SMTP_USERNAME"),
+		SMTPPassword: os.Getenv("SMTP_PASSWORD"),
+		MailFrom: mailFrom,
+		EmailTokenKey: emailTokenKey[:],
+		LoginMaxFailures: loginMaxFailures,
+		LoginIPMaxFailures: loginIPMaxFailures,
+		LoginLockoutDuration: loginLockoutDuration,
+		LoginFailureWindow: loginFailureWindow,
+		RateLimitBackend: rateLimitBackend,
+		RateLimitIP: rateLimitIP,
+		RateLimitClient: rateLimitClient,
+		RateLimitAccount: rateLimitAccount,
+		PasswordMinLength: passwordMinLength,
+		PasswordMaxLength: passwordMaxLength,
+		PasswordMinClasses: passwordMinClasses,
+		PasswordBlocklist: passwordBlocklist,
+		BreachedPasswordsDir: os.Getenv("BREACHED_PASSWORDS_DIR"),
+		IdentityProviders: identityProviders,
 	}
 
 	return &conf, nil
 }
+
+func intFromEnv(name string, fallback int) (int, error) {
+	str := os.Getenv(name)
+	if str == "" {
+		return fallback, nil
+	}
+
+	value, err := strconv.Atoi(str)
+	if err != nil {
+		return 0, errors.New(name + " must be an integer")
+	}
+
+	return value, nil
+}
@@ -0,0 +1,257 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// IdentityProviderConfig describes one upstream identity provider. Type selects a preset
+// (google, github, gitlab, microsoft) that fills in endpoints, scopes and claims,
+// oidc / oauth2 for any other provider configured by hand, saml for a SAML 2.0 identity provider
+// or ldap for a directory checking the passwords of logins with provider ldap
+type IdentityProviderConfig struct {
+	// Name is used in urls and as the type of the identities created through this provider
+	Name string `json:"name"`
+	Type string `json:"type"`
+	DisplayName string `json:"display_name"`
+
+	// Issuer is the expected iss of id tokens. For oidc providers without explicit endpoints
+	// they are discovered from Issuer + /.well-known/openid-configuration
+	Issuer string `json:"issuer"`
+	// Tenant selects the microsoft entra tenant, common by default
+	Tenant string `json:"tenant"`
+
+	ClientID string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	// RedirectURL is the callback registered at the provider, without it the provider
+	// can only be used to verify id tokens posted to /auth/login
+	RedirectURL string `json:"redirect_url"`
+	Scopes []string `json:"scopes"`
+
+	AuthURL string `json:"auth_url"`
+	TokenURL string `json:"token_url"`
+	// UserInfoURL of a github provider is its user api, e.g. https://github.example.com/api/v3/user
+	// for enterprise servers, the emails api is read from UserInfoURL + /emails
+	UserInfoURL string `json:"userinfo_url"`
+	JWKSURL string `json:"jwks_url"`
+
+	Claims ClaimMapping `json:"claims"`
+
+	// MetadataURL or MetadataFile is the SAML metadata of the identity provider, it fills Issuer with
+	// its entity id, AuthURL with its HTTP-Redirect sso service and Certificates with its signing keys.
+	// For saml providers ClientID is the entity id of the sso and RedirectURL its assertion consumer service
+	MetadataURL string `json:"metadata_url"`
+	MetadataFile string `json:"metadata_file"`
+	// Certificates are the base64 or pem encoded certificates assertions may be signed with
+	Certificates []string `json:"certificates"`
+
+	// URL is the ldap directory, e.g. ldaps://dc.corp.example.com. Users are searched below BaseDN
+	// with UserFilter as BindDN, {username} being the escaped login name, and their password is checked
+	// by binding as the entry found. Without BindDN the user binds directly as UserDN, e.g.
+	// uid={username},ou=people,dc=example,dc=com. Issuer defaults to BaseDN
+	URL string `json:"url"`
+	StartTLS bool `json:"start_tls"`
+	BindDN string `json:"bind_dn"`
+	BindPassword string `json:"bind_password"`
+	BaseDN string `json:"base_dn"`
+	UserFilter string `json:"user_filter"`
+	UserDN string `json:"user_dn"`
+	// GroupRoles maps group dns to roles, the roles of a directory user are replaced by those of its groups
+	// at every login. Groups are read from memberOf unless GroupBaseDN is set, they are searched there
+	// with GroupFilter then, {dn} being the escaped user dn
+	GroupRoles map[string]string `json:"group_roles"`
+	GroupBaseDN string `json:"group_base_dn"`
+	GroupFilter string `json:"group_filter"`
+
+	// LinkByEmail lets a login through this provider join an existing account with the same verified email.
+	// It defaults to true for google, github and gitlab, other providers may not own the emails they assert
+	// and their users have to sign in to the existing account first
+	LinkByEmail *bool `json:"link_by_email"`
+}
+
+// ClaimMapping names the upstream claims the user and identity fields are read from
+type ClaimMapping struct {
+	Subject string `json:"subject"`
+	Email string `json:"email"`
+	// EmailVerified may be left empty when the provider only returns verified addresses,
+	// set EmailAlwaysVerified in that case. Unverified emails never create or join an account
+	EmailVerified string `json:"email_verified"`
+	EmailAlwaysVerified bool `json:"email_always_verified"`
+	Name string `json:"name"`
+}
+
+var providerName = regexp.MustCompile(`^[a-z0-9_-]{1,50}$`)
+
+// LoadIdentityProviders reads a json array of providers. ${VAR} references are expanded
+// from the environment so secrets do not have to live in the file
+func LoadIdentityProviders(path string) ([]IdentityProviderConfig, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var providers []IdentityProviderConfig
+	if err := json.Unmarshal([]byte(os.ExpandEnv(string(raw))), &providers); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	seen := map[string]bool{}
+	directory := false
+	for i := range providers {
+		p := &providers[i]
+
+		if !providerName.MatchString(p.Name) {
+			return nil, fmt.Errorf("identity provider name %q must match %s", p.Name, providerName)
+		}
+		if p.Name == "email" || p.Name == "oauth" {
+			return nil, fmt.Errorf("identity provider name %q is reserved", p.Name)
+		}
+		if seen[p.Name] {
+			return nil, fmt.Errorf("identity provider %q is configured twice", p.Name)
+		}
+		seen[p.Name] = true
+
+		// logins name the provider ldap, not the directory
+		if p.Type == "ldap" {
+			if directory {
+				return nil, errors.New("only one ldap directory can be configured")
+			}
+			directory = true
+		}
+
+		if err := p.withDefaults(); err != nil {
+			return nil, fmt.Errorf("identity provider %q: %w", p.Name, err)
+		}
+	}
+
+	return providers, nil
+}
+
+// IsOIDC reports whether the provider issues id tokens, oauth2 providers are read through their userinfo endpoint
+func (p *IdentityProviderConfig) IsOIDC() bool {
+	return p.Type != "oauth2" && p.Type != "github" && p.Type != "saml" && p.Type != "ldap"
+}
+
+func (p *IdentityProviderConfig) withDefaults() error {
+	switch p.Type {
+	case "google":
+		p.Issuer = orDefault(p.Issuer, "https://accounts.google.com")
+		p.AuthURL = orDefault(p.AuthURL, "https://accounts.google.com/o/oauth2/v2/auth")
+		p.TokenURL = orDefault(p.TokenURL, "https://oauth2.googleapis.com/token")
+		p.JWKSURL = orDefault(p.JWKSURL, "https://www.googleapis.com/oauth2/v3/certs")
+		p.DisplayName = orDefault(p.DisplayName, "Google")
+	case "gitlab":
+		p.Issuer = strings.TrimSuffix(orDefault(p.Issuer, "https://gitlab.com"), "/")
+		p.AuthURL = orDefault(p.AuthURL, p.Issuer+"/oauth/authorize")
+		p.TokenURL = orDefault(p.TokenURL, p.Issuer+"/oauth/token")
+		p.JWKSURL = orDefault(p.JWKSURL, p.Issuer+"/oauth/discovery/keys")
+		p.DisplayName = orDefault(p.DisplayName, "GitLab")
+	case "microsoft":
+		p.Tenant = orDefault(p.Tenant, "common")
+		base := "https://login.microsoftonline.com/" + p.Tenant
+		// multi tenant apps receive tokens issued by the tenant of each user
+		if p.Tenant == "common" || p.Tenant == "organizations" || p.Tenant == "consumers" {
+			p.Issuer = orDefault(p.Issuer, "https://login.microsoftonline.com/{tenantid}/v2.0")
+		} else {
+			p.Issuer = orDefault(p.Issuer, base+"/v2.0")
+		}
+		p.AuthURL = orDefault(p.AuthURL, base+"/oauth2/v2.0/authorize")
+		p.TokenURL = orDefault(p.TokenURL, base+"/oauth2/v2.0/token")
+		p.JWKSURL = orDefault(p.JWKSURL, base+"/discovery/v2.0/keys")
+		p.DisplayName = orDefault(p.DisplayName, "Microsoft")
+		// entra does not send email_verified, only addresses owned by the tenant are put in email
+		if p.Claims.EmailVerified == "" {
+			p.Claims.EmailAlwaysVerified = true
+		}
+	case "github":
+		p.Issuer = orDefault(p.Issuer, "https://github.com")
+		p.AuthURL = orDefault(p.AuthURL, "https://github.com/login/oauth/authorize")
+		p.TokenURL = orDefault(p.TokenURL, "https://github.com/login/oauth/access_token")
+		p.UserInfoURL = orDefault(p.UserInfoURL, "https://api.github.com/user")
+		p.DisplayName = orDefault(p.DisplayName, "GitHub")
+		if len(p.Scopes) == 0 {
+			p.Scopes = []string{"read:user", "user:email"}
+		}
+	case "oidc":
+		if p.Issuer == "" {
+			return errors.New("issuer is required")
+		}
+	case "saml":
+		if p.RedirectURL == "" {
+			return errors.New("redirect_url, the assertion consumer service, is required")
+		}
+		if p.MetadataURL == "" && p.MetadataFile == "" && (p.Issuer == "" || p.AuthURL == "" || len(p.Certificates) == 0) {
+			return errors.New("metadata_url, metadata_file or issuer, auth_url and certificates are required")
+		}
+		// the identity provider of a company asserts the addresses it manages
+		if p.Claims.EmailVerified == "" {
+			p.Claims.EmailAlwaysVerified = true
+		}
+		// the subject of a saml identity is the NameID
+		p.Claims.Subject = orDefault(p.Claims.Subject, "NameID")
+	case "ldap":
+		if p.URL == "" || p.BaseDN == "" {
+			return errors.New("url and base_dn are required")
+		}
+		if p.BindDN == "" && p.UserDN == "" {
+			return errors.New("bind_dn or user_dn is required")
+		}
+		if p.GroupBaseDN != "" {
+			p.GroupFilter = orDefault(p.GroupFilter, "(member={dn})")
+		}
+		p.Issuer = orDefault(p.Issuer, p.BaseDN)
+		p.UserFilter = orDefault(p.UserFilter, "(|(sAMAccountName={username})(uid={username}))")
+		// active directory keeps a binary objectGUID instead
+		p.Claims.Subject = orDefault(p.Claims.Subject, "entryUUID")
+		p.Claims.Email = orDefault(p.Claims.Email, "mail")
+		p.Claims.Name = orDefault(p.Claims.Name, "displayName")
+		p.Claims.EmailAlwaysVerified = p.Claims.EmailVerified == ""
+	case "oauth2":
+		if p.AuthURL == "" || p.TokenURL == "" || p.UserInfoURL == "" {
+			return errors.New("auth_url, token_url and userinfo_url are required")
+		}
+		if p.Issuer == "" {
+			return errors.New("issuer is required to tell identities of different providers apart")
+		}
+	default:
+		return fmt.Errorf("unknown type %q", p.Type)
+	}
+
+	if p.ClientID == "" && p.Type != "ldap" {
+		return errors.New("client_id is required")
+	}
+
+	p.DisplayName = orDefault(p.DisplayName, p.Name)
+
+	if p.LinkByEmail == nil {
+		trusted := p.Type == "google" || p.Type == "github" || p.Type == "gitlab"
+		p.LinkByEmail = &trusted
+	}
+
+	if len(p.Scopes) == 0 {
+		p.Scopes = []string{"openid", "email", "profile"}
+	}
+
+	// claims are not used for github, its user and emails apis are read by a dedicated provider.
+	// For saml and ldap they name attributes, a missing email attribute falls back to an email NameID
+	p.Claims.Subject = orDefault(p.Claims.Subject, "sub")
+	p.Claims.Email = orDefault(p.Claims.Email, "email")
+	p.Claims.Name = orDefault(p.Claims.Name, "name")
+	if p.Claims.EmailVerified == "" && !p.Claims.EmailAlwaysVerified {
+		p.Claims.EmailVerified = "email_verified"
+	}
+
+	return nil
+}
+
+func orDefault(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+
+	return value
+}
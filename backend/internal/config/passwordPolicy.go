@@ -0,0 +1,44 @@
+package config
+
+import (
+	_ "embed"
+	"bufio"
+	"os"
+	"strings"
+)
+
+// commonPasswords is the blocklist every deployment gets, PASSWORD_BLOCKLIST_FILE extends it
+//go:embed common_passwords.txt
+var commonPasswords string
+
+// LoadPasswordBlocklist reads one password per line, blank lines and lines starting with # are skipped.
+// An empty path returns the built in list alone
+func LoadPasswordBlocklist(path string) ([]string, error) {
+	blocklist := parsePasswordList(commonPasswords)
+	if path == "" {
+		return blocklist, nil
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(blocklist, parsePasswordList(string(raw))...), nil
+}
+
+func parsePasswordList(raw string) []string {
+	var passwords []string
+
+	scanner := bufio.NewScanner(strings.NewReader(raw))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		passwords = append(passwords, line)
+	}
+
+	return passwords
+}
@@ -0,0 +1,33 @@
+package config
+
+import (
+	"errors"
+)
+
+// RateLimit is a token bucket refilled PerMinute tokens a minute up to Burst, a zero PerMinute disables it
+type RateLimit struct {
+	PerMinute int
+	Burst int
+}
+
+// rateLimitFromEnv reads <PREFIX>_PER_MINUTE and <PREFIX>_BURST
+func rateLimitFromEnv(prefix string, perMinute, burst int) (RateLimit, error) {
+	var err error
+
+	limit := RateLimit{}
+	if limit.PerMinute, err = intFromEnv(prefix+"_PER_MINUTE", perMinute); err != nil {
+		return limit, err
+	}
+	if limit.Burst, err = intFromEnv(prefix+"_BURST", burst); err != nil {
+		return limit, err
+	}
+
+	if limit.PerMinute < 0 {
+		return limit, errors.New(prefix + "_PER_MINUTE must not be negative")
+	}
+	if limit.PerMinute > 0 && limit.Burst <= 0 {
+		return limit, errors.New(prefix + "_BURST must be positive")
+	}
+
+	return limit, nil
+}
@@ -0,0 +1,67 @@
+package core
+
+import (
+	"go.uber.org/zap"
+
+	"context"
+	"time"
+)
+
+// AuditEvent records a security relevant change made to an account, by its owner or by an admin
+type AuditEvent struct {
+	ID string `json:"id"`
+	UserID string `json:"user_id"`
+	Action string `json:"action"`
+	IP string `json:"ip"`
+	UserAgent string `json:"user_agent"`
+	Details map[string]string `json:"details"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func NewAuditEvent(userID, action, ip, userAgent string, details map[string]string) *AuditEvent {
+	if details == nil {
+		details = map[string]string{}
+	}
+
+	return &AuditEvent{
+		UserID: userID,
+		Action: action,
+		IP: ip,
+		UserAgent: userAgent,
+		Details: details,
+		CreatedAt: time.Now().UTC(),
+	}
+}
+
+// recordAudit stores an event for a change that has already been made, a failure is logged
+// instead of returned so the caller does not report a completed change as failed
+func recordAudit(ctx context.Context, audit IAudit, event *AuditEvent) {
+	log := getLoggerFromContext(ctx)
+
+	if err := audit.Record(ctx, event); err != nil {
+		log.Error("failed to record audit event", zap.Error(err), zap.String("user_id", event.UserID), zap.String("action", event.Action))
+	}
+}
+
+type AuditUseCase struct {
+	audit IAudit
+}
+
+func NewAuditUseCase(audit IAudit) *AuditUseCase {
+	return &AuditUseCase{
+		audit,
+	}
+}
+
+// List returns the latest events of a user, newest first
+func (uc *AuditUseCase) List(ctx context.Context, userID string, limit int) ([]AuditEvent, error) {
+	log := getLoggerFromContext(ctx)
+
+	events, err := uc.audit.ByUser(ctx, userID, limit)
+	if err != nil {
+		log.Error("failed to get audit events", zap.Error(err), zap.String("user_id", userID))
+		return nil, err
+	}
+
+	return events, nil
+}
@@ -8,6 +8,10 @@ import (
 
 type Claims struct {
 	ClientID string `json:"client_id,omitempty"`
+	SessionID string `json:"sid,omitempty"`
+	// Email and EmailVerified are the OIDC claims of the user in tokens issued to clients
+	Email string `json:"email,omitempty"`
+	EmailVerified *bool `json:"email_verified,omitempty"`
 	jwt.RegisteredClaims
 }
 
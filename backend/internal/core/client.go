@@ -14,6 +14,12 @@ type Client struct {
 	RedirectURIs []string
 	Status string
 	CreatedAt time.Time
+
+	// overrides of the server-wide session policies, nil means the default applies
+	SessionPolicy *SessionPolicy
+	RememberMePolicy *SessionPolicy
+	// RequireVerifiedEmail refuses codes to users who have not verified their email address
+	RequireVerifiedEmail bool
 }
 
 func (c *Client) AllowsRedirect(uri string) bool {
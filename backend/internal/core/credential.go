@@ -4,10 +4,22 @@ import "time"
 
 type Credential struct {
 	ID string
+	// IdentityID is set for credentials of an identity such as a password or a passkey, totp
+	// secrets and recovery codes belong to the account and have UserID instead
 	IdentityID string
+	UserID string
 	Type string
 	Hash string
 	Status string
+	// Counter keeps a credential from being replayed or cloned. It is the last time step a totp
+	// code was accepted for and the last signature counter of a webauthn authenticator
+	Counter int64
+	// ExternalID is the id the authenticator knows a webauthn credential by, in base64url
+	ExternalID string
+	// PublicKey is the COSE key of a webauthn credential
+	PublicKey []byte
+	// Transports tell the browser how to reach the authenticator of a webauthn credential
+	Transports []string
 	CreatedAt time.Time
 }
 
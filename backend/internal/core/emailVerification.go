@@ -0,0 +1,147 @@
+package core
+
+import (
+	e "sso/internal/core/errors"
+	"go.uber.org/zap"
+
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// emailVerificationTTL is how long a mailed verification link can be used, in seconds
+const emailVerificationTTL = 24*60*60
+
+type EmailVerificationInput struct {
+	UserID string
+
+	IP string
+	UserAgent string
+}
+
+type EmailVerifyInput struct {
+	Token string
+
+	IP string
+	UserAgent string
+}
+
+// EmailVerificationUseCase mails signed links proving the user owns the address of the account
+type EmailVerificationUseCase struct {
+	users IUser
+	tokens IEmailTokens
+	// mailer is nil when no mail relay is configured, accounts stay unverified then
+	mailer IMailer
+	audit IAudit
+	// verifyURL is the page of the sso the verification links open
+	verifyURL string
+}
+
+func NewEmailVerificationUseCase(users IUser, tokens IEmailTokens, mailer IMailer, audit IAudit, verifyURL string) *EmailVerificationUseCase {
+	return &EmailVerificationUseCase{
+		users,
+		tokens,
+		mailer,
+		audit,
+		verifyURL,
+	}
+}
+
+// send mails a verification link to the current address of the user
+func (uc *EmailVerificationUseCase) send(ctx context.Context, user *User, ip, userAgent string) error {
+	log := getLoggerFromContext(ctx)
+
+	if uc.mailer == nil {
+		log.Error("no mailer is configured, email verification is not mailed", zap.String("user_id", user.ID))
+		return nil
+	}
+
+	token, err := uc.tokens.Issue(ctx, EmailToken{Purpose: "email_verification", UserID: user.ID, Email: user.Email}, emailVerificationTTL)
+	if err != nil {
+		log.Error("failed to issue email verification token", zap.Error(err), zap.String("user_id", user.ID))
+		return err
+	}
+
+	err = uc.mailer.Send(ctx, Mail{
+		To: user.Email,
+		Subject: "Verify your email address",
+		Text: "To confirm that " + user.Email + " is the address of your account, open this link:\n" +
+			uc.verifyURL + "?" + url.Values{"token": {token}}.Encode() + "\n\n" +
+			fmt.Sprintf("The link expires in %d hours. If you did not create an account, you can ignore this email.\n", emailVerificationTTL/3600),
+	})
+	if err != nil {
+		log.Error("failed to mail email verification", zap.Error(err), zap.String("user_id", user.ID))
+		return err
+	}
+
+	recordAudit(ctx, uc.audit, NewAuditEvent(user.ID, "email.verification_sent", ip, userAgent, nil))
+
+	return nil
+}
+
+// Resend mails a new verification link to a signed in user whose address is not verified yet
+func (uc *EmailVerificationUseCase) Resend(ctx context.Context, input EmailVerificationInput) error {
+	log := getLoggerFromContext(ctx)
+
+	user, err := uc.users.ByID(ctx, input.UserID)
+	if err != nil {
+		log.Error("failed to get user by id", zap.Error(err), zap.String("user_id", input.UserID))
+		return err
+	}
+
+	if user == nil {
+		log.Info("user not found", zap.String("user_id", input.UserID))
+		return e.UserNotFound
+	}
+
+	if user.EmailVerified {
+		log.Info("email is already verified", zap.String("user_id", user.ID))
+		return nil
+	}
+
+	return uc.send(ctx, user, input.IP, input.UserAgent)
+}
+
+// Verify marks the address the link was mailed to as verified. A link mailed to a previous
+// address of the user verifies nothing
+func (uc *EmailVerificationUseCase) Verify(ctx context.Context, input EmailVerifyInput) error {
+	log := getLoggerFromContext(ctx)
+
+	token, err := uc.tokens.Take(ctx, input.Token)
+	if err != nil {
+		log.Error("failed to take email verification token", zap.Error(err))
+		return err
+	}
+
+	if token == nil || token.Purpose != "email_verification" {
+		log.Info("email verification token is invalid or expired")
+		return e.InvalidVerificationToken
+	}
+
+	user, err := uc.users.ByID(ctx, token.UserID)
+	if err != nil {
+		log.Error("failed to get user by id", zap.Error(err), zap.String("user_id", token.UserID))
+		return err
+	}
+
+	if user == nil || !strings.EqualFold(user.Email, token.Email) {
+		log.Info("email verification token was mailed to another address", zap.String("user_id", token.UserID))
+		return e.InvalidVerificationToken
+	}
+
+	if user.EmailVerified {
+		return nil
+	}
+
+	user.EmailVerified = true
+
+	if err := uc.users.Update(ctx, user); err != nil {
+		log.Error("failed to update user", zap.Error(err), zap.String("user_id", user.ID))
+		return err
+	}
+
+	recordAudit(ctx, uc.audit, NewAuditEvent(user.ID, "email.verified", input.IP, input.UserAgent, nil))
+
+	return nil
+}
@@ -0,0 +1,261 @@
+package core
+
+import (
+	e "sso/internal/core/errors"
+	"go.uber.org/zap"
+
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
+)
+
+const (
+	// emailOTPTTL is how long a mailed code and its magic link can be redeemed, in seconds
+	emailOTPTTL = 10*60
+	maxEmailOTPAttempts = 5
+	// maxEmailOTPSends is how many codes an address gets before the last one expires
+	maxEmailOTPSends = 3
+)
+
+// EmailOTP is the login code pending for an address
+type EmailOTP struct {
+	// UserID is empty for addresses without an account, they are counted but never mailed
+	UserID string
+	CodeHash string
+	// LinkToken is the magic link mailed with the code, redeeming either one voids the other
+	LinkToken string
+	Attempts int
+	Sends int
+}
+
+type EmailOTPInput struct {
+	Email string
+	// ReturnTo is where the magic link sends the user once signed in
+	ReturnTo string
+
+	IP string
+	UserAgent string
+}
+
+// emailOTPKey is the address the codes are counted for, whatever its case
+func emailOTPKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func hashEmailOTP(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// EmailOTPUseCase mails one-time codes and magic links, LoginUseCase redeems them with the email_otp provider
+type EmailOTPUseCase struct {
+	users IUser
+	otps IEmailOTPs
+	tokens IEmailTokens
+	mailer IMailer
+	audit IAudit
+	// linkURL is the page of the sso the magic links open
+	linkURL string
+}
+
+func NewEmailOTPUseCase(users IUser, otps IEmailOTPs, tokens IEmailTokens, mailer IMailer, audit IAudit, linkURL string) *EmailOTPUseCase {
+	return &EmailOTPUseCase{
+		users,
+		otps,
+		tokens,
+		mailer,
+		audit,
+		linkURL,
+	}
+}
+
+// Send mails a code and a magic link to the address. Every address gets the same pending entry and
+// answer, the code of an account that can log in is made and mailed off the request path with its
+// failures only logged, so accounts cannot be probed by the answer or its timing
+func (uc *EmailOTPUseCase) Send(ctx context.Context, input EmailOTPInput) error {
+	log := getLoggerFromContext(ctx)
+
+	key := emailOTPKey(input.Email)
+	if key == "" {
+		return e.InvalidNameOrEmail
+	}
+
+	pending, err := uc.otps.Get(key)
+	if err != nil {
+		log.Error("failed to get pending email code", zap.Error(err))
+		return err
+	}
+
+	sends := 1
+	if pending != nil {
+		if pending.Sends >= maxEmailOTPSends {
+			log.Info("too many email codes were sent to the address", zap.String("email", key))
+			return e.TooManyEmails
+		}
+		sends = pending.Sends + 1
+
+		// a new code voids the link mailed with the previous one
+		if _, err := uc.tokens.Take(ctx, pending.LinkToken); err != nil {
+			log.Error("failed to void previous magic link", zap.Error(err))
+			return err
+		}
+	}
+
+	user, err := uc.users.ByEmail(ctx, input.Email)
+	if err != nil {
+		log.Error("failed to get user by email", zap.Error(err), zap.String("email", input.Email))
+		return err
+	}
+
+	// the send is counted before any code exists, the code of an account replaces the entry once made
+	if err := uc.otps.Issue(key, EmailOTP{Sends: sends}, emailOTPTTL); err != nil {
+		log.Error("failed to count email code", zap.Error(err), zap.String("email", key))
+		return err
+	}
+
+	if user == nil || !user.CanLogin() {
+		log.Info("email code requested for an address without an account", zap.String("email", key))
+		return nil
+	}
+
+	goDetached(ctx, func(ctx context.Context) {
+		uc.mailCode(ctx, key, user, sends, input)
+	})
+
+	return nil
+}
+
+func (uc *EmailOTPUseCase) mailCode(ctx context.Context, key string, user *User, sends int, input EmailOTPInput) {
+	log := getLoggerFromContext(ctx)
+
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		log.Error("failed to generate email code", zap.Error(err))
+		return
+	}
+	code := fmt.Sprintf("%06d", n.Int64())
+
+	linkToken, err := uc.tokens.Issue(ctx, EmailToken{Purpose: "login", UserID: user.ID, Email: user.Email}, emailOTPTTL)
+	if err != nil {
+		log.Error("failed to issue magic link", zap.Error(err), zap.String("user_id", user.ID))
+		return
+	}
+
+	err = uc.otps.Update(key, EmailOTP{
+		UserID: user.ID,
+		CodeHash: hashEmailOTP(code),
+		LinkToken: linkToken,
+		Sends: sends,
+	})
+	if err != nil {
+		log.Error("failed to store email code", zap.Error(err), zap.String("user_id", user.ID))
+		return
+	}
+
+	recordAudit(ctx, uc.audit, NewAuditEvent(user.ID, "email_otp.sent", input.IP, input.UserAgent, nil))
+
+	link := uc.linkURL + "?" + url.Values{
+		"token": {linkToken},
+		"return_to": {input.ReturnTo},
+	}.Encode()
+
+	err = uc.mailer.Send(ctx, Mail{
+		To: user.Email,
+		Subject: "Your sign in code",
+		Text: "Your sign in code is " + code + ".\n\n" +
+			"You can also sign in by opening this link:\n" + link + "\n\n" +
+			fmt.Sprintf("The code and the link expire in %d minutes. If you did not try to sign in, you can ignore this email.\n", emailOTPTTL/60),
+	})
+	if err != nil {
+		log.Error("failed to mail email code", zap.Error(err), zap.String("user_id", user.ID))
+	}
+}
+
+// redeem returns the user of a mailed code or magic link. Both are single use, the code of an
+// address is refused for good after maxEmailOTPAttempts wrong ones
+func (uc *EmailOTPUseCase) redeem(ctx context.Context, input LoginInput) (*User, error) {
+	log := getLoggerFromContext(ctx)
+
+	if input.EmailToken != "" {
+		token, err := uc.tokens.Take(ctx, input.EmailToken)
+		if err != nil {
+			log.Error("failed to take magic link", zap.Error(err))
+			return nil, err
+		}
+
+		if token == nil || token.Purpose != "login" {
+			log.Info("magic link is invalid or expired")
+			return nil, e.InvalidEmailOTP
+		}
+
+		if err := uc.otps.Delete(emailOTPKey(token.Email)); err != nil {
+			log.Error("failed to delete email code", zap.Error(err))
+			return nil, err
+		}
+
+		user, err := uc.users.ByID(ctx, token.UserID)
+		if err != nil {
+			log.Error("failed to get user by id", zap.Error(err), zap.String("user_id", token.UserID))
+			return nil, err
+		}
+
+		if user == nil || !strings.EqualFold(user.Email, token.Email) {
+			log.Info("magic link was mailed to another address of the user", zap.String("user_id", token.UserID))
+			return nil, e.InvalidEmailOTP
+		}
+
+		return user, nil
+	}
+
+	key := emailOTPKey(input.Email)
+	otp, err := uc.otps.Get(key)
+	if err != nil {
+		log.Error("failed to get pending email code", zap.Error(err))
+		return nil, err
+	}
+
+	if otp == nil || otp.UserID == "" || otp.Attempts >= maxEmailOTPAttempts {
+		log.Info("no email code is pending for the address", zap.String("email", key))
+		return nil, e.InvalidEmailOTP
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashEmailOTP(input.Code)), []byte(otp.CodeHash)) != 1 {
+		otp.Attempts++
+		if err := uc.otps.Update(key, *otp); err != nil {
+			log.Error("failed to count email code attempt", zap.Error(err))
+			return nil, err
+		}
+
+		log.Info("email code does not match", zap.String("user_id", otp.UserID), zap.Int("attempts", otp.Attempts))
+		return nil, e.InvalidEmailOTP
+	}
+
+	if err := uc.otps.Delete(key); err != nil {
+		log.Error("failed to delete email code", zap.Error(err))
+		return nil, err
+	}
+
+	if _, err := uc.tokens.Take(ctx, otp.LinkToken); err != nil {
+		log.Error("failed to void magic link", zap.Error(err))
+		return nil, err
+	}
+
+	user, err := uc.users.ByID(ctx, otp.UserID)
+	if err != nil {
+		log.Error("failed to get user by id", zap.Error(err), zap.String("user_id", otp.UserID))
+		return nil, err
+	}
+
+	if user == nil {
+		log.Info("user not found", zap.String("user_id", otp.UserID))
+		return nil, e.InvalidEmailOTP
+	}
+
+	return user, nil
+}
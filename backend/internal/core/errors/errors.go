@@ -21,18 +21,60 @@ var (
 	InvalidNameOrEmail = NewError("user name or email is invalid")
 
 	ClientNotFound = NewError("client not found")
+	ServiceProviderNotFound = NewError("service provider not found")
 	RedirectURINotAllowed = NewError("redirect uri not allowed")
 
 	IdentityNotFound = NewError("identity not found")
+	IdentityAlreadyLinked = NewError("identity is already linked to an account")
+	LastLoginMethod = NewError("the last login method cannot be unlinked")
 
 	CredentialNotFound = NewError("credential not found")
+	InvalidCredentials = NewError("invalid credentials")
+
+	MFARequired = NewError("second factor required")
+	InvalidMFAToken = NewError("mfa token is invalid or expired")
+	InvalidMFACode = NewError("second factor code is invalid")
+	MFAAlreadyEnrolled = NewError("second factor is already enrolled")
+	MFANotEnrolled = NewError("no second factor is enrolled")
+	InvalidWebAuthnResponse = NewError("webauthn response is invalid")
+	PasskeyNotFound = NewError("passkey not found")
+	InvalidEmailOTP = NewError("email code is invalid or expired")
+	TooManyEmails = NewError("too many emails were sent to the address, try again later")
+	InvalidResetToken = NewError("password reset token is invalid or expired")
+	InvalidPassword = NewError("password is invalid")
+	InvalidVerificationToken = NewError("email verification token is invalid or expired")
+	LoginLocked = NewError("too many failed logins, try again later")
+	RateLimited = NewError("too many requests, try again later")
+
+	SessionNotFound = NewError("session not found")
+	SessionInactive = NewError("session is revoked or expired")
 
 	KeyIsNil = NewError("private key is nil")
 	KeysNotFound = NewError("keys not found")
 
 	UniqueViolated = NewError("unique constraint violated")
 
+	GroupNotFound = NewError("group not found")
+	SCIMClientNotFound = NewError("scim client not found")
+	InvalidSCIMToken = NewError("scim token is invalid or revoked")
+	InvalidFilter = NewError("filter is invalid")
+	InvalidPatch = NewError("patch operation is invalid")
+	InvalidSCIMValue = NewError("attribute value is invalid")
+	VersionMismatch = NewError("resource was modified since the given version")
+
 	InvalidAuthProvider = NewError("invalid authentication provider")
+	InvalidIDToken = NewError("id token is invalid")
+	EmailNotVerified = NewError("email is not verified")
+	InvalidFederationState = NewError("federated login state is invalid or expired")
+	UpstreamLoginFailed = NewError("upstream identity provider refused the login")
+	LinkRequired = NewError("sign in to the existing account to link this identity")
+	InvalidLinkToken = NewError("link token is invalid or expired")
 	AuthCodeNotFound = NewError("authentication code not found")
 	InvalidAuthCode = NewError("authentication code is invalid")
+	InvalidAuthorizeRequest = NewError("authorization request is invalid")
+	InvalidSAMLRequest = NewError("saml request is invalid")
+	InvalidSAMLResponse = NewError("saml response is invalid")
+	LoginRequired = NewError("login required")
+	AccountSelectionRequired = NewError("account selection required")
+	ConsentRequired = NewError("consent required")
 )
@@ -0,0 +1,180 @@
+package core
+
+import (
+	e "sso/internal/core/errors"
+	"go.uber.org/zap"
+
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"sort"
+)
+
+// FederationState is what the sso remembers between redirecting to an upstream provider and its callback
+type FederationState struct {
+	Provider string
+	Nonce string
+	CodeVerifier string
+
+	ReturnTo string
+	ClientID string
+	RememberMe bool
+
+	// LinkUserID is set when a signed in user links the provider to their account instead of logging in
+	LinkUserID string
+}
+
+type FederatedLoginUseCase struct {
+	providers map[string]IFederatedProvider
+	states IFederationStates
+	login *LoginUseCase
+	identities *IdentityUseCase
+	stateExpiration int
+}
+
+func NewFederatedLoginUseCase(providers map[string]IFederatedProvider, states IFederationStates, login *LoginUseCase, identities *IdentityUseCase, stateExpiration int) *FederatedLoginUseCase {
+	return &FederatedLoginUseCase{
+		providers,
+		states,
+		login,
+		identities,
+		stateExpiration,
+	}
+}
+
+type FederatedStartInput struct {
+	Provider string
+	ReturnTo string
+	ClientID string
+	RememberMe bool
+	LinkUserID string
+}
+
+type FederatedCallbackInput struct {
+	Provider string
+	State string
+	Code string
+	// error parameter sent back by the provider, e.g. access_denied
+	Error string
+	// UserID is the user signed in to the sso, if any. It has to match the user a link was started for
+	UserID string
+
+	IP string
+	UserAgent string
+}
+
+type FederatedProviderInfo struct {
+	Name string
+	DisplayName string
+}
+
+// Providers lists the configured upstream providers for the login page
+func (uc *FederatedLoginUseCase) Providers() []FederatedProviderInfo {
+	providers := make([]FederatedProviderInfo, 0, len(uc.providers))
+	for name, provider := range uc.providers {
+		providers = append(providers, FederatedProviderInfo{
+			Name: name,
+			DisplayName: provider.DisplayName(),
+		})
+	}
+	sort.Slice(providers, func(i, j int) bool { return providers[i].Name < providers[j].Name })
+
+	return providers
+}
+
+// Start returns the upstream authorization url and the state id the caller should bind to the user agent
+func (uc *FederatedLoginUseCase) Start(ctx context.Context, input FederatedStartInput) (string, string, error) {
+	log := getLoggerFromContext(ctx)
+
+	provider, ok := uc.providers[input.Provider]
+	if !ok {
+		log.Info("unknown identity provider", zap.String("provider", input.Provider))
+		return "", "", e.InvalidAuthProvider
+	}
+
+	state := FederationState{
+		Provider: input.Provider,
+		Nonce: randomToken(32),
+		CodeVerifier: randomToken(32),
+		ReturnTo: input.ReturnTo,
+		ClientID: input.ClientID,
+		RememberMe: input.RememberMe,
+		LinkUserID: input.LinkUserID,
+	}
+
+	stateID, err := uc.states.Issue(state, uc.stateExpiration)
+	if err != nil {
+		log.Error("failed to store federation state", zap.Error(err))
+		return "", "", err
+	}
+
+	challenge := sha256.Sum256([]byte(state.CodeVerifier))
+
+	return provider.AuthCodeURL(stateID, state.Nonce, base64.RawURLEncoding.EncodeToString(challenge[:])), stateID, nil
+}
+
+// Callback finishes the upstream flow and logs the user in, the returned state carries where to send them next.
+// For a link started by a signed in user the identity is linked to their account and no session is issued
+func (uc *FederatedLoginUseCase) Callback(ctx context.Context, input FederatedCallbackInput) (string, *Session, *FederationState, error) {
+	log := getLoggerFromContext(ctx)
+
+	provider, ok := uc.providers[input.Provider]
+	if !ok {
+		log.Info("unknown identity provider", zap.String("provider", input.Provider))
+		return "", nil, nil, e.InvalidAuthProvider
+	}
+
+	state, err := uc.states.Take(input.State)
+	if err != nil {
+		log.Error("failed to get federation state", zap.Error(err))
+		return "", nil, nil, err
+	}
+
+	if state == nil || state.Provider != input.Provider {
+		log.Info("federation state not found", zap.String("provider", input.Provider))
+		return "", nil, nil, e.InvalidFederationState
+	}
+
+	if input.Error != "" {
+		log.Info("upstream login failed", zap.String("provider", input.Provider), zap.String("error", input.Error))
+		return "", nil, nil, e.UpstreamLoginFailed
+	}
+
+	if state.LinkUserID != "" && state.LinkUserID != input.UserID {
+		log.Info("identity link finished by another user", zap.String("user_id", state.LinkUserID))
+		return "", nil, nil, e.InvalidFederationState
+	}
+
+	claims, err := provider.Exchange(ctx, input.Code, state.CodeVerifier, state.Nonce)
+	if err != nil {
+		log.Info("failed to exchange upstream code", zap.Error(err), zap.String("provider", input.Provider))
+		return "", nil, nil, err
+	}
+
+	if state.LinkUserID != "" {
+		err := uc.identities.Link(ctx, IdentityChangeInput{
+			UserID: state.LinkUserID,
+			IP: input.IP,
+			UserAgent: input.UserAgent,
+		}, claims)
+
+		return "", nil, state, err
+	}
+
+	token, session, err := uc.login.Execute(ctx, LoginInput{
+		Provider: "oauth",
+		ExternalID: claims["sub"],
+		Issuer: claims["issuer"],
+		Token: claims,
+		ClientID: state.ClientID,
+		RememberMe: state.RememberMe,
+		IP: input.IP,
+		UserAgent: input.UserAgent,
+	})
+	if err != nil {
+		// the state is still needed to continue a login that ended in a LinkRequiredError
+		return "", nil, state, err
+	}
+
+	return token, session, state, nil
+}
@@ -0,0 +1,174 @@
+package core
+
+import (
+	e "sso/internal/core/errors"
+	"go.uber.org/zap"
+
+	"context"
+)
+
+// a pending link lives as long as a federation state, the user is signing in right now
+const pendingLinkExpiration = 10*60
+
+// PendingLink is an upstream identity waiting for the owner of the account with the same email to sign in
+type PendingLink struct {
+	UserID string
+	Provider string
+	ExternalID string
+	Issuer string
+	Raw string
+}
+
+// LinkRequiredError is returned instead of linking an upstream identity to an existing account
+// by email alone. The user has to sign in to that account with LinkToken to link it
+type LinkRequiredError struct {
+	LinkToken string
+	Email string
+	Provider string
+}
+
+func (err *LinkRequiredError) Error() string {
+	return e.LinkRequired.Error()
+}
+
+func (err *LinkRequiredError) Unwrap() error {
+	return e.LinkRequired
+}
+
+// FederatedUser finds or provisions the user behind verified upstream claims. The identity type
+// is the name of the provider the claims came from, externalID and issuer identify the upstream account.
+// An existing account with the same email is linked only when the provider verified the email and its
+// link_by_email policy allows it, otherwise a LinkRequiredError is returned
+func FederatedUser(ctx context.Context, userInterface IUser, links IPendingLinks, claims map[string]string, externalID, issuer string) (*User, error) {
+	log := getLoggerFromContext(ctx)
+
+	provider := claims["provider"]
+	if provider == "" {
+		log.Info("upstream claims have no provider")
+		return nil, e.InvalidAuthProvider
+	}
+
+	user, err := userInterface.ByIdentity(ctx, provider, externalID, issuer)	
+	if err != nil {
+		log.Error("failed to get user by identity", zap.Error(err))
+		return nil, err
+	}
+
+	if user != nil {
+		return user, nil
+	}
+
+	email := claims["email"]
+	verified := claims["email_verified"] == "true"
+
+	user, err = userInterface.ByEmail(ctx, email)	
+	if err != nil {
+		log.Error("failed to get user by email", zap.Error(err), zap.String("email", email))
+		return nil, err
+	}
+
+	if user != nil && (!verified || claims["link_by_email"] != "true") {
+		linkToken, err := links.Issue(PendingLink{
+			UserID: user.ID,
+			Provider: provider,
+			ExternalID: externalID,
+			Issuer: issuer,
+			Raw: claims["raw"],
+		}, pendingLinkExpiration)
+		if err != nil {
+			log.Error("failed to store pending link", zap.Error(err))
+			return nil, err
+		}
+
+		log.Info("identity link requires sign in", zap.String("user_id", user.ID), zap.String("provider", provider), zap.Bool("email_verified", verified))
+		return nil, &LinkRequiredError{
+			LinkToken: linkToken,
+			Email: user.Email,
+			Provider: provider,
+		}
+	}
+
+	if user == nil {
+		// an unverified address must not claim the email for a new account either
+		if !verified {
+			log.Info("upstream email is not verified", zap.String("provider", provider))
+			return nil, e.EmailNotVerified
+		}
+
+		name := claims["name"]
+		if name == "" {
+			name = email
+		}
+
+		user, err = NewUser(name, email)
+		if err != nil {
+			log.Info("invalid user", zap.Error(err))
+			return nil, err
+		}
+		user.EmailVerified = verified
+
+		err = userInterface.Create(ctx, user)
+		if err != nil {
+			log.Error("failed to create user", zap.Error(err))
+			return nil, err
+		}
+	} 
+
+	if err := linkIdentity(ctx, userInterface, user.ID, provider, externalID, issuer, claims["raw"]); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// linkPendingIdentity links the identity of a pending link once its user has signed in
+func linkPendingIdentity(ctx context.Context, userInterface IUser, links IPendingLinks, user *User, linkToken string) error {
+	log := getLoggerFromContext(ctx)
+
+	link, err := links.Take(linkToken)
+	if err != nil {
+		log.Error("failed to get pending link", zap.Error(err))
+		return err
+	}
+
+	if link == nil || link.UserID != user.ID {
+		log.Info("pending link not found", zap.String("user_id", user.ID))
+		return e.InvalidLinkToken
+	}
+
+	return linkIdentity(ctx, userInterface, user.ID, link.Provider, link.ExternalID, link.Issuer, link.Raw)
+}
+
+func linkIdentity(ctx context.Context, userInterface IUser, userID, provider, externalID, issuer, raw string) error {
+	log := getLoggerFromContext(ctx)
+
+	identity, err := NewIdentity(provider, externalID, issuer)
+	if err != nil {
+		log.Info("invalid identity", zap.Error(err))
+		return err
+	}
+	identity.UserID = userID
+
+	credential, err := NewCredential("oauth", raw)
+	if err != nil {
+		log.Info("invalid credential", zap.Error(err))
+		return err
+	}
+
+	err = userInterface.SaveIdentity(ctx, identity)
+	if err != nil {
+		log.Error("failed to save identity", zap.Error(err))
+		return err
+	}
+	credential.IdentityID = identity.ID
+
+	err = userInterface.SaveCredential(ctx, credential)
+	if err != nil {
+		log.Error("failed to save credential", zap.Error(err))
+		return err
+	}
+
+	log.Info("identity linked", zap.String("user_id", userID), zap.String("provider", provider))
+
+	return nil
+}
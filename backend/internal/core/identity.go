@@ -1,17 +1,23 @@
 package core
 
 import (
+	e "sso/internal/core/errors"
+	"go.uber.org/zap"
+
+	"context"
+	"errors"
+	"slices"
 	"time"
 )
 
 type Identity struct {
-	ID string
-	UserID string
-	Type string
-	ExternalID string
-	Issuer string
-	CreatedAt time.Time
-	Credentials []Credential
+	ID string `json:"id"`
+	UserID string `json:"user_id"`
+	Type string `json:"type"`
+	ExternalID string `json:"external_id"`
+	Issuer string `json:"issuer"`
+	CreatedAt time.Time `json:"created_at"`
+	Credentials []Credential `json:"-"`
 }
 
 func NewIdentity(itype, externalID, issuer string) (*Identity, error) {
@@ -21,3 +27,174 @@ func NewIdentity(itype, externalID, issuer string) (*Identity, error) {
 		Issuer: issuer,
 	}, nil
 }
+
+type IdentityUseCase struct {
+	users IUser
+	audit IAudit
+}
+
+func NewIdentityUseCase(users IUser, audit IAudit) *IdentityUseCase {
+	return &IdentityUseCase{
+		users,
+		audit,
+	}
+}
+
+// IdentityChangeInput describes who made a change for the audit trail
+type IdentityChangeInput struct {
+	UserID string
+	IP string
+	UserAgent string
+}
+
+func (uc *IdentityUseCase) List(ctx context.Context, userID string) ([]Identity, error) {
+	user, err := uc.user(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	identities := user.Identities
+	if identities == nil {
+		identities = []Identity{}
+	}
+
+	return identities, nil
+}
+
+// Link adds the upstream identity behind verified claims to the user. Linking an identity
+// the user already has is a no-op, one that belongs to another account is refused
+func (uc *IdentityUseCase) Link(ctx context.Context, input IdentityChangeInput, claims map[string]string) error {
+	log := getLoggerFromContext(ctx)
+
+	provider := claims["provider"]
+	if provider == "" {
+		log.Info("upstream claims have no provider")
+		return e.InvalidAuthProvider
+	}
+
+	user, err := uc.user(ctx, input.UserID)
+	if err != nil {
+		return err
+	}
+
+	owner, err := uc.users.ByIdentity(ctx, provider, claims["sub"], claims["issuer"])
+	if err != nil {
+		log.Error("failed to get user by identity", zap.Error(err))
+		return err
+	}
+
+	if owner != nil {
+		if owner.ID == user.ID {
+			return nil
+		}
+
+		log.Info("identity belongs to another user", zap.String("user_id", user.ID), zap.String("provider", provider))
+		return e.IdentityAlreadyLinked
+	}
+
+	// an account holds one identity per provider and issuer
+	for _, identity := range user.Identities {
+		if identity.Type == provider && identity.Issuer == claims["issuer"] {
+			log.Info("provider is already linked", zap.String("user_id", user.ID), zap.String("provider", provider))
+			return e.IdentityAlreadyLinked
+		}
+	}
+
+	err = linkIdentity(ctx, uc.users, user.ID, provider, claims["sub"], claims["issuer"], claims["raw"])
+	if errors.Is(err, e.UniqueViolated) {
+		return e.IdentityAlreadyLinked
+	}
+	if err != nil {
+		return err
+	}
+
+	recordAudit(ctx, uc.audit, NewAuditEvent(user.ID, "identity.linked", input.IP, input.UserAgent, map[string]string{
+		"provider": provider,
+		"issuer": claims["issuer"],
+		"external_id": claims["sub"],
+	}))
+
+	return nil
+}
+
+// Unlink removes an identity of the user, unless it is the only way left to sign in
+func (uc *IdentityUseCase) Unlink(ctx context.Context, input IdentityChangeInput, identityID string) error {
+	log := getLoggerFromContext(ctx)
+
+	user, err := uc.user(ctx, input.UserID)
+	if err != nil {
+		return err
+	}
+
+	var identity Identity
+	for _, candidate := range user.Identities {
+		if candidate.ID == identityID {
+			identity = candidate
+		}
+	}
+
+	if identity.ID == "" {
+		log.Info("identity not found", zap.String("user_id", user.ID), zap.String("identity_id", identityID))
+		return e.IdentityNotFound
+	}
+
+	if loginMethods(user) <= 1 {
+		log.Info("refused to unlink the last login method", zap.String("user_id", user.ID), zap.String("identity_id", identityID))
+		return e.LastLoginMethod
+	}
+
+	if err := uc.users.DeleteIdentity(ctx, user.ID, identityID); err != nil {
+		log.Error("failed to delete identity", zap.Error(err), zap.String("identity_id", identityID))
+		return err
+	}
+
+	recordAudit(ctx, uc.audit, NewAuditEvent(user.ID, "identity.unlinked", input.IP, input.UserAgent, map[string]string{
+		"identity_id": identity.ID,
+		"provider": identity.Type,
+		"issuer": identity.Issuer,
+		"external_id": identity.ExternalID,
+	}))
+
+	return nil
+}
+
+func (uc *IdentityUseCase) user(ctx context.Context, userID string) (*User, error) {
+	log := getLoggerFromContext(ctx)
+
+	user, err := uc.users.ByID(ctx, userID)
+	if err != nil {
+		log.Error("failed to get user by id", zap.Error(err), zap.String("user_id", userID))
+		return nil, err
+	}
+
+	if user == nil {
+		log.Info("user not found", zap.String("user_id", userID))
+		return nil, e.UserNotFound
+	}
+
+	return user, nil
+}
+
+// loginMethods counts what the user can sign in with on their own: the password of the email identity,
+// each upstream identity and each active passkey. An identity without any of them counts for nothing
+func loginMethods(user *User) int {
+	methods := 0
+	for _, identity := range user.Identities {
+		switch identity.Type {
+		case "email":
+			if slices.ContainsFunc(identity.Credentials, func(cred Credential) bool { return cred.Type == "password" }) {
+				methods++
+			}
+		case "webauthn":
+			for _, cred := range identity.Credentials {
+				if cred.Type == "webauthn" && cred.Status == "active" {
+					methods++
+				}
+			}
+		default:
+			methods++
+		}
+	}
+
+	return methods
+}
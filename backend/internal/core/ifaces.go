@@ -2,6 +2,7 @@ package core
 
 import (
 	"context"
+	"time"
 )
 
 type IUser interface {
@@ -9,26 +10,196 @@ type IUser interface {
 	ByEmail(ctx context.Context, email string) (*User, error)
 	ByName(ctx context.Context, name string) (*User, error)
 	ByIdentity(ctx context.Context, itype, externalID, issuer string) (*User, error)
+	// Search returns a page of the users matching filter that are not deleted, without their identities,
+	// and the total count of them. A nil filter matches every user
+	Search(ctx context.Context, filter *Filter, offset, limit int) ([]User, int, error)
 
 	Create(ctx context.Context, user *User) error
 	Update(ctx context.Context, user *User) error
 
 	SaveIdentity(ctx context.Context, identity *Identity) error
 	SaveCredential(ctx context.Context, credential *Credential) error
+	DeleteIdentity(ctx context.Context, userID, identityID string) error
+}
+
+type IGroups interface {
+	ByID(ctx context.Context, id string) (*Group, error)
+	// Search returns a page of the groups matching filter and the total count of them
+	Search(ctx context.Context, filter *Filter, offset, limit int) ([]Group, int, error)
+
+	Create(ctx context.Context, group *Group) error
+	// Update replaces the attributes and members of the group and moves it to the next version
+	Update(ctx context.Context, group *Group) error
+	Delete(ctx context.Context, id string) error
+}
+
+type ISCIMClients interface {
+	ByTokenHash(ctx context.Context, tokenHash string) (*SCIMClient, error)
+	List(ctx context.Context) ([]SCIMClient, error)
+
+	Create(ctx context.Context, client *SCIMClient) error
+	// Revoke returns SCIMClientNotFound when there is no client with the id
+	Revoke(ctx context.Context, id string) error
+}
+
+type ISessions interface {
+	ByID(ctx context.Context, id string) (*Session, error)
+	ByUser(ctx context.Context, userID string) ([]Session, error)
+
+	Create(ctx context.Context, session *Session) error
+	Update(ctx context.Context, session *Session) error
+	RevokeAll(ctx context.Context, userID string) error
+}
+
+type IAudit interface {
+	Record(ctx context.Context, event *AuditEvent) error
+	ByUser(ctx context.Context, userID string, limit int) ([]AuditEvent, error)
 }
 
 type IClient interface {
 	ByID(ctx context.Context, id string) (*Client, error)
 }
 
+type IServiceProviders interface {
+	ByEntityID(ctx context.Context, entityID string) (*ServiceProvider, error)
+}
+
+type IConsents interface {
+	Has(ctx context.Context, userID, clientID string) (bool, error)
+	Grant(ctx context.Context, userID, clientID string) error
+}
+
 type IToken interface {
 	Generate(claims *Claims) (string, error)
 	SignWithKey(claims *Claims, key PrivateKey) (string, error)
 }
 
+type IIDTokenVerifier interface {
+	Verify(ctx context.Context, rawToken string) (map[string]string, error)
+}
+
+// IFederatedProvider runs the authorization code flow against an upstream identity provider
+type IFederatedProvider interface {
+	DisplayName() string
+	AuthCodeURL(state, nonce, codeChallenge string) string
+	// Exchange redeems the code and returns the verified claims of the upstream user,
+	// id tokens must carry the nonce passed to AuthCodeURL
+	Exchange(ctx context.Context, code, codeVerifier, nonce string) (map[string]string, error)
+}
+
+// IDirectory checks passwords against an ldap directory
+type IDirectory interface {
+	// Authenticate returns InvalidCredentials when the user is unknown or the password is wrong
+	Authenticate(ctx context.Context, username, password string) (*DirectoryEntry, error)
+}
+
+type IFederationStates interface {
+	Issue(state FederationState, ttl int) (id string, err error)
+	// Take returns the state once, later calls for the same id return nil
+	Take(id string) (*FederationState, error)
+}
+
+type IPendingLinks interface {
+	Issue(link PendingLink, ttl int) (token string, err error)
+	// Take returns the link once, later calls for the same token return nil
+	Take(token string) (*PendingLink, error)
+}
+
+// ISAML reads and writes the SAML protocol messages
+type ISAML interface {
+	// ParseAuthnRequest decodes a request of the HTTP-Redirect (deflated) or HTTP-POST binding
+	ParseAuthnRequest(encoded string) (*AuthnRequest, error)
+	// SignResponse signs the response and its assertion and returns it base64 encoded for the HTTP-POST binding
+	SignResponse(response *SAMLResponse, key PrivateKey) (string, error)
+	Metadata(entityID, ssoURL string, keys []PrivateKey) ([]byte, error)
+}
+
+// IPartialSessions keeps the logins that passed the first factor until the second one is verified
+type IPartialSessions interface {
+	Issue(partial PartialSession, ttl int) (token string, err error)
+	// Get returns nil when the token is unknown or expired
+	Get(token string) (*PartialSession, error)
+	// Update replaces the partial session without extending its expiry
+	Update(token string, partial PartialSession) error
+	Delete(token string) error
+}
+
+// IWebAuthn checks the responses of authenticators for the relying party of the sso: the client
+// data, the authenticator data and the signatures. Responses it refuses are InvalidWebAuthnResponse
+type IWebAuthn interface {
+	ParseRegistration(response []byte) (*WebAuthnRegistration, error)
+	ParseAssertion(response []byte) (*WebAuthnAssertion, error)
+	// VerifyAssertion checks the signature of the assertion with a COSE public key
+	VerifyAssertion(assertion *WebAuthnAssertion, publicKey []byte) error
+}
+
+type IWebAuthnChallenges interface {
+	Issue(ceremony WebAuthnCeremony, ttl int) (challenge string, err error)
+	// Take returns the ceremony once, later calls for the same challenge return nil
+	Take(challenge string) (*WebAuthnCeremony, error)
+}
+
+// IMailer delivers the emails of the sso, such as login codes
+type IMailer interface {
+	Send(ctx context.Context, mail Mail) error
+}
+
+// IEmailTokens signs the single-use tokens of the links mailed to users. Forged tokens are
+// refused before any lookup
+type IEmailTokens interface {
+	Issue(ctx context.Context, token EmailToken, ttl int) (string, error)
+	// Take returns the token once, later calls and tokens with a wrong signature return nil
+	Take(ctx context.Context, token string) (*EmailToken, error)
+}
+
+// IEmailOTPs keeps the login code pending for each address
+type IEmailOTPs interface {
+	// Issue replaces the code pending for the address
+	Issue(email string, otp EmailOTP, ttl int) error
+	// Get returns nil when no code is pending or it expired
+	Get(email string) (*EmailOTP, error)
+	// Update replaces the pending code without extending its expiry
+	Update(email string, otp EmailOTP) error
+	Delete(email string) error
+}
+
+// ICipher encrypts the secrets that are stored but have to be read back, such as totp secrets
+type ICipher interface {
+	Encrypt(plaintext []byte) (string, error)
+	Decrypt(ciphertext string) ([]byte, error)
+}
+
+// ILoginAttempts keeps the failed login counters where every instance of the sso sees them
+type ILoginAttempts interface {
+	// Get returns nil when no failure of the key is remembered
+	Get(ctx context.Context, key string) (*LoginAttempt, error)
+	// Fail counts a failure and returns the new count, failures older than window seconds are forgotten first
+	Fail(ctx context.Context, key string, window int) (*LoginAttempt, error)
+	// Lock refuses logins of the key until the moment, an existing longer lock is kept
+	Lock(ctx context.Context, key string, until time.Time) error
+	Reset(ctx context.Context, key string) error
+}
+
+// IRateLimits holds token buckets that refill perMinute tokens a minute up to burst, shared
+// backends let every instance of the sso take from the same buckets
+type IRateLimits interface {
+	// Take takes a token from the bucket of the key. An empty bucket is left as it is and the wait
+	// until its next token is returned
+	Take(ctx context.Context, key string, perMinute, burst int) (time.Duration, error)
+}
+
+// IBreachedPasswords is a k-anonymity dataset of breached passwords, it is only ever asked
+// about the first 5 hex digits of the SHA-1 of a password
+type IBreachedPasswords interface {
+	// Range returns the uppercase hex suffixes of the breached hashes starting with prefix
+	Range(ctx context.Context, prefix string) ([]string, error)
+}
+
 type IHash interface {
 	HashPassword(raw string) (string, error)
 	CheckPassword(raw, hash string) error
+	// NeedsRehash reports a hash made with another algorithm or parameters than new ones are
+	NeedsRehash(hash string) bool
 }
 
 type IPrivateKeys interface {
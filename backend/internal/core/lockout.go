@@ -0,0 +1,301 @@
+package core
+
+import (
+	e "sso/internal/core/errors"
+	"go.uber.org/zap"
+
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+// LoginAttempt counts the failed logins in a row of an account or an address
+type LoginAttempt struct {
+	// Key is "account:<email>", "mfa:<user id>" or "ip:<address>"
+	Key string
+	Failures int
+	LastFailureAt time.Time
+	// LockedUntil is when the next login is accepted again, nil when it is accepted right away
+	LockedUntil *time.Time
+}
+
+// LockoutPolicy slows down guessing. The failures up to FreeFailures are not delayed, each one after
+// doubles the wait from BaseDelay up to MaxDelay, and MaxFailures locks logins out for LockoutDuration.
+// Failures are forgotten Window after the last one. Durations are in seconds, a zero MaxFailures
+// disables the lockout
+type LockoutPolicy struct {
+	FreeFailures int
+	BaseDelay int
+	MaxDelay int
+	MaxFailures int
+	LockoutDuration int
+	Window int
+}
+
+// LockoutPolicies are applied together, a login has to pass both its account and its address
+type LockoutPolicies struct {
+	Account LockoutPolicy
+	IP LockoutPolicy
+}
+
+// delay is how long logins are refused after the nth failure in a row
+func (p LockoutPolicy) delay(failures int) time.Duration {
+	if p.MaxFailures > 0 && failures >= p.MaxFailures {
+		return time.Duration(p.LockoutDuration)*time.Second
+	}
+
+	if failures <= p.FreeFailures || p.BaseDelay <= 0 {
+		return 0
+	}
+
+	// past the cap the shift would overflow
+	delay := time.Duration(p.MaxDelay)*time.Second
+	if exp := failures - p.FreeFailures - 1; exp < 32 {
+		delay = min(time.Duration(p.BaseDelay)*time.Second<<exp, delay)
+	}
+
+	return delay
+}
+
+// LockedOutError refuses a login while its account or address waits out failed attempts
+type LockedOutError struct {
+	RetryAfter time.Duration
+}
+
+func (err *LockedOutError) Error() string {
+	return e.LoginLocked.Error()
+}
+
+func (err *LockedOutError) Unwrap() error {
+	return e.LoginLocked
+}
+
+type UnlockInput struct {
+	UserID string
+
+	IP string
+	UserAgent string
+}
+
+// LockoutUseCase tracks failed password logins. Addresses without an account are counted the same
+// way, so a lockout does not tell whether an account exists
+type LockoutUseCase struct {
+	users IUser
+	attempts ILoginAttempts
+	policies LockoutPolicies
+	audit IAudit
+}
+
+func NewLockoutUseCase(users IUser, attempts ILoginAttempts, policies LockoutPolicies, audit IAudit) *LockoutUseCase {
+	return &LockoutUseCase{
+		users,
+		attempts,
+		policies,
+		audit,
+	}
+}
+
+func accountAttemptKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipAttemptKey(ip string) string {
+	return "ip:" + ip
+}
+
+func mfaAttemptKey(userID string) string {
+	return "mfa:" + userID
+}
+
+// keys pairs the counters a login is checked against with their policies, logins without a known address
+// are only counted for their account
+func (uc *LockoutUseCase) keys(email, ip string) map[string]LockoutPolicy {
+	keys := map[string]LockoutPolicy{
+		accountAttemptKey(email): uc.policies.Account,
+	}
+	if ip != "" {
+		keys[ipAttemptKey(ip)] = uc.policies.IP
+	}
+
+	return keys
+}
+
+// check refuses the login while its account or address is locked
+func (uc *LockoutUseCase) check(ctx context.Context, email, ip string) error {
+	return uc.checkKeys(ctx, uc.keys(email, ip))
+}
+
+// failed counts a failed login and locks its account and address for the delay the count calls for
+func (uc *LockoutUseCase) failed(ctx context.Context, email, ip, userAgent string) error {
+	lockedOut, err := uc.fail(ctx, uc.keys(email, ip))
+	if err != nil {
+		return err
+	}
+
+	if failures, ok := lockedOut[accountAttemptKey(email)]; ok {
+		uc.auditLockout(ctx, email, ip, userAgent, failures)
+	}
+
+	return nil
+}
+
+// mfaKeys pairs the counters of the second factor of a user with their policies. A valid password
+// forgets the failures of the account, so wrong codes are counted apart from them
+func (uc *LockoutUseCase) mfaKeys(userID, ip string) map[string]LockoutPolicy {
+	keys := map[string]LockoutPolicy{
+		mfaAttemptKey(userID): uc.policies.Account,
+	}
+	if ip != "" {
+		keys[ipAttemptKey(ip)] = uc.policies.IP
+	}
+
+	return keys
+}
+
+// checkMFA refuses the second factor of the user while their codes or the address are locked
+func (uc *LockoutUseCase) checkMFA(ctx context.Context, userID, ip string) error {
+	return uc.checkKeys(ctx, uc.mfaKeys(userID, ip))
+}
+
+// failedMFA counts a wrong second factor code like failed counts a wrong password
+func (uc *LockoutUseCase) failedMFA(ctx context.Context, userID, ip, userAgent string) error {
+	lockedOut, err := uc.fail(ctx, uc.mfaKeys(userID, ip))
+	if err != nil {
+		return err
+	}
+
+	if failures, ok := lockedOut[mfaAttemptKey(userID)]; ok {
+		recordAudit(ctx, uc.audit, NewAuditEvent(userID, "mfa.locked_out", ip, userAgent, map[string]string{
+			"failures": fmt.Sprint(failures),
+		}))
+	}
+
+	return nil
+}
+
+// succeededMFA forgets the wrong codes of the user
+func (uc *LockoutUseCase) succeededMFA(ctx context.Context, userID string) error {
+	log := getLoggerFromContext(ctx)
+
+	if err := uc.attempts.Reset(ctx, mfaAttemptKey(userID)); err != nil {
+		log.Error("failed to reset second factor attempts", zap.Error(err), zap.String("user_id", userID))
+		return err
+	}
+
+	return nil
+}
+
+// checkKeys returns a LockedOutError while any of the keys is locked
+func (uc *LockoutUseCase) checkKeys(ctx context.Context, keys map[string]LockoutPolicy) error {
+	log := getLoggerFromContext(ctx)
+
+	var retryAfter time.Duration
+	for key := range keys {
+		attempt, err := uc.attempts.Get(ctx, key)
+		if err != nil {
+			log.Error("failed to get login attempts", zap.Error(err), zap.String("key", key))
+			return err
+		}
+
+		if attempt != nil && attempt.LockedUntil != nil {
+			retryAfter = max(retryAfter, time.Until(*attempt.LockedUntil))
+		}
+	}
+
+	if retryAfter > 0 {
+		log.Info("login is locked", zap.Strings("keys", slices.Collect(maps.Keys(keys))), zap.Duration("retry_after", retryAfter))
+		return &LockedOutError{RetryAfter: retryAfter}
+	}
+
+	return nil
+}
+
+// fail counts a failure against each of the keys and locks them for the delay their count calls for.
+// It returns the failures of the keys this failure locked out
+func (uc *LockoutUseCase) fail(ctx context.Context, keys map[string]LockoutPolicy) (map[string]int, error) {
+	log := getLoggerFromContext(ctx)
+
+	lockedOut := map[string]int{}
+	for key, policy := range keys {
+		attempt, err := uc.attempts.Fail(ctx, key, policy.Window)
+		if err != nil {
+			log.Error("failed to count login failure", zap.Error(err), zap.String("key", key))
+			return nil, err
+		}
+
+		delay := policy.delay(attempt.Failures)
+		if delay == 0 {
+			continue
+		}
+
+		if err := uc.attempts.Lock(ctx, key, time.Now().Add(delay)); err != nil {
+			log.Error("failed to lock logins", zap.Error(err), zap.String("key", key))
+			return nil, err
+		}
+
+		if policy.MaxFailures > 0 && attempt.Failures == policy.MaxFailures {
+			log.Info("logins locked out", zap.String("key", key), zap.Int("failures", attempt.Failures))
+			lockedOut[key] = attempt.Failures
+		}
+	}
+
+	return lockedOut, nil
+}
+
+// auditLockout records the lockout of an existing account
+func (uc *LockoutUseCase) auditLockout(ctx context.Context, email, ip, userAgent string, failures int) {
+	log := getLoggerFromContext(ctx)
+
+	user, err := uc.users.ByEmail(ctx, strings.TrimSpace(email))
+	if err != nil {
+		log.Error("failed to get user by email", zap.Error(err), zap.String("email", email))
+		return
+	}
+
+	if user != nil {
+		recordAudit(ctx, uc.audit, NewAuditEvent(user.ID, "login.locked_out", ip, userAgent, map[string]string{
+			"failures": fmt.Sprint(failures),
+		}))
+	}
+}
+
+// succeeded forgets the failures of the account. Those of the address are kept, a valid password
+// of one account says nothing about the guesses made from there for others
+func (uc *LockoutUseCase) succeeded(ctx context.Context, email string) error {
+	log := getLoggerFromContext(ctx)
+
+	if err := uc.attempts.Reset(ctx, accountAttemptKey(email)); err != nil {
+		log.Error("failed to reset login attempts", zap.Error(err), zap.String("email", email))
+		return err
+	}
+
+	return nil
+}
+
+// Unlock lets an admin lift the lockout of an account before it runs out
+func (uc *LockoutUseCase) Unlock(ctx context.Context, input UnlockInput) error {
+	log := getLoggerFromContext(ctx)
+
+	user, err := uc.users.ByID(ctx, input.UserID)
+	if err != nil {
+		log.Error("failed to get user by id", zap.Error(err), zap.String("user_id", input.UserID))
+		return err
+	}
+
+	if user == nil {
+		log.Info("user not found", zap.String("user_id", input.UserID))
+		return e.UserNotFound
+	}
+
+	if err := uc.attempts.Reset(ctx, accountAttemptKey(user.Email)); err != nil {
+		log.Error("failed to reset login attempts", zap.Error(err), zap.String("user_id", user.ID))
+		return err
+	}
+
+	recordAudit(ctx, uc.audit, NewAuditEvent(user.ID, "account.unlocked", input.IP, input.UserAgent, nil))
+
+	return nil
+}
@@ -2,26 +2,54 @@ package core
 
 import (
 	e "sso/internal/core/errors"
-	"github.com/golang-jwt/jwt/v5"
 	"go.uber.org/zap"
 
 	"context"
-	"time"
+	"errors"
+	"slices"
 )
 
+// DirectoryEntry is a user found in a directory. Claims have the shape of those of federated
+// providers so directory users are provisioned and linked the same way
+type DirectoryEntry struct {
+	Claims map[string]string
+	// Roles are mapped from the groups of the user, nil when the directory maps no groups
+	Roles []string
+}
+
 type LoginUseCase struct {
 	user IUser
 	token IToken
 	hash IHash
-	sessionExp int
+	sessions ISessions
+	client IClient
+	policies SessionPolicies
+	links IPendingLinks
+	// directory is nil when no ldap directory is configured
+	directory IDirectory
+	partials IPartialSessions
+	// passkeys is nil when webauthn is not configured
+	passkeys *WebAuthnUseCase
+	// emailOTP is nil when no mailer is configured
+	emailOTP *EmailOTPUseCase
+	// lockout is nil when failed logins are not limited
+	lockout *LockoutUseCase
 }
 
-func NewLoginUseCase(user IUser, token IToken, hash IHash, sessionExp int) *LoginUseCase {
+func NewLoginUseCase(user IUser, token IToken, hash IHash, sessions ISessions, client IClient, policies SessionPolicies, links IPendingLinks, directory IDirectory, partials IPartialSessions, passkeys *WebAuthnUseCase, emailOTP *EmailOTPUseCase, lockout *LockoutUseCase) *LoginUseCase {
 	return &LoginUseCase{
 		user,
 		token,
 		hash,
-		sessionExp,
+		sessions,
+		client,
+		policies,
+		links,
+		directory,
+		partials,
+		passkeys,
+		emailOTP,
+		lockout,
 	}
 }
 
@@ -29,14 +57,30 @@ type LoginInput struct {
 	Provider string
 
 	Email string
+	// Username is the directory login name of the ldap provider
+	Username string
 	Password string
+	// LinkToken links a pending upstream identity to the account once the password and any second factor are checked
+	LinkToken string
+	// WebAuthn is the assertion response of the webauthn provider, answering a BeginLogin challenge
+	WebAuthn []byte
+	// Code is the one-time code the email_otp provider mailed to Email
+	Code string
+	// EmailToken is the signed token of the magic link the email_otp provider mailed
+	EmailToken string
 
 	ExternalID string
 	Token map[string]string
 	Issuer string
+
+	ClientID string
+	RememberMe bool
+
+	IP string
+	UserAgent string
 }
 
-func (uc *LoginUseCase) Execute(ctx context.Context, input LoginInput) (string, error) {
+func (uc *LoginUseCase) Execute(ctx context.Context, input LoginInput) (string, *Session, error) {
 	log := getLoggerFromContext(ctx)
 
 	var user *User
@@ -46,40 +90,88 @@ func (uc *LoginUseCase) Execute(ctx context.Context, input LoginInput) (string,
 	case "email":
 		user, err = uc.loginByEmail(ctx, input)	
 	case "oauth":
-		token := input.Token
-		email := token["email"]
-		user, err = GoogleOAuth(ctx, uc.user, email, token["raw"], input.Provider, input.ExternalID, input.Issuer)
+		user, err = FederatedUser(ctx, uc.user, uc.links, input.Token, input.ExternalID, input.Issuer)
+	case "ldap":
+		user, err = uc.loginByDirectory(ctx, input)
+	case "webauthn":
+		user, err = uc.loginByPasskey(ctx, input)
+	case "email_otp":
+		user, err = uc.loginByEmailOTP(ctx, input)
 	default:
 		err = e.InvalidAuthProvider
 	}
 
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
 	if !user.CanLogin() {
 		log.Info("user cannot be logged in", zap.String("user_id", user.ID), zap.String("status", user.Status))
-		return "", e.UserCannotBeLoggedIn
+		return "", nil, e.UserCannotBeLoggedIn
+	}
+
+	// the password proves the user owns the account the upstream identity claimed. With a second
+	// factor the identity waits for MFAUseCase.Verify to be linked
+	var linkToken string
+	if input.Provider == "email" {
+		linkToken = input.LinkToken
 	}
 
-	issuedAt := jwt.NewNumericDate(time.Now())
-	expiresAt := jwt.NewNumericDate(time.Now().Add(time.Duration(uc.sessionExp)*time.Second))
+	policy, err := sessionPolicy(ctx, uc.client, uc.policies, input.ClientID, input.RememberMe)
+	if err != nil {
+		return "", nil, err
+	}
 
-	claims := Claims{
-		RegisteredClaims: jwt.RegisteredClaims{
-			Subject: user.ID,
-			Issuer: "sso.semgateam.ru",
-			IssuedAt: issuedAt,
-			ExpiresAt: expiresAt,
-		},
+	// the other providers only prove the first factor, MFAUseCase.Verify issues the session.
+	// A passkey with user verification is two factors on its own
+	if factors := secondFactors(user); len(factors) > 0 && input.Provider != "webauthn" {
+		return "", nil, challengeSecondFactor(ctx, uc.partials, user, factors, PartialSession{
+			UserID: user.ID,
+			AuthMethods: authMethods(input.Provider),
+			Policy: policy,
+			RememberMe: input.RememberMe,
+			IP: input.IP,
+			UserAgent: input.UserAgent,
+			LinkToken: linkToken,
+		})
 	}
 
-	ssoSessionToken, err := uc.token.Generate(&claims)
+	if linkToken != "" {
+		if err := linkPendingIdentity(ctx, uc.user, uc.links, user, linkToken); err != nil {
+			return "", nil, err
+		}
+	}
 
-	return ssoSessionToken, err
+	return issueSession(ctx, uc.sessions, uc.token, user, input.IP, input.UserAgent, authMethods(input.Provider), policy, input.RememberMe)
 }
 
+// loginByEmail checks the password of the email identity. Failures are counted per account and
+// address, and their logins refused for a while once they pile up
 func (uc *LoginUseCase) loginByEmail(ctx context.Context, input LoginInput) (*User, error) {
+	if uc.lockout == nil {
+		return uc.checkEmailPassword(ctx, input)
+	}
+
+	if err := uc.lockout.check(ctx, input.Email, input.IP); err != nil {
+		return nil, err
+	}
+
+	user, err := uc.checkEmailPassword(ctx, input)
+	switch {
+	case err == nil:
+		if err := uc.lockout.succeeded(ctx, input.Email); err != nil {
+			return nil, err
+		}
+	case errors.Is(err, e.InvalidCredentials), errors.Is(err, e.IdentityNotFound), errors.Is(err, e.CredentialNotFound):
+		if err := uc.lockout.failed(ctx, input.Email, input.IP, input.UserAgent); err != nil {
+			return nil, err
+		}
+	}
+
+	return user, err
+}
+
+func (uc *LoginUseCase) checkEmailPassword(ctx context.Context, input LoginInput) (*User, error) {
 	log := getLoggerFromContext(ctx)
 
 	user, err := uc.user.ByEmail(ctx, input.Email)
@@ -88,6 +180,11 @@ func (uc *LoginUseCase) loginByEmail(ctx context.Context, input LoginInput) (*Us
 		return nil, err
 	}
 
+	if user == nil {
+		log.Info("user not found", zap.String("email", input.Email))
+		return nil, e.InvalidCredentials
+	}
+
 	var emailIdentity *Identity
 	for _, id := range user.Identities {
 		if id.Type == "email" {
@@ -114,9 +211,111 @@ func (uc *LoginUseCase) loginByEmail(ctx context.Context, input LoginInput) (*Us
 	}
 
 	if err := uc.hash.CheckPassword(input.Password, passwordCred.Hash); err != nil {
-		log.Fatal("failed to check password", zap.Error(err))
+		log.Info("password does not match", zap.String("user_id", user.ID))
+		return nil, e.InvalidCredentials
+	}
+
+	if uc.hash.NeedsRehash(passwordCred.Hash) {
+		uc.rehashPassword(ctx, user, passwordCred, input.Password)
+	}
+
+	return user, nil
+}
+
+// rehashPassword moves a password to the current hash algorithm and parameters while its plain text
+// is at hand. The old hash still works, so a failure does not fail the login
+func (uc *LoginUseCase) rehashPassword(ctx context.Context, user *User, cred *Credential, password string) {
+	log := getLoggerFromContext(ctx)
+
+	hashed, err := uc.hash.HashPassword(password)
+	if err != nil {
+		log.Error("failed to rehash password", zap.Error(err), zap.String("user_id", user.ID))
+		return
+	}
+
+	cred.Hash = hashed
+	if err := uc.user.SaveCredential(ctx, cred); err != nil {
+		log.Error("failed to save rehashed password", zap.Error(err), zap.String("user_id", user.ID))
+		return
+	}
+
+	log.Info("password rehashed", zap.String("user_id", user.ID))
+}
+
+// loginByPasskey signs in with a passkey alone, which requires the authenticator to verify the user
+func (uc *LoginUseCase) loginByPasskey(ctx context.Context, input LoginInput) (*User, error) {
+	log := getLoggerFromContext(ctx)
+
+	if uc.passkeys == nil {
+		log.Info("webauthn is not configured")
+		return nil, e.InvalidAuthProvider
+	}
+
+	user, assertion, err := uc.passkeys.authenticate(ctx, input.WebAuthn, "login", "")
+	if err != nil {
+		return nil, err
+	}
+
+	if !assertion.UserVerified {
+		log.Info("authenticator did not verify the user", zap.String("user_id", user.ID))
+		return nil, e.InvalidWebAuthnResponse
+	}
+
+	return user, nil
+}
+
+func (uc *LoginUseCase) loginByEmailOTP(ctx context.Context, input LoginInput) (*User, error) {
+	log := getLoggerFromContext(ctx)
+
+	if uc.emailOTP == nil {
+		log.Info("no mailer is configured")
+		return nil, e.InvalidAuthProvider
+	}
+
+	return uc.emailOTP.redeem(ctx, input)
+}
+
+// loginByDirectory checks the password against the directory and provisions the directory user on
+// the first login. The roles of the user follow its directory groups
+func (uc *LoginUseCase) loginByDirectory(ctx context.Context, input LoginInput) (*User, error) {
+	log := getLoggerFromContext(ctx)
+
+	if uc.directory == nil {
+		log.Info("no ldap directory is configured")
+		return nil, e.InvalidAuthProvider
+	}
+
+	// a bind without password is anonymous and always succeeds
+	if input.Username == "" || input.Password == "" {
+		log.Info("username or password is empty")
+		return nil, e.InvalidCredentials
+	}
+
+	entry, err := uc.directory.Authenticate(ctx, input.Username, input.Password)
+	if errors.Is(err, e.InvalidCredentials) {
+		log.Info("directory refused the credentials", zap.String("username", input.Username))
+		return nil, err
+	}
+	if err != nil {
+		log.Error("failed to authenticate against the directory", zap.Error(err), zap.String("username", input.Username))
 		return nil, err
 	}
 
+	user, err := FederatedUser(ctx, uc.user, uc.links, entry.Claims, entry.Claims["sub"], entry.Claims["issuer"])
+	if err != nil {
+		return nil, err
+	}
+
+	if entry.Roles != nil && !slices.Equal(user.Roles, entry.Roles) {
+		user.Roles = entry.Roles
+
+		if err := uc.user.Update(ctx, user); err != nil {
+			log.Error("failed to update user roles", zap.Error(err), zap.String("user_id", user.ID))
+			return nil, err
+		}
+
+		log.Info("user roles updated from directory groups", zap.String("user_id", user.ID), zap.Strings("roles", user.Roles))
+	}
+
 	return user, nil
 }
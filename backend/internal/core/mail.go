@@ -0,0 +1,17 @@
+package core
+
+// Mail is a plain text email to a user
+type Mail struct {
+	To string
+	Subject string
+	Text string
+}
+
+// EmailToken is what a signed link mailed to a user stands for
+type EmailToken struct {
+	// Purpose is the flow that mailed the link, a token is only redeemed by that flow
+	Purpose string
+	UserID string
+	// Email is the address the link was mailed to, the link is void once the user changes it
+	Email string
+}
@@ -0,0 +1,643 @@
+package core
+
+import (
+	e "sso/internal/core/errors"
+	"go.uber.org/zap"
+
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// RFC 6238 defaults, the only parameters every authenticator app supports
+	totpPeriod = 30
+	totpDigits = 6
+	// codes of the neighbouring steps are accepted for clocks that drift
+	totpSkew = 1
+
+	// mfaChallengeTTL is how long a login that passed the first factor waits for the second, in seconds
+	mfaChallengeTTL = 5*60
+	// maxMFAAttempts wrong codes end the login, the first factor has to be entered again
+	maxMFAAttempts = 5
+	recoveryCodeCount = 10
+)
+
+// PartialSession is a login that passed the first factor and waits for the second one.
+// It holds everything needed to issue the session once the code is verified
+type PartialSession struct {
+	UserID string
+	AuthMethods []string
+	Policy SessionPolicy
+	RememberMe bool
+	IP string
+	UserAgent string
+	// Attempts counts the wrong codes entered for this login
+	Attempts int
+	// LinkToken is the pending upstream identity the login links once the second factor is verified
+	LinkToken string
+}
+
+// MFARequiredError is returned by a login whose user has a second factor. The login is finished
+// by verifying a code with MFAToken
+type MFARequiredError struct {
+	MFAToken string
+	// Methods are the second factors the user can answer with: totp, webauthn and recovery_code
+	Methods []string
+}
+
+func (err *MFARequiredError) Error() string {
+	return e.MFARequired.Error()
+}
+
+func (err *MFARequiredError) Unwrap() error {
+	return e.MFARequired
+}
+
+// TOTPEnrollment is shown once to the user, the URI is what authenticator apps scan as a QR code
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI string `json:"otpauth_uri"`
+}
+
+type MFAStatus struct {
+	TOTP bool `json:"totp"`
+	Passkeys int `json:"passkeys"`
+	// RecoveryCodes is the number of unused recovery codes
+	RecoveryCodes int `json:"recovery_codes"`
+}
+
+// SecondFactorInput proves the second factor with a totp code or a recovery code. Logins can
+// also answer with the assertion of a passkey
+type SecondFactorInput struct {
+	Code string
+	RecoveryCode string
+	WebAuthn []byte
+}
+
+// TOTPCode returns the RFC 6238 code of secret at t, HMAC-SHA1 over 30 second steps with 6 digits
+func TOTPCode(secret []byte, t time.Time) string {
+	return totpAt(secret, t.Unix()/totpPeriod)
+}
+
+func totpAt(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// dynamic truncation of RFC 4226
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// checkTOTP returns the step code was generated for. Steps up to lastStep are refused, a code
+// works once even though it stays valid for its whole step
+func checkTOTP(secret []byte, code string, now time.Time, lastStep int64) (int64, bool) {
+	current := now.Unix()/totpPeriod
+
+	for step := current - totpSkew; step <= current + totpSkew; step++ {
+		if step > lastStep && hmac.Equal([]byte(totpAt(secret, step)), []byte(code)) {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// secondFactors lists the second factors the user can log in with, none means a single factor login.
+// Recovery codes only stand in for the other factors
+func secondFactors(user *User) []string {
+	factors := []string{}
+	if activeCredential(user, "totp") != nil {
+		factors = append(factors, "totp")
+	}
+	if len(activePasskeys(user)) > 0 {
+		factors = append(factors, "webauthn")
+	}
+
+	if len(factors) > 0 && activeCredential(user, "recovery_code") != nil {
+		factors = append(factors, "recovery_code")
+	}
+
+	return factors
+}
+
+// activeCredential returns the account credential of the type, nil when there is none
+func activeCredential(user *User, ctype string) *Credential {
+	for i := range user.Credentials {
+		if user.Credentials[i].Type == ctype && user.Credentials[i].Status == "active" {
+			return &user.Credentials[i]
+		}
+	}
+
+	return nil
+}
+
+// challengeSecondFactor parks a login that passed the first factor and returns the MFARequiredError
+// the client finishes it with
+func challengeSecondFactor(ctx context.Context, partials IPartialSessions, user *User, factors []string, partial PartialSession) error {
+	log := getLoggerFromContext(ctx)
+
+	token, err := partials.Issue(partial, mfaChallengeTTL)
+	if err != nil {
+		log.Error("failed to issue partial session", zap.Error(err), zap.String("user_id", user.ID))
+		return err
+	}
+
+	log.Info("second factor required", zap.String("user_id", user.ID), zap.Strings("methods", factors))
+
+	return &MFARequiredError{
+		MFAToken: token,
+		Methods: factors,
+	}
+}
+
+type MFAUseCase struct {
+	users IUser
+	hash IHash
+	cipher ICipher
+	partials IPartialSessions
+	sessions ISessions
+	token IToken
+	audit IAudit
+	// issuer names the sso in authenticator apps
+	issuer string
+	// passkeys is nil when webauthn is not configured
+	passkeys *WebAuthnUseCase
+	links IPendingLinks
+	// lockout is nil when failed logins are not limited
+	lockout *LockoutUseCase
+}
+
+func NewMFAUseCase(users IUser, hash IHash, cipher ICipher, partials IPartialSessions, sessions ISessions, token IToken, audit IAudit, issuer string, passkeys *WebAuthnUseCase, links IPendingLinks, lockout *LockoutUseCase) *MFAUseCase {
+	return &MFAUseCase{
+		users,
+		hash,
+		cipher,
+		partials,
+		sessions,
+		token,
+		audit,
+		issuer,
+		passkeys,
+		links,
+		lockout,
+	}
+}
+
+func (uc *MFAUseCase) Status(ctx context.Context, userID string) (*MFAStatus, error) {
+	user, err := uc.user(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &MFAStatus{
+		TOTP: activeCredential(user, "totp") != nil,
+		Passkeys: len(activePasskeys(user)),
+	}
+	for _, cred := range user.Credentials {
+		if cred.Type == "recovery_code" && cred.Status == "active" {
+			status.RecoveryCodes++
+		}
+	}
+
+	return status, nil
+}
+
+// StartTOTP generates a secret for the user. It is stored pending until ConfirmTOTP proves the
+// authenticator app has it, starting again replaces a pending secret
+func (uc *MFAUseCase) StartTOTP(ctx context.Context, userID string) (*TOTPEnrollment, error) {
+	log := getLoggerFromContext(ctx)
+
+	user, err := uc.user(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if activeCredential(user, "totp") != nil {
+		log.Info("totp is already enrolled", zap.String("user_id", user.ID))
+		return nil, e.MFAAlreadyEnrolled
+	}
+
+	secret := make([]byte, 20)
+	rand.Read(secret)
+
+	encrypted, err := uc.cipher.Encrypt(secret)
+	if err != nil {
+		log.Error("failed to encrypt totp secret", zap.Error(err))
+		return nil, err
+	}
+
+	cred := &Credential{
+		UserID: user.ID,
+		Type: "totp",
+		Status: "pending",
+	}
+	for _, existing := range user.Credentials {
+		if existing.Type == "totp" && existing.Status == "pending" {
+			cred = &existing
+		}
+	}
+	cred.Hash = encrypted
+
+	if err := uc.users.SaveCredential(ctx, cred); err != nil {
+		log.Error("failed to save totp credential", zap.Error(err), zap.String("user_id", user.ID))
+		return nil, err
+	}
+
+	encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)
+
+	return &TOTPEnrollment{
+		Secret: encoded,
+		URI: "otpauth://totp/" + url.PathEscape(uc.issuer+":"+user.Email) + "?" + url.Values{
+			"secret": {encoded},
+			"issuer": {uc.issuer},
+			"algorithm": {"SHA1"},
+			"digits": {fmt.Sprint(totpDigits)},
+			"period": {fmt.Sprint(totpPeriod)},
+		}.Encode(),
+	}, nil
+}
+
+// ConfirmTOTP activates the pending secret with a first code and returns the recovery codes,
+// they are shown once and only their hashes are kept
+func (uc *MFAUseCase) ConfirmTOTP(ctx context.Context, input IdentityChangeInput, code string) ([]string, error) {
+	log := getLoggerFromContext(ctx)
+
+	user, err := uc.user(ctx, input.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	if activeCredential(user, "totp") != nil {
+		log.Info("totp is already enrolled", zap.String("user_id", user.ID))
+		return nil, e.MFAAlreadyEnrolled
+	}
+
+	var pending *Credential
+	for i := range user.Credentials {
+		if user.Credentials[i].Type == "totp" && user.Credentials[i].Status == "pending" {
+			pending = &user.Credentials[i]
+		}
+	}
+
+	if pending == nil {
+		log.Info("no totp enrollment is pending", zap.String("user_id", user.ID))
+		return nil, e.MFANotEnrolled
+	}
+
+	if err := uc.checkTOTP(ctx, pending, code); err != nil {
+		return nil, err
+	}
+	pending.Status = "active"
+
+	if err := uc.users.SaveCredential(ctx, pending); err != nil {
+		log.Error("failed to activate totp credential", zap.Error(err), zap.String("user_id", user.ID))
+		return nil, err
+	}
+
+	codes, err := uc.replaceRecoveryCodes(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	recordAudit(ctx, uc.audit, NewAuditEvent(user.ID, "mfa.totp.enrolled", input.IP, input.UserAgent, nil))
+
+	return codes, nil
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes, the user proves the second factor first
+func (uc *MFAUseCase) RegenerateRecoveryCodes(ctx context.Context, input IdentityChangeInput, proof SecondFactorInput) ([]string, error) {
+	user, err := uc.enrolledUser(ctx, input.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := uc.checkSecondFactor(ctx, user, input, proof); err != nil {
+		return nil, err
+	}
+
+	codes, err := uc.replaceRecoveryCodes(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	recordAudit(ctx, uc.audit, NewAuditEvent(user.ID, "mfa.recovery_codes.regenerated", input.IP, input.UserAgent, nil))
+
+	return codes, nil
+}
+
+// DisableTOTP removes the second factor and the recovery codes, the user proves the second factor first
+func (uc *MFAUseCase) DisableTOTP(ctx context.Context, input IdentityChangeInput, proof SecondFactorInput) error {
+	log := getLoggerFromContext(ctx)
+
+	user, err := uc.enrolledUser(ctx, input.UserID)
+	if err != nil {
+		return err
+	}
+
+	if err := uc.checkSecondFactor(ctx, user, input, proof); err != nil {
+		return err
+	}
+
+	for _, cred := range user.Credentials {
+		if (cred.Type == "totp" || cred.Type == "recovery_code") && cred.Status != "revoked" {
+			cred.Status = "revoked"
+
+			if err := uc.users.SaveCredential(ctx, &cred); err != nil {
+				log.Error("failed to revoke second factor", zap.Error(err), zap.String("user_id", user.ID), zap.String("credential_id", cred.ID))
+				return err
+			}
+		}
+	}
+
+	recordAudit(ctx, uc.audit, NewAuditEvent(user.ID, "mfa.totp.disabled", input.IP, input.UserAgent, nil))
+
+	return nil
+}
+
+// WebAuthnOptions returns the options a login parked by a MFARequiredError answers with a passkey.
+// Presence is enough, the password was the other factor
+func (uc *MFAUseCase) WebAuthnOptions(ctx context.Context, mfaToken string) (*CredentialRequestOptions, error) {
+	user, _, err := uc.partialUser(ctx, mfaToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if uc.passkeys == nil || len(activePasskeys(user)) == 0 {
+		getLoggerFromContext(ctx).Info("user has no passkey", zap.String("user_id", user.ID))
+		return nil, e.MFANotEnrolled
+	}
+
+	return uc.passkeys.requestOptions(ctx, WebAuthnCeremony{Type: "mfa", UserID: user.ID}, user, "discouraged")
+}
+
+// Verify finishes a login parked by a MFARequiredError. Too many wrong codes end the login, and
+// they are counted for the user across logins so a new password login does not start the guessing over
+func (uc *MFAUseCase) Verify(ctx context.Context, mfaToken string, proof SecondFactorInput) (string, *Session, error) {
+	log := getLoggerFromContext(ctx)
+
+	user, partial, err := uc.partialUser(ctx, mfaToken)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if !user.CanLogin() {
+		log.Info("user cannot be logged in", zap.String("user_id", user.ID), zap.String("status", user.Status))
+		uc.partials.Delete(mfaToken)
+		return "", nil, e.UserCannotBeLoggedIn
+	}
+
+	if uc.lockout != nil {
+		if err := uc.lockout.checkMFA(ctx, user.ID, partial.IP); err != nil {
+			return "", nil, err
+		}
+	}
+
+	input := IdentityChangeInput{
+		UserID: user.ID,
+		IP: partial.IP,
+		UserAgent: partial.UserAgent,
+	}
+
+	method := "otp"
+	if len(proof.WebAuthn) > 0 {
+		method = "hwk"
+		err = uc.checkPasskey(ctx, user, proof.WebAuthn)
+	} else {
+		err = uc.checkSecondFactor(ctx, user, input, proof)
+	}
+
+	if errors.Is(err, e.InvalidMFACode) {
+		if uc.lockout != nil {
+			err = errors.Join(err, uc.lockout.failedMFA(ctx, user.ID, partial.IP, partial.UserAgent))
+		}
+
+		partial.Attempts++
+		if partial.Attempts >= maxMFAAttempts {
+			log.Info("too many wrong second factor codes", zap.String("user_id", user.ID))
+			err = errors.Join(err, uc.partials.Delete(mfaToken))
+		} else {
+			err = errors.Join(err, uc.partials.Update(mfaToken, *partial))
+		}
+
+		return "", nil, err
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	if err := uc.partials.Delete(mfaToken); err != nil {
+		log.Error("failed to delete partial session", zap.Error(err))
+		return "", nil, err
+	}
+
+	if uc.lockout != nil {
+		if err := uc.lockout.succeededMFA(ctx, user.ID); err != nil {
+			return "", nil, err
+		}
+	}
+
+	if partial.LinkToken != "" {
+		if err := linkPendingIdentity(ctx, uc.users, uc.links, user, partial.LinkToken); err != nil {
+			return "", nil, err
+		}
+	}
+
+	methods := append(slices.Clone(partial.AuthMethods), method, "mfa")
+
+	return issueSession(ctx, uc.sessions, uc.token, user, partial.IP, partial.UserAgent, methods, partial.Policy, partial.RememberMe)
+}
+
+// partialUser returns the parked login of mfaToken and its user
+func (uc *MFAUseCase) partialUser(ctx context.Context, mfaToken string) (*User, *PartialSession, error) {
+	log := getLoggerFromContext(ctx)
+
+	partial, err := uc.partials.Get(mfaToken)
+	if err != nil {
+		log.Error("failed to get partial session", zap.Error(err))
+		return nil, nil, err
+	}
+
+	if partial == nil {
+		log.Info("partial session not found")
+		return nil, nil, e.InvalidMFAToken
+	}
+
+	user, err := uc.user(ctx, partial.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return user, partial, nil
+}
+
+// checkPasskey accepts an assertion of a passkey of the user, a refused one counts as a wrong code
+func (uc *MFAUseCase) checkPasskey(ctx context.Context, user *User, response []byte) error {
+	if uc.passkeys == nil {
+		return e.InvalidMFACode
+	}
+
+	_, _, err := uc.passkeys.authenticate(ctx, response, "mfa", user.ID)
+	if errors.Is(err, e.InvalidWebAuthnResponse) {
+		return errors.Join(e.InvalidMFACode, err)
+	}
+
+	return err
+}
+
+// checkSecondFactor accepts a totp code or an unused recovery code, which is used up
+func (uc *MFAUseCase) checkSecondFactor(ctx context.Context, user *User, input IdentityChangeInput, proof SecondFactorInput) error {
+	log := getLoggerFromContext(ctx)
+
+	if proof.Code != "" {
+		cred := activeCredential(user, "totp")
+		if cred == nil {
+			log.Info("no totp is enrolled", zap.String("user_id", user.ID))
+			return e.InvalidMFACode
+		}
+
+		return uc.checkTOTP(ctx, cred, proof.Code)
+	}
+
+	code := normalizeRecoveryCode(proof.RecoveryCode)
+	if code == "" {
+		log.Info("no second factor code given", zap.String("user_id", user.ID))
+		return e.InvalidMFACode
+	}
+
+	for _, cred := range user.Credentials {
+		if cred.Type != "recovery_code" || cred.Status != "active" || uc.hash.CheckPassword(code, cred.Hash) != nil {
+			continue
+		}
+
+		cred.Status = "used"
+		if err := uc.users.SaveCredential(ctx, &cred); err != nil {
+			log.Error("failed to use recovery code", zap.Error(err), zap.String("user_id", user.ID))
+			return err
+		}
+
+		recordAudit(ctx, uc.audit, NewAuditEvent(user.ID, "mfa.recovery_code.used", input.IP, input.UserAgent, nil))
+
+		return nil
+	}
+
+	log.Info("recovery code does not match", zap.String("user_id", user.ID))
+	return e.InvalidMFACode
+}
+
+// checkTOTP verifies a code against the secret of cred and records its step so it cannot be used again
+func (uc *MFAUseCase) checkTOTP(ctx context.Context, cred *Credential, code string) error {
+	log := getLoggerFromContext(ctx)
+
+	secret, err := uc.cipher.Decrypt(cred.Hash)
+	if err != nil {
+		log.Error("failed to decrypt totp secret", zap.Error(err), zap.String("credential_id", cred.ID))
+		return err
+	}
+
+	step, ok := checkTOTP(secret, strings.TrimSpace(code), time.Now(), cred.Counter)
+	if !ok {
+		log.Info("totp code does not match", zap.String("credential_id", cred.ID))
+		return e.InvalidMFACode
+	}
+	cred.Counter = step
+
+	if err := uc.users.SaveCredential(ctx, cred); err != nil {
+		log.Error("failed to save totp step", zap.Error(err), zap.String("credential_id", cred.ID))
+		return err
+	}
+
+	return nil
+}
+
+// replaceRecoveryCodes revokes the unused recovery codes of the user and returns new ones
+func (uc *MFAUseCase) replaceRecoveryCodes(ctx context.Context, user *User) ([]string, error) {
+	log := getLoggerFromContext(ctx)
+
+	for _, cred := range user.Credentials {
+		if cred.Type == "recovery_code" && cred.Status == "active" {
+			cred.Status = "revoked"
+
+			if err := uc.users.SaveCredential(ctx, &cred); err != nil {
+				log.Error("failed to revoke recovery code", zap.Error(err), zap.String("user_id", user.ID))
+				return nil, err
+			}
+		}
+	}
+
+	codes := []string{}
+	for range recoveryCodeCount {
+		raw := make([]byte, 7)
+		rand.Read(raw)
+
+		// ten base32 characters, 50 bits, written as two groups of five
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(raw))[:10]
+		codes = append(codes, code[:5]+"-"+code[5:])
+
+		hash, err := uc.hash.HashPassword(code)
+		if err != nil {
+			log.Error("failed to hash recovery code", zap.Error(err))
+			return nil, err
+		}
+
+		if err := uc.users.SaveCredential(ctx, &Credential{UserID: user.ID, Type: "recovery_code", Hash: hash, Status: "active"}); err != nil {
+			log.Error("failed to save recovery code", zap.Error(err), zap.String("user_id", user.ID))
+			return nil, err
+		}
+	}
+
+	return codes, nil
+}
+
+// normalizeRecoveryCode accepts codes typed with or without the dash and in any case
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+func (uc *MFAUseCase) enrolledUser(ctx context.Context, userID string) (*User, error) {
+	log := getLoggerFromContext(ctx)
+
+	user, err := uc.user(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if activeCredential(user, "totp") == nil {
+		log.Info("no second factor is enrolled", zap.String("user_id", user.ID))
+		return nil, e.MFANotEnrolled
+	}
+
+	return user, nil
+}
+
+func (uc *MFAUseCase) user(ctx context.Context, userID string) (*User, error) {
+	log := getLoggerFromContext(ctx)
+
+	user, err := uc.users.ByID(ctx, userID)
+	if err != nil {
+		log.Error("failed to get user by id", zap.Error(err), zap.String("user_id", userID))
+		return nil, err
+	}
+
+	if user == nil {
+		log.Info("user not found", zap.String("user_id", userID))
+		return nil, e.UserNotFound
+	}
+
+	return user, nil
+}
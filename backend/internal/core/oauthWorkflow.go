@@ -5,48 +5,214 @@ import (
 	"go.uber.org/zap"
 
 	"context"
+	"errors"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type OAuthWorkflow struct {
 	client IClient
+	users IUser
 	token IToken
 	keys IPrivateKeys
 	authCodes IAuthCodes
+	consents IConsents
 
 	accessExpiration int
 	refreshExpiration int
 	authCodeExpiration int
 }
 
-func NewOAuthWorkflow(clientInterface IClient, tokenInterface IToken, keyInterface IPrivateKeys, codesInterface IAuthCodes, accessExpiration, refreshExpiration, authCodeExpiration int) *OAuthWorkflow {
+func NewOAuthWorkflow(clientInterface IClient, userInterface IUser, tokenInterface IToken, keyInterface IPrivateKeys, codesInterface IAuthCodes, consentsInterface IConsents, accessExpiration, refreshExpiration, authCodeExpiration int) *OAuthWorkflow {
 	return &OAuthWorkflow{
 		client: clientInterface,
+		users: userInterface,
 		token: tokenInterface,
 		keys: keyInterface,
 		authCodes: codesInterface,
+		consents: consentsInterface,
 		accessExpiration: accessExpiration,
 		refreshExpiration: refreshExpiration,
 		authCodeExpiration: authCodeExpiration,
 	}
 }
 
-func (w *OAuthWorkflow) Execute(ctx context.Context, userID, clientID, redirectURI string) (string, error) {
+type AuthorizeInput struct {
+	ClientID string
+	RedirectURI string
+	State string
+
+	// space separated list of none, login, consent, select_account
+	Prompt string
+	MaxAge string
+	LoginHint string
+}
+
+// Authorize applies the OIDC prompt and max_age parameters to the current sso session before issuing a code.
+// session is nil when the user agent has no valid session. With prompt=none the failures are reported
+// to the client as an error redirect, otherwise LoginRequired, AccountSelectionRequired or ConsentRequired
+// is returned and the caller is expected to send the user to the matching page
+func (w *OAuthWorkflow) Authorize(ctx context.Context, session *Session, input AuthorizeInput) (string, error) {
+	log := getLoggerFromContext(ctx)
+
+	client, err := w.allowedClient(ctx, input.ClientID, input.RedirectURI)
+	if err != nil {
+		return "", err
+	}
+
+	prompt := strings.Fields(input.Prompt)
+	for _, p := range prompt {
+		if !slices.Contains([]string{"none", "login", "consent", "select_account"}, p) {
+			log.Info("unknown prompt value", zap.String("prompt", input.Prompt))
+			return "", e.InvalidAuthorizeRequest
+		}
+	}
+
+	silent := slices.Contains(prompt, "none")
+	if silent && len(prompt) > 1 {
+		log.Info("prompt=none combined with other values", zap.String("prompt", input.Prompt))
+		return "", e.InvalidAuthorizeRequest
+	}
+
+	maxAge := -1
+	if input.MaxAge != "" {
+		maxAge, err = strconv.Atoi(input.MaxAge)
+		if err != nil || maxAge < 0 {
+			log.Info("invalid max_age", zap.String("max_age", input.MaxAge))
+			return "", e.InvalidAuthorizeRequest
+		}
+	}
+
+	var required error
+	switch {
+	case session == nil:
+		required = e.LoginRequired
+	case slices.Contains(prompt, "login"):
+		required = e.LoginRequired
+	case maxAge >= 0 && time.Since(session.CreatedAt) > time.Duration(maxAge)*time.Second:
+		required = e.LoginRequired
+	case slices.Contains(prompt, "select_account"):
+		required = e.AccountSelectionRequired
+	}
+
+	if required == nil {
+		consented, err := w.consents.Has(ctx, session.UserID, client.ID)
+		if err != nil {
+			log.Error("failed to check consent", zap.Error(err), zap.String("client_id", input.ClientID))
+			return "", err
+		}
+
+		if !consented || slices.Contains(prompt, "consent") {
+			required = e.ConsentRequired
+		}
+	}
+
+	if required != nil {
+		log.Info("user interaction required", zap.String("client_id", input.ClientID), zap.Error(required))
+
+		if silent {
+			return withQuery(input.RedirectURI, url.Values{
+				"error": {AuthorizeErrorCode(required)},
+				"state": {input.State},
+			}), nil
+		}
+
+		return "", required
+	}
+
+	return w.issueCode(ctx, client, session.UserID, input.RedirectURI, input.State)
+}
+
+// AuthorizeErrorCode maps an interaction error to the OIDC error code sent back to the client
+func AuthorizeErrorCode(err error) string {
+	switch {
+	case errors.Is(err, e.AccountSelectionRequired):
+		return "account_selection_required"
+	case errors.Is(err, e.ConsentRequired):
+		return "consent_required"
+	default:
+		return "login_required"
+	}
+}
+
+// Client returns the client the user is asked to consent to, checking the redirect like Authorize does
+func (w *OAuthWorkflow) Client(ctx context.Context, clientID, redirectURI string) (*Client, error) {
+	return w.allowedClient(ctx, clientID, redirectURI)
+}
+
+func (w *OAuthWorkflow) GrantConsent(ctx context.Context, userID string, input AuthorizeInput) error {
+	log := getLoggerFromContext(ctx)
+
+	client, err := w.allowedClient(ctx, input.ClientID, input.RedirectURI)
+	if err != nil {
+		return err
+	}
+
+	if err := w.consents.Grant(ctx, userID, client.ID); err != nil {
+		log.Error("failed to grant consent", zap.Error(err), zap.String("client_id", input.ClientID), zap.String("user_id", userID))
+		return err
+	}
+
+	return nil
+}
+
+// DenyConsent builds the access_denied redirect back to the client
+func (w *OAuthWorkflow) DenyConsent(ctx context.Context, input AuthorizeInput) (string, error) {
+	if _, err := w.allowedClient(ctx, input.ClientID, input.RedirectURI); err != nil {
+		return "", err
+	}
+
+	return withQuery(input.RedirectURI, url.Values{
+		"error": {"access_denied"},
+		"state": {input.State},
+	}), nil
+}
+
+func (w *OAuthWorkflow) allowedClient(ctx context.Context, clientID, redirectURI string) (*Client, error) {
 	log := getLoggerFromContext(ctx)
 
 	client, err := w.client.ByID(ctx, clientID)
 	if err != nil {
 		log.Fatal("failed to get client by id", zap.Error(err), zap.String("client_id", clientID))
-		return "", err
+		return nil, err
 	}
 
 	if client == nil {
 		log.Info("client not found", zap.String("client_id", clientID))
-		return "", e.ClientNotFound
+		return nil, e.ClientNotFound
 	}
 
 	if !client.AllowsRedirect(redirectURI) {
 		log.Info("redirect is not allowed", zap.String("client_id", clientID), zap.String("redirect_uri", redirectURI))
-		return "", e.RedirectURINotAllowed
+		return nil, e.RedirectURINotAllowed
+	}
+
+	return client, nil
+}
+
+// issueCode is where every code is issued, so the policies of the client on the user are applied here
+func (w *OAuthWorkflow) issueCode(ctx context.Context, client *Client, userID, redirectURI, state string) (string, error) {
+	log := getLoggerFromContext(ctx)
+
+	if client.RequireVerifiedEmail {
+		user, err := w.users.ByID(ctx, userID)
+		if err != nil {
+			log.Error("failed to get user by id", zap.Error(err), zap.String("user_id", userID))
+			return "", err
+		}
+
+		if user == nil {
+			log.Info("user not found", zap.String("user_id", userID))
+			return "", e.UserNotFound
+		}
+
+		if !user.EmailVerified {
+			log.Info("client requires a verified email", zap.String("client_id", client.ClientID), zap.String("user_id", userID))
+			return "", e.EmailNotVerified
+		}
 	}
 
 	code, err := w.authCodes.Issue(client.ID, redirectURI, userID, w.authCodeExpiration)
@@ -55,7 +221,30 @@ func (w *OAuthWorkflow) Execute(ctx context.Context, userID, clientID, redirectU
 		return "", err
 	}
 
-	return redirectURI + "?code=" + code, nil
+	return withQuery(redirectURI, url.Values{
+		"code": {code},
+		"state": {state},
+	}), nil
+}
+
+// withQuery appends the non empty params to the uri keeping its own query
+func withQuery(uri string, params url.Values) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+
+	query := u.Query()
+	for key, values := range params {
+		for _, v := range values {
+			if v != "" {
+				query.Add(key, v)
+			}
+		}
+	}
+	u.RawQuery = query.Encode()
+
+	return u.String()
 }
 
 func (w *OAuthWorkflow) ExchangeCode(ctx context.Context, authCode, clientID, clientSecret, redirectURI, userID string) (string, string, error) {
@@ -101,6 +290,20 @@ func (w *OAuthWorkflow) tokens(ctx context.Context, clientID, userID string) (st
 		return "", "", err
 	}
 
+	user, err := w.users.ByID(ctx, userID)
+	if err != nil {
+		log.Error("failed to get user by id", zap.Error(err), zap.String("user_id", userID))
+		return "", "", err
+	}
+
+	if user == nil {
+		log.Info("user not found", zap.String("user_id", userID))
+		return "", "", e.UserNotFound
+	}
+
+	accessClaims.Email = user.Email
+	accessClaims.EmailVerified = &user.EmailVerified
+
 	refreshClaims, err := NewClaims(clientID, userID, w.refreshExpiration)
 	if err != nil {
 		log.Info("invalid claims", zap.Error(err))
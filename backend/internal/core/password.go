@@ -0,0 +1,326 @@
+package core
+
+import (
+	e "sso/internal/core/errors"
+	"go.uber.org/zap"
+
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// passwordResetTTL is how long a mailed reset link can be used, in seconds
+const passwordResetTTL = 30*60
+
+type PasswordForgotInput struct {
+	Email string
+
+	IP string
+	UserAgent string
+}
+
+type PasswordResetInput struct {
+	Token string
+	Password string
+
+	IP string
+	UserAgent string
+}
+
+type PasswordChangeInput struct {
+	UserID string
+	// SessionID is the session the change is made from, it stays signed in
+	SessionID string
+	CurrentPassword string
+	NewPassword string
+	// SignOutOthers revokes every other session of the user
+	SignOutOthers bool
+
+	IP string
+	UserAgent string
+}
+
+// passwordCredential returns the password of the email identity of the user, nil when the user has none
+func passwordCredential(user *User) *Credential {
+	for _, identity := range user.Identities {
+		if identity.Type != "email" {
+			continue
+		}
+
+		for i := range identity.Credentials {
+			if identity.Credentials[i].Type == "password" {
+				return &identity.Credentials[i]
+			}
+		}
+	}
+
+	return nil
+}
+
+type PasswordUseCase struct {
+	users IUser
+	hash IHash
+	sessions ISessions
+	tokens IEmailTokens
+	// mailer is nil when no mail relay is configured, resets and change notices are not mailed then
+	mailer IMailer
+	audit IAudit
+	// resetURL is the page of the sso the reset links open
+	resetURL string
+	policy *PasswordPolicy
+	// lockout counts wrong current passwords with the failed logins of the account, nil when they are not limited
+	lockout *LockoutUseCase
+}
+
+func NewPasswordUseCase(users IUser, hash IHash, sessions ISessions, tokens IEmailTokens, mailer IMailer, audit IAudit, resetURL string, policy *PasswordPolicy, lockout *LockoutUseCase) *PasswordUseCase {
+	return &PasswordUseCase{
+		users,
+		hash,
+		sessions,
+		tokens,
+		mailer,
+		audit,
+		resetURL,
+		policy,
+		lockout,
+	}
+}
+
+// Forgot mails a reset link to the address when it belongs to an account with a password.
+// The link is issued and mailed off the request path and its failures are only logged, so the
+// answer and its timing are the same for every address and accounts cannot be probed
+func (uc *PasswordUseCase) Forgot(ctx context.Context, input PasswordForgotInput) error {
+	log := getLoggerFromContext(ctx)
+
+	if uc.mailer == nil {
+		log.Error("no mailer is configured, password reset is not mailed")
+		return nil
+	}
+
+	user, err := uc.users.ByEmail(ctx, strings.TrimSpace(input.Email))
+	if err != nil {
+		log.Error("failed to get user by email", zap.Error(err), zap.String("email", input.Email))
+		return err
+	}
+
+	if user == nil || !user.CanLogin() || passwordCredential(user) == nil {
+		log.Info("password reset requested for an address without a password", zap.String("email", input.Email))
+		return nil
+	}
+
+	goDetached(ctx, func(ctx context.Context) {
+		uc.mailReset(ctx, user, input)
+	})
+
+	return nil
+}
+
+func (uc *PasswordUseCase) mailReset(ctx context.Context, user *User, input PasswordForgotInput) {
+	log := getLoggerFromContext(ctx)
+
+	token, err := uc.tokens.Issue(ctx, EmailToken{Purpose: "password_reset", UserID: user.ID, Email: user.Email}, passwordResetTTL)
+	if err != nil {
+		log.Error("failed to issue password reset token", zap.Error(err), zap.String("user_id", user.ID))
+		return
+	}
+
+	recordAudit(ctx, uc.audit, NewAuditEvent(user.ID, "password.reset_requested", input.IP, input.UserAgent, nil))
+
+	err = uc.mailer.Send(ctx, Mail{
+		To: user.Email,
+		Subject: "Reset your password",
+		Text: "Someone asked to reset the password of your account. To choose a new password, open this link:\n" +
+			uc.resetURL + "?" + url.Values{"token": {token}}.Encode() + "\n\n" +
+			fmt.Sprintf("The link can be used once and expires in %d minutes. If you did not ask for it, you can ignore this email.\n", passwordResetTTL/60),
+	})
+	if err != nil {
+		log.Error("failed to mail password reset", zap.Error(err), zap.String("user_id", user.ID))
+	}
+}
+
+// Reset replaces the password of the user the token was mailed to and signs out every session,
+// whoever knew the old password is out
+func (uc *PasswordUseCase) Reset(ctx context.Context, input PasswordResetInput) error {
+	log := getLoggerFromContext(ctx)
+
+	if err := uc.policy.Check(ctx, input.Password); err != nil {
+		return err
+	}
+
+	token, err := uc.tokens.Take(ctx, input.Token)
+	if err != nil {
+		log.Error("failed to take password reset token", zap.Error(err))
+		return err
+	}
+
+	if token == nil || token.Purpose != "password_reset" {
+		log.Info("password reset token is invalid or expired")
+		return e.InvalidResetToken
+	}
+
+	user, err := uc.users.ByID(ctx, token.UserID)
+	if err != nil {
+		log.Error("failed to get user by id", zap.Error(err), zap.String("user_id", token.UserID))
+		return err
+	}
+
+	if user == nil || !user.CanLogin() || !strings.EqualFold(user.Email, token.Email) {
+		log.Info("password reset token was mailed to another address of the user", zap.String("user_id", token.UserID))
+		return e.InvalidResetToken
+	}
+
+	cred := passwordCredential(user)
+	if cred == nil {
+		log.Info("credential not found", zap.String("user_id", user.ID))
+		return e.CredentialNotFound
+	}
+
+	if err := uc.setPassword(ctx, user, cred, input.Password); err != nil {
+		return err
+	}
+
+	if err := uc.sessions.RevokeAll(ctx, user.ID); err != nil {
+		log.Error("failed to revoke sessions", zap.Error(err), zap.String("user_id", user.ID))
+		return err
+	}
+
+	recordAudit(ctx, uc.audit, NewAuditEvent(user.ID, "password.reset", input.IP, input.UserAgent, nil))
+
+	return nil
+}
+
+// Change replaces the password of a signed in user who knows the current one and mails the user
+// about it, so a change the user did not make does not go unnoticed
+func (uc *PasswordUseCase) Change(ctx context.Context, input PasswordChangeInput) error {
+	log := getLoggerFromContext(ctx)
+
+	user, err := uc.users.ByID(ctx, input.UserID)
+	if err != nil {
+		log.Error("failed to get user by id", zap.Error(err), zap.String("user_id", input.UserID))
+		return err
+	}
+
+	if user == nil {
+		log.Info("user not found", zap.String("user_id", input.UserID))
+		return e.UserNotFound
+	}
+
+	cred := passwordCredential(user)
+	if cred == nil {
+		log.Info("credential not found", zap.String("user_id", user.ID))
+		return e.CredentialNotFound
+	}
+
+	if err := uc.checkCurrentPassword(ctx, user, cred, input); err != nil {
+		return err
+	}
+
+	if err := uc.policy.Check(ctx, input.NewPassword); err != nil {
+		return err
+	}
+
+	if err := uc.setPassword(ctx, user, cred, input.NewPassword); err != nil {
+		return err
+	}
+
+	if input.SignOutOthers {
+		if err := uc.revokeOtherSessions(ctx, user.ID, input.SessionID); err != nil {
+			return err
+		}
+	}
+
+	recordAudit(ctx, uc.audit, NewAuditEvent(user.ID, "password.changed", input.IP, input.UserAgent, map[string]string{
+		"signed_out_others": fmt.Sprint(input.SignOutOthers),
+	}))
+
+	if uc.mailer == nil {
+		log.Info("no mailer is configured, password change is not notified", zap.String("user_id", user.ID))
+		return nil
+	}
+
+	// the password is changed already, a mail that cannot be sent does not undo it
+	err = uc.mailer.Send(ctx, Mail{
+		To: user.Email,
+		Subject: "Your password was changed",
+		Text: fmt.Sprintf("The password of your account was changed from %s (%s).\n\n", input.IP, input.UserAgent) +
+			"If you did not change it, reset your password right away and review the sessions of your account.\n",
+	})
+	if err != nil {
+		log.Error("failed to mail password change notice", zap.Error(err), zap.String("user_id", user.ID))
+	}
+
+	return nil
+}
+
+// checkCurrentPassword refuses guesses of the current password the way failed logins are, a stolen
+// session alone does not get unlimited tries
+func (uc *PasswordUseCase) checkCurrentPassword(ctx context.Context, user *User, cred *Credential, input PasswordChangeInput) error {
+	log := getLoggerFromContext(ctx)
+
+	if uc.lockout != nil {
+		if err := uc.lockout.check(ctx, user.Email, input.IP); err != nil {
+			return err
+		}
+	}
+
+	if err := uc.hash.CheckPassword(input.CurrentPassword, cred.Hash); err != nil {
+		log.Info("current password does not match", zap.String("user_id", user.ID))
+
+		if uc.lockout != nil {
+			if err := uc.lockout.failed(ctx, user.Email, input.IP, input.UserAgent); err != nil {
+				return err
+			}
+		}
+
+		return e.InvalidCredentials
+	}
+
+	if uc.lockout != nil {
+		return uc.lockout.succeeded(ctx, user.Email)
+	}
+
+	return nil
+}
+
+func (uc *PasswordUseCase) revokeOtherSessions(ctx context.Context, userID, currentID string) error {
+	log := getLoggerFromContext(ctx)
+
+	sessions, err := uc.sessions.ByUser(ctx, userID)
+	if err != nil {
+		log.Error("failed to get user sessions", zap.Error(err), zap.String("user_id", userID))
+		return err
+	}
+
+	for _, session := range sessions {
+		if session.ID == currentID || !session.IsActive() {
+			continue
+		}
+
+		session.Revoke()
+		if err := uc.sessions.Update(ctx, &session); err != nil {
+			log.Error("failed to revoke session", zap.Error(err), zap.String("session_id", session.ID))
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (uc *PasswordUseCase) setPassword(ctx context.Context, user *User, cred *Credential, password string) error {
+	log := getLoggerFromContext(ctx)
+
+	hashed, err := uc.hash.HashPassword(password)
+	if err != nil {
+		log.Error("failed to hash password", zap.Error(err), zap.String("user_id", user.ID))
+		return err
+	}
+	cred.Hash = hashed
+
+	if err := uc.users.SaveCredential(ctx, cred); err != nil {
+		log.Error("failed to save password", zap.Error(err), zap.String("user_id", user.ID))
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,157 @@
+package core
+
+import (
+	e "sso/internal/core/errors"
+	"go.uber.org/zap"
+
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// PasswordViolation is a rule of the password policy a password does not follow
+type PasswordViolation struct {
+	// Rule is one of min_length, max_length, character_classes, blocklist and breached
+	Rule string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicyError lists every rule a chosen password violates, so the user can fix them at once
+type PasswordPolicyError struct {
+	Violations []PasswordViolation
+}
+
+func (err *PasswordPolicyError) Error() string {
+	return e.InvalidPassword.Error()
+}
+
+func (err *PasswordPolicyError) Unwrap() error {
+	return e.InvalidPassword
+}
+
+// PasswordPolicy is checked on every password a user chooses, at registration, reset and change
+type PasswordPolicy struct {
+	// MinLength is counted in characters
+	MinLength int
+	// MaxLength is counted in bytes, bcrypt ignores everything past 72 of them
+	MaxLength int
+	// MinClasses is how many of lowercase, uppercase, digits and symbols the password mixes
+	MinClasses int
+	// blocklist holds the lowercased common passwords
+	blocklist map[string]bool
+	// breached is nil when no breached password dataset is configured
+	breached IBreachedPasswords
+}
+
+func NewPasswordPolicy(minLength, maxLength, minClasses int, blocklist []string, breached IBreachedPasswords) *PasswordPolicy {
+	set := make(map[string]bool, len(blocklist))
+	for _, password := range blocklist {
+		set[strings.ToLower(password)] = true
+	}
+
+	return &PasswordPolicy{
+		MinLength: minLength,
+		MaxLength: maxLength,
+		MinClasses: minClasses,
+		blocklist: set,
+		breached: breached,
+	}
+}
+
+// passwordClasses counts the character classes the password mixes
+func passwordClasses(password string) int {
+	var lower, upper, digit, symbol int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+
+	return lower + upper + digit + symbol
+}
+
+// Check returns a PasswordPolicyError listing the rules the password violates
+func (p *PasswordPolicy) Check(ctx context.Context, password string) error {
+	log := getLoggerFromContext(ctx)
+
+	var violations []PasswordViolation
+
+	if utf8.RuneCountInString(password) < p.MinLength {
+		violations = append(violations, PasswordViolation{
+			Rule: "min_length",
+			Message: fmt.Sprintf("Use at least %d characters.", p.MinLength),
+		})
+	}
+
+	if p.MaxLength > 0 && len(password) > p.MaxLength {
+		violations = append(violations, PasswordViolation{
+			Rule: "max_length",
+			Message: fmt.Sprintf("Use at most %d bytes.", p.MaxLength),
+		})
+	}
+
+	if passwordClasses(password) < p.MinClasses {
+		violations = append(violations, PasswordViolation{
+			Rule: "character_classes",
+			Message: fmt.Sprintf("Mix at least %d of lowercase letters, uppercase letters, digits and symbols.", p.MinClasses),
+		})
+	}
+
+	if p.blocklist[strings.ToLower(password)] {
+		violations = append(violations, PasswordViolation{
+			Rule: "blocklist",
+			Message: "This password is too common.",
+		})
+	} else if password != "" && p.breached != nil {
+		breached, err := p.isBreached(ctx, password)
+		if err != nil {
+			log.Error("failed to check breached passwords", zap.Error(err))
+			return err
+		}
+
+		if breached {
+			violations = append(violations, PasswordViolation{
+				Rule: "breached",
+				Message: "This password appeared in a data breach.",
+			})
+		}
+	}
+
+	if len(violations) > 0 {
+		log.Info("password violates the policy", zap.Int("violations", len(violations)))
+		return &PasswordPolicyError{Violations: violations}
+	}
+
+	return nil
+}
+
+// isBreached only lets the first 5 hex digits of the SHA-1 of the password out, the dataset
+// answers with every suffix known under that prefix and the match is made here
+func (p *PasswordPolicy) isBreached(ctx context.Context, password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	suffixes, err := p.breached.Range(ctx, hash[:5])
+	if err != nil {
+		return false, err
+	}
+
+	for _, suffix := range suffixes {
+		if strings.EqualFold(suffix, hash[5:]) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,96 @@
+package core
+
+import (
+	e "sso/internal/core/errors"
+	"go.uber.org/zap"
+
+	"context"
+	"strings"
+	"time"
+)
+
+// RateLimit is a token bucket refilled PerMinute tokens a minute up to Burst, a zero PerMinute disables it
+type RateLimit struct {
+	PerMinute int
+	Burst int
+}
+
+// RateLimits are applied together, a request takes a token from the bucket of its address, of its
+// client and of its account
+type RateLimits struct {
+	IP RateLimit
+	Client RateLimit
+	Account RateLimit
+}
+
+// RateLimitedError refuses a request until a token of each of its buckets is back
+type RateLimitedError struct {
+	RetryAfter time.Duration
+}
+
+func (err *RateLimitedError) Error() string {
+	return e.RateLimited.Error()
+}
+
+func (err *RateLimitedError) Unwrap() error {
+	return e.RateLimited
+}
+
+// RateLimitInput names the buckets of a request, the empty ones are not limited
+type RateLimitInput struct {
+	IP string
+	ClientID string
+	Account string
+}
+
+// RateLimitUseCase limits the requests of the endpoints that can be used to guess credentials or to mail users
+type RateLimitUseCase struct {
+	limits IRateLimits
+	policies RateLimits
+}
+
+func NewRateLimitUseCase(limits IRateLimits, policies RateLimits) *RateLimitUseCase {
+	return &RateLimitUseCase{
+		limits,
+		policies,
+	}
+}
+
+// Take returns a RateLimitedError when a bucket of the request is empty. A failing backend lets
+// the request through rather than lock everyone out
+func (uc *RateLimitUseCase) Take(ctx context.Context, input RateLimitInput) error {
+	log := getLoggerFromContext(ctx)
+
+	buckets := []struct {
+		key string
+		subject string
+		limit RateLimit
+	}{
+		{"ip:", input.IP, uc.policies.IP},
+		{"client:", input.ClientID, uc.policies.Client},
+		{"account:", strings.ToLower(strings.TrimSpace(input.Account)), uc.policies.Account},
+	}
+
+	var retryAfter time.Duration
+	for _, bucket := range buckets {
+		if bucket.subject == "" || bucket.limit.PerMinute <= 0 {
+			continue
+		}
+
+		key := bucket.key + bucket.subject
+		wait, err := uc.limits.Take(ctx, key, bucket.limit.PerMinute, bucket.limit.Burst)
+		if err != nil {
+			log.Error("failed to take from rate limit bucket", zap.Error(err), zap.String("key", key))
+			continue
+		}
+
+		retryAfter = max(retryAfter, wait)
+	}
+
+	if retryAfter > 0 {
+		log.Info("request is rate limited", zap.String("ip", input.IP), zap.String("client_id", input.ClientID), zap.Duration("retry_after", retryAfter))
+		return &RateLimitedError{RetryAfter: retryAfter}
+	}
+
+	return nil
+}
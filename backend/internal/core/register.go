@@ -2,26 +2,37 @@ package core
 
 import (
 	e "sso/internal/core/errors"
-	"github.com/golang-jwt/jwt/v5"
 	"go.uber.org/zap"
 
 	"context"
-	"time"
 )
 
 type RegisterUseCase struct {
 	user IUser
 	token IToken
 	hash IHash
-	sessionExp int
+	sessions ISessions
+	client IClient
+	policies SessionPolicies
+	links IPendingLinks
+	// verification is nil when accounts registered by email are not verified
+	verification *EmailVerificationUseCase
+	passwords *PasswordPolicy
+	partials IPartialSessions
 }
 
-func NewRegisterUseCase(user IUser, token IToken, hash IHash, sessionExp int) *RegisterUseCase {
+func NewRegisterUseCase(user IUser, token IToken, hash IHash, sessions ISessions, client IClient, policies SessionPolicies, links IPendingLinks, verification *EmailVerificationUseCase, passwords *PasswordPolicy, partials IPartialSessions) *RegisterUseCase {
 	return &RegisterUseCase{
 		user,
 		token,
 		hash,
-		sessionExp,
+		sessions,
+		client,
+		policies,
+		links,
+		verification,
+		passwords,
+		partials,
 	}
 }
 
@@ -35,9 +46,17 @@ type RegisterInput struct {
 	ExternalID string
 	Token map[string]string
 	Issuer string
+
+	ClientID string
+	RememberMe bool
+
+	IP string
+	UserAgent string
 }
 
-func (uc *RegisterUseCase) Execute(ctx context.Context, input RegisterInput) (string, error) {
+func (uc *RegisterUseCase) Execute(ctx context.Context, input RegisterInput) (string, *Session, error) {
+	log := getLoggerFromContext(ctx)
+
 	var user *User
 	var err error
 
@@ -46,33 +65,40 @@ func (uc *RegisterUseCase) Execute(ctx context.Context, input RegisterInput) (st
 		user, err = uc.registerByEmail(ctx, input)
 	
 	case "oauth":
-		token := input.Token
-		email := token["email"]
-		user, err = GoogleOAuth(ctx, uc.user, email, token["raw"], input.Provider, input.ExternalID, input.Issuer)
+		user, err = FederatedUser(ctx, uc.user, uc.links, input.Token, input.ExternalID, input.Issuer)
 
 	default:
 		err = e.InvalidAuthProvider
 	}
 
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
-	issuedAt := jwt.NewNumericDate(time.Now())
-	expiresAt := jwt.NewNumericDate(time.Now().Add(time.Duration(uc.sessionExp)*time.Second))
+	// an upstream identity that is already linked signs its user in, as a login would
+	if !user.CanLogin() {
+		log.Info("user cannot be logged in", zap.String("user_id", user.ID), zap.String("status", user.Status))
+		return "", nil, e.UserCannotBeLoggedIn
+	}
 
-	claims := Claims{
-		RegisteredClaims: jwt.RegisteredClaims{
-			Subject: user.ID,
-			Issuer: "sso.semgateam.ru",
-			IssuedAt: issuedAt,
-			ExpiresAt: expiresAt,
-		},
+	policy, err := sessionPolicy(ctx, uc.client, uc.policies, input.ClientID, input.RememberMe)
+	if err != nil {
+		return "", nil, err
 	}
 
-	ssoSessionToken, err := uc.token.Generate(&claims)
+	// the user of a linked identity may have a second factor, MFAUseCase.Verify issues the session then
+	if factors := secondFactors(user); len(factors) > 0 {
+		return "", nil, challengeSecondFactor(ctx, uc.partials, user, factors, PartialSession{
+			UserID: user.ID,
+			AuthMethods: authMethods(input.Provider),
+			Policy: policy,
+			RememberMe: input.RememberMe,
+			IP: input.IP,
+			UserAgent: input.UserAgent,
+		})
+	}
 
-	return ssoSessionToken, err
+	return issueSession(ctx, uc.sessions, uc.token, user, input.IP, input.UserAgent, authMethods(input.Provider), policy, input.RememberMe)
 }
 
 func (uc *RegisterUseCase) registerByEmail(ctx context.Context, input RegisterInput) (*User, error) {
@@ -84,6 +110,10 @@ func (uc *RegisterUseCase) registerByEmail(ctx context.Context, input RegisterIn
 		return nil, err
 	}
 
+	if err := uc.passwords.Check(ctx, input.Password); err != nil {
+		return nil, err
+	}
+
 	hashed, err := uc.hash.HashPassword(input.Password)
 	if err != nil {
 		log.Fatal("failed to hash password", zap.Error(err))
@@ -121,5 +151,12 @@ func (uc *RegisterUseCase) registerByEmail(ctx context.Context, input RegisterIn
 		return nil, err
 	}
 
+	// the account is usable right away, a failed mail only leaves it unverified until a resend
+	if uc.verification != nil {
+		if err := uc.verification.send(ctx, user, input.IP, input.UserAgent); err != nil {
+			log.Error("failed to send email verification", zap.Error(err), zap.String("user_id", user.ID))
+		}
+	}
+
 	return user, nil
 }
@@ -0,0 +1,324 @@
+package core
+
+import (
+	e "sso/internal/core/errors"
+	"go.uber.org/zap"
+
+	"context"
+	"slices"
+	"time"
+)
+
+const (
+	NameIDFormatEmail = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+	NameIDFormatPersistent = "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent"
+	NameIDFormatUnspecified = "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"
+
+	SAMLStatusSuccess = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	SAMLStatusResponder = "urn:oasis:names:tc:SAML:2.0:status:Responder"
+	SAMLStatusNoPassive = "urn:oasis:names:tc:SAML:2.0:status:NoPassive"
+
+	authnContextPassword = "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport"
+	authnContextUnspecified = "urn:oasis:names:tc:SAML:2.0:ac:classes:unspecified"
+)
+
+// tolerated difference between the clocks of the sso and its service providers
+const samlClockSkew = 3*time.Minute
+
+// ServiceProvider is an application that signs users in over SAML, the SAML counterpart of Client
+type ServiceProvider struct {
+	ID string `json:"id"`
+	EntityID string `json:"entity_id"`
+	Name string `json:"name"`
+	// ACSURLs are the assertion consumer services responses may be posted to, the first one is the default
+	ACSURLs []string `json:"acs_urls"`
+	NameIDFormat string `json:"name_id_format"`
+	// Attributes maps the names of the sent attributes to the user fields id, name or email
+	Attributes map[string]string `json:"attributes"`
+	Status string `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (sp *ServiceProvider) AllowsACS(url string) bool {
+	return sp.Status == "active" && slices.Contains(sp.ACSURLs, url)
+}
+
+// AuthnRequest is the part of a SAML authentication request the identity provider acts on
+type AuthnRequest struct {
+	ID string
+	Issuer string
+	IssueInstant time.Time
+	Destination string
+	ACSURL string
+	ProtocolBinding string
+	ForceAuthn bool
+	IsPassive bool
+}
+
+// SAMLResponse is an unsigned response, Assertion is nil for error statuses
+type SAMLResponse struct {
+	ID string
+	InResponseTo string
+	Issuer string
+	Destination string
+	IssueInstant time.Time
+	Status string
+	SubStatus string
+	Assertion *Assertion
+}
+
+type Assertion struct {
+	ID string
+	Issuer string
+	IssueInstant time.Time
+
+	NameID string
+	NameIDFormat string
+	Recipient string
+	InResponseTo string
+
+	Audience string
+	NotBefore time.Time
+	NotOnOrAfter time.Time
+
+	AuthnInstant time.Time
+	AuthnContext string
+	SessionIndex string
+
+	Attributes map[string][]string
+}
+
+// SAMLResult is what the user agent posts to the assertion consumer service of the service provider
+type SAMLResult struct {
+	ACSURL string
+	SAMLResponse string
+	RelayState string
+}
+
+type SAMLRequestInput struct {
+	// SAMLRequest as received from either binding, base64 encoded and possibly deflated
+	SAMLRequest string
+	RelayState string
+}
+
+// SAMLWorkflow is the SAML 2.0 identity provider, it answers authentication requests of
+// registered service providers from the sso session
+type SAMLWorkflow struct {
+	users IUser
+	providers IServiceProviders
+	keys IPrivateKeys
+	saml ISAML
+
+	entityID string
+	ssoURL string
+	assertionExpiration int
+}
+
+func NewSAMLWorkflow(users IUser, providers IServiceProviders, keys IPrivateKeys, saml ISAML, entityID, ssoURL string, assertionExpiration int) *SAMLWorkflow {
+	return &SAMLWorkflow{
+		users: users,
+		providers: providers,
+		keys: keys,
+		saml: saml,
+		entityID: entityID,
+		ssoURL: ssoURL,
+		assertionExpiration: assertionExpiration,
+	}
+}
+
+// Metadata returns the identity provider metadata service providers are configured with
+func (w *SAMLWorkflow) Metadata(ctx context.Context) ([]byte, error) {
+	log := getLoggerFromContext(ctx)
+
+	keys, err := w.keys.GetPrivateKeys()
+	if err != nil {
+		log.Error("failed to get private keys", zap.Error(err))
+		return nil, err
+	}
+
+	metadata, err := w.saml.Metadata(w.entityID, w.ssoURL, keys)
+	if err != nil {
+		log.Error("failed to build saml metadata", zap.Error(err))
+		return nil, err
+	}
+
+	return metadata, nil
+}
+
+// SSO answers an authentication request with a signed assertion for the user of the session.
+// session is nil when the user agent has no valid session, LoginRequired is returned then and the
+// caller is expected to send the user to the login page and back. Passive requests are answered
+// with a NoPassive status instead
+func (w *SAMLWorkflow) SSO(ctx context.Context, session *Session, input SAMLRequestInput) (*SAMLResult, error) {
+	log := getLoggerFromContext(ctx)
+
+	request, err := w.saml.ParseAuthnRequest(input.SAMLRequest)
+	if err != nil {
+		log.Info("invalid saml request", zap.Error(err))
+		return nil, err
+	}
+
+	sp, err := w.providers.ByEntityID(ctx, request.Issuer)
+	if err != nil {
+		log.Error("failed to get service provider", zap.Error(err), zap.String("entity_id", request.Issuer))
+		return nil, err
+	}
+
+	if sp == nil || sp.Status != "active" {
+		log.Info("service provider not found", zap.String("entity_id", request.Issuer))
+		return nil, e.ServiceProviderNotFound
+	}
+
+	acsURL := request.ACSURL
+	if acsURL == "" && len(sp.ACSURLs) > 0 {
+		acsURL = sp.ACSURLs[0]
+	}
+
+	if !sp.AllowsACS(acsURL) {
+		log.Info("acs url is not allowed", zap.String("entity_id", sp.EntityID), zap.String("acs_url", acsURL))
+		return nil, e.RedirectURINotAllowed
+	}
+
+	if request.Destination != "" && request.Destination != w.ssoURL {
+		log.Info("saml request is for another destination", zap.String("destination", request.Destination))
+		return nil, e.InvalidSAMLRequest
+	}
+
+	// ForceAuthn asks for a login made after the request was sent
+	if session == nil || (request.ForceAuthn && session.CreatedAt.Before(request.IssueInstant.Add(-samlClockSkew))) {
+		if !request.IsPassive {
+			return nil, e.LoginRequired
+		}
+
+		log.Info("passive saml request without a session", zap.String("entity_id", sp.EntityID))
+		return w.respond(ctx, acsURL, input.RelayState, &SAMLResponse{
+			InResponseTo: request.ID,
+			Status: SAMLStatusResponder,
+			SubStatus: SAMLStatusNoPassive,
+		})
+	}
+
+	user, err := w.users.ByID(ctx, session.UserID)
+	if err != nil {
+		log.Error("failed to get user by id", zap.Error(err), zap.String("user_id", session.UserID))
+		return nil, err
+	}
+
+	if user == nil {
+		log.Info("user not found", zap.String("user_id", session.UserID))
+		return nil, e.UserNotFound
+	}
+
+	if !user.CanLogin() {
+		log.Info("user cannot be logged in", zap.String("user_id", user.ID))
+		return nil, e.UserCannotBeLoggedIn
+	}
+
+	now := time.Now().UTC()
+	nameID, nameIDFormat := samlNameID(sp, user)
+
+	authnContext := authnContextUnspecified
+	if slices.Contains(session.AuthMethods, "pwd") {
+		authnContext = authnContextPassword
+	}
+
+	result, err := w.respond(ctx, acsURL, input.RelayState, &SAMLResponse{
+		InResponseTo: request.ID,
+		Status: SAMLStatusSuccess,
+		Assertion: &Assertion{
+			ID: "_" + randomToken(20),
+			Issuer: w.entityID,
+			IssueInstant: now,
+			NameID: nameID,
+			NameIDFormat: nameIDFormat,
+			Recipient: acsURL,
+			InResponseTo: request.ID,
+			Audience: sp.EntityID,
+			NotBefore: now.Add(-samlClockSkew),
+			NotOnOrAfter: now.Add(time.Duration(w.assertionExpiration)*time.Second),
+			AuthnInstant: session.CreatedAt,
+			AuthnContext: authnContext,
+			SessionIndex: session.ID,
+			Attributes: samlAttributes(sp, user),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info("saml assertion issued", zap.String("entity_id", sp.EntityID), zap.String("user_id", user.ID))
+
+	return result, nil
+}
+
+// respond fills the envelope of a response and signs it with the current key
+func (w *SAMLWorkflow) respond(ctx context.Context, acsURL, relayState string, response *SAMLResponse) (*SAMLResult, error) {
+	log := getLoggerFromContext(ctx)
+
+	keys, err := w.keys.GetPrivateKeys()
+	if err != nil {
+		log.Error("failed to get private keys", zap.Error(err))
+		return nil, err
+	}
+	if len(keys) == 0 {
+		log.Error("no private keys found")
+		return nil, e.KeysNotFound
+	}
+
+	response.ID = "_" + randomToken(20)
+	response.Issuer = w.entityID
+	response.Destination = acsURL
+	response.IssueInstant = time.Now().UTC()
+
+	encoded, err := w.saml.SignResponse(response, keys[0])
+	if err != nil {
+		log.Error("failed to sign saml response", zap.Error(err))
+		return nil, err
+	}
+
+	return &SAMLResult{
+		ACSURL: acsURL,
+		SAMLResponse: encoded,
+		RelayState: relayState,
+	}, nil
+}
+
+func samlNameID(sp *ServiceProvider, user *User) (string, string) {
+	switch sp.NameIDFormat {
+	case NameIDFormatPersistent, NameIDFormatUnspecified:
+		return user.ID, sp.NameIDFormat
+	default:
+		return user.Email, NameIDFormatEmail
+	}
+}
+
+// samlAttributes maps the user to the attributes the service provider asked for, by default email, name and uid
+func samlAttributes(sp *ServiceProvider, user *User) map[string][]string {
+	mapping := sp.Attributes
+	if len(mapping) == 0 {
+		mapping = map[string]string{
+			"email": "email",
+			"name": "name",
+			"uid": "id",
+		}
+	}
+
+	attributes := map[string][]string{}
+	for name, field := range mapping {
+		var value string
+		switch field {
+		case "id":
+			value = user.ID
+		case "name":
+			value = user.Name
+		case "email":
+			value = user.Email
+		default:
+			continue
+		}
+
+		attributes[name] = []string{value}
+	}
+
+	return attributes
+}
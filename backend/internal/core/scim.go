@@ -0,0 +1,856 @@
+package core
+
+import (
+	e "sso/internal/core/errors"
+	"go.uber.org/zap"
+
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Group is a set of users managed by a provisioning client
+type Group struct {
+	ID string `json:"id"`
+	DisplayName string `json:"display_name"`
+	ExternalID string `json:"external_id,omitempty"`
+	// Members are the ids of the users in the group
+	Members []string `json:"members"`
+	Version int `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// SCIMClient is a provisioning system allowed to manage users and groups with its bearer token
+type SCIMClient struct {
+	ID string `json:"id"`
+	Name string `json:"name"`
+	TokenHash string `json:"-"`
+	Status string `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// UserAttributes are the attributes of a user a provisioning client manages. UserName is the email
+// the user signs in with
+type UserAttributes struct {
+	UserName string
+	DisplayName string
+	ExternalID string
+	Active bool
+}
+
+type GroupAttributes struct {
+	DisplayName string
+	ExternalID string
+	Members []string
+}
+
+// PatchOperation is an operation of a SCIM PATCH request, Op is add, replace or remove
+type PatchOperation struct {
+	Op string `json:"op"`
+	Path string `json:"path"`
+	Value any `json:"value"`
+}
+
+// ListQuery selects a page of the resources matching Filter, an empty filter matches all of them
+type ListQuery struct {
+	Filter string
+	Offset int
+	Limit int
+}
+
+const (
+	DefaultSCIMPageSize = 100
+	MaxSCIMPageSize = 1000
+)
+
+// SCIMCaller describes the provisioning request for the audit trail
+type SCIMCaller struct {
+	ClientID string
+	IP string
+	UserAgent string
+}
+
+// ETag is the weak entity tag of a resource version
+func ETag(version int) string {
+	return `W/"` + strconv.Itoa(version) + `"`
+}
+
+// MatchesETag reports whether an If-Match or If-None-Match header names the version
+func MatchesETag(header string, version int) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		// weak comparison, the same version always has the same representation
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(ETag(version), "W/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkVersion refuses a change when the If-Match header does not name the current version,
+// requests without the header always apply
+func checkVersion(ifMatch string, version int) error {
+	if ifMatch == "" || MatchesETag(ifMatch, version) {
+		return nil
+	}
+
+	return e.VersionMismatch
+}
+
+func hashSCIMToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(sum[:])
+}
+
+type SCIMUseCase struct {
+	users IUser
+	groups IGroups
+	sessions ISessions
+	clients ISCIMClients
+	audit IAudit
+}
+
+func NewSCIMUseCase(users IUser, groups IGroups, sessions ISessions, clients ISCIMClients, audit IAudit) *SCIMUseCase {
+	return &SCIMUseCase{
+		users,
+		groups,
+		sessions,
+		clients,
+		audit,
+	}
+}
+
+// Authenticate returns the active client owning the bearer token
+func (uc *SCIMUseCase) Authenticate(ctx context.Context, token string) (*SCIMClient, error) {
+	log := getLoggerFromContext(ctx)
+
+	if token == "" {
+		return nil, e.InvalidSCIMToken
+	}
+
+	client, err := uc.clients.ByTokenHash(ctx, hashSCIMToken(token))
+	if err != nil {
+		log.Error("failed to get scim client", zap.Error(err))
+		return nil, err
+	}
+
+	if client == nil || client.Status != "active" {
+		log.Info("scim token is unknown or revoked")
+		return nil, e.InvalidSCIMToken
+	}
+
+	return client, nil
+}
+
+// CreateClient registers a provisioning client, the returned token is not stored and cannot be shown again
+func (uc *SCIMUseCase) CreateClient(ctx context.Context, name string) (*SCIMClient, string, error) {
+	log := getLoggerFromContext(ctx)
+
+	token := "scim_" + randomToken(32)
+	client := &SCIMClient{
+		Name: name,
+		TokenHash: hashSCIMToken(token),
+		Status: "active",
+	}
+
+	if err := uc.clients.Create(ctx, client); err != nil {
+		log.Error("failed to create scim client", zap.Error(err))
+		return nil, "", err
+	}
+
+	return client, token, nil
+}
+
+func (uc *SCIMUseCase) ListClients(ctx context.Context) ([]SCIMClient, error) {
+	log := getLoggerFromContext(ctx)
+
+	clients, err := uc.clients.List(ctx)
+	if err != nil {
+		log.Error("failed to list scim clients", zap.Error(err))
+		return nil, err
+	}
+
+	if clients == nil {
+		clients = []SCIMClient{}
+	}
+
+	return clients, nil
+}
+
+func (uc *SCIMUseCase) RevokeClient(ctx context.Context, id string) error {
+	log := getLoggerFromContext(ctx)
+
+	err := uc.clients.Revoke(ctx, id)
+	if err != nil && !errors.Is(err, e.SCIMClientNotFound) {
+		log.Error("failed to revoke scim client", zap.Error(err), zap.String("client_id", id))
+	}
+
+	return err
+}
+
+// ListUsers returns a page of the users that are not deleted and their total count
+func (uc *SCIMUseCase) ListUsers(ctx context.Context, query ListQuery) ([]User, int, error) {
+	log := getLoggerFromContext(ctx)
+
+	filter, err := parseListFilter(query.Filter, UserFilterAttributes)
+	if err != nil {
+		log.Info("invalid user filter", zap.Error(err), zap.String("filter", query.Filter))
+		return nil, 0, err
+	}
+
+	users, total, err := uc.users.Search(ctx, filter, query.Offset, query.Limit)
+	if err != nil {
+		log.Error("failed to search users", zap.Error(err))
+		return nil, 0, err
+	}
+
+	return users, total, nil
+}
+
+// GetUser returns a user that is not deleted
+func (uc *SCIMUseCase) GetUser(ctx context.Context, id string) (*User, error) {
+	log := getLoggerFromContext(ctx)
+
+	user, err := uc.users.ByID(ctx, id)
+	if err != nil {
+		log.Error("failed to get user by id", zap.Error(err), zap.String("user_id", id))
+		return nil, err
+	}
+
+	if user == nil || user.Status == "deleted" {
+		log.Info("user not found", zap.String("user_id", id))
+		return nil, e.UserNotFound
+	}
+
+	return user, nil
+}
+
+// CreateUser provisions a user, it signs in with a federated identity or sets a password later
+func (uc *SCIMUseCase) CreateUser(ctx context.Context, caller SCIMCaller, attributes UserAttributes) (*User, error) {
+	log := getLoggerFromContext(ctx)
+
+	if err := attributes.validate(); err != nil {
+		log.Info("invalid user attributes", zap.Error(err))
+		return nil, err
+	}
+
+	if err := uc.checkEmailFree(ctx, attributes.UserName, ""); err != nil {
+		return nil, err
+	}
+
+	user := &User{}
+	attributes.apply(user)
+
+	if err := uc.users.Create(ctx, user); err != nil {
+		if !errors.Is(err, e.UniqueViolated) {
+			log.Error("failed to create user", zap.Error(err))
+		}
+		return nil, err
+	}
+
+	uc.recordUserAudit(ctx, caller, user, "scim.user.provisioned")
+
+	return user, nil
+}
+
+// ReplaceUser overwrites the attributes of a user, ifMatch is the If-Match header of the request
+func (uc *SCIMUseCase) ReplaceUser(ctx context.Context, caller SCIMCaller, id, ifMatch string, attributes UserAttributes) (*User, error) {
+	user, err := uc.GetUser(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkVersion(ifMatch, user.Version); err != nil {
+		return nil, err
+	}
+
+	return uc.updateUser(ctx, caller, user, attributes)
+}
+
+// PatchUser applies the operations to the attributes of a user, all of them or none
+func (uc *SCIMUseCase) PatchUser(ctx context.Context, caller SCIMCaller, id, ifMatch string, operations []PatchOperation) (*User, error) {
+	log := getLoggerFromContext(ctx)
+
+	user, err := uc.GetUser(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkVersion(ifMatch, user.Version); err != nil {
+		return nil, err
+	}
+
+	attributes := UserAttributes{
+		UserName: user.Email,
+		DisplayName: user.Name,
+		ExternalID: user.ExternalID,
+		Active: user.Status == "active",
+	}
+
+	for _, operation := range operations {
+		if err := attributes.patch(operation); err != nil {
+			log.Info("invalid user patch", zap.Error(err), zap.String("op", operation.Op), zap.String("path", operation.Path))
+			return nil, err
+		}
+	}
+
+	return uc.updateUser(ctx, caller, user, attributes)
+}
+
+// DeleteUser deprovisions a user: it can no longer sign in, its sessions end and it leaves its groups.
+// The row is kept so the audit trail and the identities stay attributable
+func (uc *SCIMUseCase) DeleteUser(ctx context.Context, caller SCIMCaller, id, ifMatch string) error {
+	log := getLoggerFromContext(ctx)
+
+	user, err := uc.GetUser(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if err := checkVersion(ifMatch, user.Version); err != nil {
+		return err
+	}
+
+	if err := user.Delete(); err != nil {
+		return err
+	}
+
+	if err := uc.users.Update(ctx, user); err != nil {
+		log.Error("failed to delete user", zap.Error(err), zap.String("user_id", user.ID))
+		return err
+	}
+
+	if err := uc.sessions.RevokeAll(ctx, user.ID); err != nil {
+		log.Error("failed to revoke sessions of deleted user", zap.Error(err), zap.String("user_id", user.ID))
+		return err
+	}
+
+	if err := uc.leaveGroups(ctx, user.ID); err != nil {
+		return err
+	}
+
+	uc.recordUserAudit(ctx, caller, user, "scim.user.deleted")
+
+	return nil
+}
+
+func (uc *SCIMUseCase) updateUser(ctx context.Context, caller SCIMCaller, user *User, attributes UserAttributes) (*User, error) {
+	log := getLoggerFromContext(ctx)
+
+	if err := attributes.validate(); err != nil {
+		log.Info("invalid user attributes", zap.Error(err), zap.String("user_id", user.ID))
+		return nil, err
+	}
+
+	if err := uc.checkEmailFree(ctx, attributes.UserName, user.ID); err != nil {
+		return nil, err
+	}
+
+	wasActive := user.Status == "active"
+	attributes.apply(user)
+
+	if err := uc.users.Update(ctx, user); err != nil {
+		if !errors.Is(err, e.UniqueViolated) {
+			log.Error("failed to update user", zap.Error(err), zap.String("user_id", user.ID))
+		}
+		return nil, err
+	}
+
+	action := "scim.user.updated"
+	if wasActive && !attributes.Active {
+		// a deactivated user is signed out everywhere
+		if err := uc.sessions.RevokeAll(ctx, user.ID); err != nil {
+			log.Error("failed to revoke sessions of deactivated user", zap.Error(err), zap.String("user_id", user.ID))
+			return nil, err
+		}
+		action = "scim.user.deactivated"
+	} else if !wasActive && attributes.Active {
+		action = "scim.user.reactivated"
+	}
+
+	uc.recordUserAudit(ctx, caller, user, action)
+
+	return user, nil
+}
+
+// checkEmailFree refuses an email that belongs to another user, the column is unique
+func (uc *SCIMUseCase) checkEmailFree(ctx context.Context, email, userID string) error {
+	log := getLoggerFromContext(ctx)
+
+	owner, err := uc.users.ByEmail(ctx, email)
+	if err != nil {
+		log.Error("failed to get user by email", zap.Error(err))
+		return err
+	}
+
+	if owner != nil && owner.ID != userID {
+		log.Info("email belongs to another user", zap.String("user_id", owner.ID))
+		return e.UniqueViolated
+	}
+
+	return nil
+}
+
+// leaveGroups removes a deleted user from the groups it is a member of
+func (uc *SCIMUseCase) leaveGroups(ctx context.Context, userID string) error {
+	log := getLoggerFromContext(ctx)
+
+	groups, _, err := uc.groups.Search(ctx, &Filter{Op: "eq", Attribute: "members", Value: userID}, 0, MaxSCIMPageSize)
+	if err != nil {
+		log.Error("failed to get groups of user", zap.Error(err), zap.String("user_id", userID))
+		return err
+	}
+
+	for _, group := range groups {
+		group.Members = slices.DeleteFunc(group.Members, func(member string) bool { return member == userID })
+
+		if err := uc.groups.Update(ctx, &group); err != nil {
+			log.Error("failed to remove user from group", zap.Error(err), zap.String("user_id", userID), zap.String("group_id", group.ID))
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (uc *SCIMUseCase) recordUserAudit(ctx context.Context, caller SCIMCaller, user *User, action string) {
+	recordAudit(ctx, uc.audit, NewAuditEvent(user.ID, action, caller.IP, caller.UserAgent, map[string]string{
+		"scim_client_id": caller.ClientID,
+		"email": user.Email,
+		"external_id": user.ExternalID,
+	}))
+}
+
+// ListGroups returns a page of the groups matching the query and their total count
+func (uc *SCIMUseCase) ListGroups(ctx context.Context, query ListQuery) ([]Group, int, error) {
+	log := getLoggerFromContext(ctx)
+
+	filter, err := parseListFilter(query.Filter, GroupFilterAttributes)
+	if err != nil {
+		log.Info("invalid group filter", zap.Error(err), zap.String("filter", query.Filter))
+		return nil, 0, err
+	}
+
+	groups, total, err := uc.groups.Search(ctx, filter, query.Offset, query.Limit)
+	if err != nil {
+		log.Error("failed to search groups", zap.Error(err))
+		return nil, 0, err
+	}
+
+	return groups, total, nil
+}
+
+func (uc *SCIMUseCase) GetGroup(ctx context.Context, id string) (*Group, error) {
+	log := getLoggerFromContext(ctx)
+
+	group, err := uc.groups.ByID(ctx, id)
+	if err != nil {
+		log.Error("failed to get group by id", zap.Error(err), zap.String("group_id", id))
+		return nil, err
+	}
+
+	if group == nil {
+		log.Info("group not found", zap.String("group_id", id))
+		return nil, e.GroupNotFound
+	}
+
+	return group, nil
+}
+
+func (uc *SCIMUseCase) CreateGroup(ctx context.Context, attributes GroupAttributes) (*Group, error) {
+	log := getLoggerFromContext(ctx)
+
+	if err := uc.validateGroup(ctx, &attributes); err != nil {
+		return nil, err
+	}
+
+	group := &Group{}
+	attributes.apply(group)
+
+	if err := uc.groups.Create(ctx, group); err != nil {
+		if !errors.Is(err, e.UniqueViolated) {
+			log.Error("failed to create group", zap.Error(err))
+		}
+		return nil, err
+	}
+
+	return group, nil
+}
+
+func (uc *SCIMUseCase) ReplaceGroup(ctx context.Context, id, ifMatch string, attributes GroupAttributes) (*Group, error) {
+	group, err := uc.GetGroup(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkVersion(ifMatch, group.Version); err != nil {
+		return nil, err
+	}
+
+	return uc.updateGroup(ctx, group, attributes)
+}
+
+func (uc *SCIMUseCase) PatchGroup(ctx context.Context, id, ifMatch string, operations []PatchOperation) (*Group, error) {
+	log := getLoggerFromContext(ctx)
+
+	group, err := uc.GetGroup(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkVersion(ifMatch, group.Version); err != nil {
+		return nil, err
+	}
+
+	attributes := GroupAttributes{
+		DisplayName: group.DisplayName,
+		ExternalID: group.ExternalID,
+		Members: slices.Clone(group.Members),
+	}
+
+	for _, operation := range operations {
+		if err := attributes.patch(operation); err != nil {
+			log.Info("invalid group patch", zap.Error(err), zap.String("op", operation.Op), zap.String("path", operation.Path))
+			return nil, err
+		}
+	}
+
+	return uc.updateGroup(ctx, group, attributes)
+}
+
+func (uc *SCIMUseCase) DeleteGroup(ctx context.Context, id, ifMatch string) error {
+	log := getLoggerFromContext(ctx)
+
+	group, err := uc.GetGroup(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if err := checkVersion(ifMatch, group.Version); err != nil {
+		return err
+	}
+
+	if err := uc.groups.Delete(ctx, group.ID); err != nil {
+		log.Error("failed to delete group", zap.Error(err), zap.String("group_id", group.ID))
+		return err
+	}
+
+	return nil
+}
+
+func (uc *SCIMUseCase) updateGroup(ctx context.Context, group *Group, attributes GroupAttributes) (*Group, error) {
+	log := getLoggerFromContext(ctx)
+
+	if err := uc.validateGroup(ctx, &attributes); err != nil {
+		return nil, err
+	}
+
+	attributes.apply(group)
+
+	if err := uc.groups.Update(ctx, group); err != nil {
+		if !errors.Is(err, e.UniqueViolated) {
+			log.Error("failed to update group", zap.Error(err), zap.String("group_id", group.ID))
+		}
+		return nil, err
+	}
+
+	return group, nil
+}
+
+// validateGroup checks the display name and that every member is a user that is not deleted,
+// duplicate members are dropped
+func (uc *SCIMUseCase) validateGroup(ctx context.Context, attributes *GroupAttributes) error {
+	log := getLoggerFromContext(ctx)
+
+	if attributes.DisplayName == "" {
+		log.Info("group has no display name")
+		return errors.Join(e.InvalidSCIMValue, errors.New("displayName is required"))
+	}
+
+	members := []string{}
+	for _, id := range attributes.Members {
+		if slices.Contains(members, id) {
+			continue
+		}
+
+		if _, err := uc.GetUser(ctx, id); err != nil {
+			if errors.Is(err, e.UserNotFound) {
+				return errors.Join(e.InvalidSCIMValue, fmt.Errorf("member %s is not a user", id))
+			}
+			return err
+		}
+
+		members = append(members, id)
+	}
+	attributes.Members = members
+
+	return nil
+}
+
+func parseListFilter(raw string, attributes []string) (*Filter, error) {
+	if raw == "" {
+		return nil, nil
+	}
+
+	return ParseFilter(raw, attributes)
+}
+
+func (a *UserAttributes) validate() error {
+	if !strings.Contains(a.UserName, "@") {
+		return errors.Join(e.InvalidSCIMValue, errors.New("userName must be an email address"))
+	}
+
+	return nil
+}
+
+func (a UserAttributes) apply(user *User) {
+	user.Email = a.UserName
+	user.Name = a.DisplayName
+	if user.Name == "" {
+		user.Name = a.UserName
+	}
+	user.ExternalID = a.ExternalID
+
+	if a.Active {
+		user.Status = "active"
+	} else {
+		user.Status = "blocked"
+	}
+}
+
+func (a *UserAttributes) patch(operation PatchOperation) error {
+	op := strings.ToLower(operation.Op)
+	if op != "add" && op != "replace" && op != "remove" {
+		return errors.Join(e.InvalidPatch, errors.New("unknown op "+operation.Op))
+	}
+
+	path := patchPath(operation.Path)
+
+	if op == "remove" {
+		// the other attributes are required
+		if path != "externalid" {
+			return errors.Join(e.InvalidPatch, errors.New("cannot remove "+operation.Path))
+		}
+		a.ExternalID = ""
+
+		return nil
+	}
+
+	if path == "" {
+		values, ok := operation.Value.(map[string]any)
+		if !ok {
+			return errors.Join(e.InvalidPatch, errors.New("an operation without path needs an object value"))
+		}
+
+		for key, value := range flattenPatchValue("", values) {
+			if err := a.set(key, value); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	return a.set(path, operation.Value)
+}
+
+// set changes one attribute, attributes the sso does not keep such as name.givenName are ignored
+func (a *UserAttributes) set(path string, value any) error {
+	switch path {
+	case "username":
+		return setPatchString(&a.UserName, value)
+	case "displayname", "name.formatted":
+		return setPatchString(&a.DisplayName, value)
+	case "externalid":
+		return setPatchString(&a.ExternalID, value)
+	case "active":
+		active, err := patchBool(value)
+		if err != nil {
+			return err
+		}
+		a.Active = active
+	}
+
+	return nil
+}
+
+func (a GroupAttributes) apply(group *Group) {
+	group.DisplayName = a.DisplayName
+	group.ExternalID = a.ExternalID
+	group.Members = a.Members
+}
+
+func (a *GroupAttributes) patch(operation PatchOperation) error {
+	op := strings.ToLower(operation.Op)
+	if op != "add" && op != "replace" && op != "remove" {
+		return errors.Join(e.InvalidPatch, errors.New("unknown op "+operation.Op))
+	}
+
+	path := patchPath(operation.Path)
+
+	// members[value eq "id"] selects members to remove
+	if strings.HasPrefix(path, "members[") && strings.HasSuffix(path, "]") {
+		if op != "remove" {
+			return errors.Join(e.InvalidPatch, errors.New("members can only be removed by a filter"))
+		}
+
+		raw := strings.TrimSpace(operation.Path)
+		filter, err := ParseFilter(raw[strings.Index(raw, "[")+1:len(raw)-1], []string{"value"})
+		if err != nil {
+			return errors.Join(e.InvalidPatch, err)
+		}
+
+		a.Members = slices.DeleteFunc(a.Members, func(member string) bool {
+			return filter.Match(func(string) any { return member })
+		})
+
+		return nil
+	}
+
+	switch path {
+	case "":
+		if op == "remove" {
+			return errors.Join(e.InvalidPatch, errors.New("remove needs a path"))
+		}
+
+		values, ok := operation.Value.(map[string]any)
+		if !ok {
+			return errors.Join(e.InvalidPatch, errors.New("an operation without path needs an object value"))
+		}
+
+		for key, value := range values {
+			if err := a.patch(PatchOperation{Op: op, Path: key, Value: value}); err != nil {
+				return err
+			}
+		}
+
+	case "displayname":
+		if op == "remove" {
+			return errors.Join(e.InvalidPatch, errors.New("displayName is required"))
+		}
+		return setPatchString(&a.DisplayName, operation.Value)
+
+	case "externalid":
+		if op == "remove" {
+			a.ExternalID = ""
+			return nil
+		}
+		return setPatchString(&a.ExternalID, operation.Value)
+
+	case "members":
+		// remove without a value empties the group
+		if op == "remove" && operation.Value == nil {
+			a.Members = []string{}
+			return nil
+		}
+
+		members, err := patchMembers(operation.Value)
+		if err != nil {
+			return err
+		}
+
+		switch op {
+		case "add":
+			a.Members = append(a.Members, members...)
+		case "replace":
+			a.Members = members
+		case "remove":
+			a.Members = slices.DeleteFunc(a.Members, func(member string) bool { return slices.Contains(members, member) })
+		}
+
+	default:
+		return errors.Join(e.InvalidPatch, errors.New("unknown path "+operation.Path))
+	}
+
+	return nil
+}
+
+// patchPath lowercases a path and strips the schema urn in front of it
+func patchPath(path string) string {
+	path = strings.ToLower(strings.TrimSpace(path))
+	for _, schema := range filterSchemas {
+		path = strings.TrimPrefix(path, schema)
+	}
+
+	return path
+}
+
+// flattenPatchValue turns {"name": {"formatted": "x"}} into {"name.formatted": "x"}
+func flattenPatchValue(prefix string, values map[string]any) map[string]any {
+	flat := map[string]any{}
+	for key, value := range values {
+		key = patchPath(prefix + key)
+
+		if nested, ok := value.(map[string]any); ok {
+			for k, v := range flattenPatchValue(key+".", nested) {
+				flat[k] = v
+			}
+			continue
+		}
+
+		flat[key] = value
+	}
+
+	return flat
+}
+
+func setPatchString(target *string, value any) error {
+	s, ok := value.(string)
+	if !ok {
+		return errors.Join(e.InvalidSCIMValue, errors.New("expected a string"))
+	}
+	*target = s
+
+	return nil
+}
+
+// patchBool accepts the "True" and "False" strings some clients send for booleans
+func patchBool(value any) (bool, error) {
+	switch value := value.(type) {
+	case bool:
+		return value, nil
+	case string:
+		if strings.EqualFold(value, "true") {
+			return true, nil
+		}
+		if strings.EqualFold(value, "false") {
+			return false, nil
+		}
+	}
+
+	return false, errors.Join(e.InvalidSCIMValue, errors.New("expected a boolean"))
+}
+
+// patchMembers reads the ids of a members value, [{"value": "id"}] or a single {"value": "id"}
+func patchMembers(value any) ([]string, error) {
+	items, ok := value.([]any)
+	if !ok {
+		items = []any{value}
+	}
+
+	members := []string{}
+	for _, item := range items {
+		member, ok := item.(map[string]any)
+		if !ok {
+			return nil, errors.Join(e.InvalidSCIMValue, errors.New("members must be objects with a value"))
+		}
+
+		id, ok := member["value"].(string)
+		if !ok || id == "" {
+			return nil, errors.Join(e.InvalidSCIMValue, errors.New("members must be objects with a value"))
+		}
+
+		members = append(members, id)
+	}
+
+	return members, nil
+}
@@ -0,0 +1,421 @@
+package core
+
+import (
+	e "sso/internal/core/errors"
+
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Filter is a parsed SCIM filter (RFC 7644 section 3.4.2.2). Comparisons have an Attribute and,
+// except for pr, a Value of type string, bool, float64 or nil. and, or and not have Operands
+type Filter struct {
+	Op string
+	Attribute string
+	Value any
+	Operands []*Filter
+}
+
+// UserFilterAttributes are the user attributes a filter may compare
+var UserFilterAttributes = []string{"id", "username", "emails", "emails.value", "displayname", "name.formatted", "externalid", "active", "meta.created", "meta.lastmodified"}
+
+// GroupFilterAttributes are the group attributes a filter may compare
+var GroupFilterAttributes = []string{"id", "displayname", "externalid", "members", "members.value", "meta.created", "meta.lastmodified"}
+
+var filterOperators = []string{"eq", "ne", "co", "sw", "ew", "gt", "ge", "lt", "le"}
+
+// schema urns a client may put in front of an attribute name
+var filterSchemas = []string{"urn:ietf:params:scim:schemas:core:2.0:user:", "urn:ietf:params:scim:schemas:core:2.0:group:"}
+
+// ParseFilter parses raw, attribute names are lowercased and must be one of attributes
+func ParseFilter(raw string, attributes []string) (*Filter, error) {
+	tokens, err := tokenizeFilter(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &filterParser{tokens: tokens, attributes: attributes}
+
+	filter, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.pos != len(p.tokens) {
+		return nil, errors.Join(e.InvalidFilter, errors.New("unexpected "+p.tokens[p.pos].text))
+	}
+
+	return filter, nil
+}
+
+type filterToken struct {
+	text string
+	// quoted tokens are string values, never keywords
+	quoted bool
+}
+
+func tokenizeFilter(raw string) ([]filterToken, error) {
+	tokens := []filterToken{}
+
+	for i := 0; i < len(raw); {
+		switch c := raw[i]; {
+		case c == ' ' || c == '\t':
+			i++
+
+		case c == '(' || c == ')':
+			tokens = append(tokens, filterToken{text: string(c)})
+			i++
+
+		case c == '"':
+			// strings are json strings, find the closing quote past escaped ones
+			end := i + 1
+			for end < len(raw) && raw[end] != '"' {
+				if raw[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(raw) {
+				return nil, errors.Join(e.InvalidFilter, errors.New("unterminated string"))
+			}
+
+			value, err := strconv.Unquote(raw[i:end+1])
+			if err != nil {
+				return nil, errors.Join(e.InvalidFilter, err)
+			}
+
+			tokens = append(tokens, filterToken{text: value, quoted: true})
+			i = end + 1
+
+		case c == '[' || c == ']':
+			return nil, errors.Join(e.InvalidFilter, errors.New("value path filters are not supported"))
+
+		default:
+			end := i
+			for end < len(raw) && !strings.ContainsRune(" \t()\"[]", rune(raw[end])) {
+				end++
+			}
+
+			tokens = append(tokens, filterToken{text: raw[i:end]})
+			i = end
+		}
+	}
+
+	if len(tokens) == 0 {
+		return nil, errors.Join(e.InvalidFilter, errors.New("filter is empty"))
+	}
+
+	return tokens, nil
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos int
+	attributes []string
+}
+
+// keyword reports whether the next token is the unquoted keyword, matched case insensitively
+func (p *filterParser) keyword(word string) bool {
+	return p.pos < len(p.tokens) && !p.tokens[p.pos].quoted && strings.EqualFold(p.tokens[p.pos].text, word)
+}
+
+func (p *filterParser) next() (filterToken, error) {
+	if p.pos >= len(p.tokens) {
+		return filterToken{}, errors.Join(e.InvalidFilter, errors.New("unexpected end of filter"))
+	}
+
+	token := p.tokens[p.pos]
+	p.pos++
+
+	return token, nil
+}
+
+func (p *filterParser) or() (*Filter, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.keyword("or") {
+		p.pos++
+
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &Filter{Op: "or", Operands: []*Filter{left, right}}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) and() (*Filter, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.keyword("and") {
+		p.pos++
+
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &Filter{Op: "and", Operands: []*Filter{left, right}}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) unary() (*Filter, error) {
+	if p.keyword("not") {
+		p.pos++
+		if !p.keyword("(") {
+			return nil, errors.Join(e.InvalidFilter, errors.New("not must be followed by a parenthesis"))
+		}
+
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+
+		return &Filter{Op: "not", Operands: []*Filter{operand}}, nil
+	}
+
+	if p.keyword("(") {
+		p.pos++
+
+		filter, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+
+		if !p.keyword(")") {
+			return nil, errors.Join(e.InvalidFilter, errors.New("missing closing parenthesis"))
+		}
+		p.pos++
+
+		return filter, nil
+	}
+
+	return p.comparison()
+}
+
+func (p *filterParser) comparison() (*Filter, error) {
+	token, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if token.quoted || token.text == "(" || token.text == ")" {
+		return nil, errors.Join(e.InvalidFilter, errors.New("expected an attribute, got "+token.text))
+	}
+
+	attribute := strings.ToLower(token.text)
+	for _, schema := range filterSchemas {
+		attribute = strings.TrimPrefix(attribute, schema)
+	}
+
+	if !slices.Contains(p.attributes, attribute) {
+		return nil, errors.Join(e.InvalidFilter, errors.New("attribute "+token.text+" cannot be filtered"))
+	}
+
+	op, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	operator := strings.ToLower(op.text)
+	if !op.quoted && operator == "pr" {
+		return &Filter{Op: "pr", Attribute: attribute}, nil
+	}
+
+	if op.quoted || !slices.Contains(filterOperators, operator) {
+		return nil, errors.Join(e.InvalidFilter, errors.New("unknown operator "+op.text))
+	}
+
+	raw, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := filterValue(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Filter{Op: operator, Attribute: attribute, Value: value}, nil
+}
+
+func filterValue(token filterToken) (any, error) {
+	if token.quoted {
+		return token.text, nil
+	}
+
+	switch token.text {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+
+	number, err := strconv.ParseFloat(token.text, 64)
+	if err != nil {
+		return nil, errors.Join(e.InvalidFilter, errors.New("invalid value "+token.text))
+	}
+
+	return number, nil
+}
+
+// Match evaluates the filter, value returns the string, bool, time or []string of an attribute
+func (f *Filter) Match(value func(attribute string) any) bool {
+	switch f.Op {
+	case "and":
+		return f.Operands[0].Match(value) && f.Operands[1].Match(value)
+	case "or":
+		return f.Operands[0].Match(value) || f.Operands[1].Match(value)
+	case "not":
+		return !f.Operands[0].Match(value)
+	}
+
+	// multi valued attributes match when one of their values does
+	if values, ok := value(f.Attribute).([]string); ok {
+		for _, v := range values {
+			if f.compare(v) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return f.compare(value(f.Attribute))
+}
+
+func (f *Filter) compare(actual any) bool {
+	if f.Op == "pr" {
+		return actual != nil && actual != ""
+	}
+
+	switch actual := actual.(type) {
+	case string:
+		expected, ok := f.Value.(string)
+		if !ok {
+			return false
+		}
+
+		// string attributes of users and groups are case insensitive
+		actual, expected = strings.ToLower(actual), strings.ToLower(expected)
+
+		switch f.Op {
+		case "eq":
+			return actual == expected
+		case "ne":
+			return actual != expected
+		case "co":
+			return strings.Contains(actual, expected)
+		case "sw":
+			return strings.HasPrefix(actual, expected)
+		case "ew":
+			return strings.HasSuffix(actual, expected)
+		default:
+			return compareOrdered(f.Op, strings.Compare(actual, expected))
+		}
+
+	case bool:
+		expected, ok := f.Value.(bool)
+		if !ok {
+			return false
+		}
+
+		switch f.Op {
+		case "eq":
+			return actual == expected
+		case "ne":
+			return actual != expected
+		}
+
+	case time.Time:
+		raw, ok := f.Value.(string)
+		if !ok {
+			return false
+		}
+
+		expected, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return false
+		}
+
+		if f.Op == "eq" || f.Op == "ne" {
+			return actual.Equal(expected) == (f.Op == "eq")
+		}
+
+		return compareOrdered(f.Op, actual.Compare(expected))
+	}
+
+	return false
+}
+
+func compareOrdered(op string, cmp int) bool {
+	switch op {
+	case "gt":
+		return cmp > 0
+	case "ge":
+		return cmp >= 0
+	case "lt":
+		return cmp < 0
+	case "le":
+		return cmp <= 0
+	}
+
+	return false
+}
+
+// UserFilterValue returns the value a filter compares for an attribute of UserFilterAttributes
+func UserFilterValue(user *User, attribute string) any {
+	switch attribute {
+	case "id":
+		return user.ID
+	case "username", "emails", "emails.value":
+		return user.Email
+	case "displayname", "name.formatted":
+		return user.Name
+	case "externalid":
+		return user.ExternalID
+	case "active":
+		return user.Status == "active"
+	case "meta.created":
+		return user.CreatedAt
+	case "meta.lastmodified":
+		return user.UpdatedAt
+	}
+
+	return nil
+}
+
+// GroupFilterValue returns the value a filter compares for an attribute of GroupFilterAttributes
+func GroupFilterValue(group *Group, attribute string) any {
+	switch attribute {
+	case "id":
+		return group.ID
+	case "displayname":
+		return group.DisplayName
+	case "externalid":
+		return group.ExternalID
+	case "members", "members.value":
+		return group.Members
+	case "meta.created":
+		return group.CreatedAt
+	case "meta.lastmodified":
+		return group.UpdatedAt
+	}
+
+	return nil
+}
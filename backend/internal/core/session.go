@@ -0,0 +1,279 @@
+package core
+
+import (
+	e "sso/internal/core/errors"
+	"github.com/golang-jwt/jwt/v5"
+	"go.uber.org/zap"
+
+	"context"
+	"time"
+)
+
+// last_seen_at is written at most once per this interval to keep the
+// session middleware from hitting the database on every request
+const sessionTouchInterval = time.Minute
+
+// SessionPolicy limits how long a session lives: IdleTimeout is how long it survives
+// without activity, Lifetime is the absolute maximum regardless of activity. Both are in seconds,
+// a zero IdleTimeout disables the idle check
+type SessionPolicy struct {
+	IdleTimeout int `json:"idle_timeout"`
+	Lifetime int `json:"lifetime"`
+}
+
+type SessionPolicies struct {
+	Default SessionPolicy
+	RememberMe SessionPolicy
+}
+
+// For picks the policy for a login, preferring the overrides configured on the client
+func (p SessionPolicies) For(client *Client, rememberMe bool) SessionPolicy {
+	if rememberMe {
+		if client != nil && client.RememberMePolicy != nil {
+			return *client.RememberMePolicy
+		}
+
+		return p.RememberMe
+	}
+
+	if client != nil && client.SessionPolicy != nil {
+		return *client.SessionPolicy
+	}
+
+	return p.Default
+}
+
+type Session struct {
+	ID string `json:"id"`
+	UserID string `json:"user_id"`
+	IP string `json:"ip"`
+	UserAgent string `json:"user_agent"`
+	AuthMethods []string `json:"auth_methods"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	IdleTimeout int `json:"idle_timeout"`
+	RememberMe bool `json:"remember_me"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+func NewSession(userID, ip, userAgent string, authMethods []string, policy SessionPolicy, rememberMe bool) (*Session, error) {
+	if userID == "" {
+		return nil, e.UserNotFound
+	}
+
+	now := time.Now().UTC()
+
+	return &Session{
+		UserID: userID,
+		IP: ip,
+		UserAgent: userAgent,
+		AuthMethods: authMethods,
+		CreatedAt: now,
+		LastSeenAt: now,
+		ExpiresAt: now.Add(time.Duration(policy.Lifetime)*time.Second),
+		IdleTimeout: policy.IdleTimeout,
+		RememberMe: rememberMe,
+	}, nil
+}
+
+func (s *Session) IsActive() bool {
+	if s.RevokedAt != nil || !s.ExpiresAt.After(time.Now()) {
+		return false
+	}
+
+	return s.IdleTimeout == 0 || s.IdleExpiresAt().After(time.Now())
+}
+
+// IdleExpiresAt is the moment the session ends unless it is used again
+func (s *Session) IdleExpiresAt() time.Time {
+	if s.IdleTimeout == 0 || s.LastSeenAt.Add(time.Duration(s.IdleTimeout)*time.Second).After(s.ExpiresAt) {
+		return s.ExpiresAt
+	}
+
+	return s.LastSeenAt.Add(time.Duration(s.IdleTimeout)*time.Second)
+}
+
+func (s *Session) Revoke() {
+	if s.RevokedAt != nil {
+		return
+	}
+
+	now := time.Now().UTC()
+	s.RevokedAt = &now
+}
+
+// authMethods maps a login provider to the amr values recorded on the session
+func authMethods(provider string) []string {
+	switch provider {
+	case "email", "ldap":
+		return []string{"pwd"}
+	case "oauth":
+		return []string{"fed"}
+	case "email_otp":
+		// a code or link only the owner of the mailbox could read
+		return []string{"otp"}
+	case "webauthn":
+		// a hardware key the user unlocked with a pin or biometric
+		return []string{"hwk", "mfa"}
+	default:
+		return []string{provider}
+	}
+}
+
+// issueSession stores a new session for the user and signs the sso session token pointing to it
+func issueSession(ctx context.Context, sessions ISessions, token IToken, user *User, ip, userAgent string, authMethods []string, policy SessionPolicy, rememberMe bool) (string, *Session, error) {
+	log := getLoggerFromContext(ctx)
+
+	session, err := NewSession(user.ID, ip, userAgent, authMethods, policy, rememberMe)
+	if err != nil {
+		log.Info("invalid session", zap.Error(err))
+		return "", nil, err
+	}
+
+	if err := sessions.Create(ctx, session); err != nil {
+		log.Error("failed to create session", zap.Error(err), zap.String("user_id", user.ID))
+		return "", nil, err
+	}
+
+	claims := Claims{
+		SessionID: session.ID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject: user.ID,
+			Issuer: "sso.semgateam.ru",
+			IssuedAt: jwt.NewNumericDate(session.CreatedAt),
+			ExpiresAt: jwt.NewNumericDate(session.ExpiresAt),
+		},
+	}
+
+	ssoSessionToken, err := token.Generate(&claims)
+	if err != nil {
+		log.Error("failed to generate sso session token", zap.Error(err))
+		return "", nil, err
+	}
+
+	return ssoSessionToken, session, nil
+}
+
+// sessionPolicy resolves the policy for a login started on behalf of a client, clientID may be empty
+func sessionPolicy(ctx context.Context, clients IClient, policies SessionPolicies, clientID string, rememberMe bool) (SessionPolicy, error) {
+	log := getLoggerFromContext(ctx)
+
+	if clientID == "" {
+		return policies.For(nil, rememberMe), nil
+	}
+
+	client, err := clients.ByID(ctx, clientID)
+	if err != nil {
+		log.Error("failed to get client by id", zap.Error(err), zap.String("client_id", clientID))
+		return SessionPolicy{}, err
+	}
+
+	if client == nil {
+		log.Info("client not found", zap.String("client_id", clientID))
+		return SessionPolicy{}, e.ClientNotFound
+	}
+
+	return policies.For(client, rememberMe), nil
+}
+
+type SessionUseCase struct {
+	sessions ISessions
+}
+
+func NewSessionUseCase(sessions ISessions) *SessionUseCase {
+	return &SessionUseCase{
+		sessions,
+	}
+}
+
+// Validate checks that the session referenced by a token is still alive and records the activity
+func (uc *SessionUseCase) Validate(ctx context.Context, sessionID, userID string) (*Session, error) {
+	log := getLoggerFromContext(ctx)
+
+	if sessionID == "" {
+		log.Info("sso session token has no session id", zap.String("user_id", userID))
+		return nil, e.SessionNotFound
+	}
+
+	session, err := uc.sessions.ByID(ctx, sessionID)
+	if err != nil {
+		log.Error("failed to get session", zap.Error(err), zap.String("session_id", sessionID))
+		return nil, err
+	}
+
+	if session == nil || session.UserID != userID {
+		log.Info("session not found", zap.String("session_id", sessionID), zap.String("user_id", userID))
+		return nil, e.SessionNotFound
+	}
+
+	if !session.IsActive() {
+		log.Info("session is not active", zap.String("session_id", sessionID))
+		return nil, e.SessionInactive
+	}
+
+	if time.Since(session.LastSeenAt) > sessionTouchInterval {
+		session.LastSeenAt = time.Now().UTC()
+
+		if err := uc.sessions.Update(ctx, session); err != nil {
+			log.Error("failed to update session", zap.Error(err), zap.String("session_id", sessionID))
+			return nil, err
+		}
+	}
+
+	return session, nil
+}
+
+func (uc *SessionUseCase) List(ctx context.Context, userID string) ([]Session, error) {
+	log := getLoggerFromContext(ctx)
+
+	sessions, err := uc.sessions.ByUser(ctx, userID)
+	if err != nil {
+		log.Error("failed to get user sessions", zap.Error(err), zap.String("user_id", userID))
+		return nil, err
+	}
+
+	active := []Session{}
+	for _, s := range sessions {
+		if s.IsActive() {
+			active = append(active, s)
+		}
+	}
+
+	return active, nil
+}
+
+func (uc *SessionUseCase) Revoke(ctx context.Context, userID, sessionID string) error {
+	log := getLoggerFromContext(ctx)
+
+	session, err := uc.sessions.ByID(ctx, sessionID)
+	if err != nil {
+		log.Error("failed to get session", zap.Error(err), zap.String("session_id", sessionID))
+		return err
+	}
+
+	if session == nil || session.UserID != userID {
+		log.Info("session not found", zap.String("session_id", sessionID), zap.String("user_id", userID))
+		return e.SessionNotFound
+	}
+
+	session.Revoke()
+
+	if err := uc.sessions.Update(ctx, session); err != nil {
+		log.Error("failed to revoke session", zap.Error(err), zap.String("session_id", sessionID))
+		return err
+	}
+
+	return nil
+}
+
+func (uc *SessionUseCase) RevokeAll(ctx context.Context, userID string) error {
+	log := getLoggerFromContext(ctx)
+
+	if err := uc.sessions.RevokeAll(ctx, userID); err != nil {
+		log.Error("failed to revoke user sessions", zap.Error(err), zap.String("user_id", userID))
+		return err
+	}
+
+	return nil
+}
@@ -4,14 +4,28 @@ import (
 	e "sso/internal/core/errors"
 
 	"context"
+	"strings"
+	"time"
 )
 
 type User struct {
 	ID string `json:"id"`
 	Name string `json:"name"`
 	Email string `json:"email"`
+	// EmailVerified is set once the user proved to own the address, a new address starts unverified
+	EmailVerified bool `json:"email_verified"`
 	Status string `json:"status"`
+	// Roles are granted by the directory groups of the user
+	Roles []string `json:"roles"`
+	// ExternalID is the id the provisioning system knows the user by
+	ExternalID string `json:"external_id,omitempty"`
+	// Version grows with every update, provisioning clients see it as the etag of the user
+	Version int `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
 	Identities []Identity
+	// Credentials are those of the account itself, such as second factors
+	Credentials []Credential `json:"-"`
 }
 
 func NewUser(name, email string) (*User, error) {
@@ -43,6 +57,10 @@ func (u *User) Update(name, email string) error {
 		return e.InvalidNameOrEmail
 	}
 
+	if !strings.EqualFold(u.Email, email) {
+		u.EmailVerified = false
+	}
+
 	u.Name = name
 	u.Email = email
 
@@ -4,6 +4,8 @@ import (
 	"go.uber.org/zap"
 
 	"context"
+	"crypto/rand"
+	"encoding/base64"
 )
 
 func getLoggerFromContext(ctx context.Context) *zap.Logger {
@@ -15,3 +17,17 @@ func getLoggerFromContext(ctx context.Context) *zap.Logger {
 
 	return zap.L()
 }
+
+// goDetached runs fn off the request path. It keeps the values of ctx, such as its logger, but not
+// its cancellation, so fn outlives the request and the request answers the same however fn goes
+func goDetached(ctx context.Context, fn func(ctx context.Context)) {
+	go fn(context.WithoutCancel(ctx))
+}
+
+// randomToken returns n random bytes encoded as unpadded base64url
+func randomToken(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,521 @@
+package core
+
+import (
+	e "sso/internal/core/errors"
+	"go.uber.org/zap"
+
+	"context"
+	"errors"
+	"time"
+)
+
+const (
+	// webauthnChallengeTTL is how long the browser has to finish a ceremony, in seconds
+	webauthnChallengeTTL = 5*60
+)
+
+// webauthnAlgorithms are the COSE algorithms of the keys the sso verifies: ES256, EdDSA and RS256
+var webauthnAlgorithms = []int{-7, -8, -257}
+
+// WebAuthnCeremony is a registration or an authentication waiting for the response of the authenticator
+type WebAuthnCeremony struct {
+	// Type is registration, login or mfa, a challenge only finishes the ceremony it was issued for
+	Type string
+	// UserID is the user registering or proving the second factor. A passwordless login without
+	// it lets the authenticator pick the account
+	UserID string
+	// UserHandle is the id of the user in the authenticator, chosen on the first registration
+	UserHandle string
+}
+
+// WebAuthnRegistration is a new credential from an attestation response
+type WebAuthnRegistration struct {
+	Challenge string
+	CredentialID string
+	PublicKey []byte
+	SignCount uint32
+	Transports []string
+}
+
+// WebAuthnAssertion is an authentication response, its signature is checked against the
+// public key of the credential it names
+type WebAuthnAssertion struct {
+	Challenge string
+	CredentialID string
+	// UserHandle is returned by discoverable credentials, empty otherwise
+	UserHandle string
+	SignCount uint32
+	// UserVerified tells the authenticator checked a pin or biometric, not only presence
+	UserVerified bool
+	// SignedData is the authenticator data followed by the hash of the client data
+	SignedData []byte
+	Signature []byte
+}
+
+// CredentialCreationOptions are the PublicKeyCredentialCreationOptions of a registration in
+// their JSON form, binary values are base64url
+type CredentialCreationOptions struct {
+	Challenge string `json:"challenge"`
+	RP RelyingParty `json:"rp"`
+	User WebAuthnUser `json:"user"`
+	PubKeyCredParams []CredentialParameter `json:"pubKeyCredParams"`
+	Timeout int `json:"timeout"`
+	ExcludeCredentials []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation string `json:"attestation"`
+}
+
+// CredentialRequestOptions are the PublicKeyCredentialRequestOptions of an authentication in their JSON form
+type CredentialRequestOptions struct {
+	Challenge string `json:"challenge"`
+	Timeout int `json:"timeout"`
+	RPID string `json:"rpId"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string `json:"userVerification"`
+}
+
+type RelyingParty struct {
+	ID string `json:"id"`
+	Name string `json:"name"`
+}
+
+type WebAuthnUser struct {
+	ID string `json:"id"`
+	Name string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type CredentialParameter struct {
+	Type string `json:"type"`
+	Alg int `json:"alg"`
+}
+
+type CredentialDescriptor struct {
+	Type string `json:"type"`
+	ID string `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+type AuthenticatorSelection struct {
+	ResidentKey string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// Passkey is a registered webauthn credential as shown to its owner
+type Passkey struct {
+	ID string `json:"id"`
+	CredentialID string `json:"credential_id"`
+	Transports []string `json:"transports"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// passkeyIdentity returns the identity holding the passkeys of the user for the relying party, nil when there is none
+func passkeyIdentity(user *User, rpID string) *Identity {
+	for i := range user.Identities {
+		if user.Identities[i].Type == "webauthn" && user.Identities[i].Issuer == rpID {
+			return &user.Identities[i]
+		}
+	}
+
+	return nil
+}
+
+// activePasskeys returns the webauthn credentials of the user that have not been removed
+func activePasskeys(user *User) []Credential {
+	passkeys := []Credential{}
+	for _, identity := range user.Identities {
+		for _, cred := range identity.Credentials {
+			if cred.Type == "webauthn" && cred.Status == "active" {
+				passkeys = append(passkeys, cred)
+			}
+		}
+	}
+
+	return passkeys
+}
+
+func credentialDescriptors(passkeys []Credential) []CredentialDescriptor {
+	descriptors := []CredentialDescriptor{}
+	for _, cred := range passkeys {
+		descriptors = append(descriptors, CredentialDescriptor{
+			Type: "public-key",
+			ID: cred.ExternalID,
+			Transports: cred.Transports,
+		})
+	}
+
+	return descriptors
+}
+
+type WebAuthnUseCase struct {
+	users IUser
+	webauthn IWebAuthn
+	challenges IWebAuthnChallenges
+	audit IAudit
+	rpID string
+	rpName string
+}
+
+func NewWebAuthnUseCase(users IUser, webauthn IWebAuthn, challenges IWebAuthnChallenges, audit IAudit, rpID, rpName string) *WebAuthnUseCase {
+	return &WebAuthnUseCase{
+		users,
+		webauthn,
+		challenges,
+		audit,
+		rpID,
+		rpName,
+	}
+}
+
+// BeginRegistration returns the options the browser creates a passkey of the user with. Resident
+// keys are preferred so the passkey can sign in without an email
+func (uc *WebAuthnUseCase) BeginRegistration(ctx context.Context, userID string) (*CredentialCreationOptions, error) {
+	log := getLoggerFromContext(ctx)
+
+	user, err := uc.user(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	ceremony := WebAuthnCeremony{
+		Type: "registration",
+		UserID: user.ID,
+		// the user handle ends up in authenticators, it is random rather than the user id or email
+		UserHandle: randomToken(32),
+	}
+	if identity := passkeyIdentity(user, uc.rpID); identity != nil {
+		ceremony.UserHandle = identity.ExternalID
+	}
+
+	challenge, err := uc.challenges.Issue(ceremony, webauthnChallengeTTL)
+	if err != nil {
+		log.Error("failed to issue webauthn challenge", zap.Error(err))
+		return nil, err
+	}
+
+	params := []CredentialParameter{}
+	for _, alg := range webauthnAlgorithms {
+		params = append(params, CredentialParameter{Type: "public-key", Alg: alg})
+	}
+
+	return &CredentialCreationOptions{
+		Challenge: challenge,
+		RP: RelyingParty{
+			ID: uc.rpID,
+			Name: uc.rpName,
+		},
+		User: WebAuthnUser{
+			ID: ceremony.UserHandle,
+			Name: user.Email,
+			DisplayName: user.Name,
+		},
+		PubKeyCredParams: params,
+		Timeout: webauthnChallengeTTL*1000,
+		// an authenticator registers once per account
+		ExcludeCredentials: credentialDescriptors(activePasskeys(user)),
+		AuthenticatorSelection: AuthenticatorSelection{
+			ResidentKey: "preferred",
+			UserVerification: "preferred",
+		},
+		Attestation: "none",
+	}, nil
+}
+
+// FinishRegistration stores the passkey created for a BeginRegistration challenge. The first
+// passkey of the user adds its webauthn identity
+func (uc *WebAuthnUseCase) FinishRegistration(ctx context.Context, input IdentityChangeInput, response []byte) (*Passkey, error) {
+	log := getLoggerFromContext(ctx)
+
+	registration, err := uc.webauthn.ParseRegistration(response)
+	if err != nil {
+		log.Info("webauthn registration refused", zap.Error(err))
+		return nil, err
+	}
+
+	ceremony, err := uc.challenges.Take(registration.Challenge)
+	if err != nil {
+		log.Error("failed to take webauthn challenge", zap.Error(err))
+		return nil, err
+	}
+
+	if ceremony == nil || ceremony.Type != "registration" || ceremony.UserID != input.UserID {
+		log.Info("webauthn challenge is unknown or was issued for another ceremony", zap.String("user_id", input.UserID))
+		return nil, e.InvalidWebAuthnResponse
+	}
+
+	user, err := uc.user(ctx, input.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	identity := passkeyIdentity(user, uc.rpID)
+	if identity == nil {
+		identity, err = NewIdentity("webauthn", ceremony.UserHandle, uc.rpID)
+		if err != nil {
+			log.Info("invalid identity", zap.Error(err))
+			return nil, err
+		}
+		identity.UserID = user.ID
+
+		if err := uc.users.SaveIdentity(ctx, identity); err != nil {
+			log.Error("failed to save webauthn identity", zap.Error(err), zap.String("user_id", user.ID))
+			return nil, err
+		}
+	}
+
+	cred := &Credential{
+		IdentityID: identity.ID,
+		Type: "webauthn",
+		Status: "active",
+		Counter: int64(registration.SignCount),
+		ExternalID: registration.CredentialID,
+		PublicKey: registration.PublicKey,
+		Transports: registration.Transports,
+	}
+
+	err = uc.users.SaveCredential(ctx, cred)
+	if errors.Is(err, e.UniqueViolated) {
+		log.Info("webauthn credential is already registered", zap.String("user_id", user.ID))
+		return nil, e.IdentityAlreadyLinked
+	}
+	if err != nil {
+		log.Error("failed to save webauthn credential", zap.Error(err), zap.String("user_id", user.ID))
+		return nil, err
+	}
+
+	recordAudit(ctx, uc.audit, NewAuditEvent(user.ID, "webauthn.registered", input.IP, input.UserAgent, map[string]string{
+		"credential_id": cred.ExternalID,
+	}))
+
+	return &Passkey{
+		ID: cred.ID,
+		CredentialID: cred.ExternalID,
+		Transports: orEmpty(cred.Transports),
+		CreatedAt: cred.CreatedAt,
+	}, nil
+}
+
+func (uc *WebAuthnUseCase) List(ctx context.Context, userID string) ([]Passkey, error) {
+	user, err := uc.user(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	passkeys := []Passkey{}
+	for _, cred := range activePasskeys(user) {
+		passkeys = append(passkeys, Passkey{
+			ID: cred.ID,
+			CredentialID: cred.ExternalID,
+			Transports: orEmpty(cred.Transports),
+			CreatedAt: cred.CreatedAt,
+		})
+	}
+
+	return passkeys, nil
+}
+
+// Remove revokes a passkey of the user. Removing the last one also removes the webauthn
+// identity, unless it is the only way left to sign in
+func (uc *WebAuthnUseCase) Remove(ctx context.Context, input IdentityChangeInput, id string) error {
+	log := getLoggerFromContext(ctx)
+
+	user, err := uc.user(ctx, input.UserID)
+	if err != nil {
+		return err
+	}
+
+	passkeys := activePasskeys(user)
+
+	var cred *Credential
+	for i := range passkeys {
+		if passkeys[i].ID == id {
+			cred = &passkeys[i]
+		}
+	}
+
+	if cred == nil {
+		log.Info("passkey not found", zap.String("user_id", user.ID), zap.String("credential_id", id))
+		return e.PasskeyNotFound
+	}
+
+	// each passkey is a login method of its own
+	if loginMethods(user) <= 1 {
+		log.Info("last login method cannot be removed", zap.String("user_id", user.ID))
+		return e.LastLoginMethod
+	}
+
+	if len(passkeys) == 1 {
+		if err := uc.users.DeleteIdentity(ctx, user.ID, cred.IdentityID); err != nil {
+			log.Error("failed to delete webauthn identity", zap.Error(err), zap.String("user_id", user.ID))
+			return err
+		}
+	} else {
+		cred.Status = "revoked"
+
+		if err := uc.users.SaveCredential(ctx, cred); err != nil {
+			log.Error("failed to revoke passkey", zap.Error(err), zap.String("user_id", user.ID))
+			return err
+		}
+	}
+
+	recordAudit(ctx, uc.audit, NewAuditEvent(user.ID, "webauthn.removed", input.IP, input.UserAgent, map[string]string{
+		"credential_id": cred.ExternalID,
+	}))
+
+	return nil
+}
+
+// BeginLogin returns the options of a passwordless login. With an email the passkeys of that
+// account are listed, without one the authenticator offers its discoverable credentials.
+// An unknown email gets the options of a discoverable login so accounts cannot be probed
+func (uc *WebAuthnUseCase) BeginLogin(ctx context.Context, email string) (*CredentialRequestOptions, error) {
+	log := getLoggerFromContext(ctx)
+
+	if email == "" {
+		return uc.requestOptions(ctx, WebAuthnCeremony{Type: "login"}, nil, "required")
+	}
+
+	user, err := uc.users.ByEmail(ctx, email)
+	if err != nil {
+		log.Error("failed to get user by email", zap.Error(err), zap.String("email", email))
+		return nil, err
+	}
+
+	if user == nil || len(activePasskeys(user)) == 0 {
+		return uc.requestOptions(ctx, WebAuthnCeremony{Type: "login"}, nil, "required")
+	}
+
+	return uc.requestOptions(ctx, WebAuthnCeremony{Type: "login", UserID: user.ID}, user, "required")
+}
+
+// requestOptions issues the challenge of an authentication, the passkeys of user are allowed
+// when it is not nil
+func (uc *WebAuthnUseCase) requestOptions(ctx context.Context, ceremony WebAuthnCeremony, user *User, userVerification string) (*CredentialRequestOptions, error) {
+	log := getLoggerFromContext(ctx)
+
+	challenge, err := uc.challenges.Issue(ceremony, webauthnChallengeTTL)
+	if err != nil {
+		log.Error("failed to issue webauthn challenge", zap.Error(err))
+		return nil, err
+	}
+
+	allowed := []CredentialDescriptor{}
+	if user != nil {
+		allowed = credentialDescriptors(activePasskeys(user))
+	}
+
+	return &CredentialRequestOptions{
+		Challenge: challenge,
+		Timeout: webauthnChallengeTTL*1000,
+		RPID: uc.rpID,
+		AllowCredentials: allowed,
+		UserVerification: userVerification,
+	}, nil
+}
+
+// authenticate checks an assertion answering a challenge of the ceremony type and returns the
+// owner of the passkey. userID restricts the passkey to one user, it is empty for a passwordless login
+func (uc *WebAuthnUseCase) authenticate(ctx context.Context, response []byte, ceremonyType, userID string) (*User, *WebAuthnAssertion, error) {
+	log := getLoggerFromContext(ctx)
+
+	assertion, err := uc.webauthn.ParseAssertion(response)
+	if err != nil {
+		log.Info("webauthn assertion refused", zap.Error(err))
+		return nil, nil, err
+	}
+
+	ceremony, err := uc.challenges.Take(assertion.Challenge)
+	if err != nil {
+		log.Error("failed to take webauthn challenge", zap.Error(err))
+		return nil, nil, err
+	}
+
+	if ceremony == nil || ceremony.Type != ceremonyType || ceremony.UserID != userID && userID != "" {
+		log.Info("webauthn challenge is unknown or was issued for another ceremony")
+		return nil, nil, e.InvalidWebAuthnResponse
+	}
+
+	var user *User
+	switch {
+	case ceremony.UserID != "":
+		user, err = uc.users.ByID(ctx, ceremony.UserID)
+	case assertion.UserHandle != "":
+		user, err = uc.users.ByIdentity(ctx, "webauthn", assertion.UserHandle, uc.rpID)
+	default:
+		log.Info("webauthn assertion names no user")
+		return nil, nil, e.InvalidWebAuthnResponse
+	}
+
+	if err != nil {
+		log.Error("failed to get passkey owner", zap.Error(err))
+		return nil, nil, err
+	}
+
+	if user == nil {
+		log.Info("passkey owner not found")
+		return nil, nil, e.InvalidWebAuthnResponse
+	}
+
+	identity := passkeyIdentity(user, uc.rpID)
+	if identity == nil || assertion.UserHandle != "" && assertion.UserHandle != identity.ExternalID {
+		log.Info("passkey does not belong to the user", zap.String("user_id", user.ID))
+		return nil, nil, e.InvalidWebAuthnResponse
+	}
+
+	var cred *Credential
+	for i := range identity.Credentials {
+		if identity.Credentials[i].Type == "webauthn" && identity.Credentials[i].Status == "active" && identity.Credentials[i].ExternalID == assertion.CredentialID {
+			cred = &identity.Credentials[i]
+		}
+	}
+
+	if cred == nil {
+		log.Info("passkey not found", zap.String("user_id", user.ID))
+		return nil, nil, e.InvalidWebAuthnResponse
+	}
+
+	if err := uc.webauthn.VerifyAssertion(assertion, cred.PublicKey); err != nil {
+		log.Info("webauthn signature does not match", zap.Error(err), zap.String("user_id", user.ID))
+		return nil, nil, err
+	}
+
+	// authenticators that count signatures only count up, a counter that does not may be a clone
+	if (assertion.SignCount != 0 || cred.Counter != 0) && int64(assertion.SignCount) <= cred.Counter {
+		log.Info("webauthn signature counter did not increase", zap.String("user_id", user.ID), zap.String("credential_id", cred.ID))
+		return nil, nil, e.InvalidWebAuthnResponse
+	}
+	cred.Counter = int64(assertion.SignCount)
+
+	if err := uc.users.SaveCredential(ctx, cred); err != nil {
+		log.Error("failed to save webauthn signature counter", zap.Error(err), zap.String("credential_id", cred.ID))
+		return nil, nil, err
+	}
+
+	return user, assertion, nil
+}
+
+func (uc *WebAuthnUseCase) user(ctx context.Context, userID string) (*User, error) {
+	log := getLoggerFromContext(ctx)
+
+	user, err := uc.users.ByID(ctx, userID)
+	if err != nil {
+		log.Error("failed to get user by id", zap.Error(err), zap.String("user_id", userID))
+		return nil, err
+	}
+
+	if user == nil {
+		log.Info("user not found", zap.String("user_id", userID))
+		return nil, e.UserNotFound
+	}
+
+	return user, nil
+}
+
+// orEmpty keeps a nil slice from being answered as null
+func orEmpty(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+
+	return values
+}
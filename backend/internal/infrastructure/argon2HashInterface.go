@@ -0,0 +1,175 @@
+package infrastructure
+
+import (
+	e "sso/internal/core/errors"
+	"golang.org/x/crypto/argon2"
+
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	argon2Prefix = "$argon2id$"
+	argon2SaltLength = 16
+	argon2KeyLength = 32
+)
+
+var errMalformedArgon2Hash = errors.New("malformed argon2id hash")
+
+// Argon2Params are the costs of new hashes, Memory is in KiB
+type Argon2Params struct {
+	Memory uint32
+	Iterations uint32
+	Parallelism uint8
+}
+
+// Argon2HashInterface stores passwords in the PHC string format,
+// $argon2id$v=19$m=<memory>,t=<iterations>,p=<parallelism>[,keyid=<pepper id>]$<salt>$<hash>.
+// With a pepper the password is keyed with HMAC-SHA256 before hashing, keyid names the pepper
+// so a hash made without it or with another one is told apart
+type Argon2HashInterface struct {
+	params Argon2Params
+	pepper []byte
+	keyID string
+}
+
+type argon2Hash struct {
+	params Argon2Params
+	keyID string
+	salt []byte
+	key []byte
+}
+
+func NewArgon2HashInterface(params Argon2Params, pepper []byte) *Argon2HashInterface {
+	var keyID string
+	if len(pepper) > 0 {
+		sum := sha256.Sum256(pepper)
+		keyID = base64.RawStdEncoding.EncodeToString(sum[:6])
+	}
+
+	return &Argon2HashInterface{
+		params: params,
+		pepper: pepper,
+		keyID: keyID,
+	}
+}
+
+func (i *Argon2HashInterface) HashPassword(raw string) (string, error) {
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", e.Unknown(err)
+	}
+
+	key := argon2.IDKey(i.peppered(raw, i.keyID), salt, i.params.Iterations, i.params.Memory, i.params.Parallelism, argon2KeyLength)
+
+	params := fmt.Sprintf("m=%d,t=%d,p=%d", i.params.Memory, i.params.Iterations, i.params.Parallelism)
+	if i.keyID != "" {
+		params += ",keyid=" + i.keyID
+	}
+
+	return fmt.Sprintf("%sv=%d$%s$%s$%s", argon2Prefix, argon2.Version, params,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (i *Argon2HashInterface) CheckPassword(raw, hash string) error {
+	parsed, err := parseArgon2Hash(hash)
+	if err != nil {
+		return e.Unknown(err)
+	}
+
+	if parsed.keyID != "" && parsed.keyID != i.keyID {
+		return e.Unknown(errors.New("argon2id hash was made with another pepper"))
+	}
+
+	key := argon2.IDKey(i.peppered(raw, parsed.keyID), parsed.salt, parsed.params.Iterations, parsed.params.Memory, parsed.params.Parallelism, uint32(len(parsed.key)))
+	if subtle.ConstantTimeCompare(key, parsed.key) != 1 {
+		return e.Unknown(errors.New("password does not match"))
+	}
+
+	return nil
+}
+
+// NeedsRehash reports hashes made with other costs or another pepper than the current ones
+func (i *Argon2HashInterface) NeedsRehash(hash string) bool {
+	parsed, err := parseArgon2Hash(hash)
+	if err != nil {
+		return true
+	}
+
+	return parsed.params != i.params || parsed.keyID != i.keyID
+}
+
+// peppered keys the password with the pepper the hash names, hashes without keyid are unpeppered
+func (i *Argon2HashInterface) peppered(raw, keyID string) []byte {
+	if keyID == "" {
+		return []byte(raw)
+	}
+
+	mac := hmac.New(sha256.New, i.pepper)
+	mac.Write([]byte(raw))
+
+	return mac.Sum(nil)
+}
+
+func parseArgon2Hash(hash string) (*argon2Hash, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, errMalformedArgon2Hash
+	}
+
+	if parts[2] != "v="+strconv.Itoa(argon2.Version) {
+		return nil, fmt.Errorf("unsupported argon2id version %s", parts[2])
+	}
+
+	parsed := argon2Hash{}
+	for _, param := range strings.Split(parts[3], ",") {
+		name, value, _ := strings.Cut(param, "=")
+
+		if name == "keyid" {
+			parsed.keyID = value
+			continue
+		}
+
+		n, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return nil, errMalformedArgon2Hash
+		}
+
+		switch name {
+		case "m":
+			parsed.params.Memory = uint32(n)
+		case "t":
+			parsed.params.Iterations = uint32(n)
+		case "p":
+			if n > 255 {
+				return nil, errMalformedArgon2Hash
+			}
+			parsed.params.Parallelism = uint8(n)
+		default:
+			return nil, errMalformedArgon2Hash
+		}
+	}
+
+	if parsed.params.Memory == 0 || parsed.params.Iterations == 0 || parsed.params.Parallelism == 0 {
+		return nil, errMalformedArgon2Hash
+	}
+
+	var err error
+	if parsed.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, errMalformedArgon2Hash
+	}
+	if parsed.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(parsed.key) == 0 {
+		return nil, errMalformedArgon2Hash
+	}
+
+	return &parsed, nil
+}
@@ -0,0 +1,65 @@
+package infrastructure
+
+import (
+	"sso/internal/core"
+	e "sso/internal/core/errors"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"context"
+)
+
+type AuditInterface struct {
+	pool *pgxpool.Pool
+}
+
+func NewAuditInterface(pool *pgxpool.Pool) *AuditInterface {
+	return &AuditInterface{
+		pool,
+	}
+}
+
+func (i *AuditInterface) Record(ctx context.Context, event *core.AuditEvent) error {
+	var id string
+	err := i.pool.QueryRow(ctx,
+		`INSERT INTO audit_events(user_id, action, ip, user_agent, details, created_at)
+		 VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		event.UserID, event.Action, event.IP, event.UserAgent, event.Details, event.CreatedAt,
+	).Scan(&id)
+
+	if err != nil {
+		return e.Unknown(err)
+	}
+
+	event.ID = id
+
+	return nil
+}
+
+func (i *AuditInterface) ByUser(ctx context.Context, userID string, limit int) ([]core.AuditEvent, error) {
+	rows, err := i.pool.Query(ctx,
+		`SELECT id, user_id, action, ip, user_agent, details, created_at
+		 FROM audit_events WHERE user_id = $1 ORDER BY created_at DESC LIMIT $2`,
+		userID, limit,
+	)
+	if err != nil {
+		return nil, e.Unknown(err)
+	}
+	defer rows.Close()
+
+	events := []core.AuditEvent{}
+	for rows.Next() {
+		var event core.AuditEvent
+
+		if err := rows.Scan(&event.ID, &event.UserID, &event.Action, &event.IP, &event.UserAgent, &event.Details, &event.CreatedAt); err != nil {
+			return nil, e.Unknown(err)
+		}
+
+		events = append(events, event)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, e.Unknown(err)
+	}
+
+	return events, nil
+}
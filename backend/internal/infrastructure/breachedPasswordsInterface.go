@@ -0,0 +1,56 @@
+package infrastructure
+
+import (
+	e "sso/internal/core/errors"
+
+	"bufio"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BreachedPasswordsInterface reads a local copy of the Pwned Passwords range files: a directory
+// with one <PREFIX>.txt file per 5 hex digit prefix, each line is "<SUFFIX>:<COUNT>"
+type BreachedPasswordsInterface struct {
+	dir string
+}
+
+func NewBreachedPasswordsInterface(dir string) *BreachedPasswordsInterface {
+	return &BreachedPasswordsInterface{
+		dir: dir,
+	}
+}
+
+func (i *BreachedPasswordsInterface) Range(ctx context.Context, prefix string) ([]string, error) {
+	if len(prefix) != 5 || strings.ContainsAny(prefix, `/\.`) {
+		return nil, e.Unknown(errors.New("invalid hash prefix " + prefix))
+	}
+
+	file, err := os.Open(filepath.Join(i.dir, strings.ToUpper(prefix)+".txt"))
+	// a prefix without a file has no breached passwords
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, e.Unknown(err)
+	}
+	defer file.Close()
+
+	var suffixes []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		suffix, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if suffix != "" {
+			suffixes = append(suffixes, suffix)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, e.Unknown(err)
+	}
+
+	return suffixes, nil
+}
@@ -0,0 +1,60 @@
+package infrastructure
+
+import (
+	e "sso/internal/core/errors"
+
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+)
+
+// CipherInterface encrypts with AES-256-GCM, a ciphertext is the nonce followed by the sealed
+// plaintext in base64
+type CipherInterface struct {
+	aead cipher.AEAD
+}
+
+func NewCipherInterface(key []byte) (*CipherInterface, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CipherInterface{
+		aead,
+	}, nil
+}
+
+func (i *CipherInterface) Encrypt(plaintext []byte) (string, error) {
+	nonce := make([]byte, i.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", e.Unknown(err)
+	}
+
+	return base64.StdEncoding.EncodeToString(i.aead.Seal(nonce, nonce, plaintext, nil)), nil
+}
+
+func (i *CipherInterface) Decrypt(ciphertext string) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return nil, e.Unknown(err)
+	}
+
+	if len(sealed) < i.aead.NonceSize() {
+		return nil, e.Unknown(errors.New("ciphertext is too short"))
+	}
+
+	plaintext, err := i.aead.Open(nil, sealed[:i.aead.NonceSize()], sealed[i.aead.NonceSize():], nil)
+	if err != nil {
+		return nil, e.Unknown(err)
+	}
+
+	return plaintext, nil
+}
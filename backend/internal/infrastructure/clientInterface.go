@@ -27,11 +27,15 @@ func (i *ClientInterface) ByID(ctx context.Context, clientID string) (*core.Clie
 	var redirectURIs []string
 	var clientSecret string
 	var createdAt time.Time
+	var idleTimeout, lifetime, rememberMeIdleTimeout, rememberMeLifetime *int
+	var requireVerifiedEmail bool
 
 	err := i.pool.QueryRow(ctx,
-		"SELECT id, name, status, redirect_uris, client_secret, created_at FROM clients WHERE client_id = $1",
+		`SELECT id, name, status, redirect_uris, client_secret, created_at,
+		 session_idle_timeout, session_lifetime, remember_me_idle_timeout, remember_me_lifetime, require_verified_email
+		 FROM clients WHERE client_id = $1`,
 		clientID,
-	).Scan(&id, &name, &status, &redirectURIs, &clientSecret, &createdAt)
+	).Scan(&id, &name, &status, &redirectURIs, &clientSecret, &createdAt, &idleTimeout, &lifetime, &rememberMeIdleTimeout, &rememberMeLifetime, &requireVerifiedEmail)
 
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
@@ -48,7 +52,26 @@ func (i *ClientInterface) ByID(ctx context.Context, clientID string) (*core.Clie
 		RedirectURIs: redirectURIs,
 		ClientSecret: clientSecret,
 		CreatedAt:    createdAt,
+		SessionPolicy: sessionPolicy(idleTimeout, lifetime),
+		RememberMePolicy: sessionPolicy(rememberMeIdleTimeout, rememberMeLifetime),
+		RequireVerifiedEmail: requireVerifiedEmail,
 	}
 
 	return &client, nil
 }
+
+// sessionPolicy builds a client override only when its lifetime is configured
+func sessionPolicy(idleTimeout, lifetime *int) *core.SessionPolicy {
+	if lifetime == nil {
+		return nil
+	}
+
+	policy := core.SessionPolicy{
+		Lifetime: *lifetime,
+	}
+	if idleTimeout != nil {
+		policy.IdleTimeout = *idleTimeout
+	}
+
+	return &policy
+}
@@ -0,0 +1,53 @@
+package infrastructure
+
+import (
+	e "sso/internal/core/errors"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"context"
+	"errors"
+)
+
+type ConsentInterface struct {
+	pool *pgxpool.Pool
+}
+
+func NewConsentInterface(pool *pgxpool.Pool) *ConsentInterface {
+	return &ConsentInterface{
+		pool,
+	}
+}
+
+func (i *ConsentInterface) Has(ctx context.Context, userID, clientID string) (bool, error) {
+	var exists bool
+
+	err := i.pool.QueryRow(ctx,
+		"SELECT EXISTS(SELECT 1 FROM consents WHERE user_id = $1 AND client_id = $2)",
+		userID, clientID,
+	).Scan(&exists)
+
+	if err != nil {
+		return false, e.Unknown(err)
+	}
+
+	return exists, nil
+}
+
+func (i *ConsentInterface) Grant(ctx context.Context, userID, clientID string) error {
+	_, err := i.pool.Exec(ctx,
+		"INSERT INTO consents(user_id, client_id) VALUES ($1, $2) ON CONFLICT (user_id, client_id) DO NOTHING",
+		userID, clientID,
+	)
+
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23503" { // foreign key violation
+			return e.UserNotFound
+		} else {
+			return e.Unknown(err)
+		}
+	}
+
+	return nil
+}
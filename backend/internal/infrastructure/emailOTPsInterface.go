@@ -0,0 +1,76 @@
+package infrastructure
+
+import (
+	"sso/internal/core"
+
+	"sync"
+	"time"
+)
+
+type EmailOTPsInterface struct {
+	mu sync.Mutex
+	otps map[string]emailOTP
+}
+
+type emailOTP struct {
+	otp core.EmailOTP
+	expiration time.Time
+}
+
+func NewEmailOTPsInterface() *EmailOTPsInterface {
+	return &EmailOTPsInterface{
+		otps: map[string]emailOTP{},
+	}
+}
+
+func (i *EmailOTPsInterface) Issue(email string, otp core.EmailOTP, ttl int) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	now := time.Now()
+	for address, o := range i.otps {
+		if o.expiration.Before(now) {
+			delete(i.otps, address)
+		}
+	}
+
+	i.otps[email] = emailOTP{
+		otp: otp,
+		expiration: now.Add(time.Duration(ttl)*time.Second),
+	}
+
+	return nil
+}
+
+func (i *EmailOTPsInterface) Get(email string) (*core.EmailOTP, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	o, ok := i.otps[email]
+	if !ok || o.expiration.Before(time.Now()) {
+		return nil, nil
+	}
+
+	return &o.otp, nil
+}
+
+func (i *EmailOTPsInterface) Update(email string, otp core.EmailOTP) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if o, ok := i.otps[email]; ok {
+		o.otp = otp
+		i.otps[email] = o
+	}
+
+	return nil
+}
+
+func (i *EmailOTPsInterface) Delete(email string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	delete(i.otps, email)
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package infrastructure
+
+import (
+	"sso/internal/core"
+
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"sync"
+	"time"
+)
+
+// emailTokenSigner signs the ids of the tokens with HMAC-SHA256, tokens are "<id>.<mac>"
+type emailTokenSigner struct {
+	key []byte
+}
+
+func (s emailTokenSigner) sign(id string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(id))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify returns the id of a token signed with the key
+func (s emailTokenSigner) verify(signed string) (string, bool) {
+	id, mac, ok := strings.Cut(signed, ".")
+	if !ok || !hmac.Equal([]byte(mac), []byte(s.sign(id))) {
+		return "", false
+	}
+
+	return id, true
+}
+
+// EmailTokensInterface keeps the tokens in memory, mailed links do not survive the process. The sso
+// keeps them in PostgresEmailTokensInterface, this one serves the tests
+type EmailTokensInterface struct {
+	signer emailTokenSigner
+
+	mu sync.Mutex
+	tokens map[string]emailToken
+}
+
+type emailToken struct {
+	token core.EmailToken
+	expiration time.Time
+}
+
+func NewEmailTokensInterface(key []byte) *EmailTokensInterface {
+	return &EmailTokensInterface{
+		signer: emailTokenSigner{key},
+		tokens: map[string]emailToken{},
+	}
+}
+
+func (i *EmailTokensInterface) Issue(ctx context.Context, token core.EmailToken, ttl int) (string, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	now := time.Now()
+	for id, t := range i.tokens {
+		if t.expiration.Before(now) {
+			delete(i.tokens, id)
+		}
+	}
+
+	id := randomID()
+	i.tokens[id] = emailToken{
+		token: token,
+		expiration: now.Add(time.Duration(ttl)*time.Second),
+	}
+
+	return id + "." + i.signer.sign(id), nil
+}
+
+func (i *EmailTokensInterface) Take(ctx context.Context, signed string) (*core.EmailToken, error) {
+	id, ok := i.signer.verify(signed)
+	if !ok {
+		return nil, nil
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	t, ok := i.tokens[id]
+	if !ok {
+		return nil, nil
+	}
+	delete(i.tokens, id)
+
+	if t.expiration.Before(time.Now()) {
+		return nil, nil
+	}
+
+	return &t.token, nil
+}
@@ -0,0 +1,61 @@
+package infrastructure
+
+import (
+	"sso/internal/core"
+
+	"sync"
+	"time"
+)
+
+type FederationStatesInterface struct {
+	mu sync.Mutex
+	states map[string]federationState
+}
+
+type federationState struct {
+	state core.FederationState
+	expiration time.Time
+}
+
+func NewFederationStatesInterface() *FederationStatesInterface {
+	return &FederationStatesInterface{
+		states: map[string]federationState{},
+	}
+}
+
+func (i *FederationStatesInterface) Issue(state core.FederationState, ttl int) (string, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	now := time.Now()
+	for id, s := range i.states {
+		if s.expiration.Before(now) {
+			delete(i.states, id)
+		}
+	}
+
+	id := randomID()
+	i.states[id] = federationState{
+		state: state,
+		expiration: now.Add(time.Duration(ttl)*time.Second),
+	}
+
+	return id, nil
+}
+
+func (i *FederationStatesInterface) Take(id string) (*core.FederationState, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	s, ok := i.states[id]
+	if !ok {
+		return nil, nil
+	}
+	delete(i.states, id)
+
+	if s.expiration.Before(time.Now()) {
+		return nil, nil
+	}
+
+	return &s.state, nil
+}
@@ -0,0 +1,102 @@
+package infrastructure
+
+import (
+	"sso/internal/config"
+	e "sso/internal/core/errors"
+
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type githubUser struct {
+	ID int64 `json:"id"`
+	Login string `json:"login"`
+	Name string `json:"name"`
+}
+
+type githubEmail struct {
+	Email string `json:"email"`
+	Primary bool `json:"primary"`
+	Verified bool `json:"verified"`
+}
+
+// GitHubProviderInterface logs in through github, which has no id tokens: the user comes from
+// the user api and the email from the emails api, since the public profile email may be unverified or hidden
+type GitHubProviderInterface struct {
+	config config.IdentityProviderConfig
+	client *http.Client
+}
+
+func NewGitHubProviderInterface(config config.IdentityProviderConfig, client *http.Client) *GitHubProviderInterface {
+	if client == nil {
+		client = &http.Client{Timeout: 10*time.Second}
+	}
+
+	return &GitHubProviderInterface{
+		config: config,
+		client: client,
+	}
+}
+
+func (i *GitHubProviderInterface) DisplayName() string {
+	return i.config.DisplayName
+}
+
+func (i *GitHubProviderInterface) AuthCodeURL(state, nonce, codeChallenge string) string {
+	return authCodeURL(i.config, url.Values{
+		"state": {state},
+		"code_challenge": {codeChallenge},
+		"code_challenge_method": {"S256"},
+	})
+}
+
+func (i *GitHubProviderInterface) Exchange(ctx context.Context, code, codeVerifier, nonce string) (map[string]string, error) {
+	tokens, err := exchangeCode(ctx, i.client, i.config, code, codeVerifier)
+	if err != nil {
+		return nil, err
+	}
+
+	var user githubUser
+	if err := getJSON(ctx, i.client, i.config.UserInfoURL, tokens.AccessToken, &user); err != nil {
+		return nil, err
+	}
+
+	if user.ID == 0 {
+		return nil, errors.Join(e.UpstreamLoginFailed, errors.New("github user has no id"))
+	}
+
+	var emails []githubEmail
+	if err := getJSON(ctx, i.client, i.config.UserInfoURL+"/emails", tokens.AccessToken, &emails); err != nil {
+		return nil, err
+	}
+
+	email := ""
+	for _, candidate := range emails {
+		if candidate.Primary && candidate.Verified {
+			email = candidate.Email
+			break
+		}
+	}
+	if email == "" {
+		return nil, e.EmailNotVerified
+	}
+
+	name := user.Name
+	if name == "" {
+		name = user.Login
+	}
+
+	return map[string]string{
+		"provider": i.config.Name,
+		"issuer": i.config.Issuer,
+		"sub": strconv.FormatInt(user.ID, 10),
+		"email": email,
+		"email_verified": "true",
+		"name": name,
+		"link_by_email": strconv.FormatBool(i.config.LinkByEmail != nil && *i.config.LinkByEmail),
+	}, nil
+}
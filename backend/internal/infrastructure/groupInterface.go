@@ -0,0 +1,177 @@
+package infrastructure
+
+import (
+	"sso/internal/core"
+	e "sso/internal/core/errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"context"
+	"errors"
+	"strconv"
+)
+
+type GroupInterface struct {
+	pool *pgxpool.Pool
+}
+
+func NewGroupInterface(pool *pgxpool.Pool) *GroupInterface {
+	return &GroupInterface{
+		pool: pool,
+	}
+}
+
+// groupColumns are read by scanGroup, the members are aggregated so a page of groups is one query
+const groupColumns = `g.id, g.display_name, COALESCE(g.external_id, ''), g.version, g.created_at, g.updated_at,
+	ARRAY(SELECT m.user_id FROM user_group_members m WHERE m.group_id = g.id ORDER BY m.user_id)`
+
+func (i *GroupInterface) ByID(ctx context.Context, id string) (*core.Group, error) {
+	group, err := scanGroup(i.pool.QueryRow(ctx, "SELECT "+groupColumns+" FROM user_groups g WHERE g.id = $1", id))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		} else {
+			return nil, e.Unknown(err)
+		}
+	}
+
+	return group, nil
+}
+
+// Search orders the groups by creation, the filter is compiled to sql
+func (i *GroupInterface) Search(ctx context.Context, filter *core.Filter, offset, limit int) ([]core.Group, int, error) {
+	args := []any{}
+	where := "TRUE"
+	if filter != nil {
+		condition, err := filterSQL(filter, groupFilterColumns, &args)
+		if err != nil {
+			return nil, 0, err
+		}
+		where = condition
+	}
+
+	var total int
+	if err := i.pool.QueryRow(ctx, "SELECT COUNT(*) FROM user_groups g WHERE "+where, args...).Scan(&total); err != nil {
+		return nil, 0, e.Unknown(err)
+	}
+
+	args = append(args, limit, offset)
+	rows, err := i.pool.Query(ctx,
+		"SELECT "+groupColumns+" FROM user_groups g WHERE "+where+
+		" ORDER BY g.created_at, g.id LIMIT $"+strconv.Itoa(len(args)-1)+" OFFSET $"+strconv.Itoa(len(args)),
+		args...,
+	)
+	if err != nil {
+		return nil, 0, e.Unknown(err)
+	}
+	defer rows.Close()
+
+	groups := []core.Group{}
+	for rows.Next() {
+		group, err := scanGroup(rows)
+		if err != nil {
+			return nil, 0, e.Unknown(err)
+		}
+
+		groups = append(groups, *group)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, 0, e.Unknown(err)
+	}
+
+	return groups, total, nil
+}
+
+func scanGroup(row pgx.Row) (*core.Group, error) {
+	var group core.Group
+
+	err := row.Scan(&group.ID, &group.DisplayName, &group.ExternalID, &group.Version, &group.CreatedAt, &group.UpdatedAt, &group.Members)
+	if err != nil {
+		return nil, err
+	}
+
+	return &group, nil
+}
+
+func (i *GroupInterface) Create(ctx context.Context, group *core.Group) error {
+	err := pgx.BeginFunc(ctx, i.pool, func(tx pgx.Tx) error {
+		err := tx.QueryRow(ctx,
+			"INSERT INTO user_groups(display_name, external_id) VALUES ($1, NULLIF($2, '')) RETURNING id, version, created_at, updated_at",
+			group.DisplayName, group.ExternalID,
+		).Scan(&group.ID, &group.Version, &group.CreatedAt, &group.UpdatedAt)
+		if err != nil {
+			return err
+		}
+
+		return insertMembers(ctx, tx, group)
+	})
+
+	return groupError(err)
+}
+
+// Update replaces the members in the same transaction as the attributes
+func (i *GroupInterface) Update(ctx context.Context, group *core.Group) error {
+	err := pgx.BeginFunc(ctx, i.pool, func(tx pgx.Tx) error {
+		err := tx.QueryRow(ctx,
+			`UPDATE user_groups SET display_name = $1, external_id = NULLIF($2, ''), version = version + 1, updated_at = NOW()
+			 WHERE id = $3 RETURNING version, updated_at`,
+			group.DisplayName, group.ExternalID, group.ID,
+		).Scan(&group.Version, &group.UpdatedAt)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(ctx, "DELETE FROM user_group_members WHERE group_id = $1", group.ID); err != nil {
+			return err
+		}
+
+		return insertMembers(ctx, tx, group)
+	})
+
+	return groupError(err)
+}
+
+func (i *GroupInterface) Delete(ctx context.Context, id string) error {
+	tag, err := i.pool.Exec(ctx, "DELETE FROM user_groups WHERE id = $1", id)
+	if err != nil {
+		return e.Unknown(err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return e.GroupNotFound
+	}
+
+	return nil
+}
+
+func insertMembers(ctx context.Context, tx pgx.Tx, group *core.Group) error {
+	if len(group.Members) == 0 {
+		return nil
+	}
+
+	_, err := tx.Exec(ctx,
+		"INSERT INTO user_group_members(group_id, user_id) SELECT $1, unnest($2::text[])",
+		group.ID, group.Members,
+	)
+
+	return err
+}
+
+func groupError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.Is(err, pgx.ErrNoRows) {
+		return e.GroupNotFound
+	} else if errors.As(err, &pgErr) && pgErr.Code == "23505" { // unique violation
+		return e.UniqueViolated
+	} else if errors.As(err, &pgErr) && pgErr.Code == "23503" { // foreign key violation
+		return e.UserNotFound
+	} else {
+		return e.Unknown(err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+// HashInterface stores passwords as bcrypt hashes, the hashes of accounts created before argon2id
 type HashInterface struct {
 	hashCost int 
 }
@@ -32,3 +33,10 @@ func (i *HashInterface) CheckPassword(raw, hash string) error {
 
 	return nil
 }
+
+// NeedsRehash reports hashes made with another cost than the current one
+func (i *HashInterface) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+
+	return err != nil || cost != i.hashCost
+}
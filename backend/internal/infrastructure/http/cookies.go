@@ -0,0 +1,70 @@
+package http
+
+import (
+	"sso/internal/config"
+	"github.com/labstack/echo/v4"
+
+	"net/http"
+	"time"
+)
+
+const sessionCookieName = "sso_session_token"
+
+type sessionCookies struct {
+	domain string
+	path string
+	lifetime int
+	secure bool
+	sameSite http.SameSite
+}
+
+func newSessionCookies(conf *config.Config) sessionCookies {
+	return sessionCookies{
+		domain: conf.SessionCookieDomain,
+		path: conf.SessionCookiePath,
+		lifetime: conf.SessionCookieLifetime,
+		secure: conf.SessionCookieSecure,
+		sameSite: conf.SessionCookieSameSite,
+	}
+}
+
+// set stores the sso session token in a cookie that never outlives the session itself
+func (s sessionCookies) set(c echo.Context, token string, sessionExpiresAt time.Time) {
+	expires := sessionExpiresAt
+	if s.lifetime > 0 {
+		if limit := time.Now().Add(time.Duration(s.lifetime)*time.Second); limit.Before(expires) {
+			expires = limit
+		}
+	}
+
+	c.SetCookie(&http.Cookie{
+		Name: sessionCookieName,
+		Value: token,
+		Domain: s.domain,
+		Path: s.path,
+		Expires: expires,
+		MaxAge: int(time.Until(expires).Seconds()),
+		HttpOnly: true,
+		Secure: s.secure,
+		SameSite: s.sameSite,
+	})
+}
+
+func (s sessionCookies) clear(c echo.Context) {
+	c.SetCookie(&http.Cookie{
+		Name: sessionCookieName,
+		Value: "",
+		Domain: s.domain,
+		Path: s.path,
+		Expires: time.Unix(0, 0),
+		MaxAge: -1,
+		HttpOnly: true,
+		Secure: s.secure,
+		SameSite: s.sameSite,
+	})
+}
+
+// wantsJSON reports whether an api client asked for the sso session token in the response body
+func wantsJSON(c echo.Context) bool {
+	return c.QueryParam("mode") == "json"
+}
@@ -0,0 +1,123 @@
+package http
+
+import (
+	"sso/internal/core"
+	e "sso/internal/core/errors"
+	"github.com/labstack/echo/v4"
+
+	"errors"
+	"net/http"
+)
+
+// sendEmailOTPHandler mails a login code and magic link, the answer does not tell whether the address has an account
+func sendEmailOTPHandler(emailOTPUC *core.EmailOTPUseCase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		request := map[string]string{
+			"email": "",
+			"return_to": "",
+		}
+		if err := c.Bind(&request); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]any{
+				"error": "invalid body",
+			})
+		}
+
+		err := emailOTPUC.Send(ctx, core.EmailOTPInput{
+			Email: request["email"],
+			ReturnTo: safeReturnTo(request["return_to"]),
+			IP: c.RealIP(),
+			UserAgent: c.Request().UserAgent(),
+		})
+		if err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusAccepted)
+	}
+}
+
+// emailOTPSend mails a login code from the login page and asks for it
+func emailOTPSend(emailOTPUC *core.EmailOTPUseCase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		data := page{
+			Title: "Check your email",
+			ReturnTo: safeReturnTo(c.FormValue("return_to")),
+			Email: c.FormValue("email"),
+		}
+
+		err := emailOTPUC.Send(ctx, core.EmailOTPInput{
+			Email: data.Email,
+			ReturnTo: data.ReturnTo,
+			IP: c.RealIP(),
+			UserAgent: c.Request().UserAgent(),
+		})
+		if err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, e.TooManyEmails) {
+				status = http.StatusTooManyRequests
+			}
+
+			data.Error = authFailureMessage(err)
+			return render(c, status, "email_login", data)
+		}
+
+		return render(c, http.StatusOK, "email_login", data)
+	}
+}
+
+// emailLinkPage is where magic links land. Mail scanners open links too, so the token is only
+// redeemed once the user submits the page
+func emailLinkPage() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return render(c, http.StatusOK, "email_login", page{
+			Title: "Sign in",
+			ReturnTo: safeReturnTo(c.QueryParam("return_to")),
+			EmailToken: c.QueryParam("token"),
+		})
+	}
+}
+
+// emailOTPSubmit signs in with a mailed code or the token of a magic link
+func emailOTPSubmit(loginUC *core.LoginUseCase, cookies sessionCookies) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		data := page{
+			Title: "Check your email",
+			ReturnTo: safeReturnTo(c.FormValue("return_to")),
+			Email: c.FormValue("email"),
+			EmailToken: c.FormValue("token"),
+		}
+
+		token, session, err := loginUC.Execute(ctx, core.LoginInput{
+			Provider: "email_otp",
+			Email: data.Email,
+			Code: c.FormValue("code"),
+			EmailToken: data.EmailToken,
+			IP: c.RealIP(),
+			UserAgent: c.Request().UserAgent(),
+		})
+		var mfaErr *core.MFARequiredError
+		if errors.As(err, &mfaErr) {
+			return mfaPage(c, mfaErr, data.ReturnTo)
+		}
+		if err != nil {
+			// a used or expired link cannot be submitted again
+			data.EmailToken = ""
+			if data.Email == "" {
+				return renderError(c, http.StatusUnauthorized, authFailureMessage(err))
+			}
+
+			data.Error = authFailureMessage(err)
+			return render(c, http.StatusUnauthorized, "email_login", data)
+		}
+
+		cookies.set(c, token, session.ExpiresAt)
+
+		return c.Redirect(http.StatusSeeOther, data.ReturnTo)
+	}
+}
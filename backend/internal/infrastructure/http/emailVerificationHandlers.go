@@ -0,0 +1,89 @@
+package http
+
+import (
+	"sso/internal/core"
+	"github.com/labstack/echo/v4"
+
+	"net/http"
+)
+
+func verifyEmailHandler(verificationUC *core.EmailVerificationUseCase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		request := map[string]string{
+			"token": "",
+		}
+		if err := c.Bind(&request); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]any{
+				"error": "invalid body",
+			})
+		}
+
+		err := verificationUC.Verify(ctx, core.EmailVerifyInput{
+			Token: request["token"],
+			IP: c.RealIP(),
+			UserAgent: c.Request().UserAgent(),
+		})
+		if err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// resendVerificationHandler mails a new verification link to the signed in user
+func resendVerificationHandler(verificationUC *core.EmailVerificationUseCase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		session, ok := currentSession(c)
+		if !ok {
+			return c.JSON(http.StatusUnauthorized, map[string]any{
+				"error": "unauthorized",
+			})
+		}
+
+		err := verificationUC.Resend(ctx, core.EmailVerificationInput{
+			UserID: session.UserID,
+			IP: c.RealIP(),
+			UserAgent: c.Request().UserAgent(),
+		})
+		if err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusAccepted)
+	}
+}
+
+// verifyEmailPage is where verification links land, mail scanners opening the link do not verify anything
+func verifyEmailPage() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return render(c, http.StatusOK, "email_verify", page{
+			Title: "Verify your email",
+			EmailToken: c.QueryParam("token"),
+		})
+	}
+}
+
+func verifyEmailSubmit(verificationUC *core.EmailVerificationUseCase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		err := verificationUC.Verify(ctx, core.EmailVerifyInput{
+			Token: c.FormValue("token"),
+			IP: c.RealIP(),
+			UserAgent: c.Request().UserAgent(),
+		})
+		if err != nil {
+			return renderError(c, http.StatusBadRequest, authFailureMessage(err))
+		}
+
+		return render(c, http.StatusOK, "email_verify", page{
+			Title: "Verify your email",
+			Message: "Your email address is verified.",
+		})
+	}
+}
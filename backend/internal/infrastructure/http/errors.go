@@ -33,6 +33,13 @@ func Unauthorized(msg string) HTTPError {
 	}
 }
 
+func Conflict(msg string) HTTPError {
+	return HTTPError{
+		Code: 409,
+		Message: msg,
+	}
+}
+
 func BadRequest(msg string) HTTPError {
 	return HTTPError{
 		Code: 400,
@@ -46,3 +53,10 @@ func Internal(msg string) HTTPError {
 		Message: msg,
 	}
 }
+
+func TooManyRequests(msg string) HTTPError {
+	return HTTPError{
+		Code: 429,
+		Message: msg,
+	}
+}
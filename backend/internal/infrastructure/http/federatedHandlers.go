@@ -0,0 +1,158 @@
+package http
+
+import (
+	"sso/internal/core"
+	e "sso/internal/core/errors"
+	"github.com/labstack/echo/v4"
+
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const federationStateCookieName = "sso_federation_state"
+
+func federatedStartHandler(federatedUC *core.FederatedLoginUseCase, cookies sessionCookies) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		redirectURL, stateID, err := federatedUC.Start(ctx, core.FederatedStartInput{
+			Provider: c.Param("provider"),
+			ReturnTo: safeReturnTo(c.QueryParam("return_to")),
+			ClientID: c.QueryParam("client_id"),
+			RememberMe: c.QueryParam("remember_me") == "true",
+		})
+		if err != nil {
+			return renderError(c, http.StatusBadRequest, federatedFailureMessage(err))
+		}
+
+		setFederationStateCookie(c, cookies, stateID)
+
+		return c.Redirect(http.StatusFound, redirectURL)
+	}
+}
+
+// setFederationStateCookie binds the upstream round trip to this user agent, the provider
+// redirect is a top level navigation so SameSite=Lax still sends the cookie back
+func setFederationStateCookie(c echo.Context, cookies sessionCookies, stateID string) {
+	c.SetCookie(&http.Cookie{
+		Name: federationStateCookieName,
+		Value: stateID,
+		Domain: cookies.domain,
+		Path: "/auth/federated",
+		Expires: time.Now().Add(10*time.Minute),
+		HttpOnly: true,
+		Secure: cookies.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func federatedCallbackHandler(federatedUC *core.FederatedLoginUseCase, cookies sessionCookies) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		stateID, code := c.QueryParam("state"), c.QueryParam("code")
+		// saml identity providers post the response to the callback
+		posted := c.Request().Method == http.MethodPost
+		if posted {
+			stateID, code = c.FormValue("RelayState"), c.FormValue("SAMLResponse")
+		}
+
+		bound, err := c.Cookie(federationStateCookieName)
+		// a cross site post does not carry the Lax state cookie, the response is
+		// posted again from this origin once, which does
+		if err != nil && posted && c.FormValue("resubmitted") != "true" {
+			c.Response().Header().Set("Cache-Control", "no-store")
+
+			return render(c, http.StatusOK, "saml_post", page{
+				Title: "Signing in",
+				Resubmit: true,
+				SAML: &core.SAMLResult{
+					ACSURL: c.Request().URL.Path,
+					SAMLResponse: code,
+					RelayState: stateID,
+				},
+			})
+		}
+		if err != nil || subtle.ConstantTimeCompare([]byte(bound.Value), []byte(stateID)) != 1 {
+			return renderError(c, http.StatusBadRequest, federatedFailureMessage(e.InvalidFederationState))
+		}
+
+		c.SetCookie(&http.Cookie{
+			Name: federationStateCookieName,
+			Value: "",
+			Domain: cookies.domain,
+			Path: "/auth/federated",
+			MaxAge: -1,
+			HttpOnly: true,
+			Secure: cookies.secure,
+		})
+
+		userID := ""
+		if current, ok := currentSession(c); ok {
+			userID = current.UserID
+		}
+
+		token, session, state, err := federatedUC.Callback(ctx, core.FederatedCallbackInput{
+			Provider: c.Param("provider"),
+			State: stateID,
+			Code: code,
+			Error: c.QueryParam("error"),
+			UserID: userID,
+			IP: c.RealIP(),
+			UserAgent: c.Request().UserAgent(),
+		})
+		var linkErr *core.LinkRequiredError
+		if errors.As(err, &linkErr) {
+			return c.Redirect(http.StatusSeeOther, linkRedirect(state, linkErr))
+		}
+		var mfaErr *core.MFARequiredError
+		if errors.As(err, &mfaErr) {
+			return mfaPage(c, mfaErr, state.ReturnTo)
+		}
+		if err != nil {
+			return renderError(c, http.StatusUnauthorized, federatedFailureMessage(err))
+		}
+
+		// a linked identity does not replace the session the user already has
+		if state.LinkUserID != "" {
+			return c.Redirect(http.StatusSeeOther, safeReturnTo(state.ReturnTo))
+		}
+
+		cookies.set(c, token, session.ExpiresAt)
+
+		return c.Redirect(http.StatusSeeOther, safeReturnTo(state.ReturnTo))
+	}
+}
+
+// linkRedirect sends the user to the password login of the account the upstream identity claimed
+func linkRedirect(state *core.FederationState, linkErr *core.LinkRequiredError) string {
+	return "/login?" + url.Values{
+		"return_to": {safeReturnTo(state.ReturnTo)},
+		"client_id": {state.ClientID},
+		"login_hint": {linkErr.Email},
+		"link_token": {linkErr.LinkToken},
+		"link_provider": {linkErr.Provider},
+	}.Encode()
+}
+
+func federatedFailureMessage(err error) string {
+	switch {
+	case errors.Is(err, e.InvalidAuthProvider):
+		return "This sign in method is not available."
+	case errors.Is(err, e.InvalidFederationState):
+		return "The sign in attempt has expired, please try again."
+	case errors.Is(err, e.UpstreamLoginFailed):
+		return "The identity provider did not complete the sign in."
+	case errors.Is(err, e.InvalidIDToken), errors.Is(err, e.InvalidSAMLResponse):
+		return "The identity provider response could not be verified."
+	case errors.Is(err, e.EmailNotVerified):
+		return "Your email address is not verified by the identity provider."
+	case errors.Is(err, e.IdentityAlreadyLinked):
+		return "This account of the identity provider is already linked to an account."
+	default:
+		return authFailureMessage(err)
+	}
+}
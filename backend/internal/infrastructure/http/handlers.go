@@ -2,14 +2,16 @@ package http
 
 import (
 	"sso/internal/core"
-	"github.com/golang-jwt/jwt/v5"
+	e "sso/internal/core/errors"
 	"github.com/labstack/echo/v4"
 
+	"encoding/json"
 	"errors"
 	"net/http"
+	"net/url"
 )
 
-func loginHandler(loginUC *core.LoginUseCase) echo.HandlerFunc {
+func loginHandler(loginUC *core.LoginUseCase, cookies sessionCookies) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		ctx := c.Request().Context()
 		params := c.QueryParams()
@@ -29,6 +31,7 @@ func loginHandler(loginUC *core.LoginUseCase) echo.HandlerFunc {
 			request := map[string]string{
 				"email": "",
 				"password": "",
+				"link_token": "",
 			}
 			if err := c.Bind(&request); err != nil {
 				return err
@@ -38,9 +41,55 @@ func loginHandler(loginUC *core.LoginUseCase) echo.HandlerFunc {
 				Provider: "email",
 				Email: request["email"],
 				Password: request["password"],
+				LinkToken: request["link_token"],
+			}
+		case "ldap":
+			request := map[string]string{
+				"username": "",
+				"password": "",
+			}
+			if err := c.Bind(&request); err != nil {
+				return err
+			}
+
+			input = core.LoginInput{
+				Provider: "ldap",
+				Username: request["username"],
+				Password: request["password"],
+			}
+		case "email_otp":
+			request := map[string]string{
+				"email": "",
+				"code": "",
+				"token": "",
+			}
+			if err := c.Bind(&request); err != nil {
+				return err
+			}
+
+			input = core.LoginInput{
+				Provider: "email_otp",
+				Email: request["email"],
+				Code: request["code"],
+				EmailToken: request["token"],
+			}
+		case "webauthn":
+			var request struct {
+				Credential json.RawMessage `json:"credential"`
+			}
+			if err := c.Bind(&request); err != nil {
+				return err
+			}
+
+			input = core.LoginInput{
+				Provider: "webauthn",
+				WebAuthn: request.Credential,
 			}
 		case "oauth":
-			idToken := c.Get("id_token").(map[string]string)
+			idToken, ok := c.Get("id_token").(map[string]string)
+			if !ok {
+				return e.InvalidIDToken
+			}
 
 			input = core.LoginInput{
 				Provider: "oauth",
@@ -51,18 +100,33 @@ func loginHandler(loginUC *core.LoginUseCase) echo.HandlerFunc {
 			}
 		}
 
-		token, err := loginUC.Execute(ctx, input)
+		input.ClientID = c.QueryParam("client_id")
+		input.RememberMe = c.QueryParam("remember_me") == "true"
+		input.IP = c.RealIP()
+		input.UserAgent = c.Request().UserAgent()
+
+		token, session, err := loginUC.Execute(ctx, input)
 		if err != nil {
 			return err
 		}
 
+		if wantsJSON(c) {
+			return c.JSON(http.StatusOK, map[string]any{
+				"sso_session_token": token,
+				"expires_at": session.ExpiresAt,
+			})
+		}
+
+		cookies.set(c, token, session.ExpiresAt)
+
 		return c.JSON(http.StatusOK, map[string]any{
-			"sso_session_token": token,
+			"session_id": session.ID,
+			"expires_at": session.ExpiresAt,
 		})
 	}
 }
 
-func registerHandler(registerUC *core.RegisterUseCase) echo.HandlerFunc {
+func registerHandler(registerUC *core.RegisterUseCase, cookies sessionCookies) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		ctx := c.Request().Context()
 		params := c.QueryParams()
@@ -97,7 +161,10 @@ func registerHandler(registerUC *core.RegisterUseCase) echo.HandlerFunc {
 			}
 
 		case "oauth":
-			idToken := c.Get("id_token").(map[string]string)
+			idToken, ok := c.Get("id_token").(map[string]string)
+			if !ok {
+				return e.InvalidIDToken
+			}
 
 			input = core.RegisterInput{
 				Provider: "oauth",
@@ -108,17 +175,63 @@ func registerHandler(registerUC *core.RegisterUseCase) echo.HandlerFunc {
 			}
 		}
 
-		token, err := registerUC.Execute(ctx, input)
+		input.ClientID = c.QueryParam("client_id")
+		input.RememberMe = c.QueryParam("remember_me") == "true"
+		input.IP = c.RealIP()
+		input.UserAgent = c.Request().UserAgent()
+
+		token, session, err := registerUC.Execute(ctx, input)
 		if err != nil {
 			return err
 		}
 
+		if wantsJSON(c) {
+			return c.JSON(http.StatusOK, map[string]any{
+				"sso_session_token": token,
+				"expires_at": session.ExpiresAt,
+			})
+		}
+
+		cookies.set(c, token, session.ExpiresAt)
+
 		return c.JSON(http.StatusOK, map[string]any{
-			"sso_session_token": token,
+			"session_id": session.ID,
+			"expires_at": session.ExpiresAt,
 		})
 	}
 }
 
+// idTokenMiddleware verifies the upstream id token of provider=oauth requests and exposes its claims as "id_token"
+func idTokenMiddleware(verifier core.IIDTokenVerifier) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if c.QueryParam("provider") != "oauth" {
+				return next(c)
+			}
+
+			if verifier == nil {
+				return e.InvalidAuthProvider
+			}
+
+			request := map[string]string{
+				"id_token": "",
+			}
+			if err := c.Bind(&request); err != nil {
+				return err
+			}
+
+			claims, err := verifier.Verify(c.Request().Context(), request["id_token"])
+			if err != nil {
+				return err
+			}
+
+			c.Set("id_token", claims)
+
+			return next(c)
+		}
+	}
+}
+
 func oauthHandler(oauthWorkflow *core.OAuthWorkflow) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		ctx := c.Request().Context()
@@ -126,25 +239,48 @@ func oauthHandler(oauthWorkflow *core.OAuthWorkflow) echo.HandlerFunc {
 		request := map[string]string{
 			"client_id": "",
 			"redirect_uri": "",
+			"state": "",
+			"prompt": "",
+			"max_age": "",
+			"login_hint": "",
 		}
 
 		if err := c.Bind(&request); err != nil {
 			return err
 		}
 
-		token, ok := c.Get("sso_session_token").(*jwt.Token)
-		if !ok {
+		session, _ := currentSession(c)
+
+		input := core.AuthorizeInput{
+			ClientID: request["client_id"],
+			RedirectURI: request["redirect_uri"],
+			State: request["state"],
+			Prompt: request["prompt"],
+			MaxAge: request["max_age"],
+			LoginHint: request["login_hint"],
+		}
+
+		redirectURI, err := oauthWorkflow.Authorize(ctx, session, input)
+
+		interaction := errors.Is(err, e.LoginRequired) || errors.Is(err, e.AccountSelectionRequired) || errors.Is(err, e.ConsentRequired)
+		if interaction && wantsJSON(c) {
 			return c.JSON(http.StatusUnauthorized, map[string]any{
-				"error": "unauthorized",
+				"error": core.AuthorizeErrorCode(err),
+				"login_hint": request["login_hint"],
 			})
 		}
+		if interaction {
+			returnTo := authorizeReturnTo(input)
 
-		userID, err := token.Claims.GetSubject()
-		if err != nil {
-			return err
-		}
+			if errors.Is(err, e.ConsentRequired) {
+				return c.Redirect(http.StatusSeeOther, "/consent?" + url.Values{"return_to": {returnTo}}.Encode())
+			}
 
-		redirectURI, err := oauthWorkflow.Execute(ctx, userID, request["client_id"], request["redirect_uri"])
+			return c.Redirect(http.StatusSeeOther, loginRedirect(returnTo, input.ClientID, input.LoginHint))
+		}
+		if errors.Is(err, e.EmailNotVerified) && !wantsJSON(c) {
+			return renderError(c, http.StatusForbidden, authFailureMessage(err))
+		}
 		if err != nil {
 			return err
 		}
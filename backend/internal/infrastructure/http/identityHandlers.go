@@ -0,0 +1,128 @@
+package http
+
+import (
+	"sso/internal/core"
+	e "sso/internal/core/errors"
+	"github.com/labstack/echo/v4"
+
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+func listIdentitiesHandler(identityUC *core.IdentityUseCase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		session, ok := currentSession(c)
+		if !ok {
+			return c.JSON(http.StatusUnauthorized, map[string]any{
+				"error": "unauthorized",
+			})
+		}
+
+		identities, err := identityUC.List(ctx, session.UserID)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, map[string]any{
+			"identities": identities,
+		})
+	}
+}
+
+// linkIdentityHandler starts a federated flow that links the provider to the signed in user.
+// The browser has to be sent to redirect_url, the callback returns it to return_to
+func linkIdentityHandler(federatedUC *core.FederatedLoginUseCase, cookies sessionCookies) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		session, ok := currentSession(c)
+		if !ok {
+			return c.JSON(http.StatusUnauthorized, map[string]any{
+				"error": "unauthorized",
+			})
+		}
+
+		var body struct {
+			ReturnTo string `json:"return_to" form:"return_to" query:"return_to"`
+		}
+		if err := c.Bind(&body); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]any{
+				"error": "invalid body",
+			})
+		}
+
+		redirectURL, stateID, err := federatedUC.Start(ctx, core.FederatedStartInput{
+			Provider: c.Param("provider"),
+			ReturnTo: safeReturnTo(body.ReturnTo),
+			LinkUserID: session.UserID,
+		})
+		if err != nil {
+			return err
+		}
+
+		setFederationStateCookie(c, cookies, stateID)
+
+		return c.JSON(http.StatusOK, map[string]any{
+			"redirect_url": redirectURL,
+		})
+	}
+}
+
+func unlinkIdentityHandler(identityUC *core.IdentityUseCase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		session, ok := currentSession(c)
+		if !ok {
+			return c.JSON(http.StatusUnauthorized, map[string]any{
+				"error": "unauthorized",
+			})
+		}
+
+		err := identityUC.Unlink(ctx, core.IdentityChangeInput{
+			UserID: session.UserID,
+			IP: c.RealIP(),
+			UserAgent: c.Request().UserAgent(),
+		}, c.Param("id"))
+		// the error handler answers a missing identity as a failed login
+		if errors.Is(err, e.IdentityNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]any{
+				"error": "identity not found",
+			})
+		}
+		if err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+func adminListAuditEventsHandler(auditUC *core.AuditUseCase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		limit := 100
+		if raw := c.QueryParam("limit"); raw != "" {
+			parsed, err := strconv.Atoi(raw)
+			if err != nil || parsed < 1 || parsed > 1000 {
+				return c.JSON(http.StatusBadRequest, map[string]any{
+					"error": "limit must be between 1 and 1000",
+				})
+			}
+			limit = parsed
+		}
+
+		events, err := auditUC.List(ctx, c.Param("user_id"), limit)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, map[string]any{
+			"events": events,
+		})
+	}
+}
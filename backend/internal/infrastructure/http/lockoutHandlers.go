@@ -0,0 +1,26 @@
+package http
+
+import (
+	"sso/internal/core"
+	"github.com/labstack/echo/v4"
+
+	"net/http"
+)
+
+// adminUnlockHandler lifts the lockout of an account before it runs out
+func adminUnlockHandler(lockoutUC *core.LockoutUseCase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		err := lockoutUC.Unlock(ctx, core.UnlockInput{
+			UserID: c.Param("user_id"),
+			IP: c.RealIP(),
+			UserAgent: c.Request().UserAgent(),
+		})
+		if err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,228 @@
+package http
+
+import (
+	"sso/internal/core"
+	"github.com/labstack/echo/v4"
+
+	"encoding/json"
+	"net/http"
+)
+
+type secondFactorRequest struct {
+	MFAToken string `json:"mfa_token" form:"mfa_token"`
+	Code string `json:"code" form:"code"`
+	RecoveryCode string `json:"recovery_code" form:"recovery_code"`
+	// WebAuthn is the assertion of a passkey in its JSON form
+	WebAuthn json.RawMessage `json:"webauthn"`
+}
+
+func (r secondFactorRequest) proof() core.SecondFactorInput {
+	return core.SecondFactorInput{
+		Code: r.Code,
+		RecoveryCode: r.RecoveryCode,
+		WebAuthn: r.WebAuthn,
+	}
+}
+
+// mfaVerifyHandler finishes a login that answered with a mfa_token, the session is handed out like a login does
+func mfaVerifyHandler(mfaUC *core.MFAUseCase, cookies sessionCookies) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		var request secondFactorRequest
+		if err := c.Bind(&request); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]any{
+				"error": "invalid body",
+			})
+		}
+
+		token, session, err := mfaUC.Verify(ctx, request.MFAToken, request.proof())
+		if err != nil {
+			return err
+		}
+
+		if wantsJSON(c) {
+			return c.JSON(http.StatusOK, map[string]any{
+				"sso_session_token": token,
+				"expires_at": session.ExpiresAt,
+			})
+		}
+
+		cookies.set(c, token, session.ExpiresAt)
+
+		return c.JSON(http.StatusOK, map[string]any{
+			"session_id": session.ID,
+			"expires_at": session.ExpiresAt,
+		})
+	}
+}
+
+func mfaStatusHandler(mfaUC *core.MFAUseCase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		session, ok := currentSession(c)
+		if !ok {
+			return c.JSON(http.StatusUnauthorized, map[string]any{
+				"error": "unauthorized",
+			})
+		}
+
+		status, err := mfaUC.Status(ctx, session.UserID)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, status)
+	}
+}
+
+// startTOTPHandler returns the secret and the otpauth uri to show as a QR code, enrollment is
+// finished by confirming a first code
+func startTOTPHandler(mfaUC *core.MFAUseCase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		session, ok := currentSession(c)
+		if !ok {
+			return c.JSON(http.StatusUnauthorized, map[string]any{
+				"error": "unauthorized",
+			})
+		}
+
+		enrollment, err := mfaUC.StartTOTP(ctx, session.UserID)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, enrollment)
+	}
+}
+
+func confirmTOTPHandler(mfaUC *core.MFAUseCase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		session, ok := currentSession(c)
+		if !ok {
+			return c.JSON(http.StatusUnauthorized, map[string]any{
+				"error": "unauthorized",
+			})
+		}
+
+		var request secondFactorRequest
+		if err := c.Bind(&request); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]any{
+				"error": "invalid body",
+			})
+		}
+
+		codes, err := mfaUC.ConfirmTOTP(ctx, identityChange(c, session), request.Code)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, map[string]any{
+			"recovery_codes": codes,
+		})
+	}
+}
+
+func disableTOTPHandler(mfaUC *core.MFAUseCase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		session, ok := currentSession(c)
+		if !ok {
+			return c.JSON(http.StatusUnauthorized, map[string]any{
+				"error": "unauthorized",
+			})
+		}
+
+		var request secondFactorRequest
+		if err := c.Bind(&request); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]any{
+				"error": "invalid body",
+			})
+		}
+
+		if err := mfaUC.DisableTOTP(ctx, identityChange(c, session), request.proof()); err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+func regenerateRecoveryCodesHandler(mfaUC *core.MFAUseCase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		session, ok := currentSession(c)
+		if !ok {
+			return c.JSON(http.StatusUnauthorized, map[string]any{
+				"error": "unauthorized",
+			})
+		}
+
+		var request secondFactorRequest
+		if err := c.Bind(&request); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]any{
+				"error": "invalid body",
+			})
+		}
+
+		codes, err := mfaUC.RegenerateRecoveryCodes(ctx, identityChange(c, session), request.proof())
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, map[string]any{
+			"recovery_codes": codes,
+		})
+	}
+}
+
+func identityChange(c echo.Context, session *core.Session) core.IdentityChangeInput {
+	return core.IdentityChangeInput{
+		UserID: session.UserID,
+		IP: c.RealIP(),
+		UserAgent: c.Request().UserAgent(),
+	}
+}
+
+// mfaSubmit is the second step of the login page, a wrong code shows the form again until
+// the login runs out of attempts
+func mfaSubmit(mfaUC *core.MFAUseCase, cookies sessionCookies) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		data := page{
+			Title: "Two-factor authentication",
+			ReturnTo: safeReturnTo(c.FormValue("return_to")),
+			MFAToken: c.FormValue("mfa_token"),
+		}
+
+		token, session, err := mfaUC.Verify(ctx, data.MFAToken, core.SecondFactorInput{
+			Code: c.FormValue("code"),
+			RecoveryCode: c.FormValue("recovery_code"),
+		})
+		if err != nil {
+			data.Error = authFailureMessage(err)
+			return render(c, http.StatusUnauthorized, "mfa", data)
+		}
+
+		cookies.set(c, token, session.ExpiresAt)
+
+		return c.Redirect(http.StatusSeeOther, data.ReturnTo)
+	}
+}
+
+// mfaPage asks for the second factor of a login that passed the first one
+func mfaPage(c echo.Context, mfaErr *core.MFARequiredError, returnTo string) error {
+	return render(c, http.StatusOK, "mfa", page{
+		Title: "Two-factor authentication",
+		ReturnTo: safeReturnTo(returnTo),
+		MFAToken: mfaErr.MFAToken,
+	})
+}
@@ -0,0 +1,380 @@
+package http
+
+import (
+	"sso/internal/core"
+	e "sso/internal/core/errors"
+	"github.com/labstack/echo/v4"
+
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type page struct {
+	Title string
+	Error string
+	Message string
+	CSRF string
+
+	ReturnTo string
+	ClientID string
+	Email string
+	Name string
+	LinkToken string
+	LinkProvider string
+	// MFAToken carries a login that passed the first factor to the second step
+	MFAToken string
+	// EmailToken is the token of the magic link the page was opened with
+	EmailToken string
+	// EmailOTP offers the login by mailed code
+	EmailOTP bool
+
+	User *core.User
+	Client *core.Client
+	Providers []core.FederatedProviderInfo
+	SAML *core.SAMLResult
+	// Resubmit marks a saml response posted again to the callback of the sso
+	Resubmit bool
+}
+
+func render(c echo.Context, status int, name string, data page) error {
+	data.CSRF, _ = c.Get("csrf").(string)
+
+	return c.Render(status, name, data)
+}
+
+func renderError(c echo.Context, status int, msg string) error {
+	return render(c, status, "error", page{
+		Title: "Something went wrong",
+		Message: msg,
+	})
+}
+
+// safeReturnTo only lets the pages redirect inside this server
+func safeReturnTo(returnTo string) string {
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") || strings.HasPrefix(returnTo, "/\\") {
+		return "/"
+	}
+
+	return returnTo
+}
+
+// sessionUser loads the user of the current session for display, nil when signed out
+func sessionUser(c echo.Context, userUC *core.UserUseCase) (*core.User, error) {
+	session, ok := currentSession(c)
+	if !ok {
+		return nil, nil
+	}
+
+	return userUC.Get(c.Request().Context(), session.UserID, "")
+}
+
+func loginRedirect(returnTo, clientID, loginHint string) string {
+	return "/login?" + url.Values{
+		"return_to": {returnTo},
+		"client_id": {clientID},
+		"login_hint": {loginHint},
+	}.Encode()
+}
+
+// authorizeReturnTo rebuilds the authorize request as a GET url the pages send the user back to.
+// prompt and max_age are dropped, by the time the user comes back they have been satisfied
+func authorizeReturnTo(input core.AuthorizeInput) string {
+	params := url.Values{
+		"client_id": {input.ClientID},
+		"redirect_uri": {input.RedirectURI},
+	}
+	if input.State != "" {
+		params.Set("state", input.State)
+	}
+
+	return "/auth/token?" + params.Encode()
+}
+
+func authFailureMessage(err error) string {
+	var policyErr *core.PasswordPolicyError
+	if errors.As(err, &policyErr) {
+		messages := make([]string, 0, len(policyErr.Violations))
+		for _, v := range policyErr.Violations {
+			messages = append(messages, v.Message)
+		}
+
+		return "Please choose another password. " + strings.Join(messages, " ")
+	}
+
+	switch {
+	case errors.Is(err, e.InvalidCredentials), errors.Is(err, e.IdentityNotFound), errors.Is(err, e.CredentialNotFound):
+		return "Invalid email or password."
+	case errors.Is(err, e.UserCannotBeLoggedIn):
+		return "This account is disabled."
+	case errors.Is(err, e.LoginLocked):
+		return "Too many failed sign in attempts, please try again later."
+	case errors.Is(err, e.RateLimited):
+		return "Too many requests, please try again later."
+	case errors.Is(err, e.UniqueViolated):
+		return "An account with this email already exists."
+	case errors.Is(err, e.InvalidNameOrEmail):
+		return "Please enter a valid name and email."
+	case errors.Is(err, e.ClientNotFound):
+		return "The application you are signing in to is unknown."
+	case errors.Is(err, e.InvalidLinkToken):
+		return "The account link has expired, please sign in with the identity provider again."
+	case errors.Is(err, e.InvalidMFACode):
+		return "The code is not valid."
+	case errors.Is(err, e.InvalidMFAToken):
+		return "The sign in attempt has expired, please start over."
+	case errors.Is(err, e.InvalidEmailOTP):
+		return "The code or link is not valid or has expired."
+	case errors.Is(err, e.TooManyEmails):
+		return "Too many codes were sent to this address, please try again later."
+	case errors.Is(err, e.InvalidResetToken):
+		return "The reset link is not valid or has expired, please ask for a new one."
+	case errors.Is(err, e.InvalidPassword):
+		return "Please choose a password."
+	case errors.Is(err, e.InvalidVerificationToken):
+		return "The verification link is not valid or has expired, please ask for a new one."
+	case errors.Is(err, e.EmailNotVerified):
+		return "This application requires a verified email address. Please open the link we mailed you first."
+	default:
+		return "Something went wrong, please try again."
+	}
+}
+
+func linkMessage(providers []core.FederatedProviderInfo, name string) string {
+	displayName := name
+	for _, provider := range providers {
+		if provider.Name == name {
+			displayName = provider.DisplayName
+		}
+	}
+
+	return "An account with this email already exists. Sign in with your password to link your " + displayName + " account to it."
+}
+
+func indexPage(userUC *core.UserUseCase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, err := sessionUser(c, userUC)
+		if err != nil {
+			return renderError(c, http.StatusInternalServerError, authFailureMessage(err))
+		}
+
+		title := "Signed out"
+		if user != nil {
+			title = "Your account"
+		}
+
+		return render(c, http.StatusOK, "logout", page{
+			Title: title,
+			User: user,
+		})
+	}
+}
+
+func loginPage(userUC *core.UserUseCase, federatedUC *core.FederatedLoginUseCase, emailOTP bool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, err := sessionUser(c, userUC)
+		if err != nil {
+			return renderError(c, http.StatusInternalServerError, authFailureMessage(err))
+		}
+
+		data := page{
+			Title: "Sign in",
+			ReturnTo: safeReturnTo(c.QueryParam("return_to")),
+			ClientID: c.QueryParam("client_id"),
+			Email: c.QueryParam("login_hint"),
+			LinkToken: c.QueryParam("link_token"),
+			LinkProvider: c.QueryParam("link_provider"),
+			User: user,
+			Providers: federatedUC.Providers(),
+			EmailOTP: emailOTP,
+		}
+
+		if data.LinkToken != "" {
+			data.Message = linkMessage(data.Providers, data.LinkProvider)
+		}
+
+		return render(c, http.StatusOK, "login", data)
+	}
+}
+
+func loginSubmit(loginUC *core.LoginUseCase, federatedUC *core.FederatedLoginUseCase, cookies sessionCookies, emailOTP bool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		data := page{
+			Title: "Sign in",
+			ReturnTo: safeReturnTo(c.FormValue("return_to")),
+			ClientID: c.FormValue("client_id"),
+			Email: c.FormValue("email"),
+			LinkToken: c.FormValue("link_token"),
+			LinkProvider: c.FormValue("link_provider"),
+			EmailOTP: emailOTP,
+		}
+
+		token, session, err := loginUC.Execute(ctx, core.LoginInput{
+			Provider: "email",
+			Email: data.Email,
+			Password: c.FormValue("password"),
+			LinkToken: data.LinkToken,
+			ClientID: data.ClientID,
+			RememberMe: c.FormValue("remember_me") == "true",
+			IP: c.RealIP(),
+			UserAgent: c.Request().UserAgent(),
+		})
+		var mfaErr *core.MFARequiredError
+		if errors.As(err, &mfaErr) {
+			return mfaPage(c, mfaErr, data.ReturnTo)
+		}
+		if err != nil {
+			data.Error = authFailureMessage(err)
+			data.Providers = federatedUC.Providers()
+			if data.LinkToken != "" {
+				data.Message = linkMessage(data.Providers, data.LinkProvider)
+			}
+			return render(c, http.StatusUnauthorized, "login", data)
+		}
+
+		cookies.set(c, token, session.ExpiresAt)
+
+		return c.Redirect(http.StatusSeeOther, data.ReturnTo)
+	}
+}
+
+func registerPage() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return render(c, http.StatusOK, "register", page{
+			Title: "Create account",
+			ReturnTo: safeReturnTo(c.QueryParam("return_to")),
+			ClientID: c.QueryParam("client_id"),
+		})
+	}
+}
+
+func registerSubmit(registerUC *core.RegisterUseCase, cookies sessionCookies) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		data := page{
+			Title: "Create account",
+			ReturnTo: safeReturnTo(c.FormValue("return_to")),
+			ClientID: c.FormValue("client_id"),
+			Email: c.FormValue("email"),
+			Name: c.FormValue("name"),
+		}
+
+		token, session, err := registerUC.Execute(ctx, core.RegisterInput{
+			Provider: "email",
+			Name: data.Name,
+			Email: data.Email,
+			Password: c.FormValue("password"),
+			ClientID: data.ClientID,
+			IP: c.RealIP(),
+			UserAgent: c.Request().UserAgent(),
+		})
+		if err != nil {
+			data.Error = authFailureMessage(err)
+			return render(c, http.StatusBadRequest, "register", data)
+		}
+
+		cookies.set(c, token, session.ExpiresAt)
+
+		return c.Redirect(http.StatusSeeOther, data.ReturnTo)
+	}
+}
+
+// consentRequest reads the authorize parameters back out of the return_to url
+func consentRequest(returnTo string) (core.AuthorizeInput, bool) {
+	u, err := url.Parse(returnTo)
+	if err != nil || u.Path != "/auth/token" {
+		return core.AuthorizeInput{}, false
+	}
+
+	query := u.Query()
+
+	return core.AuthorizeInput{
+		ClientID: query.Get("client_id"),
+		RedirectURI: query.Get("redirect_uri"),
+		State: query.Get("state"),
+	}, true
+}
+
+func consentPage(oauthWorkflow *core.OAuthWorkflow, userUC *core.UserUseCase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		returnTo := safeReturnTo(c.QueryParam("return_to"))
+		input, ok := consentRequest(returnTo)
+		if !ok {
+			return renderError(c, http.StatusBadRequest, "The authorization request is invalid.")
+		}
+
+		user, err := sessionUser(c, userUC)
+		if err != nil {
+			return renderError(c, http.StatusInternalServerError, authFailureMessage(err))
+		}
+		if user == nil {
+			return c.Redirect(http.StatusSeeOther, loginRedirect(c.Request().RequestURI, input.ClientID, ""))
+		}
+
+		client, err := oauthWorkflow.Client(ctx, input.ClientID, input.RedirectURI)
+		if err != nil {
+			return renderError(c, http.StatusBadRequest, authFailureMessage(err))
+		}
+
+		return render(c, http.StatusOK, "consent", page{
+			Title: "Authorize " + client.Name,
+			ReturnTo: returnTo,
+			User: user,
+			Client: client,
+		})
+	}
+}
+
+func consentSubmit(oauthWorkflow *core.OAuthWorkflow) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		returnTo := safeReturnTo(c.FormValue("return_to"))
+		input, ok := consentRequest(returnTo)
+		if !ok {
+			return renderError(c, http.StatusBadRequest, "The authorization request is invalid.")
+		}
+
+		session, ok := currentSession(c)
+		if !ok {
+			return c.Redirect(http.StatusSeeOther, loginRedirect(returnTo, input.ClientID, ""))
+		}
+
+		if c.FormValue("decision") != "allow" {
+			redirectURI, err := oauthWorkflow.DenyConsent(ctx, input)
+			if err != nil {
+				return renderError(c, http.StatusBadRequest, authFailureMessage(err))
+			}
+
+			return c.Redirect(http.StatusSeeOther, redirectURI)
+		}
+
+		if err := oauthWorkflow.GrantConsent(ctx, session.UserID, input); err != nil {
+			return renderError(c, http.StatusBadRequest, authFailureMessage(err))
+		}
+
+		return c.Redirect(http.StatusSeeOther, returnTo)
+	}
+}
+
+func logoutSubmit(sessionUC *core.SessionUseCase, cookies sessionCookies) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		if session, ok := currentSession(c); ok {
+			if err := sessionUC.Revoke(ctx, session.UserID, session.ID); err != nil {
+				return renderError(c, http.StatusInternalServerError, authFailureMessage(err))
+			}
+		}
+
+		cookies.clear(c)
+
+		return c.Redirect(http.StatusSeeOther, "/logout")
+	}
+}
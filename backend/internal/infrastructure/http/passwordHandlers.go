@@ -0,0 +1,177 @@
+package http
+
+import (
+	"sso/internal/core"
+	e "sso/internal/core/errors"
+	"github.com/labstack/echo/v4"
+
+	"errors"
+	"net/http"
+)
+
+// forgotPasswordHandler mails a reset link, the answer does not tell whether the address has an account
+func forgotPasswordHandler(passwordUC *core.PasswordUseCase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		request := map[string]string{
+			"email": "",
+		}
+		if err := c.Bind(&request); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]any{
+				"error": "invalid body",
+			})
+		}
+
+		err := passwordUC.Forgot(ctx, core.PasswordForgotInput{
+			Email: request["email"],
+			IP: c.RealIP(),
+			UserAgent: c.Request().UserAgent(),
+		})
+		if err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusAccepted)
+	}
+}
+
+func resetPasswordHandler(passwordUC *core.PasswordUseCase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		request := map[string]string{
+			"token": "",
+			"password": "",
+		}
+		if err := c.Bind(&request); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]any{
+				"error": "invalid body",
+			})
+		}
+
+		err := passwordUC.Reset(ctx, core.PasswordResetInput{
+			Token: request["token"],
+			Password: request["password"],
+			IP: c.RealIP(),
+			UserAgent: c.Request().UserAgent(),
+		})
+		if err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+func forgotPasswordPage() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return render(c, http.StatusOK, "password_forgot", page{
+			Title: "Forgot your password?",
+			Email: c.QueryParam("login_hint"),
+		})
+	}
+}
+
+func forgotPasswordSubmit(passwordUC *core.PasswordUseCase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		data := page{
+			Title: "Forgot your password?",
+			Email: c.FormValue("email"),
+		}
+
+		err := passwordUC.Forgot(ctx, core.PasswordForgotInput{
+			Email: data.Email,
+			IP: c.RealIP(),
+			UserAgent: c.Request().UserAgent(),
+		})
+		if err != nil {
+			data.Error = authFailureMessage(err)
+			return render(c, http.StatusInternalServerError, "password_forgot", data)
+		}
+
+		data.Message = "If " + data.Email + " belongs to an account with a password, we sent it a link to reset the password."
+
+		return render(c, http.StatusOK, "password_forgot", data)
+	}
+}
+
+// resetPasswordPage is where reset links land, the token is only used once the new password is submitted
+func resetPasswordPage() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return render(c, http.StatusOK, "password_reset", page{
+			Title: "Choose a new password",
+			EmailToken: c.QueryParam("token"),
+		})
+	}
+}
+
+func resetPasswordSubmit(passwordUC *core.PasswordUseCase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		data := page{
+			Title: "Choose a new password",
+			EmailToken: c.FormValue("token"),
+		}
+
+		err := passwordUC.Reset(ctx, core.PasswordResetInput{
+			Token: data.EmailToken,
+			Password: c.FormValue("password"),
+			IP: c.RealIP(),
+			UserAgent: c.Request().UserAgent(),
+		})
+		if errors.Is(err, e.InvalidPassword) {
+			data.Error = authFailureMessage(err)
+			return render(c, http.StatusBadRequest, "password_reset", data)
+		}
+		if err != nil {
+			return renderError(c, http.StatusBadRequest, authFailureMessage(err))
+		}
+
+		data.Message = "Your password was changed and every session was signed out. You can now sign in with the new password."
+
+		return render(c, http.StatusOK, "password_reset", data)
+	}
+}
+
+func changePasswordHandler(passwordUC *core.PasswordUseCase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		session, ok := currentSession(c)
+		if !ok {
+			return c.JSON(http.StatusUnauthorized, map[string]any{
+				"error": "unauthorized",
+			})
+		}
+
+		var request struct {
+			CurrentPassword string `json:"current_password" form:"current_password"`
+			NewPassword string `json:"new_password" form:"new_password"`
+			SignOutOthers bool `json:"sign_out_others" form:"sign_out_others"`
+		}
+		if err := c.Bind(&request); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]any{
+				"error": "invalid body",
+			})
+		}
+
+		err := passwordUC.Change(ctx, core.PasswordChangeInput{
+			UserID: session.UserID,
+			SessionID: session.ID,
+			CurrentPassword: request.CurrentPassword,
+			NewPassword: request.NewPassword,
+			SignOutOthers: request.SignOutOthers,
+			IP: c.RealIP(),
+			UserAgent: c.Request().UserAgent(),
+		})
+		if err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,93 @@
+package http
+
+import (
+	"sso/internal/core"
+	"github.com/labstack/echo/v4"
+
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// rateLimitPeekSize bounds how much of a body is read for its client_id and account
+const rateLimitPeekSize = 64 << 10
+
+// rateLimitMiddleware takes a token per request from the buckets of its address, client_id and account,
+// the buckets are shared by every route it guards. Refused form posts of the pages get the error page
+func rateLimitMiddleware(rateLimitUC *core.RateLimitUseCase, pages bool) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		if rateLimitUC == nil {
+			return next
+		}
+
+		return func(c echo.Context) error {
+			ctx := c.Request().Context()
+
+			clientID, account := rateLimitSubjects(c)
+
+			err := rateLimitUC.Take(ctx, core.RateLimitInput{
+				IP: c.RealIP(),
+				ClientID: clientID,
+				Account: account,
+			})
+			var limitedErr *core.RateLimitedError
+			if pages && errors.As(err, &limitedErr) {
+				setRetryAfterHeader(c, limitedErr.RetryAfter)
+				return renderError(c, http.StatusTooManyRequests, authFailureMessage(err))
+			}
+			if err != nil {
+				return err
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// rateLimitSubjects finds the client_id and the account a request is made for in its query or body.
+// Forms are parsed once and kept by the request, a json body is put back for the handler
+func rateLimitSubjects(c echo.Context) (string, string) {
+	req := c.Request()
+
+	fields := map[string]string{}
+	switch contentType := req.Header.Get(echo.HeaderContentType); {
+	case strings.HasPrefix(contentType, echo.MIMEApplicationForm):
+		for _, name := range []string{"client_id", "email", "username"} {
+			fields[name] = c.FormValue(name)
+		}
+	case strings.HasPrefix(contentType, echo.MIMEApplicationJSON) && req.Body != nil:
+		peeked, err := io.ReadAll(io.LimitReader(req.Body, rateLimitPeekSize))
+		if err != nil {
+			break
+		}
+
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(peeked), req.Body), req.Body}
+
+		var body map[string]any
+		if json.Unmarshal(peeked, &body) == nil {
+			for name, value := range body {
+				if str, ok := value.(string); ok {
+					fields[name] = str
+				}
+			}
+		}
+	}
+
+	clientID := c.QueryParam("client_id")
+	if clientID == "" {
+		clientID = fields["client_id"]
+	}
+
+	account := fields["email"]
+	if account == "" {
+		account = fields["username"]
+	}
+
+	return clientID, account
+}
@@ -0,0 +1,67 @@
+package http
+
+import (
+	"github.com/labstack/echo/v4"
+
+	"embed"
+	"html/template"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+//go:embed templates/*.html
+var templatesFS embed.FS
+
+//go:embed static
+var staticFS embed.FS
+
+type templateRenderer struct {
+	templates *template.Template
+}
+
+// newTemplateRenderer parses the embedded pages, then any *.html files from overrideDir.
+// A file in overrideDir that redefines a block replaces the embedded one, so teams can
+// restyle single pages without copying the whole set
+func newTemplateRenderer(overrideDir string) (*templateRenderer, error) {
+	templates, err := template.ParseFS(templatesFS, "templates/*.html")
+	if err != nil {
+		return nil, err
+	}
+
+	if overrideDir != "" {
+		overrides, err := filepath.Glob(filepath.Join(overrideDir, "*.html"))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, path := range overrides {
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+
+			if _, err := templates.New(filepath.Base(path)).Parse(string(content)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &templateRenderer{
+		templates,
+	}, nil
+}
+
+func (r *templateRenderer) Render(w io.Writer, name string, data any, c echo.Context) error {
+	return r.templates.ExecuteTemplate(w, name, data)
+}
+
+func staticAssets() fs.FS {
+	assets, err := fs.Sub(staticFS, "static")
+	if err != nil {
+		panic(err)
+	}
+
+	return assets
+}
@@ -0,0 +1,82 @@
+package http
+
+import (
+	"sso/internal/core"
+	e "sso/internal/core/errors"
+	"github.com/labstack/echo/v4"
+
+	"errors"
+	"net/http"
+	"net/url"
+)
+
+func samlMetadataHandler(samlWorkflow *core.SAMLWorkflow) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		metadata, err := samlWorkflow.Metadata(ctx)
+		if err != nil {
+			return err
+		}
+
+		return c.Blob(http.StatusOK, "application/samlmetadata+xml", metadata)
+	}
+}
+
+// samlSSOHandler serves both bindings, the request comes in the query for HTTP-Redirect and in the form for HTTP-POST
+func samlSSOHandler(samlWorkflow *core.SAMLWorkflow) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		input := core.SAMLRequestInput{
+			SAMLRequest: c.FormValue("SAMLRequest"),
+			RelayState: c.FormValue("RelayState"),
+		}
+		if input.SAMLRequest == "" {
+			return renderError(c, http.StatusBadRequest, "The sign in request is missing.")
+		}
+
+		session, _ := currentSession(c)
+
+		// a cross site post does not carry the Lax session cookie, the same request
+		// is retried as a top level navigation that does
+		if session == nil && c.Request().Method == http.MethodPost {
+			return c.Redirect(http.StatusSeeOther, samlSSOURL(input))
+		}
+
+		result, err := samlWorkflow.SSO(ctx, session, input)
+		if errors.Is(err, e.LoginRequired) {
+			return c.Redirect(http.StatusSeeOther, loginRedirect(samlSSOURL(input), "", ""))
+		}
+		if err != nil {
+			return renderError(c, http.StatusBadRequest, samlFailureMessage(err))
+		}
+
+		c.Response().Header().Set("Cache-Control", "no-store")
+
+		return render(c, http.StatusOK, "saml_post", page{
+			Title: "Signing in",
+			SAML: result,
+		})
+	}
+}
+
+func samlSSOURL(input core.SAMLRequestInput) string {
+	query := url.Values{"SAMLRequest": {input.SAMLRequest}}
+	if input.RelayState != "" {
+		query.Set("RelayState", input.RelayState)
+	}
+
+	return "/saml/sso?" + query.Encode()
+}
+
+func samlFailureMessage(err error) string {
+	switch {
+	case errors.Is(err, e.InvalidSAMLRequest):
+		return "The sign in request of the application is invalid."
+	case errors.Is(err, e.ServiceProviderNotFound), errors.Is(err, e.RedirectURINotAllowed):
+		return "The application is not allowed to sign in with this server."
+	default:
+		return authFailureMessage(err)
+	}
+}
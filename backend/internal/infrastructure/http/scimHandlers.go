@@ -0,0 +1,583 @@
+package http
+
+import (
+	"sso/internal/core"
+	e "sso/internal/core/errors"
+	"github.com/labstack/echo/v4"
+
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	scimContentType = "application/scim+json"
+
+	scimUserSchema = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimListSchema = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimErrorSchema = "urn:ietf:params:scim:api:messages:2.0:Error"
+)
+
+type scimMeta struct {
+	ResourceType string `json:"resourceType"`
+	Created time.Time `json:"created"`
+	LastModified time.Time `json:"lastModified"`
+	Location string `json:"location"`
+	Version string `json:"version"`
+}
+
+type scimName struct {
+	Formatted string `json:"formatted,omitempty"`
+}
+
+type scimEmail struct {
+	Value string `json:"value"`
+	Type string `json:"type,omitempty"`
+	Primary bool `json:"primary,omitempty"`
+}
+
+type scimMember struct {
+	Value string `json:"value"`
+	Ref string `json:"$ref,omitempty"`
+}
+
+type scimUser struct {
+	Schemas []string `json:"schemas"`
+	ID string `json:"id,omitempty"`
+	ExternalID string `json:"externalId,omitempty"`
+	UserName string `json:"userName"`
+	DisplayName string `json:"displayName,omitempty"`
+	Name *scimName `json:"name,omitempty"`
+	Emails []scimEmail `json:"emails,omitempty"`
+	Active *bool `json:"active,omitempty"`
+	Meta *scimMeta `json:"meta,omitempty"`
+}
+
+type scimGroup struct {
+	Schemas []string `json:"schemas"`
+	ID string `json:"id,omitempty"`
+	ExternalID string `json:"externalId,omitempty"`
+	DisplayName string `json:"displayName"`
+	Members []scimMember `json:"members"`
+	Meta *scimMeta `json:"meta,omitempty"`
+}
+
+type scimList struct {
+	Schemas []string `json:"schemas"`
+	TotalResults int `json:"totalResults"`
+	ItemsPerPage int `json:"itemsPerPage"`
+	StartIndex int `json:"startIndex"`
+	Resources []any `json:"Resources"`
+}
+
+type scimPatch struct {
+	Schemas []string `json:"schemas"`
+	Operations []core.PatchOperation `json:"Operations"`
+}
+
+// scimAuthMiddleware lets provisioning clients in with the bearer token issued by the admin api
+func scimAuthMiddleware(scimUC *core.SCIMUseCase) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			ctx := c.Request().Context()
+
+			token, _ := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+
+			client, err := scimUC.Authenticate(ctx, token)
+			if errors.Is(err, e.InvalidSCIMToken) {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+				return scimError(c, http.StatusUnauthorized, "", "unauthorized")
+			}
+			if err != nil {
+				return err
+			}
+
+			c.Set("scim_client", client)
+
+			return next(c)
+		}
+	}
+}
+
+func scimCaller(c echo.Context) core.SCIMCaller {
+	caller := core.SCIMCaller{
+		IP: c.RealIP(),
+		UserAgent: c.Request().UserAgent(),
+	}
+
+	if client, ok := c.Get("scim_client").(*core.SCIMClient); ok {
+		caller.ClientID = client.ID
+	}
+
+	return caller
+}
+
+func scimServiceProviderConfigHandler() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return scimJSON(c, http.StatusOK, map[string]any{
+			"schemas": []string{"urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"},
+			"patch": map[string]any{"supported": true},
+			"bulk": map[string]any{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+			"filter": map[string]any{"supported": true, "maxResults": core.MaxSCIMPageSize},
+			"changePassword": map[string]any{"supported": false},
+			"sort": map[string]any{"supported": false},
+			"etag": map[string]any{"supported": true},
+			"authenticationSchemes": []map[string]any{
+				{
+					"type": "oauthbearertoken",
+					"name": "Bearer token",
+					"description": "A token issued to the provisioning client by the admin api",
+				},
+			},
+		})
+	}
+}
+
+func listSCIMUsersHandler(scimUC *core.SCIMUseCase, baseURL string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		query, startIndex, err := scimListQuery(c)
+		if err != nil {
+			return scimFailure(c, err)
+		}
+
+		users, total, err := scimUC.ListUsers(ctx, query)
+		if err != nil {
+			return scimFailure(c, err)
+		}
+
+		resources := []any{}
+		for _, user := range users {
+			resources = append(resources, toSCIMUser(&user, baseURL))
+		}
+
+		return scimJSON(c, http.StatusOK, scimList{
+			Schemas: []string{scimListSchema},
+			TotalResults: total,
+			ItemsPerPage: len(resources),
+			StartIndex: startIndex,
+			Resources: resources,
+		})
+	}
+}
+
+func getSCIMUserHandler(scimUC *core.SCIMUseCase, baseURL string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		user, err := scimUC.GetUser(ctx, c.Param("id"))
+		if err != nil {
+			return scimFailure(c, err)
+		}
+
+		return scimResource(c, http.StatusOK, user.Version, toSCIMUser(user, baseURL))
+	}
+}
+
+func createSCIMUserHandler(scimUC *core.SCIMUseCase, baseURL string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		var body scimUser
+		if err := decodeSCIM(c, &body); err != nil {
+			return scimError(c, http.StatusBadRequest, "invalidSyntax", "invalid body")
+		}
+
+		user, err := scimUC.CreateUser(ctx, scimCaller(c), body.attributes())
+		if err != nil {
+			return scimFailure(c, err)
+		}
+
+		resource := toSCIMUser(user, baseURL)
+		c.Response().Header().Set(echo.HeaderLocation, resource.Meta.Location)
+
+		return scimResource(c, http.StatusCreated, user.Version, resource)
+	}
+}
+
+func replaceSCIMUserHandler(scimUC *core.SCIMUseCase, baseURL string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		var body scimUser
+		if err := decodeSCIM(c, &body); err != nil {
+			return scimError(c, http.StatusBadRequest, "invalidSyntax", "invalid body")
+		}
+
+		user, err := scimUC.ReplaceUser(ctx, scimCaller(c), c.Param("id"), c.Request().Header.Get("If-Match"), body.attributes())
+		if err != nil {
+			return scimFailure(c, err)
+		}
+
+		return scimResource(c, http.StatusOK, user.Version, toSCIMUser(user, baseURL))
+	}
+}
+
+func patchSCIMUserHandler(scimUC *core.SCIMUseCase, baseURL string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		var body scimPatch
+		if err := decodeSCIM(c, &body); err != nil {
+			return scimError(c, http.StatusBadRequest, "invalidSyntax", "invalid body")
+		}
+
+		user, err := scimUC.PatchUser(ctx, scimCaller(c), c.Param("id"), c.Request().Header.Get("If-Match"), body.Operations)
+		if err != nil {
+			return scimFailure(c, err)
+		}
+
+		return scimResource(c, http.StatusOK, user.Version, toSCIMUser(user, baseURL))
+	}
+}
+
+func deleteSCIMUserHandler(scimUC *core.SCIMUseCase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		if err := scimUC.DeleteUser(ctx, scimCaller(c), c.Param("id"), c.Request().Header.Get("If-Match")); err != nil {
+			return scimFailure(c, err)
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+func listSCIMGroupsHandler(scimUC *core.SCIMUseCase, baseURL string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		query, startIndex, err := scimListQuery(c)
+		if err != nil {
+			return scimFailure(c, err)
+		}
+
+		groups, total, err := scimUC.ListGroups(ctx, query)
+		if err != nil {
+			return scimFailure(c, err)
+		}
+
+		resources := []any{}
+		for _, group := range groups {
+			resources = append(resources, toSCIMGroup(&group, baseURL))
+		}
+
+		return scimJSON(c, http.StatusOK, scimList{
+			Schemas: []string{scimListSchema},
+			TotalResults: total,
+			ItemsPerPage: len(resources),
+			StartIndex: startIndex,
+			Resources: resources,
+		})
+	}
+}
+
+func getSCIMGroupHandler(scimUC *core.SCIMUseCase, baseURL string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		group, err := scimUC.GetGroup(ctx, c.Param("id"))
+		if err != nil {
+			return scimFailure(c, err)
+		}
+
+		return scimResource(c, http.StatusOK, group.Version, toSCIMGroup(group, baseURL))
+	}
+}
+
+func createSCIMGroupHandler(scimUC *core.SCIMUseCase, baseURL string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		var body scimGroup
+		if err := decodeSCIM(c, &body); err != nil {
+			return scimError(c, http.StatusBadRequest, "invalidSyntax", "invalid body")
+		}
+
+		group, err := scimUC.CreateGroup(ctx, body.attributes())
+		if err != nil {
+			return scimFailure(c, err)
+		}
+
+		resource := toSCIMGroup(group, baseURL)
+		c.Response().Header().Set(echo.HeaderLocation, resource.Meta.Location)
+
+		return scimResource(c, http.StatusCreated, group.Version, resource)
+	}
+}
+
+func replaceSCIMGroupHandler(scimUC *core.SCIMUseCase, baseURL string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		var body scimGroup
+		if err := decodeSCIM(c, &body); err != nil {
+			return scimError(c, http.StatusBadRequest, "invalidSyntax", "invalid body")
+		}
+
+		group, err := scimUC.ReplaceGroup(ctx, c.Param("id"), c.Request().Header.Get("If-Match"), body.attributes())
+		if err != nil {
+			return scimFailure(c, err)
+		}
+
+		return scimResource(c, http.StatusOK, group.Version, toSCIMGroup(group, baseURL))
+	}
+}
+
+func patchSCIMGroupHandler(scimUC *core.SCIMUseCase, baseURL string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		var body scimPatch
+		if err := decodeSCIM(c, &body); err != nil {
+			return scimError(c, http.StatusBadRequest, "invalidSyntax", "invalid body")
+		}
+
+		group, err := scimUC.PatchGroup(ctx, c.Param("id"), c.Request().Header.Get("If-Match"), body.Operations)
+		if err != nil {
+			return scimFailure(c, err)
+		}
+
+		return scimResource(c, http.StatusOK, group.Version, toSCIMGroup(group, baseURL))
+	}
+}
+
+func deleteSCIMGroupHandler(scimUC *core.SCIMUseCase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		if err := scimUC.DeleteGroup(ctx, c.Param("id"), c.Request().Header.Get("If-Match")); err != nil {
+			return scimFailure(c, err)
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+func adminCreateSCIMClientHandler(scimUC *core.SCIMUseCase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		var body struct {
+			Name string `json:"name"`
+		}
+		if err := c.Bind(&body); err != nil || body.Name == "" {
+			return c.JSON(http.StatusBadRequest, map[string]any{
+				"error": "name is required",
+			})
+		}
+
+		client, token, err := scimUC.CreateClient(ctx, body.Name)
+		if err != nil {
+			return err
+		}
+
+		// the token is only stored hashed, this is the one chance to read it
+		return c.JSON(http.StatusCreated, map[string]any{
+			"client": client,
+			"token": token,
+		})
+	}
+}
+
+func adminListSCIMClientsHandler(scimUC *core.SCIMUseCase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		clients, err := scimUC.ListClients(ctx)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, map[string]any{
+			"clients": clients,
+		})
+	}
+}
+
+func adminRevokeSCIMClientHandler(scimUC *core.SCIMUseCase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		if err := scimUC.RevokeClient(ctx, c.Param("id")); err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// scimListQuery reads startIndex and count, out of range values are clamped as RFC 7644 asks
+func scimListQuery(c echo.Context) (core.ListQuery, int, error) {
+	startIndex := 1
+	if raw := c.QueryParam("startIndex"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil {
+			return core.ListQuery{}, 0, errors.Join(e.InvalidSCIMValue, errors.New("startIndex must be a number"))
+		}
+		startIndex = max(parsed, 1)
+	}
+
+	count := core.DefaultSCIMPageSize
+	if raw := c.QueryParam("count"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil {
+			return core.ListQuery{}, 0, errors.Join(e.InvalidSCIMValue, errors.New("count must be a number"))
+		}
+		count = min(max(parsed, 0), core.MaxSCIMPageSize)
+	}
+
+	return core.ListQuery{
+		Filter: c.QueryParam("filter"),
+		Offset: startIndex - 1,
+		Limit: count,
+	}, startIndex, nil
+}
+
+// attributes reads the user of a POST or PUT, a user is active unless active is false
+func (u scimUser) attributes() core.UserAttributes {
+	displayName := u.DisplayName
+	if displayName == "" && u.Name != nil {
+		displayName = u.Name.Formatted
+	}
+
+	return core.UserAttributes{
+		UserName: u.UserName,
+		DisplayName: displayName,
+		ExternalID: u.ExternalID,
+		Active: u.Active == nil || *u.Active,
+	}
+}
+
+func (g scimGroup) attributes() core.GroupAttributes {
+	members := []string{}
+	for _, member := range g.Members {
+		members = append(members, member.Value)
+	}
+
+	return core.GroupAttributes{
+		DisplayName: g.DisplayName,
+		ExternalID: g.ExternalID,
+		Members: members,
+	}
+}
+
+func toSCIMUser(user *core.User, baseURL string) scimUser {
+	active := user.Status == "active"
+
+	return scimUser{
+		Schemas: []string{scimUserSchema},
+		ID: user.ID,
+		ExternalID: user.ExternalID,
+		UserName: user.Email,
+		DisplayName: user.Name,
+		Name: &scimName{Formatted: user.Name},
+		Emails: []scimEmail{{Value: user.Email, Type: "work", Primary: true}},
+		Active: &active,
+		Meta: &scimMeta{
+			ResourceType: "User",
+			Created: user.CreatedAt,
+			LastModified: user.UpdatedAt,
+			Location: baseURL + "/Users/" + user.ID,
+			Version: core.ETag(user.Version),
+		},
+	}
+}
+
+func toSCIMGroup(group *core.Group, baseURL string) scimGroup {
+	members := []scimMember{}
+	for _, id := range group.Members {
+		members = append(members, scimMember{Value: id, Ref: baseURL + "/Users/" + id})
+	}
+
+	return scimGroup{
+		Schemas: []string{scimGroupSchema},
+		ID: group.ID,
+		ExternalID: group.ExternalID,
+		DisplayName: group.DisplayName,
+		Members: members,
+		Meta: &scimMeta{
+			ResourceType: "Group",
+			Created: group.CreatedAt,
+			LastModified: group.UpdatedAt,
+			Location: baseURL + "/Groups/" + group.ID,
+			Version: core.ETag(group.Version),
+		},
+	}
+}
+
+// decodeSCIM reads a json body, the echo binder refuses the application/scim+json content type
+func decodeSCIM(c echo.Context, v any) error {
+	return json.NewDecoder(c.Request().Body).Decode(v)
+}
+
+// scimResource answers with a single resource and its etag, a GET naming the current
+// version in If-None-Match gets 304 without a body
+func scimResource(c echo.Context, status, version int, resource any) error {
+	c.Response().Header().Set("ETag", core.ETag(version))
+
+	ifNoneMatch := c.Request().Header.Get("If-None-Match")
+	if c.Request().Method == http.MethodGet && ifNoneMatch != "" && core.MatchesETag(ifNoneMatch, version) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	return scimJSON(c, status, resource)
+}
+
+func scimJSON(c echo.Context, status int, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return c.Blob(status, scimContentType, body)
+}
+
+func scimError(c echo.Context, status int, scimType, detail string) error {
+	body := map[string]any{
+		"schemas": []string{scimErrorSchema},
+		"status": strconv.Itoa(status),
+		"detail": detail,
+	}
+	if scimType != "" {
+		body["scimType"] = scimType
+	}
+
+	return scimJSON(c, status, body)
+}
+
+// scimFailure answers the core errors in the SCIM error format, unexpected errors go to the error handler
+func scimFailure(c echo.Context, err error) error {
+	// joined errors carry the reason on the following lines
+	detail := strings.ReplaceAll(err.Error(), "\n", ": ")
+
+	switch {
+	case errors.Is(err, e.UserNotFound):
+		return scimError(c, http.StatusNotFound, "", "user not found")
+
+	case errors.Is(err, e.GroupNotFound):
+		return scimError(c, http.StatusNotFound, "", "group not found")
+
+	case errors.Is(err, e.InvalidFilter):
+		return scimError(c, http.StatusBadRequest, "invalidFilter", detail)
+
+	case errors.Is(err, e.InvalidPatch):
+		return scimError(c, http.StatusBadRequest, "invalidPath", detail)
+
+	case errors.Is(err, e.InvalidSCIMValue):
+		return scimError(c, http.StatusBadRequest, "invalidValue", detail)
+
+	case errors.Is(err, e.UniqueViolated):
+		return scimError(c, http.StatusConflict, "uniqueness", "a resource with this userName or displayName exists")
+
+	case errors.Is(err, e.VersionMismatch):
+		return scimError(c, http.StatusPreconditionFailed, "", "resource was modified, read it again")
+	}
+
+	return err
+}
@@ -7,29 +7,253 @@ import (
 	echojwt "github.com/labstack/echo-jwt/v4"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/golang-jwt/jwt/v5"
 	"go.uber.org/zap"
 
 	"context"
+	"crypto/subtle"
 	"errors"
 	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
-func SetupHandlers(conf *config.Config, e *echo.Echo, baseLogger *zap.Logger, userUC *core.UserUseCase, loginUC *core.LoginUseCase, registerUC *core.RegisterUseCase, oauthWorkflow *core.OAuthWorkflow, jwksUC *core.GetPublicKeysUseCase) {
-	tokenMiddleware := echojwt.WithConfig(echojwt.Config{
+func SetupHandlers(conf *config.Config, e *echo.Echo, baseLogger *zap.Logger, userUC *core.UserUseCase, loginUC *core.LoginUseCase, registerUC *core.RegisterUseCase, oauthWorkflow *core.OAuthWorkflow, jwksUC *core.GetPublicKeysUseCase, sessionUC *core.SessionUseCase, idTokenVerifier core.IIDTokenVerifier, federatedUC *core.FederatedLoginUseCase, identityUC *core.IdentityUseCase, auditUC *core.AuditUseCase, samlWorkflow *core.SAMLWorkflow, scimUC *core.SCIMUseCase, mfaUC *core.MFAUseCase, webauthnUC *core.WebAuthnUseCase, emailOTPUC *core.EmailOTPUseCase, passwordUC *core.PasswordUseCase, verificationUC *core.EmailVerificationUseCase, lockoutUC *core.LockoutUseCase, rateLimitUC *core.RateLimitUseCase) error {
+	tokenConfig := echojwt.Config{
 		SigningKey: []byte(conf.SigningKey),
-		TokenLookup: "cookie:sso_session_token",
+		TokenLookup: "cookie:" + sessionCookieName + ",header:Authorization:Bearer ",
 		ContextKey: "sso_session_token",
 		SigningMethod: conf.SigningMethod.Alg(),
-	})
+		NewClaimsFunc: func(c echo.Context) jwt.Claims {
+			return new(core.Claims)
+		},
+	}
+	tokenMiddleware := echojwt.WithConfig(tokenConfig)
+
+	// the authorize endpoint handles anonymous users itself
+	optionalTokenConfig := tokenConfig
+	optionalTokenConfig.ContinueOnIgnoredError = true
+	optionalTokenConfig.ErrorHandler = func(c echo.Context, err error) error {
+		return nil
+	}
+	optionalTokenMiddleware := echojwt.WithConfig(optionalTokenConfig)
+
+	cookies := newSessionCookies(conf)
 
 	initMiddleware(e, baseLogger)
 
+	// the endpoints credentials can be guessed at or users mailed from
+	rateLimit := rateLimitMiddleware(rateLimitUC, false)
+	pageRateLimit := rateLimitMiddleware(rateLimitUC, true)
+
 	auth := e.Group("/auth")
-	auth.POST("/login", loginHandler(loginUC))
-	auth.POST("/register", registerHandler(registerUC))
-	auth.POST("/token", oauthHandler(oauthWorkflow), tokenMiddleware)
+	auth.POST("/login", loginHandler(loginUC, cookies), rateLimit, idTokenMiddleware(idTokenVerifier))
+	auth.POST("/register", registerHandler(registerUC, cookies), rateLimit, idTokenMiddleware(idTokenVerifier))
+	auth.GET("/token", oauthHandler(oauthWorkflow), rateLimit, optionalTokenMiddleware, optionalSessionMiddleware(sessionUC))
+	auth.POST("/token", oauthHandler(oauthWorkflow), rateLimit, optionalTokenMiddleware, optionalSessionMiddleware(sessionUC))
+	auth.POST("/logout", logoutHandler(sessionUC, cookies), tokenMiddleware, sessionMiddleware(sessionUC))
+
+	auth.GET("/federated/:provider/start", federatedStartHandler(federatedUC, cookies))
+	// the session tells whether a link started by a signed in user is finished by the same user
+	auth.GET("/federated/:provider/callback", federatedCallbackHandler(federatedUC, cookies), optionalTokenMiddleware, optionalSessionMiddleware(sessionUC))
+	auth.POST("/federated/:provider/callback", federatedCallbackHandler(federatedUC, cookies), optionalTokenMiddleware, optionalSessionMiddleware(sessionUC))
+
+	sessions := auth.Group("/sessions", tokenMiddleware, sessionMiddleware(sessionUC))
+	sessions.GET("", listSessionsHandler(sessionUC))
+	sessions.DELETE("", revokeAllSessionsHandler(sessionUC, cookies))
+	sessions.DELETE("/:id", revokeSessionHandler(sessionUC))
+
+	auth.POST("/mfa/verify", mfaVerifyHandler(mfaUC, cookies), rateLimit)
+	auth.POST("/mfa/webauthn/options", mfaWebAuthnOptionsHandler(mfaUC), rateLimit)
+	mfa := auth.Group("/mfa", tokenMiddleware, sessionMiddleware(sessionUC))
+	mfa.GET("", mfaStatusHandler(mfaUC))
+	mfa.POST("/totp", startTOTPHandler(mfaUC))
+	mfa.POST("/totp/confirm", confirmTOTPHandler(mfaUC))
+	mfa.DELETE("/totp", disableTOTPHandler(mfaUC))
+	mfa.POST("/recovery-codes", regenerateRecoveryCodesHandler(mfaUC))
+
+	if emailOTPUC != nil {
+		auth.POST("/email-otp", sendEmailOTPHandler(emailOTPUC))
+	}
+
+	auth.POST("/password/forgot", forgotPasswordHandler(passwordUC), rateLimit)
+	auth.POST("/password/reset", resetPasswordHandler(passwordUC), rateLimit)
+	auth.POST("/password/change", changePasswordHandler(passwordUC), rateLimit, tokenMiddleware, sessionMiddleware(sessionUC))
+
+	auth.POST("/email/verify", verifyEmailHandler(verificationUC))
+	auth.POST("/email/verify/resend", resendVerificationHandler(verificationUC), tokenMiddleware, sessionMiddleware(sessionUC))
+
+	auth.POST("/webauthn/login/options", beginPasskeyLoginHandler(webauthnUC))
+	passkeys := auth.Group("/webauthn", tokenMiddleware, sessionMiddleware(sessionUC))
+	passkeys.POST("/register/options", beginPasskeyRegistrationHandler(webauthnUC))
+	passkeys.POST("/register", finishPasskeyRegistrationHandler(webauthnUC))
+	passkeys.GET("/credentials", listPasskeysHandler(webauthnUC))
+	passkeys.DELETE("/credentials/:id", removePasskeyHandler(webauthnUC))
+
+	identities := auth.Group("/identities", tokenMiddleware, sessionMiddleware(sessionUC))
+	identities.GET("", listIdentitiesHandler(identityUC))
+	identities.POST("/link/:provider", linkIdentityHandler(federatedUC, cookies))
+	identities.DELETE("/:id", unlinkIdentityHandler(identityUC))
+
+	renderer, err := newTemplateRenderer(conf.TemplatesDir)
+	if err != nil {
+		return err
+	}
+	e.Renderer = renderer
+
+	e.StaticFS("/static", staticAssets())
+
+	csrfMiddleware := middleware.CSRFWithConfig(middleware.CSRFConfig{
+		TokenLookup: "form:_csrf",
+		CookieName: "_csrf",
+		CookiePath: "/",
+		CookieDomain: conf.SessionCookieDomain,
+		CookieHTTPOnly: true,
+		CookieSecure: conf.SessionCookieSecure,
+		CookieSameSite: http.SameSiteStrictMode,
+	})
+
+	pages := e.Group("", csrfMiddleware, optionalTokenMiddleware, optionalSessionMiddleware(sessionUC))
+	pages.GET("/", indexPage(userUC))
+	pages.GET("/login", loginPage(userUC, federatedUC, emailOTPUC != nil))
+	pages.POST("/login", loginSubmit(loginUC, federatedUC, cookies, emailOTPUC != nil), pageRateLimit)
+	pages.POST("/login/mfa", mfaSubmit(mfaUC, cookies), pageRateLimit)
+	// logins by mailed code need a mailer
+	if emailOTPUC != nil {
+		pages.POST("/login/email/send", emailOTPSend(emailOTPUC))
+		pages.GET("/login/email", emailLinkPage())
+		pages.POST("/login/email", emailOTPSubmit(loginUC, cookies))
+	}
+	pages.GET("/password/forgot", forgotPasswordPage())
+	pages.POST("/password/forgot", forgotPasswordSubmit(passwordUC), pageRateLimit)
+	pages.GET("/password/reset", resetPasswordPage())
+	pages.POST("/password/reset", resetPasswordSubmit(passwordUC), pageRateLimit)
+	pages.GET("/verify-email", verifyEmailPage())
+	pages.POST("/verify-email", verifyEmailSubmit(verificationUC))
+	pages.GET("/register", registerPage())
+	pages.POST("/register", registerSubmit(registerUC, cookies), pageRateLimit)
+	pages.GET("/consent", consentPage(oauthWorkflow, userUC))
+	pages.POST("/consent", consentSubmit(oauthWorkflow))
+	pages.GET("/logout", indexPage(userUC))
+	pages.POST("/logout", logoutSubmit(sessionUC, cookies))
+
+	saml := e.Group("/saml")
+	saml.GET("/metadata", samlMetadataHandler(samlWorkflow))
+	saml.GET("/sso", samlSSOHandler(samlWorkflow), optionalTokenMiddleware, optionalSessionMiddleware(sessionUC))
+	saml.POST("/sso", samlSSOHandler(samlWorkflow), optionalTokenMiddleware, optionalSessionMiddleware(sessionUC))
+
+	scimBaseURL := conf.PublicURL + "/scim/v2"
+	scim := e.Group("/scim/v2", scimAuthMiddleware(scimUC))
+	scim.GET("/ServiceProviderConfig", scimServiceProviderConfigHandler())
+	scim.GET("/Users", listSCIMUsersHandler(scimUC, scimBaseURL))
+	scim.POST("/Users", createSCIMUserHandler(scimUC, scimBaseURL))
+	scim.GET("/Users/:id", getSCIMUserHandler(scimUC, scimBaseURL))
+	scim.PUT("/Users/:id", replaceSCIMUserHandler(scimUC, scimBaseURL))
+	scim.PATCH("/Users/:id", patchSCIMUserHandler(scimUC, scimBaseURL))
+	scim.DELETE("/Users/:id", deleteSCIMUserHandler(scimUC))
+	scim.GET("/Groups", listSCIMGroupsHandler(scimUC, scimBaseURL))
+	scim.POST("/Groups", createSCIMGroupHandler(scimUC, scimBaseURL))
+	scim.GET("/Groups/:id", getSCIMGroupHandler(scimUC, scimBaseURL))
+	scim.PUT("/Groups/:id", replaceSCIMGroupHandler(scimUC, scimBaseURL))
+	scim.PATCH("/Groups/:id", patchSCIMGroupHandler(scimUC, scimBaseURL))
+	scim.DELETE("/Groups/:id", deleteSCIMGroupHandler(scimUC))
+
+	admin := e.Group("/admin", adminMiddleware(conf.AdminAPIKey))
+	admin.GET("/users/:user_id/sessions", adminListSessionsHandler(sessionUC))
+	admin.DELETE("/users/:user_id/sessions", adminRevokeAllSessionsHandler(sessionUC))
+	admin.DELETE("/users/:user_id/sessions/:id", adminRevokeSessionHandler(sessionUC))
+	admin.GET("/users/:user_id/audit", adminListAuditEventsHandler(auditUC))
+	admin.POST("/users/:user_id/unlock", adminUnlockHandler(lockoutUC))
+	admin.GET("/scim/clients", adminListSCIMClientsHandler(scimUC))
+	admin.POST("/scim/clients", adminCreateSCIMClientHandler(scimUC))
+	admin.DELETE("/scim/clients/:id", adminRevokeSCIMClientHandler(scimUC))
 
 	e.GET("/.well-known/jwks.json", jwksHandler(jwksUC))
+
+	return nil
+}
+
+// sessionMiddleware checks that the session behind a valid sso session token has not been revoked
+func sessionMiddleware(sessionUC *core.SessionUseCase) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			session, err := loadSession(c, sessionUC)
+			if err != nil {
+				return err
+			}
+
+			if session == nil {
+				return echo.NewHTTPError(http.StatusUnauthorized, "session is revoked or expired")
+			}
+
+			c.Set("session", session)
+
+			return next(c)
+		}
+	}
+}
+
+// optionalSessionMiddleware lets requests without a usable session through, handlers decide what to do
+func optionalSessionMiddleware(sessionUC *core.SessionUseCase) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			session, err := loadSession(c, sessionUC)
+			if err != nil {
+				return err
+			}
+
+			if session != nil {
+				c.Set("session", session)
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// loadSession returns nil without error when there is no token or its session is gone
+func loadSession(c echo.Context, sessionUC *core.SessionUseCase) (*core.Session, error) {
+	ctx := c.Request().Context()
+
+	token, ok := c.Get("sso_session_token").(*jwt.Token)
+	if !ok {
+		return nil, nil
+	}
+
+	claims, ok := token.Claims.(*core.Claims)
+	if !ok {
+		return nil, nil
+	}
+
+	session, err := sessionUC.Validate(ctx, claims.SessionID, claims.Subject)
+	if errors.Is(err, e.SessionNotFound) || errors.Is(err, e.SessionInactive) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+func adminMiddleware(apiKey string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if apiKey == "" {
+				return echo.NewHTTPError(http.StatusForbidden, "admin api is disabled")
+			}
+
+			provided, found := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+			if !found || subtle.ConstantTimeCompare([]byte(provided), []byte(apiKey)) != 1 {
+				return echo.NewHTTPError(http.StatusUnauthorized, "unauthorized")
+			}
+
+			return next(c)
+		}
+	}
 }
 
 func errorHandler(err error, c echo.Context) {
@@ -53,30 +277,151 @@ func errorHandler(err error, c echo.Context) {
 	case errors.Is(err, e.RedirectURINotAllowed):
 		httpErr = BadRequest("redirect uri is not allowed")
 
-	case errors.Is(err, e.IdentityNotFound):
-	case errors.Is(err, e.CredentialNotFound):
+	case errors.Is(err, e.IdentityNotFound), errors.Is(err, e.CredentialNotFound), errors.Is(err, e.InvalidCredentials):
 		httpErr = Unauthorized("authentication failure")
 
+	case errors.Is(err, e.LoginLocked):
+		httpErr = TooManyRequests("too many failed logins, try again later")
+
+	case errors.Is(err, e.RateLimited):
+		httpErr = TooManyRequests("too many requests, try again later")
+
+	case errors.Is(err, e.SessionNotFound):
+		httpErr = NotFound("session not found")
+
 	case errors.Is(err, e.InvalidNameOrEmail):
 		httpErr = BadRequest("invalid name or email")
 
 	case errors.Is(err, e.ClientNotFound):
 		httpErr = NotFound("client not found")
 
+	case errors.Is(err, e.SCIMClientNotFound):
+		httpErr = NotFound("scim client not found")
+
+	case errors.Is(err, e.InvalidAuthorizeRequest):
+		httpErr = BadRequest("invalid authorization request")
+
+	case errors.Is(err, e.InvalidSAMLRequest):
+		httpErr = BadRequest("invalid saml request")
+
+	case errors.Is(err, e.ServiceProviderNotFound):
+		httpErr = NotFound("service provider not found")
+
 	case errors.Is(err, e.InvalidAuthProvider):
 		httpErr = BadRequest("invalid authentication provider")
 
+	case errors.Is(err, e.InvalidIDToken):
+		httpErr = Unauthorized("id token is invalid")
+
+	case errors.Is(err, e.InvalidSAMLResponse):
+		httpErr = Unauthorized("saml response is invalid")
+
+	case errors.Is(err, e.EmailNotVerified):
+		httpErr = Forbidden("email is not verified")
+
+	case errors.Is(err, e.LinkRequired):
+		httpErr = Conflict("an account with this email exists, sign in to it to link this identity")
+
+	case errors.Is(err, e.InvalidLinkToken):
+		httpErr = BadRequest("link token is invalid or expired")
+
+	case errors.Is(err, e.IdentityAlreadyLinked):
+		httpErr = Conflict("identity is already linked to an account")
+
+	case errors.Is(err, e.LastLoginMethod):
+		httpErr = Conflict("the last login method cannot be unlinked")
+
+	case errors.Is(err, e.MFARequired):
+		httpErr = Unauthorized("second factor required")
+
+	case errors.Is(err, e.InvalidMFAToken):
+		httpErr = Unauthorized("mfa token is invalid or expired")
+
+	case errors.Is(err, e.InvalidMFACode):
+		httpErr = Unauthorized("second factor code is invalid")
+
+	case errors.Is(err, e.MFAAlreadyEnrolled):
+		httpErr = Conflict("second factor is already enrolled")
+
+	case errors.Is(err, e.MFANotEnrolled):
+		httpErr = BadRequest("no second factor is enrolled")
+
+	case errors.Is(err, e.InvalidWebAuthnResponse):
+		httpErr = Unauthorized("webauthn response is invalid")
+
+	case errors.Is(err, e.PasskeyNotFound):
+		httpErr = NotFound("passkey not found")
+
+	case errors.Is(err, e.InvalidEmailOTP):
+		httpErr = Unauthorized("email code is invalid or expired")
+
+	case errors.Is(err, e.TooManyEmails):
+		httpErr = TooManyRequests("too many emails were sent to the address, try again later")
+
+	case errors.Is(err, e.InvalidResetToken):
+		httpErr = BadRequest("password reset token is invalid or expired")
+
+	case errors.Is(err, e.InvalidPassword):
+		httpErr = BadRequest("password is invalid")
+
+	case errors.Is(err, e.InvalidVerificationToken):
+		httpErr = BadRequest("email verification token is invalid or expired")
+
 	default:
 		httpErr = Internal("internal server error")	
 	}
 
+	body := map[string]any{
+		"error": httpErr.Message,
+	}
+
+	// the client has to send the token along with the password login of the existing account
+	var linkErr *core.LinkRequiredError
+	if errors.As(err, &linkErr) {
+		body["link_token"] = linkErr.LinkToken
+	}
+
+	// the login is finished by posting a code with the token to /auth/mfa/verify
+	var mfaErr *core.MFARequiredError
+	if errors.As(err, &mfaErr) {
+		body["mfa_token"] = mfaErr.MFAToken
+		body["mfa_methods"] = mfaErr.Methods
+	}
+
+	// the client knows when the next login can succeed
+	var lockedErr *core.LockedOutError
+	if errors.As(err, &lockedErr) {
+		setRetryAfter(c, body, lockedErr.RetryAfter)
+	}
+
+	var rateLimitedErr *core.RateLimitedError
+	if errors.As(err, &rateLimitedErr) {
+		setRetryAfter(c, body, rateLimitedErr.RetryAfter)
+	}
+
+	// every rule the password violates, so a form can show them at once
+	var policyErr *core.PasswordPolicyError
+	if errors.As(err, &policyErr) {
+		body["violations"] = policyErr.Violations
+	}
+
 	if !c.Response().Committed {
-		c.JSON(httpErr.Code, map[string]string{
-			"error": httpErr.Message,
-		})
+		c.JSON(httpErr.Code, body)
 	}
 }
 
+// setRetryAfter tells in whole seconds when a refused request can be made again
+func setRetryAfter(c echo.Context, body map[string]any, wait time.Duration) {
+	body["retry_after"] = setRetryAfterHeader(c, wait)
+}
+
+func setRetryAfterHeader(c echo.Context, wait time.Duration) int {
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	c.Response().Header().Set("Retry-After", strconv.Itoa(retryAfter))
+
+	return retryAfter
+}
+
 func initMiddleware(e *echo.Echo, baseLogger *zap.Logger) {
 	loggerMiddleware := func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func (c echo.Context) error {
@@ -0,0 +1,136 @@
+package http
+
+import (
+	"sso/internal/core"
+	"github.com/labstack/echo/v4"
+
+	"net/http"
+)
+
+func currentSession(c echo.Context) (*core.Session, bool) {
+	session, ok := c.Get("session").(*core.Session)
+	return session, ok
+}
+
+func listSessionsHandler(sessionUC *core.SessionUseCase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		session, ok := currentSession(c)
+		if !ok {
+			return c.JSON(http.StatusUnauthorized, map[string]any{
+				"error": "unauthorized",
+			})
+		}
+
+		sessions, err := sessionUC.List(ctx, session.UserID)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, map[string]any{
+			"current": session.ID,
+			"sessions": sessions,
+		})
+	}
+}
+
+func revokeSessionHandler(sessionUC *core.SessionUseCase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		session, ok := currentSession(c)
+		if !ok {
+			return c.JSON(http.StatusUnauthorized, map[string]any{
+				"error": "unauthorized",
+			})
+		}
+
+		if err := sessionUC.Revoke(ctx, session.UserID, c.Param("id")); err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+func revokeAllSessionsHandler(sessionUC *core.SessionUseCase, cookies sessionCookies) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		session, ok := currentSession(c)
+		if !ok {
+			return c.JSON(http.StatusUnauthorized, map[string]any{
+				"error": "unauthorized",
+			})
+		}
+
+		if err := sessionUC.RevokeAll(ctx, session.UserID); err != nil {
+			return err
+		}
+
+		cookies.clear(c)
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+func logoutHandler(sessionUC *core.SessionUseCase, cookies sessionCookies) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		session, ok := currentSession(c)
+		if !ok {
+			return c.JSON(http.StatusUnauthorized, map[string]any{
+				"error": "unauthorized",
+			})
+		}
+
+		if err := sessionUC.Revoke(ctx, session.UserID, session.ID); err != nil {
+			return err
+		}
+
+		cookies.clear(c)
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+func adminListSessionsHandler(sessionUC *core.SessionUseCase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		sessions, err := sessionUC.List(ctx, c.Param("user_id"))
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, map[string]any{
+			"sessions": sessions,
+		})
+	}
+}
+
+func adminRevokeSessionHandler(sessionUC *core.SessionUseCase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		if err := sessionUC.Revoke(ctx, c.Param("user_id"), c.Param("id")); err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+func adminRevokeAllSessionsHandler(sessionUC *core.SessionUseCase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		if err := sessionUC.RevokeAll(ctx, c.Param("user_id")); err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,145 @@
+package http
+
+import (
+	"sso/internal/core"
+	"github.com/labstack/echo/v4"
+
+	"io"
+	"net/http"
+)
+
+// beginPasskeyRegistrationHandler returns the options of navigator.credentials.create for the signed in user
+func beginPasskeyRegistrationHandler(webauthnUC *core.WebAuthnUseCase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		session, ok := currentSession(c)
+		if !ok {
+			return c.JSON(http.StatusUnauthorized, map[string]any{
+				"error": "unauthorized",
+			})
+		}
+
+		options, err := webauthnUC.BeginRegistration(ctx, session.UserID)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, options)
+	}
+}
+
+// finishPasskeyRegistrationHandler stores the passkey, the body is the PublicKeyCredential in its JSON form
+func finishPasskeyRegistrationHandler(webauthnUC *core.WebAuthnUseCase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		session, ok := currentSession(c)
+		if !ok {
+			return c.JSON(http.StatusUnauthorized, map[string]any{
+				"error": "unauthorized",
+			})
+		}
+
+		response, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]any{
+				"error": "invalid body",
+			})
+		}
+
+		passkey, err := webauthnUC.FinishRegistration(ctx, identityChange(c, session), response)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusCreated, passkey)
+	}
+}
+
+func listPasskeysHandler(webauthnUC *core.WebAuthnUseCase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		session, ok := currentSession(c)
+		if !ok {
+			return c.JSON(http.StatusUnauthorized, map[string]any{
+				"error": "unauthorized",
+			})
+		}
+
+		passkeys, err := webauthnUC.List(ctx, session.UserID)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, map[string]any{
+			"passkeys": passkeys,
+		})
+	}
+}
+
+func removePasskeyHandler(webauthnUC *core.WebAuthnUseCase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		session, ok := currentSession(c)
+		if !ok {
+			return c.JSON(http.StatusUnauthorized, map[string]any{
+				"error": "unauthorized",
+			})
+		}
+
+		if err := webauthnUC.Remove(ctx, identityChange(c, session), c.Param("id")); err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// beginPasskeyLoginHandler returns the options of navigator.credentials.get, the assertion is
+// posted to /auth/login?provider=webauthn
+func beginPasskeyLoginHandler(webauthnUC *core.WebAuthnUseCase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		var body struct {
+			Email string `json:"email" form:"email"`
+		}
+		if err := c.Bind(&body); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]any{
+				"error": "invalid body",
+			})
+		}
+
+		options, err := webauthnUC.BeginLogin(ctx, body.Email)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, options)
+	}
+}
+
+// mfaWebAuthnOptionsHandler returns the options a login answers its second factor with a passkey,
+// the assertion is posted to /auth/mfa/verify as webauthn
+func mfaWebAuthnOptionsHandler(mfaUC *core.MFAUseCase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		var request secondFactorRequest
+		if err := c.Bind(&request); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]any{
+				"error": "invalid body",
+			})
+		}
+
+		options, err := mfaUC.WebAuthnOptions(ctx, request.MFAToken)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, options)
+	}
+}
@@ -0,0 +1,117 @@
+package infrastructure
+
+import (
+	"sso/internal/config"
+	"sso/internal/core"
+
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type discoveryDocument struct {
+	Issuer string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint string `json:"token_endpoint"`
+	UserInfoEndpoint string `json:"userinfo_endpoint"`
+	JWKSURI string `json:"jwks_uri"`
+}
+
+// NewIdentityProviders builds the upstream providers from configuration. Providers with a redirect url
+// are returned for the brokered login, every oidc provider also verifies id tokens posted to /auth/login.
+// saml providers are read from their metadata first. The verifier is nil when no oidc provider is configured
+func NewIdentityProviders(ctx context.Context, configs []config.IdentityProviderConfig, client *http.Client) (map[string]core.IFederatedProvider, core.IIDTokenVerifier, error) {
+	if client == nil {
+		client = &http.Client{Timeout: 10*time.Second}
+	}
+
+	providers := map[string]core.IFederatedProvider{}
+	verifiers := []*OIDCVerifierInterface{}
+
+	for _, conf := range configs {
+		if !conf.IsOIDC() {
+			if conf.RedirectURL == "" {
+				continue
+			}
+
+			switch conf.Type {
+			case "github":
+				providers[conf.Name] = NewGitHubProviderInterface(conf, client)
+			case "saml":
+				if conf.MetadataURL != "" || conf.MetadataFile != "" {
+					if err := importSAMLMetadata(ctx, client, &conf); err != nil {
+						return nil, nil, fmt.Errorf("identity provider %q: %w", conf.Name, err)
+					}
+				}
+
+				provider, err := NewSAMLProviderInterface(conf)
+				if err != nil {
+					return nil, nil, fmt.Errorf("identity provider %q: %w", conf.Name, err)
+				}
+				providers[conf.Name] = provider
+			default:
+				providers[conf.Name] = NewOAuth2ProviderInterface(conf, client)
+			}
+			continue
+		}
+
+		if conf.AuthURL == "" || conf.TokenURL == "" || conf.JWKSURL == "" {
+			if err := discover(ctx, client, &conf); err != nil {
+				return nil, nil, fmt.Errorf("identity provider %q: %w", conf.Name, err)
+			}
+		}
+
+		issuers := []string{conf.Issuer}
+		// google signs some tokens with the scheme-less issuer
+		if conf.Issuer == "https://accounts.google.com" {
+			issuers = append(issuers, "accounts.google.com")
+		}
+
+		keys := NewRemoteKeySource(conf.JWKSURL, client, time.Hour)
+		verifier := NewOIDCVerifierInterface(conf, issuers, keys)
+		verifiers = append(verifiers, verifier)
+
+		if conf.RedirectURL != "" {
+			providers[conf.Name] = NewOIDCProviderInterface(conf, verifier, client)
+		}
+	}
+
+	if len(verifiers) == 0 {
+		return providers, nil, nil
+	}
+
+	return providers, NewIDTokenVerifiersInterface(verifiers), nil
+}
+
+// discover fills the missing endpoints of conf from the openid configuration of its issuer
+func discover(ctx context.Context, client *http.Client, conf *config.IdentityProviderConfig) error {
+	var doc discoveryDocument
+	if err := getJSON(ctx, client, strings.TrimSuffix(conf.Issuer, "/")+"/.well-known/openid-configuration", "", &doc); err != nil {
+		return err
+	}
+
+	if doc.Issuer != conf.Issuer {
+		return fmt.Errorf("discovery document is for issuer %q", doc.Issuer)
+	}
+
+	if conf.AuthURL == "" {
+		conf.AuthURL = doc.AuthorizationEndpoint
+	}
+	if conf.TokenURL == "" {
+		conf.TokenURL = doc.TokenEndpoint
+	}
+	if conf.UserInfoURL == "" {
+		conf.UserInfoURL = doc.UserInfoEndpoint
+	}
+	if conf.JWKSURL == "" {
+		conf.JWKSURL = doc.JWKSURI
+	}
+
+	if conf.AuthURL == "" || conf.TokenURL == "" || conf.JWKSURL == "" {
+		return fmt.Errorf("discovery document of %q is missing endpoints", conf.Issuer)
+	}
+
+	return nil
+}
@@ -0,0 +1,236 @@
+package infrastructure
+
+import (
+	"sso/internal/config"
+	"sso/internal/core"
+	e "sso/internal/core/errors"
+	"github.com/go-ldap/ldap/v3"
+
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const ldapTimeout = 10*time.Second
+
+// LDAPInterface checks passwords by binding to an ldap directory, see IdentityProviderConfig for the
+// search and bind modes. Every login opens its own connection
+type LDAPInterface struct {
+	config config.IdentityProviderConfig
+}
+
+func NewLDAPInterface(config config.IdentityProviderConfig) *LDAPInterface {
+	return &LDAPInterface{
+		config: config,
+	}
+}
+
+func (i *LDAPInterface) Authenticate(ctx context.Context, username, password string) (*core.DirectoryEntry, error) {
+	conn, err := i.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var entry *ldap.Entry
+	if i.config.BindDN != "" {
+		if err := conn.Bind(i.config.BindDN, i.config.BindPassword); err != nil {
+			return nil, e.Unknown(err)
+		}
+
+		entry, err = i.search(conn, i.config.BaseDN, ldap.ScopeWholeSubtree, strings.ReplaceAll(i.config.UserFilter, "{username}", ldap.EscapeFilter(username)))
+		if err != nil {
+			return nil, err
+		}
+
+		if err := bindAs(conn, entry.DN, password); err != nil {
+			return nil, err
+		}
+	} else {
+		dn := strings.ReplaceAll(i.config.UserDN, "{username}", ldap.EscapeDN(username))
+		if err := bindAs(conn, dn, password); err != nil {
+			return nil, err
+		}
+
+		entry, err = i.search(conn, dn, ldap.ScopeBaseObject, "(objectClass=*)")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var roles []string
+	if len(i.config.GroupRoles) > 0 {
+		groups, err := i.groups(conn, entry)
+		if err != nil {
+			return nil, err
+		}
+
+		roles = mapRoles(i.config.GroupRoles, groups)
+	}
+
+	claims, err := i.claims(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	return &core.DirectoryEntry{
+		Claims: claims,
+		Roles: roles,
+	}, nil
+}
+
+func (i *LDAPInterface) dial(ctx context.Context) (*ldap.Conn, error) {
+	dialer := &net.Dialer{Timeout: ldapTimeout}
+	if deadline, ok := ctx.Deadline(); ok {
+		dialer.Deadline = deadline
+	}
+
+	conn, err := ldap.DialURL(i.config.URL, ldap.DialWithDialer(dialer))
+	if err != nil {
+		return nil, e.Unknown(err)
+	}
+	conn.SetTimeout(ldapTimeout)
+
+	if i.config.StartTLS {
+		u, err := url.Parse(i.config.URL)
+		if err != nil {
+			conn.Close()
+			return nil, e.Unknown(err)
+		}
+
+		if err := conn.StartTLS(&tls.Config{ServerName: u.Hostname()}); err != nil {
+			conn.Close()
+			return nil, e.Unknown(err)
+		}
+	}
+
+	return conn, nil
+}
+
+// search returns the single entry matching filter, no entry or several of them are invalid credentials
+func (i *LDAPInterface) search(conn *ldap.Conn, baseDN string, scope int, filter string) (*ldap.Entry, error) {
+	attributes := []string{i.config.Claims.Subject, i.config.Claims.Email, i.config.Claims.Name, "cn", "memberOf"}
+	if i.config.Claims.EmailVerified != "" {
+		attributes = append(attributes, i.config.Claims.EmailVerified)
+	}
+
+	result, err := conn.Search(ldap.NewSearchRequest(baseDN, scope, ldap.NeverDerefAliases, 2, int(ldapTimeout.Seconds()), false, filter, attributes, nil))
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) || ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, e.InvalidCredentials
+	}
+	if err != nil {
+		return nil, e.Unknown(err)
+	}
+
+	if len(result.Entries) != 1 {
+		return nil, e.InvalidCredentials
+	}
+
+	return result.Entries[0], nil
+}
+
+// groups returns the dns of the groups of entry, from memberOf or a search below GroupBaseDN
+func (i *LDAPInterface) groups(conn *ldap.Conn, entry *ldap.Entry) ([]string, error) {
+	if i.config.GroupBaseDN == "" {
+		return entry.GetEqualFoldAttributeValues("memberOf"), nil
+	}
+
+	// the user may not be allowed to read the groups
+	if i.config.BindDN != "" {
+		if err := conn.Bind(i.config.BindDN, i.config.BindPassword); err != nil {
+			return nil, e.Unknown(err)
+		}
+	}
+
+	filter := strings.ReplaceAll(i.config.GroupFilter, "{dn}", ldap.EscapeFilter(entry.DN))
+	result, err := conn.Search(ldap.NewSearchRequest(i.config.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, int(ldapTimeout.Seconds()), false, filter, []string{"1.1"}, nil))
+	if err != nil {
+		return nil, e.Unknown(err)
+	}
+
+	groups := []string{}
+	for _, group := range result.Entries {
+		groups = append(groups, group.DN)
+	}
+
+	return groups, nil
+}
+
+func (i *LDAPInterface) claims(entry *ldap.Entry) (map[string]string, error) {
+	subject := entry.GetEqualFoldRawAttributeValue(i.config.Claims.Subject)
+	if len(subject) == 0 {
+		return nil, errors.Join(e.InvalidCredentials, errors.New("directory entry has no "+i.config.Claims.Subject))
+	}
+
+	// binary ids such as the objectGUID of active directory are stored as hex
+	externalID := string(subject)
+	if !utf8.Valid(subject) {
+		externalID = hex.EncodeToString(subject)
+	}
+
+	name := entry.GetEqualFoldAttributeValue(i.config.Claims.Name)
+	if name == "" {
+		name = entry.GetEqualFoldAttributeValue("cn")
+	}
+
+	verified := i.config.Claims.EmailAlwaysVerified
+	if !verified {
+		// directories store booleans as TRUE and FALSE
+		verified, _ = strconv.ParseBool(entry.GetEqualFoldAttributeValue(i.config.Claims.EmailVerified))
+	}
+
+	raw, err := json.Marshal(map[string]any{
+		"dn": entry.DN,
+		"email": entry.GetEqualFoldAttributeValue(i.config.Claims.Email),
+		"name": name,
+	})
+	if err != nil {
+		return nil, e.Unknown(err)
+	}
+
+	return map[string]string{
+		"provider": "ldap",
+		"issuer": i.config.Issuer,
+		"sub": externalID,
+		"email": entry.GetEqualFoldAttributeValue(i.config.Claims.Email),
+		"email_verified": strconv.FormatBool(verified),
+		"name": name,
+		"link_by_email": strconv.FormatBool(i.config.LinkByEmail != nil && *i.config.LinkByEmail),
+		"raw": string(raw),
+	}, nil
+}
+
+// bindAs checks the password of dn, a refused bind means invalid credentials
+func bindAs(conn *ldap.Conn, dn, password string) error {
+	err := conn.Bind(dn, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return e.InvalidCredentials
+	}
+	if err != nil {
+		return e.Unknown(err)
+	}
+
+	return nil
+}
+
+// mapRoles returns the sorted roles of groups, dns are compared case insensitively
+func mapRoles(groupRoles map[string]string, groups []string) []string {
+	roles := []string{}
+	for group, role := range groupRoles {
+		if slices.ContainsFunc(groups, func(dn string) bool { return strings.EqualFold(dn, group) }) && !slices.Contains(roles, role) {
+			roles = append(roles, role)
+		}
+	}
+	slices.Sort(roles)
+
+	return roles
+}
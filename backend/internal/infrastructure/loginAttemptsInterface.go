@@ -0,0 +1,116 @@
+package infrastructure
+
+import (
+	"sso/internal/core"
+	e "sso/internal/core/errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// LoginAttemptsInterface keeps the counters in postgres, every instance of the sso counts into the same rows
+type LoginAttemptsInterface struct {
+	pool *pgxpool.Pool
+
+	mu sync.Mutex
+	prunedAt time.Time
+}
+
+func NewLoginAttemptsInterface(pool *pgxpool.Pool) *LoginAttemptsInterface {
+	return &LoginAttemptsInterface{
+		pool: pool,
+	}
+}
+
+func (i *LoginAttemptsInterface) Get(ctx context.Context, key string) (*core.LoginAttempt, error) {
+	var attempt core.LoginAttempt
+
+	err := i.pool.QueryRow(ctx,
+		`SELECT key, failures, last_failure_at, CASE WHEN locked_until > NOW() THEN locked_until END
+		 FROM login_attempts WHERE key = $1`,
+		key,
+	).Scan(&attempt.Key, &attempt.Failures, &attempt.LastFailureAt, &attempt.LockedUntil)
+
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		} else {
+			return nil, e.Unknown(err)
+		}
+	}
+
+	return &attempt, nil
+}
+
+// Fail counts in a single upsert so concurrent failures on several instances are all counted
+func (i *LoginAttemptsInterface) Fail(ctx context.Context, key string, window int) (*core.LoginAttempt, error) {
+	var attempt core.LoginAttempt
+
+	err := i.pool.QueryRow(ctx,
+		`INSERT INTO login_attempts(key, failures, last_failure_at, expires_at) VALUES ($1, 1, NOW(), NOW() + make_interval(secs => $2))
+		 ON CONFLICT (key) DO UPDATE SET
+		   failures = CASE WHEN login_attempts.last_failure_at < NOW() - make_interval(secs => $2) THEN 1 ELSE login_attempts.failures + 1 END,
+		   last_failure_at = NOW(),
+		   expires_at = NOW() + make_interval(secs => $2)
+		 RETURNING key, failures, last_failure_at, CASE WHEN locked_until > NOW() THEN locked_until END`,
+		key,
+		window,
+	).Scan(&attempt.Key, &attempt.Failures, &attempt.LastFailureAt, &attempt.LockedUntil)
+
+	if err != nil {
+		return nil, e.Unknown(err)
+	}
+
+	if err := i.prune(ctx); err != nil {
+		return nil, err
+	}
+
+	return &attempt, nil
+}
+
+// prune deletes the rows whose failures are forgotten and whose lock ran out, they are no different
+// from missing ones. Each instance prunes at most once a minute
+func (i *LoginAttemptsInterface) prune(ctx context.Context) error {
+	i.mu.Lock()
+	if time.Since(i.prunedAt) < time.Minute {
+		i.mu.Unlock()
+		return nil
+	}
+	i.prunedAt = time.Now()
+	i.mu.Unlock()
+
+	_, err := i.pool.Exec(ctx,
+		"DELETE FROM login_attempts WHERE expires_at < NOW() AND (locked_until IS NULL OR locked_until < NOW())",
+	)
+	if err != nil {
+		return e.Unknown(err)
+	}
+
+	return nil
+}
+
+func (i *LoginAttemptsInterface) Lock(ctx context.Context, key string, until time.Time) error {
+	_, err := i.pool.Exec(ctx,
+		`UPDATE login_attempts SET locked_until = GREATEST(COALESCE(locked_until, $2), $2) WHERE key = $1`,
+		key,
+		until.UTC(),
+	)
+	if err != nil {
+		return e.Unknown(err)
+	}
+
+	return nil
+}
+
+func (i *LoginAttemptsInterface) Reset(ctx context.Context, key string) error {
+	_, err := i.pool.Exec(ctx, "DELETE FROM login_attempts WHERE key = $1", key)
+	if err != nil {
+		return e.Unknown(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,202 @@
+package infrastructure
+
+import (
+	"sso/internal/config"
+	e "sso/internal/core/errors"
+
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// OIDCProviderInterface runs the authorization code flow with PKCE against an upstream OpenID provider
+type OIDCProviderInterface struct {
+	config config.IdentityProviderConfig
+	verifier *OIDCVerifierInterface
+	client *http.Client
+}
+
+func NewOIDCProviderInterface(config config.IdentityProviderConfig, verifier *OIDCVerifierInterface, client *http.Client) *OIDCProviderInterface {
+	if client == nil {
+		client = &http.Client{Timeout: 10*time.Second}
+	}
+
+	return &OIDCProviderInterface{
+		config: config,
+		verifier: verifier,
+		client: client,
+	}
+}
+
+func (i *OIDCProviderInterface) DisplayName() string {
+	return i.config.DisplayName
+}
+
+func (i *OIDCProviderInterface) AuthCodeURL(state, nonce, codeChallenge string) string {
+	return authCodeURL(i.config, url.Values{
+		"state": {state},
+		"nonce": {nonce},
+		"code_challenge": {codeChallenge},
+		"code_challenge_method": {"S256"},
+	})
+}
+
+func (i *OIDCProviderInterface) Exchange(ctx context.Context, code, codeVerifier, nonce string) (map[string]string, error) {
+	tokens, err := exchangeCode(ctx, i.client, i.config, code, codeVerifier)
+	if err != nil {
+		return nil, err
+	}
+
+	if tokens.IDToken == "" {
+		return nil, e.InvalidIDToken
+	}
+
+	claims, err := i.verifier.Verify(ctx, tokens.IDToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims["nonce"] != nonce {
+		return nil, errors.Join(e.InvalidIDToken, errors.New("nonce mismatch"))
+	}
+
+	return claims, nil
+}
+
+// OAuth2ProviderInterface reads the upstream user from a userinfo endpoint, for providers that do not issue id tokens
+type OAuth2ProviderInterface struct {
+	config config.IdentityProviderConfig
+	client *http.Client
+}
+
+func NewOAuth2ProviderInterface(config config.IdentityProviderConfig, client *http.Client) *OAuth2ProviderInterface {
+	if client == nil {
+		client = &http.Client{Timeout: 10*time.Second}
+	}
+
+	return &OAuth2ProviderInterface{
+		config: config,
+		client: client,
+	}
+}
+
+func (i *OAuth2ProviderInterface) DisplayName() string {
+	return i.config.DisplayName
+}
+
+func (i *OAuth2ProviderInterface) AuthCodeURL(state, nonce, codeChallenge string) string {
+	return authCodeURL(i.config, url.Values{
+		"state": {state},
+		"code_challenge": {codeChallenge},
+		"code_challenge_method": {"S256"},
+	})
+}
+
+// Exchange ignores the nonce, without an id token the state and the pkce verifier bind the code to the login
+func (i *OAuth2ProviderInterface) Exchange(ctx context.Context, code, codeVerifier, nonce string) (map[string]string, error) {
+	tokens, err := exchangeCode(ctx, i.client, i.config, code, codeVerifier)
+	if err != nil {
+		return nil, err
+	}
+
+	userInfo := map[string]any{}
+	if err := getJSON(ctx, i.client, i.config.UserInfoURL, tokens.AccessToken, &userInfo); err != nil {
+		return nil, err
+	}
+
+	claims, err := mapClaims(i.config, i.config.Issuer, userInfo)
+	if err != nil {
+		return nil, errors.Join(e.UpstreamLoginFailed, err)
+	}
+
+	return claims, nil
+}
+
+func authCodeURL(config config.IdentityProviderConfig, params url.Values) string {
+	params.Set("response_type", "code")
+	params.Set("client_id", config.ClientID)
+	params.Set("redirect_uri", config.RedirectURL)
+	params.Set("scope", strings.Join(config.Scopes, " "))
+
+	separator := "?"
+	if strings.Contains(config.AuthURL, "?") {
+		separator = "&"
+	}
+
+	return config.AuthURL + separator + params.Encode()
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	IDToken string `json:"id_token"`
+	TokenType string `json:"token_type"`
+	Error string `json:"error"`
+}
+
+func exchangeCode(ctx context.Context, client *http.Client, config config.IdentityProviderConfig, code, codeVerifier string) (*tokenResponse, error) {
+	form := url.Values{
+		"grant_type": {"authorization_code"},
+		"code": {code},
+		"redirect_uri": {config.RedirectURL},
+		"client_id": {config.ClientID},
+		"client_secret": {config.ClientSecret},
+		"code_verifier": {codeVerifier},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, config.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, e.Unknown(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, e.Unknown(err)
+	}
+	defer resp.Body.Close()
+
+	var tokens tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, e.Unknown(err)
+	}
+
+	if resp.StatusCode != http.StatusOK || tokens.Error != "" {
+		return nil, fmt.Errorf("%w: token endpoint responded with %d %s", e.UpstreamLoginFailed, resp.StatusCode, tokens.Error)
+	}
+
+	return &tokens, nil
+}
+
+// getJSON fetches an upstream api document, accessToken may be empty for public documents
+func getJSON(ctx context.Context, client *http.Client, url, accessToken string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return e.Unknown(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return e.Unknown(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s responded with %d", e.UpstreamLoginFailed, url, resp.StatusCode)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return e.Unknown(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,312 @@
+package infrastructure
+
+import (
+	"sso/internal/config"
+	"sso/internal/core"
+	e "sso/internal/core/errors"
+	"github.com/golang-jwt/jwt/v5"
+
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeySource resolves the public key an upstream provider signed an id token with
+type KeySource interface {
+	Key(ctx context.Context, kid string) (*rsa.PublicKey, error)
+}
+
+// OIDCVerifierInterface checks id tokens issued by an upstream OpenID provider
+type OIDCVerifierInterface struct {
+	config config.IdentityProviderConfig
+	issuers []string
+	keys KeySource
+}
+
+// NewOIDCVerifierInterface accepts tokens for the client id of config from any of issuers, an issuer
+// may contain a {tenantid} placeholder which is matched against the tid claim of the token
+func NewOIDCVerifierInterface(config config.IdentityProviderConfig, issuers []string, keys KeySource) *OIDCVerifierInterface {
+	return &OIDCVerifierInterface{
+		config: config,
+		issuers: issuers,
+		keys: keys,
+	}
+}
+
+// Verify checks the signature, iss, aud and exp of an id token and
+// returns the mapped claims in the shape core.LoginInput.Token expects
+func (i *OIDCVerifierInterface) Verify(ctx context.Context, rawToken string) (map[string]string, error) {
+	claims := jwt.MapClaims{}
+
+	_, err := jwt.ParseWithClaims(rawToken, claims, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		return i.keys.Key(ctx, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256"}),
+		jwt.WithAudience(i.config.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
+	if err != nil {
+		return nil, errors.Join(e.InvalidIDToken, err)
+	}
+
+	issuer, _ := claims.GetIssuer()
+	tenantID, _ := claims["tid"].(string)
+	if !slices.ContainsFunc(i.issuers, func(pattern string) bool { return issuerMatches(pattern, issuer, tenantID) }) {
+		return nil, errors.Join(e.InvalidIDToken, fmt.Errorf("unexpected issuer %q", issuer))
+	}
+
+	mapped, err := mapClaims(i.config, issuer, claims)
+	if err != nil {
+		return nil, errors.Join(e.InvalidIDToken, err)
+	}
+
+	mapped["nonce"], _ = claims["nonce"].(string)
+	mapped["raw"] = rawToken
+
+	return mapped, nil
+}
+
+// accepts reports whether the verifier is responsible for tokens of issuer, before the token is verified
+func (i *OIDCVerifierInterface) accepts(issuer string) bool {
+	return slices.ContainsFunc(i.issuers, func(pattern string) bool {
+		prefix, suffix, templated := strings.Cut(pattern, "{tenantid}")
+		if !templated {
+			return pattern == issuer
+		}
+
+		return len(issuer) > len(prefix)+len(suffix) && strings.HasPrefix(issuer, prefix) && strings.HasSuffix(issuer, suffix)
+	})
+}
+
+func issuerMatches(pattern, issuer, tenantID string) bool {
+	if strings.Contains(pattern, "{tenantid}") {
+		return tenantID != "" && strings.ReplaceAll(pattern, "{tenantid}", tenantID) == issuer
+	}
+
+	return pattern == issuer
+}
+
+// mapClaims reads the user and identity fields out of upstream claims according to the claim mapping
+// of the provider, along with its linking policy
+func mapClaims(conf config.IdentityProviderConfig, issuer string, claims map[string]any) (map[string]string, error) {
+	mapping := conf.Claims
+
+	subject := claimString(claims, mapping.Subject)
+	if subject == "" {
+		return nil, fmt.Errorf("claim %q is empty", mapping.Subject)
+	}
+
+	email := claimString(claims, mapping.Email)
+	if email == "" {
+		return nil, fmt.Errorf("claim %q is empty", mapping.Email)
+	}
+
+	// some providers send email_verified as a string
+	verified := mapping.EmailAlwaysVerified || claimString(claims, mapping.EmailVerified) == "true"
+
+	return map[string]string{
+		"provider": conf.Name,
+		"issuer": issuer,
+		"sub": subject,
+		"email": email,
+		"email_verified": strconv.FormatBool(verified),
+		"name": claimString(claims, mapping.Name),
+		"link_by_email": strconv.FormatBool(conf.LinkByEmail != nil && *conf.LinkByEmail),
+	}, nil
+}
+
+func claimString(claims map[string]any, name string) string {
+	if name == "" {
+		return ""
+	}
+
+	switch value := claims[name].(type) {
+	case string:
+		return value
+	case bool:
+		return strconv.FormatBool(value)
+	case float64:
+		// numeric ids such as github's arrive as float64 from encoding/json
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case json.Number:
+		return value.String()
+	default:
+		return ""
+	}
+}
+
+// IDTokenVerifiersInterface dispatches id tokens to the verifier of the provider that issued them
+type IDTokenVerifiersInterface struct {
+	verifiers []*OIDCVerifierInterface
+}
+
+func NewIDTokenVerifiersInterface(verifiers []*OIDCVerifierInterface) *IDTokenVerifiersInterface {
+	return &IDTokenVerifiersInterface{
+		verifiers,
+	}
+}
+
+func (i *IDTokenVerifiersInterface) Verify(ctx context.Context, rawToken string) (map[string]string, error) {
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(rawToken, claims); err != nil {
+		return nil, errors.Join(e.InvalidIDToken, err)
+	}
+
+	// the issuer only picks the verifier, it is checked again against the verified token
+	issuer, _ := claims.GetIssuer()
+	for _, verifier := range i.verifiers {
+		if verifier.accepts(issuer) {
+			return verifier.Verify(ctx, rawToken)
+		}
+	}
+
+	return nil, errors.Join(e.InvalidIDToken, fmt.Errorf("no identity provider for issuer %q", issuer))
+}
+
+// StaticKeySource serves keys known in advance, mostly for tests
+type StaticKeySource struct {
+	keys map[string]*rsa.PublicKey
+}
+
+func NewStaticKeySource(keys map[string]*rsa.PublicKey) *StaticKeySource {
+	return &StaticKeySource{
+		keys,
+	}
+}
+
+func (s *StaticKeySource) Key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	key, ok := s.keys[kid]
+	if !ok {
+		return nil, e.KeysNotFound
+	}
+
+	return key, nil
+}
+
+// RemoteKeySource fetches a JWKS document over http and caches it. An unknown kid forces a refetch,
+// but not more often than minRefresh so forged tokens cannot be used to hammer the provider
+type RemoteKeySource struct {
+	url string
+	client *http.Client
+	ttl time.Duration
+	minRefresh time.Duration
+
+	mu sync.Mutex
+	keys map[string]*rsa.PublicKey
+	fetchedAt time.Time
+}
+
+func NewRemoteKeySource(url string, client *http.Client, ttl time.Duration) *RemoteKeySource {
+	if client == nil {
+		client = &http.Client{Timeout: 10*time.Second}
+	}
+
+	return &RemoteKeySource{
+		url: url,
+		client: client,
+		ttl: ttl,
+		minRefresh: 10*time.Second,
+		keys: map[string]*rsa.PublicKey{},
+	}
+}
+
+func (s *RemoteKeySource) Key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.keys[kid]
+	stale := time.Since(s.fetchedAt) > s.ttl
+
+	if ok && !stale {
+		return key, nil
+	}
+
+	if !stale && time.Since(s.fetchedAt) < s.minRefresh {
+		return nil, e.KeysNotFound
+	}
+
+	if err := s.fetch(ctx); err != nil {
+		// keep serving the cached keys if the provider is temporarily unavailable
+		if ok {
+			return key, nil
+		}
+		return nil, err
+	}
+
+	key, ok = s.keys[kid]
+	if !ok {
+		return nil, e.KeysNotFound
+	}
+
+	return key, nil
+}
+
+func (s *RemoteKeySource) fetch(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return e.Unknown(err)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return e.Unknown(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return e.Unknown(fmt.Errorf("jwks endpoint responded with %d", resp.StatusCode))
+	}
+
+	var jwks core.JWKS
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return e.Unknown(err)
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+
+		key, err := rsaPublicKey(jwk)
+		if err != nil {
+			continue
+		}
+
+		keys[jwk.Kid] = key
+	}
+
+	s.keys = keys
+	s.fetchedAt = time.Now()
+
+	return nil
+}
+
+func rsaPublicKey(jwk core.JWK) (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+	if err != nil {
+		return nil, err
+	}
+
+	eBytes, err := base64.RawURLEncoding.DecodeString(jwk.E)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(eBytes).Int64()),
+	}, nil
+}
@@ -0,0 +1,77 @@
+package infrastructure
+
+import (
+	"sso/internal/core"
+
+	"sync"
+	"time"
+)
+
+type PartialSessionsInterface struct {
+	mu sync.Mutex
+	partials map[string]partialSession
+}
+
+type partialSession struct {
+	partial core.PartialSession
+	expiration time.Time
+}
+
+func NewPartialSessionsInterface() *PartialSessionsInterface {
+	return &PartialSessionsInterface{
+		partials: map[string]partialSession{},
+	}
+}
+
+func (i *PartialSessionsInterface) Issue(partial core.PartialSession, ttl int) (string, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	now := time.Now()
+	for token, p := range i.partials {
+		if p.expiration.Before(now) {
+			delete(i.partials, token)
+		}
+	}
+
+	token := randomID()
+	i.partials[token] = partialSession{
+		partial: partial,
+		expiration: now.Add(time.Duration(ttl)*time.Second),
+	}
+
+	return token, nil
+}
+
+func (i *PartialSessionsInterface) Get(token string) (*core.PartialSession, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	p, ok := i.partials[token]
+	if !ok || p.expiration.Before(time.Now()) {
+		return nil, nil
+	}
+
+	return &p.partial, nil
+}
+
+func (i *PartialSessionsInterface) Update(token string, partial core.PartialSession) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if p, ok := i.partials[token]; ok {
+		p.partial = partial
+		i.partials[token] = p
+	}
+
+	return nil
+}
+
+func (i *PartialSessionsInterface) Delete(token string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	delete(i.partials, token)
+
+	return nil
+}
@@ -0,0 +1,69 @@
+package infrastructure
+
+import (
+	"sso/internal/core"
+	e "sso/internal/core/errors"
+
+	"errors"
+	"strings"
+)
+
+// PasswordHashInterface hashes new passwords with the configured algorithm and checks the stored
+// ones with the algorithm their prefix names, so accounts move to the current one as they log in
+type PasswordHashInterface struct {
+	current core.IHash
+	argon2 *Argon2HashInterface
+	bcrypt *HashInterface
+}
+
+// NewPasswordHashInterface hashes new passwords with algorithm, argon2id or bcrypt
+func NewPasswordHashInterface(algorithm string, argon2 *Argon2HashInterface, bcrypt *HashInterface) (*PasswordHashInterface, error) {
+	i := &PasswordHashInterface{
+		argon2: argon2,
+		bcrypt: bcrypt,
+	}
+
+	switch algorithm {
+	case "argon2id":
+		i.current = argon2
+	case "bcrypt":
+		i.current = bcrypt
+	default:
+		return nil, errors.New("unknown password hash algorithm " + algorithm)
+	}
+
+	return i, nil
+}
+
+func (i *PasswordHashInterface) HashPassword(raw string) (string, error) {
+	return i.current.HashPassword(raw)
+}
+
+func (i *PasswordHashInterface) CheckPassword(raw, hash string) error {
+	h, err := i.byPrefix(hash)
+	if err != nil {
+		return err
+	}
+
+	return h.CheckPassword(raw, hash)
+}
+
+func (i *PasswordHashInterface) NeedsRehash(hash string) bool {
+	h, err := i.byPrefix(hash)
+	if err != nil {
+		return false
+	}
+
+	return h != i.current || h.NeedsRehash(hash)
+}
+
+func (i *PasswordHashInterface) byPrefix(hash string) (core.IHash, error) {
+	switch {
+	case strings.HasPrefix(hash, argon2Prefix):
+		return i.argon2, nil
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return i.bcrypt, nil
+	default:
+		return nil, e.Unknown(errors.New("unknown password hash format"))
+	}
+}
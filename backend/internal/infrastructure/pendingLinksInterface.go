@@ -0,0 +1,61 @@
+package infrastructure
+
+import (
+	"sso/internal/core"
+
+	"sync"
+	"time"
+)
+
+type PendingLinksInterface struct {
+	mu sync.Mutex
+	links map[string]pendingLink
+}
+
+type pendingLink struct {
+	link core.PendingLink
+	expiration time.Time
+}
+
+func NewPendingLinksInterface() *PendingLinksInterface {
+	return &PendingLinksInterface{
+		links: map[string]pendingLink{},
+	}
+}
+
+func (i *PendingLinksInterface) Issue(link core.PendingLink, ttl int) (string, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	now := time.Now()
+	for token, l := range i.links {
+		if l.expiration.Before(now) {
+			delete(i.links, token)
+		}
+	}
+
+	token := randomID()
+	i.links[token] = pendingLink{
+		link: link,
+		expiration: now.Add(time.Duration(ttl)*time.Second),
+	}
+
+	return token, nil
+}
+
+func (i *PendingLinksInterface) Take(token string) (*core.PendingLink, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	l, ok := i.links[token]
+	if !ok {
+		return nil, nil
+	}
+	delete(i.links, token)
+
+	if l.expiration.Before(time.Now()) {
+		return nil, nil
+	}
+
+	return &l.link, nil
+}
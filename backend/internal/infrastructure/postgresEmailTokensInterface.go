@@ -0,0 +1,100 @@
+package infrastructure
+
+import (
+	"sso/internal/core"
+	e "sso/internal/core/errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// PostgresEmailTokensInterface keeps the tokens in postgres, so mailed links survive restarts and are
+// redeemed once across every instance of the sso
+type PostgresEmailTokensInterface struct {
+	pool *pgxpool.Pool
+	signer emailTokenSigner
+
+	mu sync.Mutex
+	prunedAt time.Time
+}
+
+func NewPostgresEmailTokensInterface(pool *pgxpool.Pool, key []byte) *PostgresEmailTokensInterface {
+	return &PostgresEmailTokensInterface{
+		pool: pool,
+		signer: emailTokenSigner{key},
+	}
+}
+
+func (i *PostgresEmailTokensInterface) Issue(ctx context.Context, token core.EmailToken, ttl int) (string, error) {
+	id := randomID()
+
+	_, err := i.pool.Exec(ctx,
+		`INSERT INTO email_tokens(id, purpose, user_id, email, expires_at) VALUES ($1, $2, $3, $4, NOW() + make_interval(secs => $5))`,
+		id,
+		token.Purpose,
+		token.UserID,
+		token.Email,
+		ttl,
+	)
+	if err != nil {
+		return "", e.Unknown(err)
+	}
+
+	if err := i.prune(ctx); err != nil {
+		return "", err
+	}
+
+	return id + "." + i.signer.sign(id), nil
+}
+
+// Take deletes the row of the token, so of concurrent requests on several instances only one gets it
+func (i *PostgresEmailTokensInterface) Take(ctx context.Context, signed string) (*core.EmailToken, error) {
+	id, ok := i.signer.verify(signed)
+	if !ok {
+		return nil, nil
+	}
+
+	var token core.EmailToken
+	var valid bool
+
+	err := i.pool.QueryRow(ctx,
+		`DELETE FROM email_tokens WHERE id = $1 RETURNING purpose, user_id, email, expires_at > NOW()`,
+		id,
+	).Scan(&token.Purpose, &token.UserID, &token.Email, &valid)
+
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		} else {
+			return nil, e.Unknown(err)
+		}
+	}
+
+	if !valid {
+		return nil, nil
+	}
+
+	return &token, nil
+}
+
+// prune deletes the tokens that expired unused. Each instance prunes at most once a minute
+func (i *PostgresEmailTokensInterface) prune(ctx context.Context) error {
+	i.mu.Lock()
+	if time.Since(i.prunedAt) < time.Minute {
+		i.mu.Unlock()
+		return nil
+	}
+	i.prunedAt = time.Now()
+	i.mu.Unlock()
+
+	_, err := i.pool.Exec(ctx, "DELETE FROM email_tokens WHERE expires_at < NOW()")
+	if err != nil {
+		return e.Unknown(err)
+	}
+
+	return nil
+}
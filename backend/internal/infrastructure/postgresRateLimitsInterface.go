@@ -0,0 +1,83 @@
+package infrastructure
+
+import (
+	e "sso/internal/core/errors"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"context"
+	"sync"
+	"time"
+)
+
+// PostgresRateLimitsInterface keeps the buckets in postgres, so the limits hold across every instance of the sso
+type PostgresRateLimitsInterface struct {
+	pool *pgxpool.Pool
+
+	mu sync.Mutex
+	prunedAt time.Time
+}
+
+func NewPostgresRateLimitsInterface(pool *pgxpool.Pool) *PostgresRateLimitsInterface {
+	return &PostgresRateLimitsInterface{
+		pool: pool,
+	}
+}
+
+// Take refills and takes from the bucket in a single upsert, so concurrent requests on several
+// instances never take the same token. The row remembers whether the last take succeeded
+func (i *PostgresRateLimitsInterface) Take(ctx context.Context, key string, perMinute, burst int) (time.Duration, error) {
+	var tokens float64
+	var allowed bool
+
+	err := i.pool.QueryRow(ctx,
+		`INSERT INTO rate_limits(key, tokens, updated_at, allowed, full_at)
+		 VALUES ($1, $3::float8 - 1, NOW(), $3::float8 >= 1, NOW() + make_interval(secs => $3::float8 * 60 / NULLIF($2::float8, 0)))
+		 ON CONFLICT (key) DO UPDATE SET
+		   tokens = LEAST($3::float8, rate_limits.tokens + EXTRACT(EPOCH FROM NOW() - rate_limits.updated_at) * $2::float8 / 60)
+		     - CASE WHEN LEAST($3::float8, rate_limits.tokens + EXTRACT(EPOCH FROM NOW() - rate_limits.updated_at) * $2::float8 / 60) >= 1 THEN 1 ELSE 0 END,
+		   allowed = LEAST($3::float8, rate_limits.tokens + EXTRACT(EPOCH FROM NOW() - rate_limits.updated_at) * $2::float8 / 60) >= 1,
+		   updated_at = NOW(),
+		   full_at = NOW() + make_interval(secs => $3::float8 * 60 / NULLIF($2::float8, 0))
+		 RETURNING tokens, allowed`,
+		key,
+		perMinute,
+		burst,
+	).Scan(&tokens, &allowed)
+
+	if err != nil {
+		return 0, e.Unknown(err)
+	}
+
+	if err := i.prune(ctx); err != nil {
+		return 0, err
+	}
+
+	if allowed {
+		return 0, nil
+	}
+
+	if perMinute <= 0 {
+		return time.Minute, nil
+	}
+
+	return time.Duration((1 - tokens) * 60 / float64(perMinute) * float64(time.Second)), nil
+}
+
+// prune deletes the buckets that refilled, a missing row is a full bucket. Each instance prunes
+// at most once a minute
+func (i *PostgresRateLimitsInterface) prune(ctx context.Context) error {
+	i.mu.Lock()
+	if time.Since(i.prunedAt) < time.Minute {
+		i.mu.Unlock()
+		return nil
+	}
+	i.prunedAt = time.Now()
+	i.mu.Unlock()
+
+	_, err := i.pool.Exec(ctx, "DELETE FROM rate_limits WHERE full_at < NOW()")
+	if err != nil {
+		return e.Unknown(err)
+	}
+
+	return nil
+}
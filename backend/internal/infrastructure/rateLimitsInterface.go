@@ -0,0 +1,65 @@
+package infrastructure
+
+import (
+	"golang.org/x/time/rate"
+
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimitsInterface keeps the buckets in memory, each instance of the sso limits on its own
+type RateLimitsInterface struct {
+	mu sync.Mutex
+	buckets map[string]*rate.Limiter
+	sweptAt time.Time
+}
+
+func NewRateLimitsInterface() *RateLimitsInterface {
+	return &RateLimitsInterface{
+		buckets: map[string]*rate.Limiter{},
+		sweptAt: time.Now(),
+	}
+}
+
+func (i *RateLimitsInterface) Take(ctx context.Context, key string, perMinute, burst int) (time.Duration, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	now := time.Now()
+	i.sweep(now)
+
+	limit := rate.Limit(float64(perMinute)/60)
+	bucket, ok := i.buckets[key]
+	if !ok || bucket.Limit() != limit || bucket.Burst() != burst {
+		bucket = rate.NewLimiter(limit, burst)
+		i.buckets[key] = bucket
+	}
+
+	reservation := bucket.ReserveN(now, 1)
+	if !reservation.OK() {
+		return time.Minute, nil
+	}
+
+	// the token is only taken when it is there already
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return delay, nil
+	}
+
+	return 0, nil
+}
+
+// sweep drops the full buckets once a minute, they are no different from new ones
+func (i *RateLimitsInterface) sweep(now time.Time) {
+	if now.Sub(i.sweptAt) < time.Minute {
+		return
+	}
+	i.sweptAt = now
+
+	for key, bucket := range i.buckets {
+		if bucket.TokensAt(now) >= float64(bucket.Burst()) {
+			delete(i.buckets, key)
+		}
+	}
+}
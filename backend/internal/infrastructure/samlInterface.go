@@ -0,0 +1,316 @@
+package infrastructure
+
+import (
+	"sso/internal/core"
+	e "sso/internal/core/errors"
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	samlProtocolNS = "urn:oasis:names:tc:SAML:2.0:protocol"
+	samlAssertionNS = "urn:oasis:names:tc:SAML:2.0:assertion"
+	samlMetadataNS = "urn:oasis:names:tc:SAML:2.0:metadata"
+
+	samlBindingRedirect = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	samlBindingPOST = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+
+	// requests larger than this are not inflated
+	maxSAMLMessageSize = 256*1024
+)
+
+type authnRequestXML struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol AuthnRequest"`
+	ID string `xml:"ID,attr"`
+	Version string `xml:"Version,attr"`
+	IssueInstant time.Time `xml:"IssueInstant,attr"`
+	Destination string `xml:"Destination,attr"`
+	AssertionConsumerServiceURL string `xml:"AssertionConsumerServiceURL,attr"`
+	ProtocolBinding string `xml:"ProtocolBinding,attr"`
+	ForceAuthn bool `xml:"ForceAuthn,attr"`
+	IsPassive bool `xml:"IsPassive,attr"`
+	Issuer string `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+}
+
+// SAMLInterface encodes the SAML messages of the identity provider. The keys come without
+// certificates, so a self-signed certificate is made for each key and reused while the process runs
+type SAMLInterface struct {
+	mu sync.Mutex
+	certificates map[string][]byte
+}
+
+func NewSAMLInterface() *SAMLInterface {
+	return &SAMLInterface{
+		certificates: map[string][]byte{},
+	}
+}
+
+func (i *SAMLInterface) ParseAuthnRequest(encoded string) (*core.AuthnRequest, error) {
+	raw, err := decodeSAMLMessage(encoded)
+	if err != nil {
+		return nil, errors.Join(e.InvalidSAMLRequest, err)
+	}
+
+	var request authnRequestXML
+	if err := xml.Unmarshal(raw, &request); err != nil {
+		return nil, errors.Join(e.InvalidSAMLRequest, err)
+	}
+
+	if request.Version != "2.0" || request.ID == "" || request.Issuer == "" {
+		return nil, errors.Join(e.InvalidSAMLRequest, errors.New("authn request is missing version, id or issuer"))
+	}
+
+	return &core.AuthnRequest{
+		ID: request.ID,
+		Issuer: strings.TrimSpace(request.Issuer),
+		IssueInstant: request.IssueInstant,
+		Destination: request.Destination,
+		ACSURL: request.AssertionConsumerServiceURL,
+		ProtocolBinding: request.ProtocolBinding,
+		ForceAuthn: request.ForceAuthn,
+		IsPassive: request.IsPassive,
+	}, nil
+}
+
+func (i *SAMLInterface) SignResponse(response *core.SAMLResponse, key core.PrivateKey) (string, error) {
+	cert, err := i.certificate(key)
+	if err != nil {
+		return "", err
+	}
+
+	signer, err := dsig.NewSigningContext(&key.Value, [][]byte{cert})
+	if err != nil {
+		return "", e.Unknown(err)
+	}
+	signer.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+
+	el := etree.NewElement("samlp:Response")
+	el.CreateAttr("xmlns:samlp", samlProtocolNS)
+	el.CreateAttr("xmlns:saml", samlAssertionNS)
+	el.CreateAttr("ID", response.ID)
+	el.CreateAttr("Version", "2.0")
+	el.CreateAttr("IssueInstant", samlTime(response.IssueInstant))
+	el.CreateAttr("Destination", response.Destination)
+	if response.InResponseTo != "" {
+		el.CreateAttr("InResponseTo", response.InResponseTo)
+	}
+	el.CreateElement("saml:Issuer").SetText(response.Issuer)
+
+	statusCode := el.CreateElement("samlp:Status").CreateElement("samlp:StatusCode")
+	statusCode.CreateAttr("Value", response.Status)
+	if response.SubStatus != "" {
+		statusCode.CreateElement("samlp:StatusCode").CreateAttr("Value", response.SubStatus)
+	}
+
+	if response.Assertion != nil {
+		assertion, err := signEnveloped(signer, assertionElement(response.Assertion))
+		if err != nil {
+			return "", err
+		}
+		el.AddChild(assertion)
+	}
+
+	signed, err := signEnveloped(signer, el)
+	if err != nil {
+		return "", err
+	}
+
+	doc := etree.NewDocument()
+	doc.SetRoot(signed)
+
+	raw, err := doc.WriteToBytes()
+	if err != nil {
+		return "", e.Unknown(err)
+	}
+
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
+
+func (i *SAMLInterface) Metadata(entityID, ssoURL string, keys []core.PrivateKey) ([]byte, error) {
+	el := etree.NewElement("md:EntityDescriptor")
+	el.CreateAttr("xmlns:md", samlMetadataNS)
+	el.CreateAttr("xmlns:ds", dsig.Namespace)
+	el.CreateAttr("entityID", entityID)
+
+	idp := el.CreateElement("md:IDPSSODescriptor")
+	idp.CreateAttr("protocolSupportEnumeration", samlProtocolNS)
+	idp.CreateAttr("WantAuthnRequestsSigned", "false")
+
+	for _, key := range keys {
+		cert, err := i.certificate(key)
+		if err != nil {
+			return nil, err
+		}
+
+		descriptor := idp.CreateElement("md:KeyDescriptor")
+		descriptor.CreateAttr("use", "signing")
+		descriptor.CreateElement("ds:KeyInfo").CreateElement("ds:X509Data").CreateElement("ds:X509Certificate").SetText(base64.StdEncoding.EncodeToString(cert))
+	}
+
+	for _, format := range []string{core.NameIDFormatEmail, core.NameIDFormatPersistent, core.NameIDFormatUnspecified} {
+		idp.CreateElement("md:NameIDFormat").SetText(format)
+	}
+
+	for _, binding := range []string{samlBindingRedirect, samlBindingPOST} {
+		service := idp.CreateElement("md:SingleSignOnService")
+		service.CreateAttr("Binding", binding)
+		service.CreateAttr("Location", ssoURL)
+	}
+
+	doc := etree.NewDocument()
+	doc.CreateProcInst("xml", `version="1.0" encoding="UTF-8"`)
+	doc.SetRoot(el)
+	doc.Indent(2)
+
+	raw, err := doc.WriteToBytes()
+	if err != nil {
+		return nil, e.Unknown(err)
+	}
+
+	return raw, nil
+}
+
+// certificate returns the der encoded self-signed certificate of a key
+func (i *SAMLInterface) certificate(key core.PrivateKey) ([]byte, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	id := key.Name + ":" + key.Value.N.String()
+	if cert, ok := i.certificates[id]; ok {
+		return cert, nil
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, e.Unknown(err)
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{CommonName: key.Name},
+		NotBefore: now.Add(-time.Hour),
+		NotAfter: now.AddDate(10, 0, 0),
+		KeyUsage: x509.KeyUsageDigitalSignature,
+	}
+
+	cert, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.Value.PublicKey, &key.Value)
+	if err != nil {
+		return nil, e.Unknown(err)
+	}
+
+	i.certificates[id] = cert
+
+	return cert, nil
+}
+
+func assertionElement(assertion *core.Assertion) *etree.Element {
+	el := etree.NewElement("saml:Assertion")
+	// declared here as well, the assertion is signed on its own
+	el.CreateAttr("xmlns:saml", samlAssertionNS)
+	el.CreateAttr("ID", assertion.ID)
+	el.CreateAttr("Version", "2.0")
+	el.CreateAttr("IssueInstant", samlTime(assertion.IssueInstant))
+	el.CreateElement("saml:Issuer").SetText(assertion.Issuer)
+
+	subject := el.CreateElement("saml:Subject")
+	nameID := subject.CreateElement("saml:NameID")
+	nameID.CreateAttr("Format", assertion.NameIDFormat)
+	nameID.SetText(assertion.NameID)
+
+	confirmation := subject.CreateElement("saml:SubjectConfirmation")
+	confirmation.CreateAttr("Method", "urn:oasis:names:tc:SAML:2.0:cm:bearer")
+	confirmationData := confirmation.CreateElement("saml:SubjectConfirmationData")
+	if assertion.InResponseTo != "" {
+		confirmationData.CreateAttr("InResponseTo", assertion.InResponseTo)
+	}
+	confirmationData.CreateAttr("NotOnOrAfter", samlTime(assertion.NotOnOrAfter))
+	confirmationData.CreateAttr("Recipient", assertion.Recipient)
+
+	conditions := el.CreateElement("saml:Conditions")
+	conditions.CreateAttr("NotBefore", samlTime(assertion.NotBefore))
+	conditions.CreateAttr("NotOnOrAfter", samlTime(assertion.NotOnOrAfter))
+	conditions.CreateElement("saml:AudienceRestriction").CreateElement("saml:Audience").SetText(assertion.Audience)
+
+	statement := el.CreateElement("saml:AuthnStatement")
+	statement.CreateAttr("AuthnInstant", samlTime(assertion.AuthnInstant))
+	statement.CreateAttr("SessionIndex", assertion.SessionIndex)
+	statement.CreateElement("saml:AuthnContext").CreateElement("saml:AuthnContextClassRef").SetText(assertion.AuthnContext)
+
+	if len(assertion.Attributes) > 0 {
+		names := make([]string, 0, len(assertion.Attributes))
+		for name := range assertion.Attributes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		attributes := el.CreateElement("saml:AttributeStatement")
+		for _, name := range names {
+			attribute := attributes.CreateElement("saml:Attribute")
+			attribute.CreateAttr("Name", name)
+			attribute.CreateAttr("NameFormat", "urn:oasis:names:tc:SAML:2.0:attrname-format:basic")
+
+			for _, value := range assertion.Attributes[name] {
+				attributeValue := attribute.CreateElement("saml:AttributeValue")
+				attributeValue.CreateAttr("xmlns:xs", "http://www.w3.org/2001/XMLSchema")
+				attributeValue.CreateAttr("xmlns:xsi", "http://www.w3.org/2001/XMLSchema-instance")
+				attributeValue.CreateAttr("xsi:type", "xs:string")
+				attributeValue.SetText(value)
+			}
+		}
+	}
+
+	return el
+}
+
+// signEnveloped signs el and moves the signature right after the issuer, where the schema expects it
+func signEnveloped(signer *dsig.SigningContext, el *etree.Element) (*etree.Element, error) {
+	signed, err := signer.SignEnveloped(el)
+	if err != nil {
+		return nil, e.Unknown(err)
+	}
+
+	signature := signed.Child[len(signed.Child)-1]
+	signed.RemoveChildAt(len(signed.Child) - 1)
+	signed.InsertChildAt(1, signature)
+
+	return signed, nil
+}
+
+// decodeSAMLMessage reads a base64 message that is deflated for the HTTP-Redirect binding and plain for HTTP-POST
+func decodeSAMLMessage(encoded string) ([]byte, error) {
+	compressed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, err
+	}
+
+	inflated, err := io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(compressed)), maxSAMLMessageSize))
+	if err == nil && len(inflated) > 0 {
+		return inflated, nil
+	}
+
+	if !bytes.HasPrefix(bytes.TrimSpace(compressed), []byte("<")) {
+		return nil, errors.New("saml message is neither deflated nor xml")
+	}
+
+	return compressed, nil
+}
+
+func samlTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05Z")
+}
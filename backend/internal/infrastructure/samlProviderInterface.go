@@ -0,0 +1,429 @@
+package infrastructure
+
+import (
+	"sso/internal/config"
+	e "sso/internal/core/errors"
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	samlBearer = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+
+	// tolerated difference between the clocks of the sso and the identity provider
+	samlClockSkew = 3*time.Minute
+)
+
+type entityDescriptorXML struct {
+	EntityID string `xml:"entityID,attr"`
+	IDPSSODescriptor *struct {
+		KeyDescriptors []struct {
+			Use string `xml:"use,attr"`
+			Certificates []string `xml:"KeyInfo>X509Data>X509Certificate"`
+		} `xml:"KeyDescriptor"`
+		SingleSignOnServices []struct {
+			Binding string `xml:"Binding,attr"`
+			Location string `xml:"Location,attr"`
+		} `xml:"SingleSignOnService"`
+	} `xml:"IDPSSODescriptor"`
+}
+
+// SAMLProviderInterface logs in through a SAML 2.0 identity provider. The authorization url carries an
+// AuthnRequest for the HTTP-Redirect binding, the code passed to Exchange is the SAMLResponse the
+// identity provider posted to the assertion consumer service
+type SAMLProviderInterface struct {
+	config config.IdentityProviderConfig
+	certificates []*x509.Certificate
+}
+
+func NewSAMLProviderInterface(config config.IdentityProviderConfig) (*SAMLProviderInterface, error) {
+	certificates := []*x509.Certificate{}
+	for _, encoded := range config.Certificates {
+		cert, err := parseCertificate(encoded)
+		if err != nil {
+			return nil, err
+		}
+
+		certificates = append(certificates, cert)
+	}
+
+	if len(certificates) == 0 {
+		return nil, errors.New("no signing certificates")
+	}
+
+	return &SAMLProviderInterface{
+		config: config,
+		certificates: certificates,
+	}, nil
+}
+
+func (i *SAMLProviderInterface) DisplayName() string {
+	return i.config.DisplayName
+}
+
+// AuthCodeURL ignores the pkce challenge, the request id derived from the nonce binds the response to the login
+func (i *SAMLProviderInterface) AuthCodeURL(state, nonce, codeChallenge string) string {
+	request := etree.NewElement("samlp:AuthnRequest")
+	request.CreateAttr("xmlns:samlp", samlProtocolNS)
+	request.CreateAttr("xmlns:saml", samlAssertionNS)
+	request.CreateAttr("ID", samlRequestID(nonce))
+	request.CreateAttr("Version", "2.0")
+	request.CreateAttr("IssueInstant", samlTime(time.Now()))
+	request.CreateAttr("Destination", i.config.AuthURL)
+	request.CreateAttr("AssertionConsumerServiceURL", i.config.RedirectURL)
+	request.CreateAttr("ProtocolBinding", samlBindingPOST)
+	request.CreateElement("saml:Issuer").SetText(i.config.ClientID)
+	policy := request.CreateElement("samlp:NameIDPolicy")
+	policy.CreateAttr("AllowCreate", "true")
+
+	doc := etree.NewDocument()
+	doc.SetRoot(request)
+
+	var buf bytes.Buffer
+	// writes to a buffer do not fail
+	w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	doc.WriteTo(w)
+	w.Close()
+
+	separator := "?"
+	if strings.Contains(i.config.AuthURL, "?") {
+		separator = "&"
+	}
+
+	return i.config.AuthURL + separator + url.Values{
+		"SAMLRequest": {base64.StdEncoding.EncodeToString(buf.Bytes())},
+		"RelayState": {state},
+	}.Encode()
+}
+
+func (i *SAMLProviderInterface) Exchange(ctx context.Context, code, codeVerifier, nonce string) (map[string]string, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(code))
+	if err != nil {
+		return nil, errors.Join(e.InvalidSAMLResponse, err)
+	}
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(raw); err != nil {
+		return nil, errors.Join(e.InvalidSAMLResponse, err)
+	}
+
+	response := doc.Root()
+	if response == nil || response.Tag != "Response" || response.NamespaceURI() != samlProtocolNS {
+		return nil, errors.Join(e.InvalidSAMLResponse, errors.New("not a saml response"))
+	}
+
+	status := response.FindElement("./Status/StatusCode")
+	if status == nil || status.SelectAttrValue("Value", "") != "urn:oasis:names:tc:SAML:2.0:status:Success" {
+		return nil, fmt.Errorf("%w: saml status %s", e.UpstreamLoginFailed, statusValue(status))
+	}
+
+	validator := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{
+		Roots: i.certificates,
+	})
+
+	// only the elements returned by the validator are trusted, anything else
+	// in the document may have been added after signing
+	responseSigned := signatureOf(response) != nil
+	if responseSigned {
+		response, err = validator.Validate(response)
+		if err != nil {
+			return nil, errors.Join(e.InvalidSAMLResponse, err)
+		}
+	}
+
+	if len(response.SelectElements("EncryptedAssertion")) > 0 {
+		return nil, errors.Join(e.InvalidSAMLResponse, errors.New("encrypted assertions are not supported"))
+	}
+
+	assertions := response.SelectElements("Assertion")
+	if len(assertions) != 1 {
+		return nil, errors.Join(e.InvalidSAMLResponse, fmt.Errorf("response has %d assertions", len(assertions)))
+	}
+
+	assertion := assertions[0]
+	if !responseSigned || signatureOf(assertion) != nil {
+		assertion, err = validator.Validate(assertion)
+		if err != nil {
+			return nil, errors.Join(e.InvalidSAMLResponse, err)
+		}
+	}
+
+	requestID := samlRequestID(nonce)
+	if err := i.checkResponse(response, assertion, requestID, time.Now()); err != nil {
+		return nil, errors.Join(e.InvalidSAMLResponse, err)
+	}
+
+	return i.claims(assertion)
+}
+
+// checkResponse applies the checks of the web browser sso profile to a verified response
+func (i *SAMLProviderInterface) checkResponse(response, assertion *etree.Element, requestID string, now time.Time) error {
+	if response.SelectAttrValue("InResponseTo", "") != requestID {
+		return errors.New("response is not for this login")
+	}
+
+	if destination := response.SelectAttrValue("Destination", ""); destination != "" && destination != i.config.RedirectURL {
+		return fmt.Errorf("response is for destination %q", destination)
+	}
+
+	issuer := assertion.SelectElement("Issuer")
+	if issuer == nil || strings.TrimSpace(issuer.Text()) != i.config.Issuer {
+		return errors.New("assertion is from another issuer")
+	}
+
+	confirmed := false
+	for _, confirmation := range assertion.FindElements("./Subject/SubjectConfirmation") {
+		data := confirmation.SelectElement("SubjectConfirmationData")
+		if confirmation.SelectAttrValue("Method", "") != samlBearer || data == nil {
+			continue
+		}
+
+		if data.SelectAttrValue("Recipient", "") != i.config.RedirectURL || data.SelectAttrValue("InResponseTo", "") != requestID {
+			continue
+		}
+
+		if notOnOrAfter, err := time.Parse(time.RFC3339, data.SelectAttrValue("NotOnOrAfter", "")); err != nil || !now.Before(notOnOrAfter.Add(samlClockSkew)) {
+			continue
+		}
+
+		confirmed = true
+	}
+	if !confirmed {
+		return errors.New("assertion has no valid bearer confirmation")
+	}
+
+	conditions := assertion.SelectElement("Conditions")
+	if conditions == nil {
+		return errors.New("assertion has no conditions")
+	}
+
+	if raw := conditions.SelectAttrValue("NotBefore", ""); raw != "" {
+		notBefore, err := time.Parse(time.RFC3339, raw)
+		if err != nil || now.Add(samlClockSkew).Before(notBefore) {
+			return errors.New("assertion is not yet valid")
+		}
+	}
+
+	if raw := conditions.SelectAttrValue("NotOnOrAfter", ""); raw != "" {
+		notOnOrAfter, err := time.Parse(time.RFC3339, raw)
+		if err != nil || !now.Before(notOnOrAfter.Add(samlClockSkew)) {
+			return errors.New("assertion has expired")
+		}
+	}
+
+	// every audience restriction has to name the sso
+	restrictions := conditions.SelectElements("AudienceRestriction")
+	if len(restrictions) == 0 {
+		return errors.New("assertion has no audience")
+	}
+	for _, restriction := range restrictions {
+		found := false
+		for _, audience := range restriction.SelectElements("Audience") {
+			if strings.TrimSpace(audience.Text()) == i.config.ClientID {
+				found = true
+			}
+		}
+
+		if !found {
+			return errors.New("assertion is for another audience")
+		}
+	}
+
+	return nil
+}
+
+func (i *SAMLProviderInterface) claims(assertion *etree.Element) (map[string]string, error) {
+	nameIDEl := assertion.FindElement("./Subject/NameID")
+	if nameIDEl == nil || strings.TrimSpace(nameIDEl.Text()) == "" {
+		return nil, errors.Join(e.InvalidSAMLResponse, errors.New("assertion has no name id"))
+	}
+	nameID := strings.TrimSpace(nameIDEl.Text())
+
+	attributes := map[string][]string{}
+	for _, attribute := range assertion.FindElements("./AttributeStatement/Attribute") {
+		name := attribute.SelectAttrValue("Name", "")
+		for _, value := range attribute.SelectElements("AttributeValue") {
+			attributes[name] = append(attributes[name], strings.TrimSpace(value.Text()))
+		}
+	}
+
+	first := func(name string) string {
+		if values := attributes[name]; len(values) > 0 {
+			return values[0]
+		}
+
+		return ""
+	}
+
+	subject := nameID
+	if i.config.Claims.Subject != "NameID" {
+		subject = first(i.config.Claims.Subject)
+	}
+	if subject == "" {
+		return nil, errors.Join(e.InvalidSAMLResponse, errors.New("assertion has no subject"))
+	}
+
+	email := first(i.config.Claims.Email)
+	if email == "" && nameIDEl.SelectAttrValue("Format", "") == "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress" {
+		email = nameID
+	}
+
+	verified := i.config.Claims.EmailAlwaysVerified
+	if !verified {
+		verified, _ = strconv.ParseBool(first(i.config.Claims.EmailVerified))
+	}
+
+	raw, err := json.Marshal(map[string]any{
+		"name_id": nameID,
+		"attributes": attributes,
+	})
+	if err != nil {
+		return nil, e.Unknown(err)
+	}
+
+	return map[string]string{
+		"provider": "saml",
+		"issuer": i.config.Issuer,
+		"sub": subject,
+		"email": email,
+		"email_verified": strconv.FormatBool(verified),
+		"name": first(i.config.Claims.Name),
+		"link_by_email": strconv.FormatBool(i.config.LinkByEmail != nil && *i.config.LinkByEmail),
+		"raw": string(raw),
+	}, nil
+}
+
+// importSAMLMetadata fills the missing entity id, sso url and certificates of conf from the identity provider metadata
+func importSAMLMetadata(ctx context.Context, client *http.Client, conf *config.IdentityProviderConfig) error {
+	var raw []byte
+	var err error
+	if conf.MetadataFile != "" {
+		raw, err = os.ReadFile(conf.MetadataFile)
+	} else {
+		raw, err = fetchMetadata(ctx, client, conf.MetadataURL)
+	}
+	if err != nil {
+		return err
+	}
+
+	var metadata entityDescriptorXML
+	if err := xml.Unmarshal(raw, &metadata); err != nil {
+		return fmt.Errorf("failed to parse saml metadata: %w", err)
+	}
+
+	if metadata.EntityID == "" || metadata.IDPSSODescriptor == nil {
+		return errors.New("saml metadata does not describe an identity provider")
+	}
+
+	if conf.Issuer == "" {
+		conf.Issuer = metadata.EntityID
+	}
+
+	if conf.AuthURL == "" {
+		for _, service := range metadata.IDPSSODescriptor.SingleSignOnServices {
+			if service.Binding == samlBindingRedirect {
+				conf.AuthURL = service.Location
+			}
+		}
+	}
+
+	if len(conf.Certificates) == 0 {
+		for _, descriptor := range metadata.IDPSSODescriptor.KeyDescriptors {
+			if descriptor.Use == "" || descriptor.Use == "signing" {
+				conf.Certificates = append(conf.Certificates, descriptor.Certificates...)
+			}
+		}
+	}
+
+	if conf.AuthURL == "" || len(conf.Certificates) == 0 {
+		return errors.New("saml metadata has no HTTP-Redirect sso service or signing certificate")
+	}
+
+	return nil
+}
+
+func fetchMetadata(ctx context.Context, client *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, e.Unknown(err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, e.Unknown(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s responded with %d", url, resp.StatusCode)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+}
+
+// parseCertificate accepts a pem block or the bare base64 der found in metadata
+func parseCertificate(encoded string) (*x509.Certificate, error) {
+	der := []byte{}
+	if block, _ := pem.Decode([]byte(encoded)); block != nil {
+		der = block.Bytes
+	} else {
+		decoded, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(encoded), ""))
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate: %w", err)
+		}
+		der = decoded
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate: %w", err)
+	}
+
+	return cert, nil
+}
+
+func signatureOf(el *etree.Element) *etree.Element {
+	for _, child := range el.ChildElements() {
+		if child.Tag == "Signature" && child.NamespaceURI() == dsig.Namespace {
+			return child
+		}
+	}
+
+	return nil
+}
+
+func statusValue(status *etree.Element) string {
+	if status == nil {
+		return "missing"
+	}
+
+	value := status.SelectAttrValue("Value", "")
+	if sub := status.SelectElement("StatusCode"); sub != nil {
+		value += " " + sub.SelectAttrValue("Value", "")
+	}
+
+	return value
+}
+
+// samlRequestID turns a nonce into an xml id, which must not start with a digit
+func samlRequestID(nonce string) string {
+	return "_" + nonce
+}
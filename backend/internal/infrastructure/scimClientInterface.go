@@ -0,0 +1,91 @@
+package infrastructure
+
+import (
+	"sso/internal/core"
+	e "sso/internal/core/errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"context"
+	"errors"
+)
+
+type SCIMClientInterface struct {
+	pool *pgxpool.Pool
+}
+
+func NewSCIMClientInterface(pool *pgxpool.Pool) *SCIMClientInterface {
+	return &SCIMClientInterface{
+		pool: pool,
+	}
+}
+
+func (i *SCIMClientInterface) ByTokenHash(ctx context.Context, tokenHash string) (*core.SCIMClient, error) {
+	var client core.SCIMClient
+
+	err := i.pool.QueryRow(ctx,
+		"SELECT id, name, token_hash, status, created_at FROM scim_clients WHERE token_hash = $1",
+		tokenHash,
+	).Scan(&client.ID, &client.Name, &client.TokenHash, &client.Status, &client.CreatedAt)
+
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		} else {
+			return nil, e.Unknown(err)
+		}
+	}
+
+	return &client, nil
+}
+
+func (i *SCIMClientInterface) List(ctx context.Context) ([]core.SCIMClient, error) {
+	rows, err := i.pool.Query(ctx, "SELECT id, name, token_hash, status, created_at FROM scim_clients ORDER BY created_at")
+	if err != nil {
+		return nil, e.Unknown(err)
+	}
+	defer rows.Close()
+
+	clients := []core.SCIMClient{}
+	for rows.Next() {
+		var client core.SCIMClient
+
+		if err := rows.Scan(&client.ID, &client.Name, &client.TokenHash, &client.Status, &client.CreatedAt); err != nil {
+			return nil, e.Unknown(err)
+		}
+
+		clients = append(clients, client)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, e.Unknown(err)
+	}
+
+	return clients, nil
+}
+
+func (i *SCIMClientInterface) Create(ctx context.Context, client *core.SCIMClient) error {
+	err := i.pool.QueryRow(ctx,
+		"INSERT INTO scim_clients(name, token_hash, status) VALUES ($1, $2, $3) RETURNING id, created_at",
+		client.Name, client.TokenHash, client.Status,
+	).Scan(&client.ID, &client.CreatedAt)
+
+	if err != nil {
+		return e.Unknown(err)
+	}
+
+	return nil
+}
+
+func (i *SCIMClientInterface) Revoke(ctx context.Context, id string) error {
+	tag, err := i.pool.Exec(ctx, "UPDATE scim_clients SET status = 'revoked' WHERE id = $1", id)
+	if err != nil {
+		return e.Unknown(err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return e.SCIMClientNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,164 @@
+package infrastructure
+
+import (
+	"sso/internal/core"
+	e "sso/internal/core/errors"
+
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// filterColumn is the sql expression a filter attribute compares, kind is string, bool, time or members
+type filterColumn struct {
+	expr string
+	kind string
+}
+
+var userFilterColumns = map[string]filterColumn{
+	"id": {"u.id", "string"},
+	"username": {"u.email", "string"},
+	"emails": {"u.email", "string"},
+	"emails.value": {"u.email", "string"},
+	"displayname": {"u.name", "string"},
+	"name.formatted": {"u.name", "string"},
+	"externalid": {"COALESCE(u.external_id, '')", "string"},
+	"active": {"(u.status = 'active')", "bool"},
+	"meta.created": {"u.created_at", "time"},
+	"meta.lastmodified": {"u.updated_at", "time"},
+}
+
+var groupFilterColumns = map[string]filterColumn{
+	"id": {"g.id", "string"},
+	"displayname": {"g.display_name", "string"},
+	"externalid": {"COALESCE(g.external_id, '')", "string"},
+	"members": {"m.user_id", "members"},
+	"members.value": {"m.user_id", "members"},
+	"meta.created": {"g.created_at", "time"},
+	"meta.lastmodified": {"g.updated_at", "time"},
+}
+
+// filterSQL compiles a filter to a condition with the semantics of core.Filter.Match, values are
+// appended to args and referenced as $n
+func filterSQL(filter *core.Filter, columns map[string]filterColumn, args *[]any) (string, error) {
+	switch filter.Op {
+	case "and", "or":
+		left, err := filterSQL(filter.Operands[0], columns, args)
+		if err != nil {
+			return "", err
+		}
+
+		right, err := filterSQL(filter.Operands[1], columns, args)
+		if err != nil {
+			return "", err
+		}
+
+		return "(" + left + " " + strings.ToUpper(filter.Op) + " " + right + ")", nil
+
+	case "not":
+		operand, err := filterSQL(filter.Operands[0], columns, args)
+		if err != nil {
+			return "", err
+		}
+
+		return "(NOT " + operand + ")", nil
+	}
+
+	column, ok := columns[filter.Attribute]
+	if !ok {
+		return "", errors.Join(e.InvalidFilter, errors.New("attribute "+filter.Attribute+" cannot be filtered"))
+	}
+
+	if column.kind == "members" {
+		// a group matches when one of its members does
+		condition := compareSQL(filter, column.expr, "string", args)
+		return "EXISTS (SELECT 1 FROM user_group_members m WHERE m.group_id = g.id AND " + condition + ")", nil
+	}
+
+	return compareSQL(filter, column.expr, column.kind, args), nil
+}
+
+func compareSQL(filter *core.Filter, expr, kind string, args *[]any) string {
+	if filter.Op == "pr" {
+		if kind == "string" {
+			return "(" + expr + " <> '')"
+		}
+
+		return "TRUE"
+	}
+
+	arg := func(value any) string {
+		*args = append(*args, value)
+		return "$" + strconv.Itoa(len(*args))
+	}
+
+	// a value of another type than the attribute never matches
+	switch kind {
+	case "string":
+		value, ok := filter.Value.(string)
+		if !ok {
+			return "FALSE"
+		}
+
+		switch filter.Op {
+		case "eq":
+			return "(lower(" + expr + ") = lower(" + arg(value) + "))"
+		case "ne":
+			return "(lower(" + expr + ") <> lower(" + arg(value) + "))"
+		case "co":
+			return "(" + expr + " ILIKE " + arg("%"+escapeLike(value)+"%") + ")"
+		case "sw":
+			return "(" + expr + " ILIKE " + arg(escapeLike(value)+"%") + ")"
+		case "ew":
+			return "(" + expr + " ILIKE " + arg("%"+escapeLike(value)) + ")"
+		default:
+			return "(lower(" + expr + ") " + sqlOperator(filter.Op) + " lower(" + arg(value) + "))"
+		}
+
+	case "bool":
+		value, ok := filter.Value.(bool)
+		if !ok || (filter.Op != "eq" && filter.Op != "ne") {
+			return "FALSE"
+		}
+
+		return "(" + expr + " " + sqlOperator(filter.Op) + " " + arg(value) + ")"
+
+	case "time":
+		raw, ok := filter.Value.(string)
+		if !ok {
+			return "FALSE"
+		}
+
+		value, err := time.Parse(time.RFC3339, raw)
+		if err != nil || filter.Op == "co" || filter.Op == "sw" || filter.Op == "ew" {
+			return "FALSE"
+		}
+
+		return "(" + expr + " " + sqlOperator(filter.Op) + " " + arg(value.UTC()) + ")"
+	}
+
+	return "FALSE"
+}
+
+func sqlOperator(op string) string {
+	switch op {
+	case "eq":
+		return "="
+	case "ne":
+		return "<>"
+	case "gt":
+		return ">"
+	case "ge":
+		return ">="
+	case "lt":
+		return "<"
+	default:
+		return "<="
+	}
+}
+
+// escapeLike makes the wildcards of a LIKE pattern literal, backslash is the default escape
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(value)
+}
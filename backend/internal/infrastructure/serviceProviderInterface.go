@@ -0,0 +1,42 @@
+package infrastructure
+
+import (
+	"sso/internal/core"
+	e "sso/internal/core/errors"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"context"
+	"errors"
+)
+
+type ServiceProviderInterface struct {
+	pool *pgxpool.Pool
+}
+
+func NewServiceProviderInterface(pool *pgxpool.Pool) *ServiceProviderInterface {
+	return &ServiceProviderInterface{
+		pool: pool,
+	}
+}
+
+func (i *ServiceProviderInterface) ByEntityID(ctx context.Context, entityID string) (*core.ServiceProvider, error) {
+	var sp core.ServiceProvider
+
+	err := i.pool.QueryRow(ctx,
+		`SELECT id, entity_id, name, acs_urls, name_id_format, attributes, status, created_at
+		 FROM saml_service_providers WHERE entity_id = $1`,
+		entityID,
+	).Scan(&sp.ID, &sp.EntityID, &sp.Name, &sp.ACSURLs, &sp.NameIDFormat, &sp.Attributes, &sp.Status, &sp.CreatedAt)
+
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		} else {
+			return nil, e.Unknown(err)
+		}
+	}
+
+	return &sp, nil
+}
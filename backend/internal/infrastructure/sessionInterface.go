@@ -0,0 +1,121 @@
+package infrastructure
+
+import (
+	"sso/internal/core"
+	e "sso/internal/core/errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"context"
+	"errors"
+	"time"
+)
+
+type SessionInterface struct {
+	pool *pgxpool.Pool
+}
+
+func NewSessionInterface(pool *pgxpool.Pool) *SessionInterface {
+	return &SessionInterface{
+		pool,
+	}
+}
+
+func (i *SessionInterface) ByID(ctx context.Context, id string) (*core.Session, error) {
+	var session core.Session
+
+	err := i.pool.QueryRow(ctx,
+		`SELECT id, user_id, ip, user_agent, auth_methods, created_at, last_seen_at, expires_at, idle_timeout, remember_me, revoked_at
+		 FROM sessions WHERE id = $1`,
+		id,
+	).Scan(&session.ID, &session.UserID, &session.IP, &session.UserAgent, &session.AuthMethods, &session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt, &session.IdleTimeout, &session.RememberMe, &session.RevokedAt)
+
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		} else {
+			return nil, e.Unknown(err)
+		}
+	}
+
+	return &session, nil
+}
+
+func (i *SessionInterface) ByUser(ctx context.Context, userID string) ([]core.Session, error) {
+	rows, err := i.pool.Query(ctx,
+		`SELECT id, user_id, ip, user_agent, auth_methods, created_at, last_seen_at, expires_at, idle_timeout, remember_me, revoked_at
+		 FROM sessions WHERE user_id = $1 ORDER BY last_seen_at DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, e.Unknown(err)
+	}
+	defer rows.Close()
+
+	sessions := []core.Session{}
+	for rows.Next() {
+		var session core.Session
+
+		err := rows.Scan(&session.ID, &session.UserID, &session.IP, &session.UserAgent, &session.AuthMethods, &session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt, &session.IdleTimeout, &session.RememberMe, &session.RevokedAt)
+		if err != nil {
+			return nil, e.Unknown(err)
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, e.Unknown(err)
+	}
+
+	return sessions, nil
+}
+
+func (i *SessionInterface) Create(ctx context.Context, session *core.Session) error {
+	var id string
+	err := i.pool.QueryRow(ctx,
+		`INSERT INTO sessions(user_id, ip, user_agent, auth_methods, created_at, last_seen_at, expires_at, idle_timeout, remember_me)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`,
+		session.UserID, session.IP, session.UserAgent, session.AuthMethods, session.CreatedAt, session.LastSeenAt, session.ExpiresAt, session.IdleTimeout, session.RememberMe,
+	).Scan(&id)
+
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23503" { // foreign key violation
+			return e.UserNotFound
+		} else {
+			return e.Unknown(err)
+		}
+	}
+
+	session.ID = id
+
+	return nil
+}
+
+func (i *SessionInterface) Update(ctx context.Context, session *core.Session) error {
+	_, err := i.pool.Exec(ctx,
+		"UPDATE sessions SET last_seen_at = $1, expires_at = $2, revoked_at = $3 WHERE id = $4",
+		session.LastSeenAt, session.ExpiresAt, session.RevokedAt, session.ID,
+	)
+
+	if err != nil {
+		return e.Unknown(err)
+	}
+
+	return nil
+}
+
+func (i *SessionInterface) RevokeAll(ctx context.Context, userID string) error {
+	_, err := i.pool.Exec(ctx,
+		"UPDATE sessions SET revoked_at = $1 WHERE user_id = $2 AND revoked_at IS NULL",
+		time.Now().UTC(), userID,
+	)
+
+	if err != nil {
+		return e.Unknown(err)
+	}
+
+	return nil
+}
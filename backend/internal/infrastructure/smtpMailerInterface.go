@@ -0,0 +1,114 @@
+package infrastructure
+
+import (
+	"sso/internal/core"
+	e "sso/internal/core/errors"
+
+	"bytes"
+	"context"
+	"crypto/tls"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+const smtpTimeout = 10*time.Second
+
+// SMTPMailerInterface sends the emails through a relay, upgrading to tls when the relay offers it
+type SMTPMailerInterface struct {
+	addr string
+	from string
+	username string
+	password string
+}
+
+func NewSMTPMailerInterface(addr, from, username, password string) *SMTPMailerInterface {
+	return &SMTPMailerInterface{
+		addr,
+		from,
+		username,
+		password,
+	}
+}
+
+func (i *SMTPMailerInterface) Send(ctx context.Context, m core.Mail) error {
+	from, err := mail.ParseAddress(i.from)
+	if err != nil {
+		return e.Unknown(err)
+	}
+
+	to, err := mail.ParseAddress(m.To)
+	if err != nil {
+		return e.Unknown(err)
+	}
+
+	dialer := net.Dialer{Timeout: smtpTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", i.addr)
+	if err != nil {
+		return e.Unknown(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+	host, _, _ := net.SplitHostPort(i.addr)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return e.Unknown(err)
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return e.Unknown(err)
+		}
+	}
+
+	if i.username != "" {
+		if err := client.Auth(smtp.PlainAuth("", i.username, i.password, host)); err != nil {
+			return e.Unknown(err)
+		}
+	}
+
+	if err := client.Mail(from.Address); err != nil {
+		return e.Unknown(err)
+	}
+	if err := client.Rcpt(to.Address); err != nil {
+		return e.Unknown(err)
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return e.Unknown(err)
+	}
+	if _, err := w.Write(mailMessage(from, to, m)); err != nil {
+		return e.Unknown(err)
+	}
+	if err := w.Close(); err != nil {
+		return e.Unknown(err)
+	}
+
+	if err := client.Quit(); err != nil {
+		return e.Unknown(err)
+	}
+
+	return nil
+}
+
+// mailMessage formats a plain text email, the lines of the body end with crlf as smtp expects
+func mailMessage(from, to *mail.Address, m core.Mail) []byte {
+	var b bytes.Buffer
+	b.WriteString("From: " + from.String() + "\r\n")
+	b.WriteString("To: " + to.String() + "\r\n")
+	b.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", m.Subject) + "\r\n")
+	b.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(m.Text, "\r\n", "\n"), "\n", "\r\n"))
+
+	return b.Bytes()
+}
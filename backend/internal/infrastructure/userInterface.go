@@ -9,6 +9,7 @@ import (
 
 	"context"
 	"errors"
+	"strconv"
 )
 
 type UserInterface struct {
@@ -21,115 +22,79 @@ func NewUserInterface(pool *pgxpool.Pool) *UserInterface {
 	}
 }
 
-func (i *UserInterface) ByID(ctx context.Context, id string) (*core.User, error) {
-	var name string
-	var email string
-	var status string
-
-	err := i.pool.QueryRow(ctx, 
-	"SELECT name, email, status FROM users WHERE id = $1",
-		id,
-	).Scan(&name, &email, &status)
-	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			return nil, nil
-		} else {
-			return nil, e.Unknown(err)
-		}
-	}
-
-	user := core.User{
-		ID: id,
-		Name: name,
-		Email: email,
-		Status: status,
-	}
+// userColumns are read by scanUser, external_id is null for users no provisioning client manages
+const userColumns = "u.id, u.name, u.email, u.email_verified, u.status, u.roles, COALESCE(u.external_id, ''), u.version, u.created_at, u.updated_at"
 
-	if err := i.preload(ctx, &user); err != nil {
-		return nil, err
-	}
-
-	return &user, nil
+func (i *UserInterface) ByID(ctx context.Context, id string) (*core.User, error) {
+	return i.one(ctx, "SELECT "+userColumns+" FROM users u WHERE u.id = $1", id)
 }
 
 func (i *UserInterface) ByIdentity(ctx context.Context, itype, externalID, issuer string) (*core.User, error) {
-	var id string
-	var name string
-	var email string
-	var status string
-
-	err := i.pool.QueryRow(ctx, 
-		`SELECT u.id, u.name, u.email, u.status 
+	return i.one(ctx,
+		`SELECT `+userColumns+`
 		 FROM users u
 		 JOIN identities i ON u.id = i.user_id
 		 WHERE i.type = $1 AND i.external_id = $2 AND i.issuer = $3`,
 		itype, externalID, issuer,
-	).Scan(&id, &name, &email, &status)
+	)
+}
 
-	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			return nil, nil
-		} else {
-			return nil, e.Unknown(err)
+func (i *UserInterface) ByEmail(ctx context.Context, email string) (*core.User, error) {
+	return i.one(ctx, "SELECT "+userColumns+" FROM users u WHERE u.email = $1", email)
+}
+
+func (i *UserInterface) ByName(ctx context.Context, name string) (*core.User, error) {
+	return i.one(ctx, "SELECT "+userColumns+" FROM users u WHERE u.name = $1", name)
+}
+
+// Search orders the users by creation, the filter is compiled to sql
+func (i *UserInterface) Search(ctx context.Context, filter *core.Filter, offset, limit int) ([]core.User, int, error) {
+	args := []any{}
+	where := "u.status <> 'deleted'"
+	if filter != nil {
+		condition, err := filterSQL(filter, userFilterColumns, &args)
+		if err != nil {
+			return nil, 0, err
 		}
+		where += " AND " + condition
 	}
 
-	user := core.User{
-		ID: id,
-		Name: name,
-		Email: email,
-		Status: status,
+	var total int
+	if err := i.pool.QueryRow(ctx, "SELECT COUNT(*) FROM users u WHERE "+where, args...).Scan(&total); err != nil {
+		return nil, 0, e.Unknown(err)
 	}
 
-	if err := i.preload(ctx, &user); err != nil {
-		return nil, err
+	args = append(args, limit, offset)
+	rows, err := i.pool.Query(ctx,
+		"SELECT "+userColumns+" FROM users u WHERE "+where+
+		" ORDER BY u.created_at, u.id LIMIT $"+strconv.Itoa(len(args)-1)+" OFFSET $"+strconv.Itoa(len(args)),
+		args...,
+	)
+	if err != nil {
+		return nil, 0, e.Unknown(err)
 	}
+	defer rows.Close()
 
-	return &user, nil
-}
-
-func (i *UserInterface) ByEmail(ctx context.Context, email string) (*core.User, error) {
-	var id string
-	var name string
-	var status string
-
-	err := i.pool.QueryRow(ctx,
-		"SELECT id, name, status FROM users WHERE email = $1",
-		email,
-	).Scan(&id, &name, &status)
-
-	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			return nil, nil
-		} else {
-			return nil, e.Unknown(err)
+	users := []core.User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, 0, e.Unknown(err)
 		}
-	}
 
-	user := core.User{
-		ID: id,
-		Name: name,
-		Email: email,
-		Status: status,
+		users = append(users, *user)
 	}
 
-	if err := i.preload(ctx, &user); err != nil {
-		return nil, err
+	if err := rows.Err(); err != nil {
+		return nil, 0, e.Unknown(err)
 	}
 
-	return &user, nil
+	return users, total, nil
 }
 
-func (i *UserInterface) ByName(ctx context.Context, name string) (*core.User, error) {
-	var id string
-	var email string
-	var status string
-
-	err := i.pool.QueryRow(ctx, 
-	"SELECT id, email, status FROM users WHERE name = $1",
-		name,
-	).Scan(&id, &email, &status)
-
+// one returns the user selected by query with its identities, nil when there is none
+func (i *UserInterface) one(ctx context.Context, query string, args ...any) (*core.User, error) {
+	user, err := scanUser(i.pool.QueryRow(ctx, query, args...))
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return nil, nil
@@ -138,14 +103,18 @@ func (i *UserInterface) ByName(ctx context.Context, name string) (*core.User, er
 		}
 	}
 
-	user := core.User{
-		ID: id,
-		Name: name,
-		Email: email,
-		Status: status,
+	if err := i.preload(ctx, user); err != nil {
+		return nil, err
 	}
 
-	if err := i.preload(ctx, &user); err != nil {
+	return user, nil
+}
+
+func scanUser(row pgx.Row) (*core.User, error) {
+	var user core.User
+
+	err := row.Scan(&user.ID, &user.Name, &user.Email, &user.EmailVerified, &user.Status, &user.Roles, &user.ExternalID, &user.Version, &user.CreatedAt, &user.UpdatedAt)
+	if err != nil {
 		return nil, err
 	}
 
@@ -155,10 +124,15 @@ func (i *UserInterface) ByName(ctx context.Context, name string) (*core.User, er
 func (i *UserInterface) Create(ctx context.Context, user *core.User) error {
 	var id string
 	err := i.pool.QueryRow(ctx,
-		"INSERT INTO users(name, email) VALUES ($1, $2) RETURNING id",
+		`INSERT INTO users(name, email, status, roles, external_id, email_verified) VALUES ($1, $2, COALESCE(NULLIF($3, ''), 'active'), $4, NULLIF($5, ''), $6)
+		 RETURNING id, version, created_at, updated_at`,
 		user.Name,
 		user.Email,
-	).Scan(&id)
+		user.Status,
+		orEmpty(user.Roles),
+		user.ExternalID,
+		user.EmailVerified,
+	).Scan(&id, &user.Version, &user.CreatedAt, &user.UpdatedAt)
 
 	if err != nil {
 		var pgErr *pgconn.PgError
@@ -174,18 +148,25 @@ func (i *UserInterface) Create(ctx context.Context, user *core.User) error {
 	return nil
 }
 
+// Update writes the user and moves it to the next version
 func (i *UserInterface) Update(ctx context.Context, user *core.User) error {
-	_, err := i.pool.Exec(ctx, 
-		"UPDATE users SET name = $1, email = $2, status = $3 WHERE id = $4", 
+	err := i.pool.QueryRow(ctx, 
+		`UPDATE users SET name = $1, email = $2, status = $3, roles = $4, external_id = NULLIF($5, ''), email_verified = $6, version = version + 1, updated_at = NOW()
+		 WHERE id = $7 RETURNING version, updated_at`, 
 		user.Name,
 		user.Email,
 		user.Status,
+		orEmpty(user.Roles),
+		user.ExternalID,
+		user.EmailVerified,
 		user.ID,
-	)
+	).Scan(&user.Version, &user.UpdatedAt)
 
 	if err != nil {
 		var pgErr *pgconn.PgError
-		if errors.As(err, &pgErr) && pgErr.Code == "23505" { // unique violation
+		if errors.Is(err, pgx.ErrNoRows) {
+			return e.UserNotFound
+		} else if errors.As(err, &pgErr) && pgErr.Code == "23505" { // unique violation
 			return e.UniqueViolated
 		} else {
 			return e.Unknown(err)
@@ -224,6 +205,8 @@ func (i *UserInterface) SaveIdentity(ctx context.Context, identity *core.Identit
 		var pgErr *pgconn.PgError
 		if errors.As(err, &pgErr) && pgErr.Code == "23503" { // foreign key violation
 			return e.UserNotFound
+		} else if errors.As(err, &pgErr) && pgErr.Code == "23505" { // unique violation
+			return e.UniqueViolated
 		} else {
 			return e.Unknown(err)
 		}
@@ -234,25 +217,36 @@ func (i *UserInterface) SaveIdentity(ctx context.Context, identity *core.Identit
 	return nil
 }
 
+// SaveCredential stores a credential of an identity or, when IdentityID is empty, of the account
 func (i *UserInterface) SaveCredential(ctx context.Context, credential *core.Credential) error {
 	if credential.ID != "" { 
 		_, err := i.pool.Exec(ctx, 
-			"UPDATE credentials SET hash = $1, status = $2 WHERE id = $3",
-			credential.Hash, credential.Status, credential.ID,
+			"UPDATE credentials SET hash = $1, status = $2, counter = $3, transports = $4 WHERE id = $5",
+			credential.Hash, credential.Status, credential.Counter, orEmpty(credential.Transports), credential.ID,
 		)
 
-		return err
+		if err != nil {
+			return e.Unknown(err)
+		}
+
+		return nil
 	} 
 
 	var id string
 	err := i.pool.QueryRow(ctx, 
-		"INSERT INTO credentials(identity_id, type, hash) VALUES ($1, $2, $3) RETURNING id",
-		credential.IdentityID, credential.Type, credential.Hash,
+		`INSERT INTO credentials(identity_id, user_id, type, hash, status, counter, external_id, public_key, transports)
+		 VALUES (NULLIF($1, ''), NULLIF($2, ''), $3, $4, COALESCE(NULLIF($5, ''), 'active'), $6, NULLIF($7, ''), $8, $9) RETURNING id`,
+		credential.IdentityID, credential.UserID, credential.Type, credential.Hash, credential.Status, credential.Counter,
+		credential.ExternalID, credential.PublicKey, orEmpty(credential.Transports),
 	).Scan(&id)
 
 	if err != nil {
 		var pgErr *pgconn.PgError
-		if errors.As(err, &pgErr) && pgErr.Code == "23503" { // foreign key violation
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" { // unique violation
+			return e.UniqueViolated
+		} else if errors.As(err, &pgErr) && pgErr.Code == "23503" && credential.IdentityID == "" { // foreign key violation
+			return e.UserNotFound
+		} else if errors.As(err, &pgErr) && pgErr.Code == "23503" {
 			return e.IdentityNotFound
 		} else {
 			return e.Unknown(err)
@@ -264,6 +258,24 @@ func (i *UserInterface) SaveCredential(ctx context.Context, credential *core.Cre
 	return nil
 }
 
+// DeleteIdentity removes an identity of the user together with its credentials
+func (i *UserInterface) DeleteIdentity(ctx context.Context, userID, identityID string) error {
+	tag, err := i.pool.Exec(ctx,
+		"DELETE FROM identities WHERE id = $1 AND user_id = $2",
+		identityID, userID,
+	)
+
+	if err != nil {
+		return e.Unknown(err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return e.IdentityNotFound
+	}
+
+	return nil
+}
+
 func (i *UserInterface) preload(ctx context.Context, user *core.User) error {
 	identityRows, err := i.pool.Query(ctx, 
 		"SELECT id, type, external_id, issuer, created_at FROM identities WHERE user_id = $1",
@@ -282,39 +294,66 @@ func (i *UserInterface) preload(ctx context.Context, user *core.User) error {
 		var identity core.Identity
 
 		err := identityRows.Scan(&identity.ID, &identity.Type, &identity.ExternalID, &identity.Issuer, &identity.CreatedAt)
+		identity.UserID = user.ID
 
 		if err != nil {
 			return e.Unknown(err)
 		}
 
-		credentialRows, err := i.pool.Query(ctx, 
-			"SELECT id, type, hash, status, created_at FROM credentials WHERE identity_id = $1",
-			identity.ID,
-		)
-
+		identity.Credentials, err = i.credentials(ctx, "identity_id", identity.ID)
 		if err != nil {
-			if errors.Is(err, pgx.ErrNoRows) {
-				continue
-			} else {
-				return e.Unknown(err)
-			}
+			return err
 		}
-		defer credentialRows.Close()
 
-		for credentialRows.Next() {
-			var cred core.Credential
+		user.Identities = append(user.Identities, identity)
+	}
 
-			err := credentialRows.Scan(&cred.ID, &cred.Type, &cred.Hash, &cred.Status, &cred.CreatedAt)
+	user.Credentials, err = i.credentials(ctx, "user_id", user.ID)
+	if err != nil {
+		return err
+	}
 
-			if err != nil {
-				return e.Unknown(err)
-			}
+	return nil
+}
 
-			identity.Credentials = append(identity.Credentials, cred)
+// credentials returns the credentials owned by the identity or the user, column is one of identity_id and user_id
+func (i *UserInterface) credentials(ctx context.Context, column, owner string) ([]core.Credential, error) {
+	rows, err := i.pool.Query(ctx, 
+		`SELECT id, COALESCE(identity_id, ''), COALESCE(user_id, ''), type, COALESCE(hash, ''), status, counter,
+		 COALESCE(external_id, ''), public_key, transports, created_at
+		 FROM credentials WHERE `+column+` = $1 ORDER BY created_at`,
+		owner,
+	)
+	if err != nil {
+		return nil, e.Unknown(err)
+	}
+	defer rows.Close()
+
+	credentials := []core.Credential{}
+	for rows.Next() {
+		var cred core.Credential
+
+		err := rows.Scan(&cred.ID, &cred.IdentityID, &cred.UserID, &cred.Type, &cred.Hash, &cred.Status, &cred.Counter,
+			&cred.ExternalID, &cred.PublicKey, &cred.Transports, &cred.CreatedAt)
+		if err != nil {
+			return nil, e.Unknown(err)
 		}
 
-		user.Identities = append(user.Identities, identity)
+		credentials = append(credentials, cred)
 	}
 
-	return nil
+	if err := rows.Err(); err != nil {
+		return nil, e.Unknown(err)
+	}
+
+	return credentials, nil
+}
+
+// orEmpty keeps a nil slice from being stored as NULL in a not null array column
+func orEmpty(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+
+	return values
 }
@@ -0,0 +1,14 @@
+package infrastructure
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+)
+
+// randomID returns an unguessable url safe identifier
+func randomID() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
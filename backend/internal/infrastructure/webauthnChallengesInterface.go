@@ -0,0 +1,62 @@
+package infrastructure
+
+import (
+	"sso/internal/core"
+
+	"sync"
+	"time"
+)
+
+type WebAuthnChallengesInterface struct {
+	mu sync.Mutex
+	ceremonies map[string]webauthnCeremony
+}
+
+type webauthnCeremony struct {
+	ceremony core.WebAuthnCeremony
+	expiration time.Time
+}
+
+func NewWebAuthnChallengesInterface() *WebAuthnChallengesInterface {
+	return &WebAuthnChallengesInterface{
+		ceremonies: map[string]webauthnCeremony{},
+	}
+}
+
+func (i *WebAuthnChallengesInterface) Issue(ceremony core.WebAuthnCeremony, ttl int) (string, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	now := time.Now()
+	for challenge, c := range i.ceremonies {
+		if c.expiration.Before(now) {
+			delete(i.ceremonies, challenge)
+		}
+	}
+
+	// the challenge is the random value the authenticator signs, base64url as the browser echoes it
+	challenge := randomID()
+	i.ceremonies[challenge] = webauthnCeremony{
+		ceremony: ceremony,
+		expiration: now.Add(time.Duration(ttl)*time.Second),
+	}
+
+	return challenge, nil
+}
+
+func (i *WebAuthnChallengesInterface) Take(challenge string) (*core.WebAuthnCeremony, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	c, ok := i.ceremonies[challenge]
+	if !ok {
+		return nil, nil
+	}
+	delete(i.ceremonies, challenge)
+
+	if c.expiration.Before(time.Now()) {
+		return nil, nil
+	}
+
+	return &c.ceremony, nil
+}
@@ -0,0 +1,393 @@
+package infrastructure
+
+import (
+	"sso/internal/core"
+	e "sso/internal/core/errors"
+
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"slices"
+	"strings"
+)
+
+// authenticator data flags
+const (
+	flagUserPresent = 0x01
+	flagUserVerified = 0x04
+	flagAttestedCredential = 0x40
+)
+
+// COSE algorithms
+const (
+	coseES256 = -7
+	coseEdDSA = -8
+	coseRS256 = -257
+)
+
+// WebAuthnInterface checks the responses of authenticators. Attestation is not evaluated against
+// a trust store, the sso asks for none and accepts any authenticator
+type WebAuthnInterface struct {
+	rpIDHash [32]byte
+	origins []string
+}
+
+func NewWebAuthnInterface(rpID string, origins []string) *WebAuthnInterface {
+	return &WebAuthnInterface{
+		rpIDHash: sha256.Sum256([]byte(rpID)),
+		origins: origins,
+	}
+}
+
+// credentialResponse is a PublicKeyCredential in its JSON form, binary values are base64url
+type credentialResponse struct {
+	ID string `json:"id"`
+	RawID string `json:"rawId"`
+	Type string `json:"type"`
+	Response struct {
+		ClientDataJSON string `json:"clientDataJSON"`
+		// registration
+		AttestationObject string `json:"attestationObject"`
+		Transports []string `json:"transports"`
+		// authentication
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature string `json:"signature"`
+		UserHandle string `json:"userHandle"`
+	} `json:"response"`
+}
+
+type clientData struct {
+	Type string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin string `json:"origin"`
+}
+
+type authenticatorData struct {
+	flags byte
+	signCount uint32
+	credentialID []byte
+	// publicKey is the COSE key of an attested credential
+	publicKey []byte
+}
+
+func (i *WebAuthnInterface) ParseRegistration(response []byte) (*core.WebAuthnRegistration, error) {
+	credential, clientDataJSON, challenge, err := i.parseResponse(response, "webauthn.create")
+	if err != nil {
+		return nil, err
+	}
+
+	attestationObject, err := decodeBase64URL(credential.Response.AttestationObject)
+	if err != nil {
+		return nil, errors.Join(e.InvalidWebAuthnResponse, err)
+	}
+
+	decoded, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return nil, errors.Join(e.InvalidWebAuthnResponse, err)
+	}
+
+	attestation, ok := decoded.(map[any]any)
+	if !ok {
+		return nil, errors.Join(e.InvalidWebAuthnResponse, errors.New("attestation object is not a map"))
+	}
+
+	rawAuthData, _ := attestation["authData"].([]byte)
+	authData, err := i.parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+
+	if authData.publicKey == nil {
+		return nil, errors.Join(e.InvalidWebAuthnResponse, errors.New("authenticator data has no attested credential"))
+	}
+
+	if base64.RawURLEncoding.EncodeToString(authData.credentialID) != credential.ID {
+		return nil, errors.Join(e.InvalidWebAuthnResponse, errors.New("attested credential is not the one of the response"))
+	}
+
+	publicKey, alg, err := parseCOSEKey(authData.publicKey)
+	if err != nil {
+		return nil, errors.Join(e.InvalidWebAuthnResponse, err)
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(slices.Clone(rawAuthData), clientDataHash[:]...)
+	statement, _ := attestation["attStmt"].(map[any]any)
+
+	switch attestation["fmt"] {
+	case "none":
+	case "packed":
+		if err := verifyPackedAttestation(statement, signed, publicKey, alg); err != nil {
+			return nil, errors.Join(e.InvalidWebAuthnResponse, err)
+		}
+	default:
+		return nil, errors.Join(e.InvalidWebAuthnResponse, errors.New("attestation format is not supported"))
+	}
+
+	return &core.WebAuthnRegistration{
+		Challenge: challenge,
+		CredentialID: credential.ID,
+		PublicKey: authData.publicKey,
+		SignCount: authData.signCount,
+		Transports: credential.Response.Transports,
+	}, nil
+}
+
+func (i *WebAuthnInterface) ParseAssertion(response []byte) (*core.WebAuthnAssertion, error) {
+	credential, clientDataJSON, challenge, err := i.parseResponse(response, "webauthn.get")
+	if err != nil {
+		return nil, err
+	}
+
+	rawAuthData, err := decodeBase64URL(credential.Response.AuthenticatorData)
+	if err != nil {
+		return nil, errors.Join(e.InvalidWebAuthnResponse, err)
+	}
+
+	authData, err := i.parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := decodeBase64URL(credential.Response.Signature)
+	if err != nil {
+		return nil, errors.Join(e.InvalidWebAuthnResponse, err)
+	}
+
+	userHandle, err := decodeBase64URL(credential.Response.UserHandle)
+	if err != nil {
+		return nil, errors.Join(e.InvalidWebAuthnResponse, err)
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+
+	return &core.WebAuthnAssertion{
+		Challenge: challenge,
+		CredentialID: credential.ID,
+		UserHandle: base64.RawURLEncoding.EncodeToString(userHandle),
+		SignCount: authData.signCount,
+		UserVerified: authData.flags&flagUserVerified != 0,
+		SignedData: append(slices.Clone(rawAuthData), clientDataHash[:]...),
+		Signature: signature,
+	}, nil
+}
+
+func (i *WebAuthnInterface) VerifyAssertion(assertion *core.WebAuthnAssertion, publicKey []byte) error {
+	key, alg, err := parseCOSEKey(publicKey)
+	if err != nil {
+		return errors.Join(e.InvalidWebAuthnResponse, err)
+	}
+
+	if err := verifySignature(key, alg, assertion.SignedData, assertion.Signature); err != nil {
+		return errors.Join(e.InvalidWebAuthnResponse, err)
+	}
+
+	return nil
+}
+
+// parseResponse decodes the credential and checks its client data was made for a ceremony of
+// ctype on an origin of the sso. It returns the raw client data and the challenge it answers
+func (i *WebAuthnInterface) parseResponse(response []byte, ctype string) (*credentialResponse, []byte, string, error) {
+	var credential credentialResponse
+	if err := json.Unmarshal(response, &credential); err != nil {
+		return nil, nil, "", errors.Join(e.InvalidWebAuthnResponse, err)
+	}
+
+	if credential.Type != "public-key" {
+		return nil, nil, "", errors.Join(e.InvalidWebAuthnResponse, errors.New("credential is not a public key"))
+	}
+
+	rawID, err := decodeBase64URL(credential.RawID)
+	if err != nil || len(rawID) == 0 {
+		return nil, nil, "", errors.Join(e.InvalidWebAuthnResponse, errors.New("credential has no id"))
+	}
+	credential.ID = base64.RawURLEncoding.EncodeToString(rawID)
+
+	clientDataJSON, err := decodeBase64URL(credential.Response.ClientDataJSON)
+	if err != nil {
+		return nil, nil, "", errors.Join(e.InvalidWebAuthnResponse, err)
+	}
+
+	var data clientData
+	if err := json.Unmarshal(clientDataJSON, &data); err != nil {
+		return nil, nil, "", errors.Join(e.InvalidWebAuthnResponse, err)
+	}
+
+	if data.Type != ctype {
+		return nil, nil, "", errors.Join(e.InvalidWebAuthnResponse, errors.New("client data is of another ceremony"))
+	}
+
+	// a phishing site gets a response for its own origin, which is refused here
+	if !slices.Contains(i.origins, data.Origin) {
+		return nil, nil, "", errors.Join(e.InvalidWebAuthnResponse, errors.New("origin is not allowed: "+data.Origin))
+	}
+
+	if data.Challenge == "" {
+		return nil, nil, "", errors.Join(e.InvalidWebAuthnResponse, errors.New("client data has no challenge"))
+	}
+
+	return &credential, clientDataJSON, data.Challenge, nil
+}
+
+// parseAuthenticatorData checks the data was made for the relying party with the user present
+func (i *WebAuthnInterface) parseAuthenticatorData(raw []byte) (*authenticatorData, error) {
+	if len(raw) < 37 {
+		return nil, errors.Join(e.InvalidWebAuthnResponse, errors.New("authenticator data is too short"))
+	}
+
+	if subtle.ConstantTimeCompare(raw[:32], i.rpIDHash[:]) != 1 {
+		return nil, errors.Join(e.InvalidWebAuthnResponse, errors.New("authenticator data is for another relying party"))
+	}
+
+	data := &authenticatorData{
+		flags: raw[32],
+		signCount: binary.BigEndian.Uint32(raw[33:37]),
+	}
+
+	if data.flags&flagUserPresent == 0 {
+		return nil, errors.Join(e.InvalidWebAuthnResponse, errors.New("user was not present"))
+	}
+
+	if data.flags&flagAttestedCredential != 0 {
+		// aaguid, then the length of the credential id
+		rest := raw[37:]
+		if len(rest) < 18 {
+			return nil, errors.Join(e.InvalidWebAuthnResponse, errors.New("attested credential data is too short"))
+		}
+
+		idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if len(rest) < idLength {
+			return nil, errors.Join(e.InvalidWebAuthnResponse, errors.New("credential id is too short"))
+		}
+		data.credentialID = rest[:idLength]
+		rest = rest[idLength:]
+
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, errors.Join(e.InvalidWebAuthnResponse, err)
+		}
+		data.publicKey = rest[:len(rest)-len(after)]
+	}
+
+	return data, nil
+}
+
+// parseCOSEKey returns the public key of a COSE_Key with the algorithm it signs with
+func parseCOSEKey(raw []byte) (crypto.PublicKey, int64, error) {
+	decoded, _, err := decodeCBOR(raw)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	key, ok := decoded.(map[any]any)
+	if !ok {
+		return nil, 0, errors.New("cose key is not a map")
+	}
+
+	alg, _ := key[int64(3)].(int64)
+	switch alg {
+	case coseES256:
+		x, _ := key[int64(-2)].([]byte)
+		y, _ := key[int64(-3)].([]byte)
+		if key[int64(1)] != int64(2) || key[int64(-1)] != int64(1) || len(x) != 32 || len(y) != 32 {
+			return nil, 0, errors.New("es256 key is not a p-256 point")
+		}
+
+		public, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), append(append([]byte{4}, x...), y...))
+		if err != nil {
+			return nil, 0, err
+		}
+		return public, alg, nil
+
+	case coseEdDSA:
+		x, _ := key[int64(-2)].([]byte)
+		if key[int64(1)] != int64(1) || key[int64(-1)] != int64(6) || len(x) != ed25519.PublicKeySize {
+			return nil, 0, errors.New("eddsa key is not an ed25519 key")
+		}
+		return ed25519.PublicKey(x), alg, nil
+
+	case coseRS256:
+		n, _ := key[int64(-1)].([]byte)
+		exponent, _ := key[int64(-2)].([]byte)
+		if key[int64(1)] != int64(3) || len(n) < 256 || len(exponent) == 0 || len(exponent) > 4 {
+			return nil, 0, errors.New("rs256 key is not a rsa key of 2048 bits or more")
+		}
+		public := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(exponent).Int64()),
+		}
+		if public.E < 3 {
+			return nil, 0, errors.New("rsa exponent is too small")
+		}
+		return public, alg, nil
+
+	default:
+		return nil, 0, errors.New("cose algorithm is not supported")
+	}
+}
+
+func verifySignature(key crypto.PublicKey, alg int64, signed, signature []byte) error {
+	switch alg {
+	case coseES256:
+		digest := sha256.Sum256(signed)
+		public, ok := key.(*ecdsa.PublicKey)
+		if !ok || !ecdsa.VerifyASN1(public, digest[:], signature) {
+			return errors.New("es256 signature does not match")
+		}
+	case coseEdDSA:
+		public, ok := key.(ed25519.PublicKey)
+		if !ok || !ed25519.Verify(public, signed, signature) {
+			return errors.New("eddsa signature does not match")
+		}
+	case coseRS256:
+		digest := sha256.Sum256(signed)
+		public, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("rs256 key is not a rsa key")
+		}
+		return rsa.VerifyPKCS1v15(public, crypto.SHA256, digest[:], signature)
+	default:
+		return errors.New("cose algorithm is not supported")
+	}
+
+	return nil
+}
+
+// verifyPackedAttestation checks the signature of a packed statement. Self attestation is signed by the
+// credential key, full attestation by the certificate of the authenticator model
+func verifyPackedAttestation(statement map[any]any, signed []byte, credentialKey crypto.PublicKey, credentialAlg int64) error {
+	alg, _ := statement["alg"].(int64)
+	signature, _ := statement["sig"].([]byte)
+	chain, _ := statement["x5c"].([]any)
+
+	if len(chain) == 0 {
+		if alg != credentialAlg {
+			return errors.New("self attestation algorithm is not the one of the credential")
+		}
+		return verifySignature(credentialKey, alg, signed, signature)
+	}
+
+	leaf, _ := chain[0].([]byte)
+	certificate, err := x509.ParseCertificate(leaf)
+	if err != nil {
+		return err
+	}
+
+	return verifySignature(certificate.PublicKey, alg, signed, signature)
+}
+
+// decodeBase64URL accepts base64url with or without padding, as browsers and libraries differ
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
@@ -58,9 +58,42 @@ func main() {
 	clientInterface := infrastructure.NewClientInterface(pool)
 	tokenInterface := infrastructure.NewTokenInterface(conf.SigningKey, conf.SigningMethod)
 	userInterface := infrastructure.NewUserInterface(pool)
-	hashInterface := infrastructure.NewHashInterface(conf.HashCost)
 	keysInterface := infrastructure.NewKeyInterface()
 	codesInterface := infrastructure.NewAuthCodesInterface()
+	sessionInterface := infrastructure.NewSessionInterface(pool)
+	consentInterface := infrastructure.NewConsentInterface(pool)
+	pendingLinksInterface := infrastructure.NewPendingLinksInterface()
+	auditInterface := infrastructure.NewAuditInterface(pool)
+	serviceProviderInterface := infrastructure.NewServiceProviderInterface(pool)
+	groupInterface := infrastructure.NewGroupInterface(pool)
+	scimClientInterface := infrastructure.NewSCIMClientInterface(pool)
+	partialSessionsInterface := infrastructure.NewPartialSessionsInterface()
+	argon2Params := infrastructure.Argon2Params{
+		Memory: conf.Argon2Memory,
+		Iterations: conf.Argon2Iterations,
+		Parallelism: conf.Argon2Parallelism,
+	}
+	hashInterface, err := infrastructure.NewPasswordHashInterface(conf.PasswordHashAlgorithm, infrastructure.NewArgon2HashInterface(argon2Params, conf.PasswordPepper), infrastructure.NewHashInterface(conf.HashCost))
+	if err != nil {
+		log.Log.Fatal("failed to init password hashing", zap.Error(err))
+		os.Exit(1)
+	}
+	cipherInterface, err := infrastructure.NewCipherInterface(conf.CredentialEncryptionKey)
+	if err != nil {
+		log.Log.Fatal("failed to init credential cipher", zap.Error(err))
+		os.Exit(1)
+	}
+
+	// logins with provider ldap are checked against the directory of the providers file
+	var directory core.IDirectory
+	for _, provider := range conf.IdentityProviders {
+		if provider.Type == "ldap" {
+			directory = infrastructure.NewLDAPInterface(provider)
+		}
+	}
+
+	webauthnInterface := infrastructure.NewWebAuthnInterface(conf.WebAuthnRPID, conf.WebAuthnOrigins)
+	emailTokensInterface := infrastructure.NewPostgresEmailTokensInterface(pool, conf.EmailTokenKey)
 
 	log.Log.Info("Initialized interfaces")
 
@@ -71,18 +104,95 @@ func main() {
 	}
 	keysInterface.SavePrivateKey(privateKey)
 
-	oauthWorkflow := core.NewOAuthWorkflow(clientInterface, tokenInterface, keysInterface, codesInterface, conf.AccessTokenExp, conf.RefreshTokenExp, conf.AuthCodeExp)
+	oauthWorkflow := core.NewOAuthWorkflow(clientInterface, userInterface, tokenInterface, keysInterface, codesInterface, consentInterface, conf.AccessTokenExp, conf.RefreshTokenExp, conf.AuthCodeExp)
+
+	sessionPolicies := core.SessionPolicies{
+		Default: core.SessionPolicy{
+			IdleTimeout: conf.SessionIdleTimeout,
+			Lifetime: conf.SessionExp,
+		},
+		RememberMe: core.SessionPolicy{
+			IdleTimeout: conf.RememberMeIdleTimeout,
+			Lifetime: conf.RememberMeExp,
+		},
+	}
 
-	loginUC := core.NewLoginUseCase(userInterface, tokenInterface, hashInterface, conf.SessionExp)
-	registerUC := core.NewRegisterUseCase(userInterface, tokenInterface, hashInterface, conf.SessionExp)
+	// the delays before a lockout stay short, a user who mistyped is not kept waiting long
+	lockoutPolicies := core.LockoutPolicies{
+		Account: core.LockoutPolicy{
+			FreeFailures: 3,
+			BaseDelay: 1,
+			MaxDelay: 60,
+			MaxFailures: conf.LoginMaxFailures,
+			LockoutDuration: conf.LoginLockoutDuration,
+			Window: conf.LoginFailureWindow,
+		},
+		IP: core.LockoutPolicy{
+			FreeFailures: 20,
+			BaseDelay: 1,
+			MaxDelay: 60,
+			MaxFailures: conf.LoginIPMaxFailures,
+			LockoutDuration: conf.LoginLockoutDuration,
+			Window: conf.LoginFailureWindow,
+		},
+	}
+	lockoutUC := core.NewLockoutUseCase(userInterface, infrastructure.NewLoginAttemptsInterface(pool), lockoutPolicies, auditInterface)
+
+	// replicas share the buckets through postgres, a single instance can keep them in memory
+	var rateLimits core.IRateLimits = infrastructure.NewRateLimitsInterface()
+	if conf.RateLimitBackend == "postgres" {
+		rateLimits = infrastructure.NewPostgresRateLimitsInterface(pool)
+	}
+	rateLimitUC := core.NewRateLimitUseCase(rateLimits, core.RateLimits{
+		IP: core.RateLimit(conf.RateLimitIP),
+		Client: core.RateLimit(conf.RateLimitClient),
+		Account: core.RateLimit(conf.RateLimitAccount),
+	})
+
+	// logins by mailed code are offered when a mail relay is configured
+	var mailer core.IMailer
+	var emailOTPUC *core.EmailOTPUseCase
+	if conf.SMTPAddr != "" {
+		mailer = infrastructure.NewSMTPMailerInterface(conf.SMTPAddr, conf.MailFrom, conf.SMTPUsername, conf.SMTPPassword)
+		emailOTPUC = core.NewEmailOTPUseCase(userInterface, infrastructure.NewEmailOTPsInterface(), emailTokensInterface, mailer, auditInterface, conf.PublicURL+"/login/email")
+	}
+
+	webauthnUC := core.NewWebAuthnUseCase(userInterface, webauthnInterface, infrastructure.NewWebAuthnChallengesInterface(), auditInterface, conf.WebAuthnRPID, conf.WebAuthnRPName)
+	loginUC := core.NewLoginUseCase(userInterface, tokenInterface, hashInterface, sessionInterface, clientInterface, sessionPolicies, pendingLinksInterface, directory, partialSessionsInterface, webauthnUC, emailOTPUC, lockoutUC)
+	// the breached check is offered when a copy of the range files is mounted
+	var breachedPasswords core.IBreachedPasswords
+	if conf.BreachedPasswordsDir != "" {
+		breachedPasswords = infrastructure.NewBreachedPasswordsInterface(conf.BreachedPasswordsDir)
+	}
+	passwordPolicy := core.NewPasswordPolicy(conf.PasswordMinLength, conf.PasswordMaxLength, conf.PasswordMinClasses, conf.PasswordBlocklist, breachedPasswords)
+
+	verificationUC := core.NewEmailVerificationUseCase(userInterface, emailTokensInterface, mailer, auditInterface, conf.PublicURL+"/verify-email")
+	registerUC := core.NewRegisterUseCase(userInterface, tokenInterface, hashInterface, sessionInterface, clientInterface, sessionPolicies, pendingLinksInterface, verificationUC, passwordPolicy, partialSessionsInterface)
+	sessionUC := core.NewSessionUseCase(sessionInterface)
 	userUC := core.NewUserUseCase(userInterface)
 	jwksUC := core.NewJWKSUseCase(keysInterface)
+	identityUC := core.NewIdentityUseCase(userInterface, auditInterface)
+	auditUC := core.NewAuditUseCase(auditInterface)
+	scimUC := core.NewSCIMUseCase(userInterface, groupInterface, sessionInterface, scimClientInterface, auditInterface)
+	mfaUC := core.NewMFAUseCase(userInterface, hashInterface, cipherInterface, partialSessionsInterface, sessionInterface, tokenInterface, auditInterface, conf.TOTPIssuer, webauthnUC, pendingLinksInterface, lockoutUC)
+	passwordUC := core.NewPasswordUseCase(userInterface, hashInterface, sessionInterface, emailTokensInterface, mailer, auditInterface, conf.PublicURL+"/password/reset", passwordPolicy, lockoutUC)
+	samlWorkflow := core.NewSAMLWorkflow(userInterface, serviceProviderInterface, keysInterface, infrastructure.NewSAMLInterface(), conf.SAMLEntityID, conf.PublicURL+"/saml/sso", conf.SAMLAssertionExp)
+
+	federatedProviders, idTokenVerifier, err := infrastructure.NewIdentityProviders(ctx, conf.IdentityProviders, nil)
+	if err != nil {
+		log.Log.Fatal("failed to init identity providers", zap.Error(err))
+		os.Exit(1)
+	}
+	federatedUC := core.NewFederatedLoginUseCase(federatedProviders, infrastructure.NewFederationStatesInterface(), loginUC, identityUC, 10*60)
 
 	log.Log.Info("Initialized use cases")
 
 	e := echo.New()
 
-	http.SetupHandlers(conf, e, log.Log, userUC, loginUC, registerUC, oauthWorkflow, jwksUC)	
+	if err := http.SetupHandlers(conf, e, log.Log, userUC, loginUC, registerUC, oauthWorkflow, jwksUC, sessionUC, idTokenVerifier, federatedUC, identityUC, auditUC, samlWorkflow, scimUC, mfaUC, webauthnUC, emailOTPUC, passwordUC, verificationUC, lockoutUC, rateLimitUC); err != nil {
+		log.Log.Fatal("failed to setup http handlers", zap.Error(err))
+		os.Exit(1)
+	}
 
 	log.Log.Info("HTTP handlers setup")
 
@@ -0,0 +1,41 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE sessions
+ADD COLUMN idle_timeout INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE sessions
+ADD COLUMN remember_me BOOLEAN NOT NULL DEFAULT false;
+
+ALTER TABLE clients
+ADD COLUMN session_idle_timeout INTEGER;
+
+ALTER TABLE clients
+ADD COLUMN session_lifetime INTEGER;
+
+ALTER TABLE clients
+ADD COLUMN remember_me_idle_timeout INTEGER;
+
+ALTER TABLE clients
+ADD COLUMN remember_me_lifetime INTEGER;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE clients
+DROP COLUMN remember_me_lifetime;
+
+ALTER TABLE clients
+DROP COLUMN remember_me_idle_timeout;
+
+ALTER TABLE clients
+DROP COLUMN session_lifetime;
+
+ALTER TABLE clients
+DROP COLUMN session_idle_timeout;
+
+ALTER TABLE sessions
+DROP COLUMN remember_me;
+
+ALTER TABLE sessions
+DROP COLUMN idle_timeout;
+-- +goose StatementEnd
@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS consents (
+  user_id CHAR(36) NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  client_id CHAR(36) NOT NULL REFERENCES clients(id) ON DELETE CASCADE,
+  created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+
+  PRIMARY KEY(user_id, client_id)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE consents;
+-- +goose StatementEnd
@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+-- identities created by the google only login were typed after the login method,
+-- they are now typed after the provider they came from
+UPDATE identities SET type = 'google'
+WHERE type = 'oauth' AND issuer IN ('https://accounts.google.com', 'accounts.google.com');
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+UPDATE identities SET type = 'oauth'
+WHERE type = 'google';
+-- +goose StatementEnd
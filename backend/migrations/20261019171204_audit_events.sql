@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+-- user_id has no foreign key, the trail outlives the accounts it describes
+CREATE TABLE IF NOT EXISTS audit_events (
+  id CHAR(36) PRIMARY KEY DEFAULT gen_random_uuid()::text,
+  user_id CHAR(36) NOT NULL,
+  action VARCHAR(100) NOT NULL,
+  ip VARCHAR(45) NOT NULL DEFAULT '',
+  user_agent TEXT NOT NULL DEFAULT '',
+  details JSONB NOT NULL DEFAULT '{}',
+  created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS audit_events_user_id_idx ON audit_events(user_id, created_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE audit_events;
+-- +goose StatementEnd
@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS saml_service_providers (
+  id CHAR(36) PRIMARY KEY DEFAULT gen_random_uuid()::text,
+  entity_id VARCHAR(1024) NOT NULL UNIQUE,
+  name VARCHAR(255) NOT NULL,
+  acs_urls TEXT[] NOT NULL DEFAULT '{}',
+  name_id_format VARCHAR(255) NOT NULL DEFAULT 'urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress',
+  -- saml attribute name -> user field (id, name, email), empty sends email, name and uid
+  attributes JSONB NOT NULL DEFAULT '{}',
+  status VARCHAR(20) NOT NULL DEFAULT 'active',
+  created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE saml_service_providers;
+-- +goose StatementEnd
@@ -0,0 +1,50 @@
+-- +goose Up
+-- +goose StatementBegin
+-- provisioned names and addresses are longer than those of the registration form
+ALTER TABLE users
+  ALTER COLUMN name TYPE VARCHAR(255),
+  ALTER COLUMN email TYPE VARCHAR(255),
+  ADD COLUMN external_id VARCHAR(255),
+  ADD COLUMN version INTEGER NOT NULL DEFAULT 1,
+  ADD COLUMN created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+  ADD COLUMN updated_at TIMESTAMP NOT NULL DEFAULT NOW();
+
+CREATE TABLE IF NOT EXISTS user_groups (
+  id CHAR(36) PRIMARY KEY DEFAULT gen_random_uuid()::text,
+  display_name VARCHAR(255) NOT NULL UNIQUE,
+  external_id VARCHAR(255),
+  version INTEGER NOT NULL DEFAULT 1,
+  created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+  updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS user_group_members (
+  group_id CHAR(36) NOT NULL REFERENCES user_groups(id) ON DELETE CASCADE,
+  user_id CHAR(36) NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  PRIMARY KEY (group_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS user_group_members_user_id ON user_group_members(user_id);
+
+-- only a sha256 of the bearer token is kept, it is shown once when the client is created
+CREATE TABLE IF NOT EXISTS scim_clients (
+  id CHAR(36) PRIMARY KEY DEFAULT gen_random_uuid()::text,
+  name VARCHAR(255) NOT NULL,
+  token_hash CHAR(64) NOT NULL UNIQUE,
+  status VARCHAR(20) NOT NULL DEFAULT 'active',
+  created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE scim_clients;
+DROP TABLE user_group_members;
+DROP TABLE user_groups;
+
+ALTER TABLE users
+  DROP COLUMN external_id,
+  DROP COLUMN version,
+  DROP COLUMN created_at,
+  DROP COLUMN updated_at;
+-- +goose StatementEnd
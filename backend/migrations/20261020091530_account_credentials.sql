@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+-- second factors belong to the account rather than to one of its identities,
+-- unlinking an identity must not remove them
+ALTER TABLE credentials
+  ALTER COLUMN identity_id DROP NOT NULL,
+  ADD COLUMN user_id CHAR(36) REFERENCES users(id) ON DELETE CASCADE,
+  ADD COLUMN counter BIGINT NOT NULL DEFAULT 0,
+  ADD CONSTRAINT credentials_owner CHECK (identity_id IS NOT NULL OR user_id IS NOT NULL);
+
+CREATE INDEX IF NOT EXISTS credentials_user_id ON credentials(user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DELETE FROM credentials WHERE identity_id IS NULL;
+
+ALTER TABLE credentials
+  DROP CONSTRAINT credentials_owner,
+  DROP COLUMN counter,
+  DROP COLUMN user_id,
+  ALTER COLUMN identity_id SET NOT NULL;
+-- +goose StatementEnd
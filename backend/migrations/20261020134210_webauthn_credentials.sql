@@ -0,0 +1,22 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE credentials
+  ADD COLUMN external_id VARCHAR(255),
+  ADD COLUMN public_key BYTEA,
+  ADD COLUMN transports TEXT[] NOT NULL DEFAULT '{}';
+
+-- an authenticator credential is registered to one account only
+CREATE UNIQUE INDEX IF NOT EXISTS credentials_webauthn_external_id ON credentials(external_id) WHERE type = 'webauthn';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS credentials_webauthn_external_id;
+
+DELETE FROM credentials WHERE type = 'webauthn';
+
+ALTER TABLE credentials
+  DROP COLUMN transports,
+  DROP COLUMN public_key,
+  DROP COLUMN external_id;
+-- +goose StatementEnd
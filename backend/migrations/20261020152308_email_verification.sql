@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users
+  ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT false;
+
+-- federated accounts were only provisioned from an upstream verified email, accounts registered by email
+-- that linked a provider later never had their address checked
+UPDATE users SET email_verified = true
+WHERE id IN (SELECT user_id FROM identities WHERE type <> 'email')
+  AND id NOT IN (SELECT user_id FROM identities WHERE type = 'email');
+
+ALTER TABLE clients
+  ADD COLUMN require_verified_email BOOLEAN NOT NULL DEFAULT false;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE clients
+  DROP COLUMN require_verified_email;
+
+ALTER TABLE users
+  DROP COLUMN email_verified;
+-- +goose StatementEnd
@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS login_attempts (
+  key VARCHAR(320) PRIMARY KEY,
+  failures INTEGER NOT NULL DEFAULT 0,
+  last_failure_at TIMESTAMP NOT NULL DEFAULT NOW(),
+  -- expires_at is when the failures are forgotten, the row is pruned once its lock ran out too
+  expires_at TIMESTAMP NOT NULL DEFAULT NOW(),
+  locked_until TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS login_attempts_expires_at_idx ON login_attempts(expires_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE login_attempts;
+-- +goose StatementEnd
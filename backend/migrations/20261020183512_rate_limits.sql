@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS rate_limits (
+  key VARCHAR(512) PRIMARY KEY,
+  tokens DOUBLE PRECISION NOT NULL,
+  updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+  allowed BOOLEAN NOT NULL DEFAULT TRUE,
+  -- full_at is when the bucket refilled for sure, the row is pruned after it
+  full_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS rate_limits_full_at_idx ON rate_limits(full_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE rate_limits;
+-- +goose StatementEnd
@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS email_tokens (
+  id VARCHAR(64) PRIMARY KEY,
+  purpose VARCHAR(32) NOT NULL,
+  user_id CHAR(36) NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  email VARCHAR(320) NOT NULL,
+  expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS email_tokens_expires_at_idx ON email_tokens(expires_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE email_tokens;
+-- +goose StatementEnd
@@ -0,0 +1,142 @@
+package test
+
+import (
+	"sso/internal/config"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/require"
+
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sessionLogin(s *pagesServer, query string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/auth/login?provider=email"+query, strings.NewReader(`{"email":"user@example.com","password":"password"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+
+	return s.do(req)
+}
+
+func listSessions(s *pagesServer, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	return s.do(httptest.NewRequest(http.MethodGet, "/auth/sessions", nil), cookies...)
+}
+
+func secureCookies(conf *config.Config) {
+	conf.SessionCookieDomain = "sso.test"
+	conf.SessionCookiePath = "/auth"
+	conf.SessionCookieLifetime = 600
+	conf.SessionCookieSecure = true
+	conf.SessionCookieSameSite = http.SameSiteStrictMode
+}
+
+func TestSessionCookieAttributes(t *testing.T) {
+	s := newPagesServer(t, "", nil, secureCookies)
+
+	rec := sessionLogin(s, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	cookie := findCookie(rec, "sso_session_token")
+	require.NotNil(t, cookie)
+	require.NotEmpty(t, cookie.Value)
+	require.Equal(t, "sso.test", cookie.Domain)
+	require.Equal(t, "/auth", cookie.Path)
+	require.True(t, cookie.HttpOnly)
+	require.True(t, cookie.Secure)
+	require.Equal(t, http.SameSiteStrictMode, cookie.SameSite)
+
+	// the cookie lifetime caps the hour of the session
+	require.Positive(t, cookie.MaxAge)
+	require.LessOrEqual(t, cookie.MaxAge, 600)
+	require.WithinDuration(t, time.Now().Add(600*time.Second), cookie.Expires, 5*time.Second)
+
+	// the token is not in the body of a browser login
+	var body map[string]any
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	require.NotContains(t, body, "sso_session_token")
+	require.NotEmpty(t, body["session_id"])
+}
+
+func TestSessionCookieDefaults(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+
+	cookie := findCookie(sessionLogin(s, ""), "sso_session_token")
+	require.NotNil(t, cookie)
+	require.Empty(t, cookie.Domain)
+	require.Equal(t, "/", cookie.Path)
+	require.True(t, cookie.HttpOnly)
+	require.False(t, cookie.Secure)
+	require.Equal(t, http.SameSiteLaxMode, cookie.SameSite)
+
+	// without a cookie lifetime the cookie lasts as long as the session
+	require.WithinDuration(t, time.Now().Add(time.Hour), cookie.Expires, 5*time.Second)
+}
+
+func TestSessionTokenInJSON(t *testing.T) {
+	s := newPagesServer(t, "", nil, secureCookies)
+
+	rec := sessionLogin(s, "&mode=json")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Nil(t, findCookie(rec, "sso_session_token"))
+
+	var body struct {
+		Token string `json:"sso_session_token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	require.NotEmpty(t, body.Token)
+	require.WithinDuration(t, time.Now().Add(time.Hour), body.ExpiresAt, 5*time.Second)
+
+	// an api client sends the token back as a bearer token
+	req := httptest.NewRequest(http.MethodGet, "/auth/sessions", nil)
+	req.Header.Set("Authorization", "Bearer "+body.Token)
+	require.Equal(t, http.StatusOK, s.do(req).Code)
+}
+
+func TestSessionTokenLookup(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+
+	require.Equal(t, http.StatusUnauthorized, listSessions(s).Code)
+
+	cookie := findCookie(sessionLogin(s, ""), "sso_session_token")
+	require.NotNil(t, cookie)
+	require.Equal(t, http.StatusOK, listSessions(s, cookie).Code)
+
+	req := httptest.NewRequest(http.MethodGet, "/auth/sessions", nil)
+	req.Header.Set("Authorization", "Bearer "+cookie.Value)
+	require.Equal(t, http.StatusOK, s.do(req).Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/auth/sessions", nil)
+	req.Header.Set("Authorization", "Bearer invalid")
+	require.Equal(t, http.StatusUnauthorized, s.do(req).Code)
+
+	invalid := *cookie
+	invalid.Value = "invalid"
+	require.Equal(t, http.StatusUnauthorized, listSessions(s, &invalid).Code)
+}
+
+func TestLogoutClearsSessionCookie(t *testing.T) {
+	s := newPagesServer(t, "", nil, secureCookies)
+
+	cookie := findCookie(sessionLogin(s, ""), "sso_session_token")
+	require.NotNil(t, cookie)
+
+	rec := s.do(httptest.NewRequest(http.MethodPost, "/auth/logout", nil), cookie)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+
+	// the cleared cookie has the attributes of the one it replaces, or the browser keeps both
+	cleared := findCookie(rec, "sso_session_token")
+	require.NotNil(t, cleared)
+	require.Empty(t, cleared.Value)
+	require.Negative(t, cleared.MaxAge)
+	require.True(t, cleared.Expires.Before(time.Now()))
+	require.Equal(t, "sso.test", cleared.Domain)
+	require.Equal(t, "/auth", cleared.Path)
+	require.True(t, cleared.HttpOnly)
+	require.True(t, cleared.Secure)
+	require.Equal(t, http.SameSiteStrictMode, cleared.SameSite)
+
+	require.Equal(t, http.StatusUnauthorized, listSessions(s, cookie).Code)
+}
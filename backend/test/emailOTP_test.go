@@ -0,0 +1,201 @@
+package test
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/require"
+
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var (
+	emailOTPCode = regexp.MustCompile(`code is ([0-9]{6})\.`)
+	emailOTPLink = regexp.MustCompile(`http://sso\.test/login/email\?\S+`)
+)
+
+// sendEmailOTP asks for a code for the address and returns the code and magic link of the mail
+func sendEmailOTP(t *testing.T, s *pagesServer, email string) (string, *url.URL) {
+	sent := len(s.smtp.sent(email))
+
+	rec := mfaDo(s, http.MethodPost, "/auth/email-otp", `{"email":"`+email+`","return_to":"/account"}`)
+	require.Equal(t, http.StatusAccepted, rec.Code)
+
+	mails := s.smtp.await(t, email, sent+1)
+	require.Len(t, mails, sent+1)
+	require.Equal(t, "Your sign in code", mails[sent].Subject)
+
+	code := emailOTPCode.FindStringSubmatch(mails[sent].Text)
+	require.Len(t, code, 2)
+
+	link, err := url.Parse(emailOTPLink.FindString(mails[sent].Text))
+	require.NoError(t, err)
+	require.Equal(t, "/account", link.Query().Get("return_to"))
+
+	return code[1], link
+}
+
+func emailOTPLogin(s *pagesServer, body string) *httptest.ResponseRecorder {
+	return mfaDo(s, http.MethodPost, "/auth/login?provider=email_otp", body)
+}
+
+func TestEmailOTPCodeLogin(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+	code, link := sendEmailOTP(t, s, "user@example.com")
+
+	rec := emailOTPLogin(s, `{"email":"user@example.com","code":"000000"}`)
+	if code == "000000" {
+		rec = emailOTPLogin(s, `{"email":"user@example.com","code":"999999"}`)
+	}
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	require.Contains(t, rec.Body.String(), "email code is invalid or expired")
+
+	// the address is matched whatever its case
+	rec = emailOTPLogin(s, `{"email":"User@Example.com","code":"`+code+`"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NotNil(t, findCookie(rec, "sso_session_token"))
+
+	session := s.sessionRepo.sessions[len(s.sessionRepo.sessions)-1]
+	require.Equal(t, []string{"otp"}, session.AuthMethods)
+
+	// the code and the link mailed with it are single use
+	require.Equal(t, http.StatusUnauthorized, emailOTPLogin(s, `{"email":"user@example.com","code":"`+code+`"}`).Code)
+	require.Equal(t, http.StatusUnauthorized, emailOTPLogin(s, `{"token":"`+link.Query().Get("token")+`"}`).Code)
+
+	require.True(t, containsAuditAction(s.auditRepo.events, "email_otp.sent"))
+}
+
+func TestEmailOTPMagicLink(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+	code, link := sendEmailOTP(t, s, "user@example.com")
+
+	// opening the link does not use it up, mail scanners open links too
+	rec := s.do(httptest.NewRequest(http.MethodGet, link.RequestURI(), nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Nil(t, findCookie(rec, "sso_session_token"))
+	require.Contains(t, rec.Body.String(), `name="token" value="`+link.Query().Get("token")+`"`)
+
+	csrfCookie := findCookie(rec, "_csrf")
+	require.NotNil(t, csrfCookie)
+	form := url.Values{
+		"_csrf": {csrfInput.FindStringSubmatch(rec.Body.String())[1]},
+		"token": {link.Query().Get("token")},
+		"return_to": {"/account"},
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/login/email", strings.NewReader(form.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec = s.do(req, csrfCookie)
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	require.Equal(t, "/account", rec.Header().Get("Location"))
+	require.NotNil(t, findCookie(rec, "sso_session_token"))
+
+	req = httptest.NewRequest(http.MethodPost, "/login/email", strings.NewReader(form.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec = s.do(req, csrfCookie)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	require.Contains(t, rec.Body.String(), "The code or link is not valid or has expired.")
+
+	require.Equal(t, http.StatusUnauthorized, emailOTPLogin(s, `{"email":"user@example.com","code":"`+code+`"}`).Code)
+
+	// a token that was not signed by the sso is refused
+	token := link.Query().Get("token")
+	require.Equal(t, http.StatusUnauthorized, emailOTPLogin(s, `{"token":"`+token[:strings.Index(token, ".")]+`.forged"}`).Code)
+}
+
+func TestEmailOTPUnknownAddress(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+
+	rec := mfaDo(s, http.MethodPost, "/auth/email-otp", `{"email":"nobody@example.com"}`)
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	require.Empty(t, s.smtp.sent("nobody@example.com"))
+
+	require.Equal(t, http.StatusUnauthorized, emailOTPLogin(s, `{"email":"nobody@example.com","code":"000000"}`).Code)
+}
+
+func TestEmailOTPFailingMailer(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+	// the relay is gone, mailing the code of the existing account fails
+	s.smtp.listener.Close()
+
+	rec := mfaDo(s, http.MethodPost, "/auth/email-otp", `{"email":"user@example.com"}`)
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	unknown := mfaDo(s, http.MethodPost, "/auth/email-otp", `{"email":"nobody@example.com"}`)
+	require.Equal(t, unknown.Body.String(), rec.Body.String())
+}
+
+func TestEmailOTPRateLimit(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+
+	first, _ := sendEmailOTP(t, s, "user@example.com")
+	sendEmailOTP(t, s, "user@example.com")
+	last, _ := sendEmailOTP(t, s, "user@example.com")
+
+	rec := mfaDo(s, http.MethodPost, "/auth/email-otp", `{"email":"USER@example.com"}`)
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+	require.Len(t, s.smtp.sent("user@example.com"), 3)
+
+	// unknown addresses are limited the same, the answer tells nothing about the account
+	for range 3 {
+		require.Equal(t, http.StatusAccepted, mfaDo(s, http.MethodPost, "/auth/email-otp", `{"email":"nobody@example.com"}`).Code)
+	}
+	require.Equal(t, http.StatusTooManyRequests, mfaDo(s, http.MethodPost, "/auth/email-otp", `{"email":"nobody@example.com"}`).Code)
+
+	// only the last code mailed is valid
+	if first != last {
+		require.Equal(t, http.StatusUnauthorized, emailOTPLogin(s, `{"email":"user@example.com","code":"`+first+`"}`).Code)
+	}
+	require.Equal(t, http.StatusOK, emailOTPLogin(s, `{"email":"user@example.com","code":"`+last+`"}`).Code)
+}
+
+func TestEmailOTPTooManyAttempts(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+	code, _ := sendEmailOTP(t, s, "user@example.com")
+
+	wrong := "000000"
+	if code == wrong {
+		wrong = "999999"
+	}
+	for range 5 {
+		require.Equal(t, http.StatusUnauthorized, emailOTPLogin(s, `{"email":"user@example.com","code":"`+wrong+`"}`).Code)
+	}
+
+	require.Equal(t, http.StatusUnauthorized, emailOTPLogin(s, `{"email":"user@example.com","code":"`+code+`"}`).Code)
+
+	code, _ = sendEmailOTP(t, s, "user@example.com")
+	require.Equal(t, http.StatusOK, emailOTPLogin(s, `{"email":"user@example.com","code":"`+code+`"}`).Code)
+}
+
+func TestEmailOTPHostedLogin(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+
+	rec := s.do(httptest.NewRequest(http.MethodGet, "/login", nil))
+	require.Contains(t, rec.Body.String(), `action="/login/email/send"`)
+	csrfCookie := findCookie(rec, "_csrf")
+	csrf := csrfInput.FindStringSubmatch(rec.Body.String())[1]
+
+	form := url.Values{
+		"_csrf": {csrf},
+		"email": {"user@example.com"},
+		"return_to": {"/account"},
+	}
+	req := httptest.NewRequest(http.MethodPost, "/login/email/send", strings.NewReader(form.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec = s.do(req, csrfCookie)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), `name="code"`)
+
+	mails := s.smtp.await(t, "user@example.com", 1)
+	require.Len(t, mails, 1)
+
+	form.Set("code", emailOTPCode.FindStringSubmatch(mails[0].Text)[1])
+	req = httptest.NewRequest(http.MethodPost, "/login/email", strings.NewReader(form.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec = s.do(req, csrfCookie)
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	require.Equal(t, "/account", rec.Header().Get("Location"))
+	require.NotNil(t, findCookie(rec, "sso_session_token"))
+}
@@ -0,0 +1,164 @@
+package test
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/require"
+
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var emailVerificationLink = regexp.MustCompile(`http://sso\.test/verify-email\?\S+`)
+
+// registerByEmail creates an account by email and returns its session cookie
+func registerByEmail(t *testing.T, s *pagesServer, email string) *http.Cookie {
+	rec := mfaDo(s, http.MethodPost, "/auth/register?provider=email", `{"name":"new user","email":"`+email+`","password":"password"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	sessionCookie := findCookie(rec, "sso_session_token")
+	require.NotNil(t, sessionCookie)
+
+	return sessionCookie
+}
+
+// verificationToken returns the token of the last verification link mailed to the address
+func verificationToken(t *testing.T, s *pagesServer, email string) string {
+	mails := s.smtp.sent(email)
+	require.NotEmpty(t, mails)
+	require.Equal(t, "Verify your email address", mails[len(mails)-1].Subject)
+
+	link, err := url.Parse(emailVerificationLink.FindString(mails[len(mails)-1].Text))
+	require.NoError(t, err)
+	require.NotEmpty(t, link.Query().Get("token"))
+
+	return link.Query().Get("token")
+}
+
+func emailVerified(t *testing.T, s *pagesServer, email string) bool {
+	user, err := s.userRepo.ByEmail(context.Background(), email)
+	require.NoError(t, err)
+	require.NotNil(t, user)
+
+	return user.EmailVerified
+}
+
+func TestEmailVerification(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+	registerByEmail(t, s, "new@example.com")
+
+	require.False(t, emailVerified(t, s, "new@example.com"))
+	token := verificationToken(t, s, "new@example.com")
+
+	rec := mfaDo(s, http.MethodPost, "/auth/email/verify", `{"token":"`+token+`"}`)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	require.True(t, emailVerified(t, s, "new@example.com"))
+
+	rec = mfaDo(s, http.MethodPost, "/auth/email/verify", `{"token":"`+token+`"}`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Contains(t, rec.Body.String(), "email verification token is invalid or expired")
+
+	require.True(t, containsAuditAction(s.auditRepo.events, "email.verification_sent"))
+	require.True(t, containsAuditAction(s.auditRepo.events, "email.verified"))
+}
+
+func TestAuthorizeRequiresVerifiedEmail(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+	sessionCookie := registerByEmail(t, s, "new@example.com")
+
+	user, err := s.userRepo.ByEmail(context.Background(), "new@example.com")
+	require.NoError(t, err)
+	require.NoError(t, s.consentRepo.Grant(context.Background(), user.ID, "2"))
+
+	authorize := "/auth/token?" + url.Values{
+		"client_id": {"id2"},
+		"redirect_uri": {"https://verified.client.com/callback"},
+		"state": {"xyz"},
+	}.Encode()
+
+	// the browser gets the error page
+	rec := s.do(httptest.NewRequest(http.MethodGet, authorize, nil), sessionCookie)
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	require.Contains(t, rec.Body.String(), "This application requires a verified email address.")
+
+	rec = s.do(httptest.NewRequest(http.MethodGet, authorize+"&mode=json", nil), sessionCookie)
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	require.JSONEq(t, `{"error":"email is not verified"}`, rec.Body.String())
+
+	token := verificationToken(t, s, "new@example.com")
+	require.Equal(t, http.StatusNoContent, mfaDo(s, http.MethodPost, "/auth/email/verify", `{"token":"`+token+`"}`).Code)
+
+	rec = s.do(httptest.NewRequest(http.MethodGet, authorize, nil), sessionCookie)
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	require.True(t, strings.HasPrefix(rec.Header().Get("Location"), "https://verified.client.com/callback?code="))
+}
+
+func TestEmailVerificationForgedToken(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+	registerByEmail(t, s, "new@example.com")
+	token := verificationToken(t, s, "new@example.com")
+
+	id, _, _ := strings.Cut(token, ".")
+	rec := mfaDo(s, http.MethodPost, "/auth/email/verify", `{"token":"`+id+`.forged"}`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// a login link is no verification token
+	_, link := sendEmailOTP(t, s, "new@example.com")
+	rec = mfaDo(s, http.MethodPost, "/auth/email/verify", `{"token":"`+link.Query().Get("token")+`"}`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	require.False(t, emailVerified(t, s, "new@example.com"))
+}
+
+func TestEmailVerificationResend(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+	sessionCookie := registerByEmail(t, s, "new@example.com")
+
+	require.Equal(t, http.StatusUnauthorized, mfaDo(s, http.MethodPost, "/auth/email/verify/resend", "").Code)
+
+	rec := mfaDo(s, http.MethodPost, "/auth/email/verify/resend", "", sessionCookie)
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	require.Len(t, s.smtp.sent("new@example.com"), 2)
+
+	token := verificationToken(t, s, "new@example.com")
+	require.Equal(t, http.StatusNoContent, mfaDo(s, http.MethodPost, "/auth/email/verify", `{"token":"`+token+`"}`).Code)
+
+	// a verified address gets no more links
+	rec = mfaDo(s, http.MethodPost, "/auth/email/verify/resend", "", sessionCookie)
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	require.Len(t, s.smtp.sent("new@example.com"), 2)
+}
+
+func TestEmailVerificationHostedPage(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+	registerByEmail(t, s, "new@example.com")
+	token := verificationToken(t, s, "new@example.com")
+
+	// opening the link alone verifies nothing
+	rec := s.do(httptest.NewRequest(http.MethodGet, "/verify-email?token="+url.QueryEscape(token), nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), `name="token" value="`+token+`"`)
+	require.False(t, emailVerified(t, s, "new@example.com"))
+
+	csrfCookie := findCookie(rec, "_csrf")
+	form := url.Values{
+		"_csrf": {csrfInput.FindStringSubmatch(rec.Body.String())[1]},
+		"token": {token},
+	}
+	req := httptest.NewRequest(http.MethodPost, "/verify-email", strings.NewReader(form.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec = s.do(req, csrfCookie)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "Your email address is verified.")
+	require.True(t, emailVerified(t, s, "new@example.com"))
+
+	req = httptest.NewRequest(http.MethodPost, "/verify-email", strings.NewReader(form.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec = s.do(req, csrfCookie)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Contains(t, rec.Body.String(), "The verification link is not valid or has expired")
+}
@@ -3,12 +3,17 @@ package test
 import (
 	"github.com/golang-jwt/jwt/v5"
 	"sso/internal/core"
+	e "sso/internal/core/errors"
 
 	"crypto/rand"
 	"crypto/rsa"
 	"context"
 	"errors"
 	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
 )
 
 type FakeClientRepository struct {
@@ -79,14 +84,30 @@ type FakeUserRepository struct {
 }
 
 func (r *FakeUserRepository) preload(user *core.User) {
+	loaded := user.Identities
+	user.Identities = nil
+
+	for _, id := range loaded {
+		if !slices.ContainsFunc(r.identities, func(i core.Identity) bool { return i.ID == id.ID }) {
+			user.Identities = append(user.Identities, id)
+		}
+	}
+
 	for _, id := range r.identities {
 		if id.UserID == user.ID {
-			user.Identities = append(user.Identities, id)		
 			for _, cred := range r.credentials {
 				if cred.IdentityID == id.ID {
 					id.Credentials = append(id.Credentials, cred)
 				}
 			}
+			user.Identities = append(user.Identities, id)
+		}
+	}
+
+	user.Credentials = nil
+	for _, cred := range r.credentials {
+		if cred.UserID == user.ID && cred.IdentityID == "" {
+			user.Credentials = append(user.Credentials, cred)
 		}
 	}
 }
@@ -142,8 +163,30 @@ func (r *FakeUserRepository) ByIdentity(ctx context.Context, itype, externalID,
 	return nil, nil
 }
 
+func (r *FakeUserRepository) Search(ctx context.Context, filter *core.Filter, offset, limit int) ([]core.User, int, error) {
+	matching := []core.User{}
+	for _, user := range r.users {
+		if user.Status == "deleted" {
+			continue
+		}
+		if filter != nil && !filter.Match(func(attribute string) any { return core.UserFilterValue(&user, attribute) }) {
+			continue
+		}
+
+		user.Identities = nil
+		matching = append(matching, user)
+	}
+
+	page := matching[min(offset, len(matching)):min(offset+limit, len(matching))]
+
+	return page, len(matching), nil
+}
+
 func (r *FakeUserRepository) Create(ctx context.Context, user *core.User) error {
 	user.ID = user.Name + user.Email
+	user.Version = 1
+	user.CreatedAt = time.Now()
+	user.UpdatedAt = user.CreatedAt
 
 	r.users = append(r.users, *user)
 
@@ -161,7 +204,15 @@ func (r *FakeUserRepository) Update(ctx context.Context, u *core.User) error {
 
 	user.Name = u.Name
 	user.Email = u.Email
+	user.EmailVerified = u.EmailVerified
 	user.Status = u.Status
+	user.Roles = u.Roles
+	user.ExternalID = u.ExternalID
+	user.Version++
+	user.UpdatedAt = time.Now()
+
+	u.Version = user.Version
+	u.UpdatedAt = user.UpdatedAt
 
 	return nil
 }
@@ -175,11 +226,40 @@ func (r *FakeUserRepository) SaveIdentity(ctx context.Context, identity *core.Id
 }
 
 func (r *FakeUserRepository) SaveCredential(ctx context.Context, cred *core.Credential) error {
+	if cred.ID != "" {
+		for i := range r.credentials {
+			if r.credentials[i].ID == cred.ID {
+				r.credentials[i] = *cred
+				return nil
+			}
+		}
+	} else {
+		cred.ID = fmt.Sprintf("credential_%d", len(r.credentials)+1)
+	}
+
 	r.credentials = append(r.credentials, *cred)
 
 	return nil
 }
 
+func (r *FakeUserRepository) DeleteIdentity(ctx context.Context, userID, identityID string) error {
+	found := false
+	r.identities = slices.DeleteFunc(r.identities, func(i core.Identity) bool {
+		matches := i.ID == identityID && i.UserID == userID
+		found = found || matches
+		return matches
+	})
+	if !found {
+		return errors.New("identity not found")
+	}
+
+	for i := range r.users {
+		r.users[i].Identities = slices.DeleteFunc(r.users[i].Identities, func(i core.Identity) bool { return i.ID == identityID })
+	}
+
+	return nil
+}
+
 type FakeHashRepository struct {}
 func (r *FakeHashRepository) HashPassword(raw string) (string, error) {
 	return raw + "_hashed", nil
@@ -193,3 +273,298 @@ func (r *FakeHashRepository) CheckPassword(raw, hash string) error {
 	return nil
 }
 
+func (r *FakeHashRepository) NeedsRehash(hash string) bool {
+	return false
+}
+
+type FakeLoginAttemptsRepository struct {
+	attempts map[string]core.LoginAttempt
+}
+
+func (r *FakeLoginAttemptsRepository) Get(ctx context.Context, key string) (*core.LoginAttempt, error) {
+	attempt, ok := r.attempts[key]
+	if !ok {
+		return nil, nil
+	}
+
+	if attempt.LockedUntil != nil && !attempt.LockedUntil.After(time.Now()) {
+		attempt.LockedUntil = nil
+	}
+
+	return &attempt, nil
+}
+
+func (r *FakeLoginAttemptsRepository) Fail(ctx context.Context, key string, window int) (*core.LoginAttempt, error) {
+	if r.attempts == nil {
+		r.attempts = map[string]core.LoginAttempt{}
+	}
+
+	attempt, ok := r.attempts[key]
+	if !ok || attempt.LastFailureAt.Before(time.Now().Add(-time.Duration(window)*time.Second)) {
+		attempt = core.LoginAttempt{Key: key, LockedUntil: attempt.LockedUntil}
+	}
+
+	attempt.Failures++
+	attempt.LastFailureAt = time.Now()
+	r.attempts[key] = attempt
+
+	return r.Get(ctx, key)
+}
+
+func (r *FakeLoginAttemptsRepository) Lock(ctx context.Context, key string, until time.Time) error {
+	attempt, ok := r.attempts[key]
+	if !ok {
+		return nil
+	}
+
+	if attempt.LockedUntil == nil || attempt.LockedUntil.Before(until) {
+		attempt.LockedUntil = &until
+	}
+	r.attempts[key] = attempt
+
+	return nil
+}
+
+func (r *FakeLoginAttemptsRepository) Reset(ctx context.Context, key string) error {
+	delete(r.attempts, key)
+
+	return nil
+}
+
+// expire ends the locks as if their time had passed
+func (r *FakeLoginAttemptsRepository) expire() {
+	for key, attempt := range r.attempts {
+		attempt.LockedUntil = nil
+		r.attempts[key] = attempt
+	}
+}
+
+type FakeSessionRepository struct {
+	sessions []core.Session
+}
+
+func (r *FakeSessionRepository) ByID(ctx context.Context, id string) (*core.Session, error) {
+	for _, s := range r.sessions {
+		if s.ID == id {
+			return &s, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (r *FakeSessionRepository) ByUser(ctx context.Context, userID string) ([]core.Session, error) {
+	var sessions []core.Session
+	for _, s := range r.sessions {
+		if s.UserID == userID {
+			sessions = append(sessions, s)
+		}
+	}
+
+	return sessions, nil
+}
+
+func (r *FakeSessionRepository) Create(ctx context.Context, session *core.Session) error {
+	session.ID = "session_id" + strconv.Itoa(len(r.sessions)+1)
+
+	r.sessions = append(r.sessions, *session)
+
+	return nil
+}
+
+func (r *FakeSessionRepository) Update(ctx context.Context, session *core.Session) error {
+	for i := range r.sessions {
+		if r.sessions[i].ID == session.ID {
+			r.sessions[i] = *session
+			return nil
+		}
+	}
+
+	return errors.New("session not found")
+}
+
+func (r *FakeSessionRepository) RevokeAll(ctx context.Context, userID string) error {
+	now := time.Now()
+	for i := range r.sessions {
+		if r.sessions[i].UserID == userID && r.sessions[i].RevokedAt == nil {
+			r.sessions[i].RevokedAt = &now
+		}
+	}
+
+	return nil
+}
+
+type FakeConsentRepository struct {
+	consents map[string]bool
+}
+
+func (r *FakeConsentRepository) Has(ctx context.Context, userID, clientID string) (bool, error) {
+	return r.consents[userID+clientID], nil
+}
+
+func (r *FakeConsentRepository) Grant(ctx context.Context, userID, clientID string) error {
+	if r.consents == nil {
+		r.consents = map[string]bool{}
+	}
+	r.consents[userID+clientID] = true
+
+	return nil
+}
+
+type FakeAuditRepository struct {
+	// mu guards events against the events recorded off the request path
+	mu sync.Mutex
+	events []core.AuditEvent
+}
+
+func (r *FakeAuditRepository) Record(ctx context.Context, event *core.AuditEvent) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	event.ID = "event_id" + strconv.Itoa(len(r.events)+1)
+
+	r.events = append(r.events, *event)
+
+	return nil
+}
+
+func (r *FakeAuditRepository) ByUser(ctx context.Context, userID string, limit int) ([]core.AuditEvent, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	events := []core.AuditEvent{}
+	for i := len(r.events) - 1; i >= 0 && len(events) < limit; i-- {
+		if r.events[i].UserID == userID {
+			events = append(events, r.events[i])
+		}
+	}
+
+	return events, nil
+}
+
+type FakeServiceProviderRepository struct {
+	providers []core.ServiceProvider
+}
+
+func (r *FakeServiceProviderRepository) ByEntityID(ctx context.Context, entityID string) (*core.ServiceProvider, error) {
+	for _, sp := range r.providers {
+		if sp.EntityID == entityID {
+			return &sp, nil
+		}
+	}
+
+	return nil, nil
+}
+
+type FakeGroupRepository struct {
+	groups []core.Group
+}
+
+func (r *FakeGroupRepository) ByID(ctx context.Context, id string) (*core.Group, error) {
+	for _, g := range r.groups {
+		if g.ID == id {
+			g.Members = slices.Clone(g.Members)
+			return &g, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (r *FakeGroupRepository) Search(ctx context.Context, filter *core.Filter, offset, limit int) ([]core.Group, int, error) {
+	matching := []core.Group{}
+	for _, group := range r.groups {
+		if filter != nil && !filter.Match(func(attribute string) any { return core.GroupFilterValue(&group, attribute) }) {
+			continue
+		}
+
+		group.Members = slices.Clone(group.Members)
+		matching = append(matching, group)
+	}
+
+	page := matching[min(offset, len(matching)):min(offset+limit, len(matching))]
+
+	return page, len(matching), nil
+}
+
+func (r *FakeGroupRepository) Create(ctx context.Context, group *core.Group) error {
+	for _, g := range r.groups {
+		if g.DisplayName == group.DisplayName {
+			return e.UniqueViolated
+		}
+	}
+
+	group.ID = "group_id" + strconv.Itoa(len(r.groups)+1)
+	group.Version = 1
+	group.CreatedAt = time.Now()
+	group.UpdatedAt = group.CreatedAt
+
+	stored := *group
+	stored.Members = slices.Clone(group.Members)
+	r.groups = append(r.groups, stored)
+
+	return nil
+}
+
+func (r *FakeGroupRepository) Update(ctx context.Context, group *core.Group) error {
+	for i := range r.groups {
+		if r.groups[i].ID == group.ID {
+			group.Version = r.groups[i].Version + 1
+			group.UpdatedAt = time.Now()
+
+			r.groups[i] = *group
+			r.groups[i].Members = slices.Clone(group.Members)
+			return nil
+		}
+	}
+
+	return e.GroupNotFound
+}
+
+func (r *FakeGroupRepository) Delete(ctx context.Context, id string) error {
+	before := len(r.groups)
+	r.groups = slices.DeleteFunc(r.groups, func(g core.Group) bool { return g.ID == id })
+	if len(r.groups) == before {
+		return e.GroupNotFound
+	}
+
+	return nil
+}
+
+type FakeSCIMClientRepository struct {
+	clients []core.SCIMClient
+}
+
+func (r *FakeSCIMClientRepository) ByTokenHash(ctx context.Context, tokenHash string) (*core.SCIMClient, error) {
+	for _, c := range r.clients {
+		if c.TokenHash == tokenHash {
+			return &c, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (r *FakeSCIMClientRepository) List(ctx context.Context) ([]core.SCIMClient, error) {
+	return r.clients, nil
+}
+
+func (r *FakeSCIMClientRepository) Create(ctx context.Context, client *core.SCIMClient) error {
+	client.ID = "scim_client_id" + strconv.Itoa(len(r.clients)+1)
+	client.CreatedAt = time.Now()
+
+	r.clients = append(r.clients, *client)
+
+	return nil
+}
+
+func (r *FakeSCIMClientRepository) Revoke(ctx context.Context, id string) error {
+	for i := range r.clients {
+		if r.clients[i].ID == id {
+			r.clients[i].Status = "revoked"
+			return nil
+		}
+	}
+
+	return e.SCIMClientNotFound
+}
@@ -2,35 +2,68 @@ package test
 
 import (
 	"sso/internal/core"
+	e "sso/internal/core/errors"
+	"sso/internal/infrastructure"
 	"github.com/stretchr/testify/require"
 
 	"context"
+	"strconv"
 	"testing"
 )
 
-type googleInput struct {
+type federatedInput struct {
 	Email string
+	EmailVerified bool
+	LinkByEmail bool
 	RawToken string
 	Provider string
 	ExternalID string
 	Issuer string
 }
 
-func TestGoogleOAuth(t *testing.T) {
+func existingUser() (*FakeUserRepository, *FakeHashRepository, *FakeTokenRepository) {
+	userRepo := &FakeUserRepository{
+		users: []core.User{
+			{
+				ID: "user_id",
+				Name: "user",
+				Email: "user@example.com",
+				Status: "active",
+			},
+		},
+	}
+
+	return userRepo, &FakeHashRepository{}, &FakeTokenRepository{}
+}
+
+func requireLinkRequired(t *testing.T, input federatedInput, user *core.User, userRepo *FakeUserRepository, err error) {
+	var linkErr *core.LinkRequiredError
+	require.ErrorAs(t, err, &linkErr)
+	require.ErrorIs(t, err, e.LinkRequired)
+	require.NotEmpty(t, linkErr.LinkToken)
+	require.Equal(t, "user@example.com", linkErr.Email)
+	require.Nil(t, user)
+	require.Empty(t, userRepo.identities)
+	require.Empty(t, userRepo.credentials)
+}
+
+func TestFederatedUser(t *testing.T) {
 	tests := []struct{
 		testName string
 		wantError bool
-		input googleInput
+		input federatedInput
 		setupRepositories func() (*FakeUserRepository, *FakeHashRepository, *FakeTokenRepository)
-		runChecks func(*testing.T, googleInput, *core.User, *FakeUserRepository, error)
+		runChecks func(*testing.T, federatedInput, *core.User, *FakeUserRepository, error)
 	}{
 		{
 			testName: "user not exists with email, must create user, identity and credential",
 			wantError: false,
-			input: googleInput{
+			input: federatedInput{
 				Email: "user@example.com",
+				EmailVerified: true,
+				LinkByEmail: true,
 				RawToken: "token",
-				Provider: "oauth",
+				Provider: "google",
 				ExternalID: "test_issuer_user_id",
 				Issuer: "test.issuer.com",
 			},
@@ -45,7 +78,7 @@ func TestGoogleOAuth(t *testing.T) {
 				return userRepo, hashRepo, tokenRepo
 			},
 
-			runChecks: func(t *testing.T, input googleInput, user *core.User, userRepo *FakeUserRepository, err error) {
+			runChecks: func(t *testing.T, input federatedInput, user *core.User, userRepo *FakeUserRepository, err error) {
 				require.NoError(t, err)
 				require.NotNil(t, user)
 
@@ -69,10 +102,12 @@ func TestGoogleOAuth(t *testing.T) {
 		{
 			testName: "user exists with email, but without identity, must create identity and credential",
 			wantError: false,
-			input: googleInput{
+			input: federatedInput{
 				Email: "user@example.com",
+				EmailVerified: true,
+				LinkByEmail: true,
 				RawToken: "token",
-				Provider: "oauth",
+				Provider: "google",
 				ExternalID: "test_issuer_user_id",
 				Issuer: "test.issuer.com",
 			},
@@ -94,7 +129,7 @@ func TestGoogleOAuth(t *testing.T) {
 				return userRepo, hashRepo, tokenRepo
 			},
 
-			runChecks: func(t *testing.T, input googleInput, user *core.User, userRepo *FakeUserRepository, err error) {
+			runChecks: func(t *testing.T, input federatedInput, user *core.User, userRepo *FakeUserRepository, err error) {
 				require.NoError(t, err)
 				require.NotNil(t, user)
 
@@ -118,10 +153,12 @@ func TestGoogleOAuth(t *testing.T) {
 		{
 			testName: "user exists with identity",
 			wantError: false,
-			input: googleInput{
+			input: federatedInput{
 				Email: "user@example.com",
+				EmailVerified: true,
+				LinkByEmail: true,
 				RawToken: "token",
-				Provider: "oauth",
+				Provider: "google",
 				ExternalID: "external_user_id",
 				Issuer: "test.issuer.com",
 			},
@@ -139,7 +176,7 @@ func TestGoogleOAuth(t *testing.T) {
 						{
 							ID: "identity_id",
 							UserID: "user_id",
-							Type: "oauth",
+							Type: "google",
 							ExternalID: "external_user_id",
 							Issuer: "test.issuer.com",
 						},
@@ -150,7 +187,7 @@ func TestGoogleOAuth(t *testing.T) {
 
 				return userRepo, hashRepo, tokenRepo
 			},
-			runChecks: func(t *testing.T, input googleInput, user *core.User, userRepo *FakeUserRepository, err error) {
+			runChecks: func(t *testing.T, input federatedInput, user *core.User, userRepo *FakeUserRepository, err error) {
 				require.NoError(t, err)
 				require.NotNil(t, user)
 
@@ -158,11 +195,65 @@ func TestGoogleOAuth(t *testing.T) {
 				require.Len(t, userRepo.identities, 1)
 			},
 		},
+		{
+			testName: "user exists with email, but upstream email is not verified, must not link",
+			wantError: true,
+			input: federatedInput{
+				Email: "user@example.com",
+				EmailVerified: false,
+				LinkByEmail: true,
+				RawToken: "token",
+				Provider: "google",
+				ExternalID: "test_issuer_user_id",
+				Issuer: "test.issuer.com",
+			},
+			setupRepositories: existingUser,
+			runChecks: requireLinkRequired,
+		},
+
+		{
+			testName: "user exists with email, but provider policy does not link by email, must not link",
+			wantError: true,
+			input: federatedInput{
+				Email: "user@example.com",
+				EmailVerified: true,
+				LinkByEmail: false,
+				RawToken: "token",
+				Provider: "corp",
+				ExternalID: "test_issuer_user_id",
+				Issuer: "test.issuer.com",
+			},
+			setupRepositories: existingUser,
+			runChecks: requireLinkRequired,
+		},
+
+		{
+			testName: "user not exists and upstream email is not verified, must not create user",
+			wantError: true,
+			input: federatedInput{
+				Email: "user@example.com",
+				EmailVerified: false,
+				LinkByEmail: true,
+				RawToken: "token",
+				Provider: "google",
+				ExternalID: "test_issuer_user_id",
+				Issuer: "test.issuer.com",
+			},
+			setupRepositories: func() (*FakeUserRepository, *FakeHashRepository, *FakeTokenRepository) {
+				return &FakeUserRepository{}, &FakeHashRepository{}, &FakeTokenRepository{}
+			},
+			runChecks: func(t *testing.T, input federatedInput, user *core.User, userRepo *FakeUserRepository, err error) {
+				require.ErrorIs(t, err, e.EmailNotVerified)
+				require.Nil(t, user)
+				require.Empty(t, userRepo.users)
+				require.Empty(t, userRepo.identities)
+			},
+		},
 		// test template
 		// {
 		// 	testName: "",
 		// 	wantError: false,
-		// 	input: googleInput{
+		// 	input: federatedInput{
 		// 		Email: "",
 		// 		RawToken: "",
 		// 		Provider: "",
@@ -185,7 +276,7 @@ func TestGoogleOAuth(t *testing.T) {
 
 		// 		return userRepo, hashRepo, tokenRepo
 		// 	},
-		// 	runChecks: func(t *testing.T, input googleInput, user *core.User, userRepo *FakeUserRepository, err error) {
+		// 	runChecks: func(t *testing.T, input federatedInput, user *core.User, userRepo *FakeUserRepository, err error) {
 		// 	},
 		// },
 	}
@@ -194,7 +285,14 @@ func TestGoogleOAuth(t *testing.T) {
 		t.Run(tt.testName, func(t *testing.T) {
 			ctx := context.Background()
 			userRepo, _, _ := tt.setupRepositories()
-			user, err := core.GoogleOAuth(ctx, userRepo, tt.input.Email, tt.input.RawToken, tt.input.Provider, tt.input.ExternalID, tt.input.Issuer)
+			claims := map[string]string{
+				"provider": tt.input.Provider,
+				"email": tt.input.Email,
+				"email_verified": strconv.FormatBool(tt.input.EmailVerified),
+				"link_by_email": strconv.FormatBool(tt.input.LinkByEmail),
+				"raw": tt.input.RawToken,
+			}
+			user, err := core.FederatedUser(ctx, userRepo, infrastructure.NewPendingLinksInterface(), claims, tt.input.ExternalID, tt.input.Issuer)
 
 			tt.runChecks(t, tt.input, user, userRepo, err)
 		})
@@ -0,0 +1,388 @@
+package test
+
+import (
+	"sso/internal/core"
+	"sso/internal/infrastructure"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeProvider is a minimal upstream OpenID provider: /authorize immediately approves
+// and redirects back with a code, /token checks the pkce verifier and issues an id token
+type fakeProvider struct {
+	t *testing.T
+	server *httptest.Server
+	key *rsa.PrivateKey
+
+	mu sync.Mutex
+	codes map[string]fakeAuthorization
+	// nonce overrides the nonce put in the id token when set
+	nonce string
+	email string
+	emailVerified bool
+}
+
+type fakeAuthorization struct {
+	nonce string
+	challenge string
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	p := &fakeProvider{
+		t: t,
+		key: key,
+		codes: map[string]fakeAuthorization{},
+		email: "federated@example.com",
+		emailVerified: true,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/authorize", p.authorize)
+	mux.HandleFunc("/token", p.token)
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+
+	return p
+}
+
+func (p *fakeProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	require.Equal(p.t, "code", query.Get("response_type"))
+	require.Equal(p.t, "S256", query.Get("code_challenge_method"))
+
+	code := base64.RawURLEncoding.EncodeToString([]byte(query.Get("state")))
+
+	p.mu.Lock()
+	p.codes[code] = fakeAuthorization{
+		nonce: query.Get("nonce"),
+		challenge: query.Get("code_challenge"),
+	}
+	p.mu.Unlock()
+
+	http.Redirect(w, r, query.Get("redirect_uri")+"?"+url.Values{
+		"code": {code},
+		"state": {query.Get("state")},
+	}.Encode(), http.StatusFound)
+}
+
+func (p *fakeProvider) token(w http.ResponseWriter, r *http.Request) {
+	require.NoError(p.t, r.ParseForm())
+
+	p.mu.Lock()
+	auth, ok := p.codes[r.PostForm.Get("code")]
+	delete(p.codes, r.PostForm.Get("code"))
+	nonce := p.nonce
+	email, emailVerified := p.email, p.emailVerified
+	p.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || r.PostForm.Get("client_secret") != "client_secret" || base64.RawURLEncoding.EncodeToString(challenge[:]) != auth.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	if nonce == "" {
+		nonce = auth.nonce
+	}
+
+	idToken := signIDToken(p.t, p.key, "kid1", jwt.MapClaims{
+		"iss": p.server.URL,
+		"aud": "client_id",
+		"sub": "upstream_user_id",
+		"email": email,
+		"email_verified": emailVerified,
+		"nonce": nonce,
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token": "access_token",
+		"token_type": "Bearer",
+		"id_token": idToken,
+	})
+}
+
+func (p *fakeProvider) provider() core.IFederatedProvider {
+	conf := testProviderConfig("fake")
+	conf.DisplayName = "Fake"
+	conf.AuthURL = p.server.URL + "/authorize"
+	conf.TokenURL = p.server.URL + "/token"
+	conf.ClientSecret = "client_secret"
+	conf.RedirectURL = "http://sso.test/auth/federated/fake/callback"
+	conf.Scopes = []string{"openid", "email"}
+
+	verifier := infrastructure.NewOIDCVerifierInterface(conf, []string{p.server.URL}, infrastructure.NewStaticKeySource(map[string]*rsa.PublicKey{
+		"kid1": &p.key.PublicKey,
+	}))
+
+	return infrastructure.NewOIDCProviderInterface(conf, verifier, p.server.Client())
+}
+
+// startFederatedLogin runs the start endpoint and lets the fake provider approve,
+// returning the callback url and the state binding cookie
+func startFederatedLogin(t *testing.T, s *pagesServer, p *fakeProvider) (string, *http.Cookie) {
+	rec := s.do(httptest.NewRequest(http.MethodGet, "/auth/federated/fake/start?return_to=/account", nil))
+	require.Equal(t, http.StatusFound, rec.Code)
+
+	stateCookie := findCookie(rec, "sso_federation_state")
+	require.NotNil(t, stateCookie)
+	require.True(t, stateCookie.HttpOnly)
+
+	return approveUpstream(t, p, rec.Header().Get("Location")), stateCookie
+}
+
+// approveUpstream lets the fake provider approve an authorization request and returns the callback url
+func approveUpstream(t *testing.T, p *fakeProvider, authURL string) string {
+	require.True(t, strings.HasPrefix(authURL, p.server.URL+"/authorize?"))
+
+	client := p.server.Client()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	resp, err := client.Get(authURL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+
+	return callback.RequestURI()
+}
+
+func TestFederatedLogin(t *testing.T) {
+	p := newFakeProvider(t)
+	s := newPagesServer(t, "", map[string]core.IFederatedProvider{"fake": p.provider()})
+
+	rec := s.do(httptest.NewRequest(http.MethodGet, "/login", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "/auth/federated/fake/start")
+	require.Contains(t, rec.Body.String(), "Sign in with Fake")
+
+	callback, stateCookie := startFederatedLogin(t, s, p)
+
+	rec = s.do(httptest.NewRequest(http.MethodGet, callback, nil), stateCookie)
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	require.Equal(t, "/account", rec.Header().Get("Location"))
+
+	sessionCookie := findCookie(rec, "sso_session_token")
+	require.NotNil(t, sessionCookie)
+
+	user, err := s.userRepo.ByIdentity(t.Context(), "fake", "upstream_user_id", p.server.URL)
+	require.NoError(t, err)
+	require.NotNil(t, user)
+	require.Equal(t, "federated@example.com", user.Email)
+
+	sessions, err := s.sessionRepo.ByUser(t.Context(), user.ID)
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	require.Equal(t, []string{"fed"}, sessions[0].AuthMethods)
+
+	// the state is single use
+	rec = s.do(httptest.NewRequest(http.MethodGet, callback, nil), stateCookie)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	require.Contains(t, rec.Body.String(), "has expired")
+}
+
+func TestFederatedLoginRejectsTampering(t *testing.T) {
+	tests := []struct{
+		testName string
+		run func(t *testing.T, s *pagesServer, p *fakeProvider) int
+	}{
+		{
+			testName: "missing state cookie",
+			run: func(t *testing.T, s *pagesServer, p *fakeProvider) int {
+				callback, _ := startFederatedLogin(t, s, p)
+				return s.do(httptest.NewRequest(http.MethodGet, callback, nil)).Code
+			},
+		},
+		{
+			testName: "state of another login",
+			run: func(t *testing.T, s *pagesServer, p *fakeProvider) int {
+				callback, _ := startFederatedLogin(t, s, p)
+				_, otherCookie := startFederatedLogin(t, s, p)
+				return s.do(httptest.NewRequest(http.MethodGet, callback, nil), otherCookie).Code
+			},
+		},
+		{
+			testName: "nonce mismatch",
+			run: func(t *testing.T, s *pagesServer, p *fakeProvider) int {
+				p.nonce = "replayed"
+				callback, stateCookie := startFederatedLogin(t, s, p)
+				return s.do(httptest.NewRequest(http.MethodGet, callback, nil), stateCookie).Code
+			},
+		},
+		{
+			testName: "upstream error",
+			run: func(t *testing.T, s *pagesServer, p *fakeProvider) int {
+				callback, stateCookie := startFederatedLogin(t, s, p)
+				u, _ := url.Parse(callback)
+				query := u.Query()
+				query.Del("code")
+				query.Set("error", "access_denied")
+				return s.do(httptest.NewRequest(http.MethodGet, u.Path+"?"+query.Encode(), nil), stateCookie).Code
+			},
+		},
+		{
+			testName: "unknown provider",
+			run: func(t *testing.T, s *pagesServer, p *fakeProvider) int {
+				return s.do(httptest.NewRequest(http.MethodGet, "/auth/federated/other/start", nil)).Code
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			p := newFakeProvider(t)
+			s := newPagesServer(t, "", map[string]core.IFederatedProvider{"fake": p.provider()})
+
+			code := test.run(t, s, p)
+			require.True(t, code == http.StatusBadRequest || code == http.StatusUnauthorized, "got %d", code)
+
+			user, err := s.userRepo.ByEmail(t.Context(), "federated@example.com")
+			require.NoError(t, err)
+			require.Nil(t, user)
+		})
+	}
+}
+
+func TestFederatedLoginLinksAfterPasswordLogin(t *testing.T) {
+	p := newFakeProvider(t)
+	// the upstream claims the email of an existing account without verifying it
+	p.email = "user@example.com"
+	p.emailVerified = false
+	s := newPagesServer(t, "", map[string]core.IFederatedProvider{"fake": p.provider()})
+
+	callback, stateCookie := startFederatedLogin(t, s, p)
+	rec := s.do(httptest.NewRequest(http.MethodGet, callback, nil), stateCookie)
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	require.Nil(t, findCookie(rec, "sso_session_token"))
+
+	loginURL, err := url.Parse(rec.Header().Get("Location"))
+	require.NoError(t, err)
+	require.Equal(t, "/login", loginURL.Path)
+	require.Equal(t, "user@example.com", loginURL.Query().Get("login_hint"))
+	linkToken := loginURL.Query().Get("link_token")
+	require.NotEmpty(t, linkToken)
+
+	user, err := s.userRepo.ByIdentity(t.Context(), "fake", "upstream_user_id", p.server.URL)
+	require.NoError(t, err)
+	require.Nil(t, user)
+
+	rec = s.do(httptest.NewRequest(http.MethodGet, loginURL.RequestURI(), nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "link your Fake account")
+	csrfCookie := findCookie(rec, "_csrf")
+	match := csrfInput.FindStringSubmatch(rec.Body.String())
+	require.Len(t, match, 2)
+
+	login := func(password string) *httptest.ResponseRecorder {
+		form := url.Values{
+			"_csrf": {match[1]},
+			"email": {"user@example.com"},
+			"password": {password},
+			"return_to": {"/account"},
+			"link_token": {linkToken},
+			"link_provider": {"fake"},
+		}
+		req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return s.do(req, csrfCookie)
+	}
+
+	// a wrong password keeps the link pending
+	rec = login("wrong")
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	require.Contains(t, rec.Body.String(), linkToken)
+
+	rec = login("password")
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+
+	user, err = s.userRepo.ByIdentity(t.Context(), "fake", "upstream_user_id", p.server.URL)
+	require.NoError(t, err)
+	require.NotNil(t, user)
+	require.Equal(t, "user_id1", user.ID)
+
+	// the link token is single use
+	rec = login("password")
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// from now on the upstream login signs in directly
+	callback, stateCookie = startFederatedLogin(t, s, p)
+	rec = s.do(httptest.NewRequest(http.MethodGet, callback, nil), stateCookie)
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	require.Equal(t, "/account", rec.Header().Get("Location"))
+	require.NotNil(t, findCookie(rec, "sso_session_token"))
+}
+
+func TestFederatedLoginLinksAfterSecondFactor(t *testing.T) {
+	p := newFakeProvider(t)
+	p.email = "user@example.com"
+	p.emailVerified = false
+	s := newPagesServer(t, "", map[string]core.IFederatedProvider{"fake": p.provider()})
+	secret, _ := enrollTOTP(t, s, passwordLogin(t, s))
+
+	pendingLink := func() string {
+		callback, stateCookie := startFederatedLogin(t, s, p)
+		rec := s.do(httptest.NewRequest(http.MethodGet, callback, nil), stateCookie)
+		require.Equal(t, http.StatusSeeOther, rec.Code)
+
+		loginURL, err := url.Parse(rec.Header().Get("Location"))
+		require.NoError(t, err)
+		linkToken := loginURL.Query().Get("link_token")
+		require.NotEmpty(t, linkToken)
+
+		return linkToken
+	}
+
+	linked := func() bool {
+		user, err := s.userRepo.ByIdentity(t.Context(), "fake", "upstream_user_id", p.server.URL)
+		require.NoError(t, err)
+		return user != nil
+	}
+
+	login := func(linkToken string) string {
+		rec := mfaDo(s, http.MethodPost, "/auth/login?provider=email", `{"email":"user@example.com","password":"password","link_token":"`+linkToken+`"}`)
+		require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+		var body struct {
+			MFAToken string `json:"mfa_token"`
+		}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		require.NotEmpty(t, body.MFAToken)
+
+		return body.MFAToken
+	}
+
+	// the password alone links nothing, neither does a wrong code
+	mfaToken := login(pendingLink())
+	require.False(t, linked())
+	require.Equal(t, http.StatusUnauthorized, verifyMFA(s, mfaToken, "code", "000000").Code)
+	require.False(t, linked())
+
+	mfaToken = login(pendingLink())
+	rec := verifyMFA(s, mfaToken, "code", core.TOTPCode(secret, time.Now()))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.True(t, linked())
+}
@@ -0,0 +1,185 @@
+package test
+
+import (
+	"sso/internal/config"
+	"sso/internal/core"
+	e "sso/internal/core/errors"
+	"sso/internal/infrastructure"
+	"github.com/stretchr/testify/require"
+
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// fakeGitHub serves the oauth token endpoint and the user and emails apis
+type fakeGitHub struct {
+	server *httptest.Server
+	emails []map[string]any
+}
+
+func newFakeGitHub(t *testing.T, emails []map[string]any) *fakeGitHub {
+	g := &fakeGitHub{
+		emails: emails,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /login/oauth/access_token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+
+		w.Header().Set("Content-Type", "application/json")
+		// github answers token errors with 200 and an error field
+		if r.PostForm.Get("code") != "github_code" || r.PostForm.Get("client_secret") != "github_secret" {
+			json.NewEncoder(w).Encode(map[string]string{"error": "bad_verification_code"})
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "gho_token",
+			"token_type": "bearer",
+			"scope": "read:user,user:email",
+		})
+	})
+	mux.HandleFunc("GET /user", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer gho_token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]any{
+			"id": 583231,
+			"login": "octocat",
+			"name": nil,
+			"email": "public@example.com",
+		})
+	})
+	mux.HandleFunc("GET /user/emails", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer gho_token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		json.NewEncoder(w).Encode(g.emails)
+	})
+	g.server = httptest.NewServer(mux)
+	t.Cleanup(g.server.Close)
+
+	return g
+}
+
+func (g *fakeGitHub) provider(t *testing.T) core.IFederatedProvider {
+	linkByEmail := true
+
+	providers, _, err := infrastructure.NewIdentityProviders(context.Background(), []config.IdentityProviderConfig{
+		{
+			Name: "github",
+			Type: "github",
+			DisplayName: "GitHub",
+			Issuer: "https://github.com",
+			ClientID: "github_id",
+			ClientSecret: "github_secret",
+			RedirectURL: "https://sso.example.com/auth/federated/github/callback",
+			AuthURL: g.server.URL + "/login/oauth/authorize",
+			TokenURL: g.server.URL + "/login/oauth/access_token",
+			UserInfoURL: g.server.URL + "/user",
+			LinkByEmail: &linkByEmail,
+		},
+	}, g.server.Client())
+	require.NoError(t, err)
+	require.Contains(t, providers, "github")
+
+	return providers["github"]
+}
+
+func TestGitHubProvider(t *testing.T) {
+	tests := []struct{
+		testName string
+		code string
+		emails []map[string]any
+		wantEmail string
+		wantError error
+	}{
+		{
+			testName: "primary verified email",
+			code: "github_code",
+			emails: []map[string]any{
+				{"email": "secondary@example.com", "primary": false, "verified": true},
+				{"email": "octocat@example.com", "primary": true, "verified": true},
+			},
+			wantEmail: "octocat@example.com",
+		},
+		{
+			testName: "primary email not verified",
+			code: "github_code",
+			emails: []map[string]any{
+				{"email": "octocat@example.com", "primary": true, "verified": false},
+				{"email": "secondary@example.com", "primary": false, "verified": true},
+			},
+			wantError: e.EmailNotVerified,
+		},
+		{
+			testName: "no emails",
+			code: "github_code",
+			emails: []map[string]any{},
+			wantError: e.EmailNotVerified,
+		},
+		{
+			testName: "bad code",
+			code: "wrong_code",
+			wantError: e.UpstreamLoginFailed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			github := newFakeGitHub(t, tt.emails)
+
+			claims, err := github.provider(t).Exchange(context.Background(), tt.code, "verifier", "nonce")
+			if tt.wantError != nil {
+				require.ErrorIs(t, err, tt.wantError)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, "github", claims["provider"])
+			require.Equal(t, "https://github.com", claims["issuer"])
+			require.Equal(t, "583231", claims["sub"])
+			require.Equal(t, tt.wantEmail, claims["email"])
+			require.Equal(t, "octocat", claims["name"])
+		})
+	}
+}
+
+func TestGitHubFederatedLogin(t *testing.T) {
+	github := newFakeGitHub(t, []map[string]any{
+		{"email": "user@example.com", "primary": true, "verified": true},
+	})
+	provider := github.provider(t)
+
+	authURL, err := url.Parse(provider.AuthCodeURL("state", "nonce", "challenge"))
+	require.NoError(t, err)
+	require.Empty(t, authURL.Query().Get("nonce"))
+
+	s := newPagesServer(t, "", map[string]core.IFederatedProvider{"github": provider})
+
+	rec := s.do(httptest.NewRequest(http.MethodGet, "/auth/federated/github/start", nil))
+	require.Equal(t, http.StatusFound, rec.Code)
+	stateCookie := findCookie(rec, "sso_federation_state")
+	require.NotNil(t, stateCookie)
+
+	rec = s.do(httptest.NewRequest(http.MethodGet, "/auth/federated/github/callback?"+url.Values{
+		"code": {"github_code"},
+		"state": {stateCookie.Value},
+	}.Encode(), nil), stateCookie)
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	require.NotNil(t, findCookie(rec, "sso_session_token"))
+
+	// the existing user with the verified email gets the github identity
+	user, err := s.userRepo.ByIdentity(context.Background(), "github", "583231", "https://github.com")
+	require.NoError(t, err)
+	require.NotNil(t, user)
+	require.Equal(t, "user_id1", user.ID)
+}
@@ -0,0 +1,145 @@
+package test
+
+import (
+	"sso/internal/core"
+	"sso/internal/infrastructure"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+
+	"context"
+	"regexp"
+	"testing"
+)
+
+// cheap parameters, the defaults take a noticeable time per hash
+var testArgon2Params = infrastructure.Argon2Params{Memory: 1024, Iterations: 1, Parallelism: 1}
+
+var argon2PHC = regexp.MustCompile(`^\$argon2id\$v=19\$m=1024,t=1,p=1(,keyid=[A-Za-z0-9+/]+)?\$[A-Za-z0-9+/]+\$[A-Za-z0-9+/]+$`)
+
+func TestArgon2Hash(t *testing.T) {
+	argon := infrastructure.NewArgon2HashInterface(testArgon2Params, nil)
+
+	hash, err := argon.HashPassword("password")
+	require.NoError(t, err)
+	require.Regexp(t, argon2PHC, hash)
+	require.NotContains(t, hash, "keyid")
+
+	other, err := argon.HashPassword("password")
+	require.NoError(t, err)
+	require.NotEqual(t, hash, other, "every hash has its own salt")
+
+	require.NoError(t, argon.CheckPassword("password", hash))
+	require.Error(t, argon.CheckPassword("wrong password", hash))
+	require.Error(t, argon.CheckPassword("password", "$argon2id$v=19$m=1024,t=1,p=1$broken"))
+	require.False(t, argon.NeedsRehash(hash))
+
+	// the parameters of the hash are used to check it, new ones only ask for a rehash
+	stronger := infrastructure.NewArgon2HashInterface(infrastructure.Argon2Params{Memory: 2048, Iterations: 2, Parallelism: 1}, nil)
+	require.NoError(t, stronger.CheckPassword("password", hash))
+	require.True(t, stronger.NeedsRehash(hash))
+}
+
+func TestArgon2HashPepper(t *testing.T) {
+	plain := infrastructure.NewArgon2HashInterface(testArgon2Params, nil)
+	peppered := infrastructure.NewArgon2HashInterface(testArgon2Params, []byte("0123456789abcdef"))
+	repeppered := infrastructure.NewArgon2HashInterface(testArgon2Params, []byte("fedcba9876543210"))
+
+	hash, err := peppered.HashPassword("password")
+	require.NoError(t, err)
+	require.Regexp(t, argon2PHC, hash)
+	require.Contains(t, hash, ",keyid=")
+
+	require.NoError(t, peppered.CheckPassword("password", hash))
+	require.False(t, peppered.NeedsRehash(hash))
+
+	// without the pepper the database alone cannot check the password
+	require.Error(t, plain.CheckPassword("password", hash))
+	require.Error(t, repeppered.CheckPassword("password", hash))
+
+	// hashes made before the pepper was configured still work and get peppered on login
+	unpeppered, err := plain.HashPassword("password")
+	require.NoError(t, err)
+	require.NoError(t, peppered.CheckPassword("password", unpeppered))
+	require.True(t, peppered.NeedsRehash(unpeppered))
+}
+
+func TestPasswordHashDispatch(t *testing.T) {
+	argon := infrastructure.NewArgon2HashInterface(testArgon2Params, nil)
+	bcryptHash := infrastructure.NewHashInterface(bcrypt.MinCost)
+
+	hashes, err := infrastructure.NewPasswordHashInterface("argon2id", argon, bcryptHash)
+	require.NoError(t, err)
+
+	legacy, err := bcryptHash.HashPassword("password")
+	require.NoError(t, err)
+
+	require.NoError(t, hashes.CheckPassword("password", legacy))
+	require.Error(t, hashes.CheckPassword("wrong password", legacy))
+	require.True(t, hashes.NeedsRehash(legacy))
+
+	current, err := hashes.HashPassword("password")
+	require.NoError(t, err)
+	require.Regexp(t, argon2PHC, current)
+	require.NoError(t, hashes.CheckPassword("password", current))
+	require.False(t, hashes.NeedsRehash(current))
+
+	require.Error(t, hashes.CheckPassword("password", "password_hashed"))
+	require.False(t, hashes.NeedsRehash("password_hashed"))
+
+	// bcrypt can still be chosen, then argon2id hashes are moved back
+	bcryptFirst, err := infrastructure.NewPasswordHashInterface("bcrypt", argon, bcryptHash)
+	require.NoError(t, err)
+	require.True(t, bcryptFirst.NeedsRehash(current))
+	require.False(t, bcryptFirst.NeedsRehash(legacy))
+
+	_, err = infrastructure.NewPasswordHashInterface("md5", argon, bcryptHash)
+	require.Error(t, err)
+}
+
+func TestLoginRehashesPassword(t *testing.T) {
+	bcryptHash := infrastructure.NewHashInterface(bcrypt.MinCost)
+	legacy, err := bcryptHash.HashPassword("password")
+	require.NoError(t, err)
+
+	userRepo := &FakeUserRepository{
+		users: []core.User{
+			{ID: "user_id1", Name: "1", Email: "email@example.com", Status: "active"},
+		},
+		identities: []core.Identity{
+			{ID: "identity_id1", UserID: "user_id1", Type: "email", ExternalID: "email@example.com", Issuer: "sso.test.com"},
+		},
+		credentials: []core.Credential{
+			{ID: "credential_id1", IdentityID: "identity_id1", Type: "password", Hash: legacy, Status: "active"},
+		},
+	}
+
+	hashes, err := infrastructure.NewPasswordHashInterface("argon2id", infrastructure.NewArgon2HashInterface(testArgon2Params, nil), bcryptHash)
+	require.NoError(t, err)
+
+	policies := core.SessionPolicies{
+		Default: core.SessionPolicy{Lifetime: 3600},
+	}
+	loginUC := core.NewLoginUseCase(userRepo, infrastructure.NewTokenInterface("secret", jwt.SigningMethodHS256), hashes, &FakeSessionRepository{}, &FakeClientRepository{}, policies, infrastructure.NewPendingLinksInterface(), nil, infrastructure.NewPartialSessionsInterface(), nil, nil, nil)
+
+	input := core.LoginInput{
+		Provider: "email",
+		Email: "email@example.com",
+		Password: "password",
+	}
+
+	_, _, err = loginUC.Execute(context.Background(), input)
+	require.NoError(t, err)
+	require.Regexp(t, argon2PHC, userRepo.credentials[0].Hash)
+	require.Equal(t, "credential_id1", userRepo.credentials[0].ID)
+
+	// the rehashed password signs in and is left alone
+	rehashed := userRepo.credentials[0].Hash
+	_, _, err = loginUC.Execute(context.Background(), input)
+	require.NoError(t, err)
+	require.Equal(t, rehashed, userRepo.credentials[0].Hash)
+
+	input.Password = "wrong password"
+	_, _, err = loginUC.Execute(context.Background(), input)
+	require.Error(t, err)
+}
@@ -0,0 +1,170 @@
+package test
+
+import (
+	"sso/internal/core"
+	e "sso/internal/core/errors"
+	"github.com/stretchr/testify/require"
+
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// passwordLogin signs the seeded user in through the api and returns the session cookie
+func passwordLogin(t *testing.T, s *pagesServer) *http.Cookie {
+	req := httptest.NewRequest(http.MethodPost, "/auth/login?provider=email", strings.NewReader(`{"email":"user@example.com","password":"password"}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	rec := s.do(req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	sessionCookie := findCookie(rec, "sso_session_token")
+	require.NotNil(t, sessionCookie)
+
+	return sessionCookie
+}
+
+func listIdentities(t *testing.T, s *pagesServer, sessionCookie *http.Cookie) []core.Identity {
+	rec := s.do(httptest.NewRequest(http.MethodGet, "/auth/identities", nil), sessionCookie)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NotContains(t, rec.Body.String(), "password_hashed")
+
+	var body struct {
+		Identities []core.Identity `json:"identities"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+
+	return body.Identities
+}
+
+func unlinkIdentity(s *pagesServer, sessionCookie *http.Cookie, id string) int {
+	return s.do(httptest.NewRequest(http.MethodDelete, "/auth/identities/"+id, nil), sessionCookie).Code
+}
+
+func TestIdentityLinkAndUnlink(t *testing.T) {
+	p := newFakeProvider(t)
+	s := newPagesServer(t, "", map[string]core.IFederatedProvider{"fake": p.provider()})
+
+	rec := s.do(httptest.NewRequest(http.MethodGet, "/auth/identities", nil))
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	sessionCookie := passwordLogin(t, s)
+
+	identities := listIdentities(t, s, sessionCookie)
+	require.Len(t, identities, 1)
+	require.Equal(t, "email", identities[0].Type)
+
+	require.Equal(t, http.StatusConflict, unlinkIdentity(s, sessionCookie, "identity_id1"))
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/identities/link/fake", strings.NewReader(`{"return_to":"/account"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec = s.do(req, sessionCookie)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	stateCookie := findCookie(rec, "sso_federation_state")
+	require.NotNil(t, stateCookie)
+
+	var started struct {
+		RedirectURL string `json:"redirect_url"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &started))
+	callback := approveUpstream(t, p, started.RedirectURL)
+
+	rec = s.do(httptest.NewRequest(http.MethodGet, callback, nil), stateCookie, sessionCookie)
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	require.Equal(t, "/account", rec.Header().Get("Location"))
+	// the existing session is kept
+	require.Nil(t, findCookie(rec, "sso_session_token"))
+
+	identities = listIdentities(t, s, sessionCookie)
+	require.Len(t, identities, 2)
+
+	user, err := s.userRepo.ByIdentity(t.Context(), "fake", "upstream_user_id", p.server.URL)
+	require.NoError(t, err)
+	require.Equal(t, "user_id1", user.ID)
+
+	require.Equal(t, http.StatusNotFound, unlinkIdentity(s, sessionCookie, "unknown"))
+	require.Equal(t, http.StatusNoContent, unlinkIdentity(s, sessionCookie, "identity_id1"))
+
+	identities = listIdentities(t, s, sessionCookie)
+	require.Len(t, identities, 1)
+	require.Equal(t, "fake", identities[0].Type)
+
+	require.Equal(t, http.StatusConflict, unlinkIdentity(s, sessionCookie, identities[0].ID))
+
+	events, err := s.auditRepo.ByUser(t.Context(), "user_id1", 10)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	require.Equal(t, "identity.unlinked", events[0].Action)
+	require.Equal(t, "email", events[0].Details["provider"])
+	require.Equal(t, "identity.linked", events[1].Action)
+	require.Equal(t, "fake", events[1].Details["provider"])
+}
+
+func TestIdentityLinkRequiresSameUser(t *testing.T) {
+	p := newFakeProvider(t)
+	s := newPagesServer(t, "", map[string]core.IFederatedProvider{"fake": p.provider()})
+
+	sessionCookie := passwordLogin(t, s)
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/identities/link/fake", nil)
+	rec := s.do(req, sessionCookie)
+	require.Equal(t, http.StatusOK, rec.Code)
+	stateCookie := findCookie(rec, "sso_federation_state")
+
+	var started struct {
+		RedirectURL string `json:"redirect_url"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &started))
+	callback := approveUpstream(t, p, started.RedirectURL)
+
+	// finishing the link without the session that started it must neither link nor log in
+	rec = s.do(httptest.NewRequest(http.MethodGet, callback, nil), stateCookie)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	require.Nil(t, findCookie(rec, "sso_session_token"))
+
+	user, err := s.userRepo.ByIdentity(t.Context(), "fake", "upstream_user_id", p.server.URL)
+	require.NoError(t, err)
+	require.Nil(t, user)
+}
+
+func TestIdentityLinkConflicts(t *testing.T) {
+	userRepo := &FakeUserRepository{
+		users: []core.User{
+			{ID: "user_id1", Name: "first", Email: "first@example.com", Status: "active"},
+			{ID: "user_id2", Name: "second", Email: "second@example.com", Status: "active"},
+		},
+		identities: []core.Identity{
+			{ID: "identity_id1", UserID: "user_id1", Type: "email"},
+			{ID: "identity_id2", UserID: "user_id2", Type: "fake", ExternalID: "upstream_user_id", Issuer: "https://fake.example.com"},
+		},
+	}
+	auditRepo := &FakeAuditRepository{}
+	uc := core.NewIdentityUseCase(userRepo, auditRepo)
+
+	claims := map[string]string{
+		"provider": "fake",
+		"issuer": "https://fake.example.com",
+		"sub": "upstream_user_id",
+	}
+
+	err := uc.Link(t.Context(), core.IdentityChangeInput{UserID: "user_id1"}, claims)
+	require.ErrorIs(t, err, e.IdentityAlreadyLinked)
+
+	// linking an identity the user already has changes nothing
+	err = uc.Link(t.Context(), core.IdentityChangeInput{UserID: "user_id2"}, claims)
+	require.NoError(t, err)
+
+	// one identity per provider and issuer
+	claims["sub"] = "other_upstream_user_id"
+	err = uc.Link(t.Context(), core.IdentityChangeInput{UserID: "user_id2"}, claims)
+	require.ErrorIs(t, err, e.IdentityAlreadyLinked)
+
+	require.Empty(t, auditRepo.events)
+
+	// identities of other users cannot be unlinked
+	err = uc.Unlink(t.Context(), core.IdentityChangeInput{UserID: "user_id1"}, "identity_id2")
+	require.ErrorIs(t, err, e.IdentityNotFound)
+}
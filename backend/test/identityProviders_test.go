@@ -0,0 +1,255 @@
+package test
+
+import (
+	"sso/internal/config"
+	"sso/internal/core"
+	e "sso/internal/core/errors"
+	"sso/internal/infrastructure"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeProvidersFile(t *testing.T, providers string) string {
+	path := filepath.Join(t.TempDir(), "providers.json")
+	require.NoError(t, os.WriteFile(path, []byte(providers), 0o600))
+
+	return path
+}
+
+func TestLoadIdentityProviders(t *testing.T) {
+	t.Setenv("GITLAB_SECRET", "gitlab_secret")
+
+	providers, err := config.LoadIdentityProviders(writeProvidersFile(t, `[
+		{"name": "google", "type": "google", "client_id": "google_id"},
+		{"name": "gitlab", "type": "gitlab", "issuer": "https://git.example.com/", "client_id": "gitlab_id", "client_secret": "${GITLAB_SECRET}"},
+		{"name": "entra", "type": "microsoft", "client_id": "entra_id"},
+		{"name": "corp", "type": "oidc", "issuer": "https://idp.example.com", "client_id": "corp_id", "claims": {"email": "mail", "email_verified": "mail_verified"}}
+	]`))
+	require.NoError(t, err)
+	require.Len(t, providers, 4)
+
+	google := providers[0]
+	require.Equal(t, "https://accounts.google.com", google.Issuer)
+	require.Equal(t, "Google", google.DisplayName)
+	require.Equal(t, []string{"openid", "email", "profile"}, google.Scopes)
+	require.Equal(t, "sub", google.Claims.Subject)
+
+	gitlab := providers[1]
+	require.Equal(t, "https://git.example.com", gitlab.Issuer)
+	require.Equal(t, "https://git.example.com/oauth/token", gitlab.TokenURL)
+	require.Equal(t, "gitlab_secret", gitlab.ClientSecret)
+
+	entra := providers[2]
+	require.Equal(t, "https://login.microsoftonline.com/{tenantid}/v2.0", entra.Issuer)
+	require.True(t, entra.Claims.EmailAlwaysVerified)
+
+	corp := providers[3]
+	require.Equal(t, "corp", corp.DisplayName)
+	require.Equal(t, "mail", corp.Claims.Email)
+	require.Equal(t, "mail_verified", corp.Claims.EmailVerified)
+	require.Equal(t, "name", corp.Claims.Name)
+	require.Empty(t, corp.AuthURL)
+
+	invalid := []string{
+		`[{"name": "google", "type": "google"}]`,
+		`[{"name": "Google", "type": "google", "client_id": "id"}]`,
+		`[{"name": "oauth", "type": "google", "client_id": "id"}]`,
+		`[{"name": "corp", "type": "oidc", "client_id": "id"}]`,
+		`[{"name": "corp", "type": "saml", "client_id": "id"}]`,
+		`[{"name": "corp", "type": "ldap", "url": "ldap://dc.corp", "bind_dn": "cn=sso"}]`,
+		`[{"name": "corp", "type": "ldap", "url": "ldap://dc.corp", "base_dn": "dc=corp"}]`,
+		`[{"name": "a", "type": "ldap", "url": "ldap://a", "base_dn": "dc=a", "user_dn": "uid={username},dc=a"}, {"name": "b", "type": "ldap", "url": "ldap://b", "base_dn": "dc=b", "user_dn": "uid={username},dc=b"}]`,
+		`[{"name": "corp", "type": "oauth2", "issuer": "https://corp", "client_id": "id", "auth_url": "https://corp/auth"}]`,
+		`[{"name": "a", "type": "google", "client_id": "id"}, {"name": "a", "type": "gitlab", "client_id": "id"}]`,
+	}
+	for _, providers := range invalid {
+		_, err := config.LoadIdentityProviders(writeProvidersFile(t, providers))
+		require.Error(t, err, providers)
+	}
+}
+
+func TestIdentityProvidersDiscovery(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	var server *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer": server.URL,
+			"authorization_endpoint": server.URL + "/authorize",
+			"token_endpoint": server.URL + "/token",
+			"jwks_uri": server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(core.JWKS{
+			Keys: []core.JWK{publicJWK(key, "kid1")},
+		})
+	})
+	server = httptest.NewServer(mux)
+	defer server.Close()
+
+	providers, verifier, err := infrastructure.NewIdentityProviders(context.Background(), []config.IdentityProviderConfig{
+		{
+			Name: "corp",
+			Type: "oidc",
+			DisplayName: "Corp",
+			Issuer: server.URL,
+			ClientID: "corp_id",
+			RedirectURL: "https://sso.example.com/auth/federated/corp/callback",
+			Scopes: []string{"openid", "email"},
+			Claims: config.ClaimMapping{
+				Subject: "employee_id",
+				Email: "mail",
+				EmailAlwaysVerified: true,
+				Name: "display_name",
+			},
+		},
+	}, server.Client())
+	require.NoError(t, err)
+	require.NotNil(t, verifier)
+
+	authURL, err := url.Parse(providers["corp"].AuthCodeURL("state", "nonce", "challenge"))
+	require.NoError(t, err)
+	require.Equal(t, server.URL+"/authorize", authURL.Scheme+"://"+authURL.Host+authURL.Path)
+	require.Equal(t, "corp_id", authURL.Query().Get("client_id"))
+
+	claims, err := verifier.Verify(context.Background(), signIDToken(t, key, "kid1", jwt.MapClaims{
+		"iss": server.URL,
+		"aud": "corp_id",
+		"employee_id": 42,
+		"mail": "employee@example.com",
+		"display_name": "Employee",
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}))
+	require.NoError(t, err)
+	require.Equal(t, "corp", claims["provider"])
+	require.Equal(t, "42", claims["sub"])
+	require.Equal(t, "employee@example.com", claims["email"])
+	require.Equal(t, "Employee", claims["name"])
+
+	_, err = verifier.Verify(context.Background(), signIDToken(t, key, "kid1", jwt.MapClaims{
+		"iss": "https://other.example.com",
+		"aud": "corp_id",
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}))
+	require.ErrorIs(t, err, e.InvalidIDToken)
+}
+
+func TestIdentityProvidersTenantIssuer(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	keys := infrastructure.NewStaticKeySource(map[string]*rsa.PublicKey{
+		"kid1": &key.PublicKey,
+	})
+	verifier := infrastructure.NewIDTokenVerifiersInterface([]*infrastructure.OIDCVerifierInterface{
+		infrastructure.NewOIDCVerifierInterface(config.IdentityProviderConfig{
+			Name: "microsoft",
+			ClientID: "client_id",
+			Claims: config.ClaimMapping{
+				Subject: "sub",
+				Email: "email",
+				EmailAlwaysVerified: true,
+			},
+		}, []string{"https://login.microsoftonline.com/{tenantid}/v2.0"}, keys),
+	})
+
+	claims := func(issuer, tenantID string) jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss": issuer,
+			"tid": tenantID,
+			"aud": "client_id",
+			"sub": "entra_user_id",
+			"email": "user@example.com",
+			"iat": time.Now().Unix(),
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+	}
+
+	_, err = verifier.Verify(context.Background(), signIDToken(t, key, "kid1", claims("https://login.microsoftonline.com/tenant1/v2.0", "tenant1")))
+	require.NoError(t, err)
+
+	// the issuer has to belong to the tenant the token claims
+	_, err = verifier.Verify(context.Background(), signIDToken(t, key, "kid1", claims("https://login.microsoftonline.com/tenant1/v2.0", "tenant2")))
+	require.ErrorIs(t, err, e.InvalidIDToken)
+}
+
+func TestOAuth2ProviderUserInfo(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.PostForm.Get("code") != "code" || r.PostForm.Get("code_verifier") != "verifier" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "access_token",
+			"token_type": "Bearer",
+		})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access_token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]any{
+			"id": 1234567,
+			"login": "octo",
+			"primary_email": "octo@example.com",
+			"confirmed": true,
+		})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	providers, verifier, err := infrastructure.NewIdentityProviders(context.Background(), []config.IdentityProviderConfig{
+		{
+			Name: "forge",
+			Type: "oauth2",
+			Issuer: server.URL,
+			ClientID: "forge_id",
+			RedirectURL: "https://sso.example.com/auth/federated/forge/callback",
+			AuthURL: server.URL + "/authorize",
+			TokenURL: server.URL + "/token",
+			UserInfoURL: server.URL + "/userinfo",
+			Claims: config.ClaimMapping{
+				Subject: "id",
+				Email: "primary_email",
+				EmailVerified: "confirmed",
+				Name: "login",
+			},
+		},
+	}, server.Client())
+	require.NoError(t, err)
+	require.Nil(t, verifier)
+
+	claims, err := providers["forge"].Exchange(context.Background(), "code", "verifier", "nonce")
+	require.NoError(t, err)
+	require.Equal(t, "forge", claims["provider"])
+	require.Equal(t, server.URL, claims["issuer"])
+	require.Equal(t, "1234567", claims["sub"])
+	require.Equal(t, "octo@example.com", claims["email"])
+	require.Equal(t, "octo", claims["name"])
+
+	_, err = providers["forge"].Exchange(context.Background(), "wrong", "verifier", "nonce")
+	require.ErrorIs(t, err, e.UpstreamLoginFailed)
+}
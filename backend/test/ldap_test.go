@@ -0,0 +1,420 @@
+package test
+
+import (
+	"sso/internal/config"
+	"sso/internal/core"
+	e "sso/internal/core/errors"
+	"sso/internal/infrastructure"
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type fakeDirectoryEntry struct {
+	dn string
+	password string
+	attributes map[string][]string
+}
+
+// fakeDirectory is an in-process ldap server speaking just enough of the protocol for the
+// directory login: simple binds, searches with and, or, not, equality and presence filters
+type fakeDirectory struct {
+	listener net.Listener
+
+	mu sync.Mutex
+	entries []fakeDirectoryEntry
+	// binds are the dns of every bind attempt
+	binds []string
+}
+
+func newFakeDirectory(t *testing.T, entries []fakeDirectoryEntry) *fakeDirectory {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	d := &fakeDirectory{
+		listener: listener,
+		entries: entries,
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go d.serve(conn)
+		}
+	}()
+
+	return d
+}
+
+func (d *fakeDirectory) url() string {
+	return "ldap://" + d.listener.Addr().String()
+}
+
+func (d *fakeDirectory) setAttribute(dn, name string, values []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, entry := range d.entries {
+		if strings.EqualFold(entry.dn, dn) {
+			entry.attributes[name] = values
+		}
+	}
+}
+
+func (d *fakeDirectory) serve(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+
+		id := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		var responses []*ber.Packet
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			responses = []*ber.Packet{d.bind(op)}
+		case ldap.ApplicationSearchRequest:
+			responses = d.search(op)
+		default:
+			return
+		}
+
+		for _, response := range responses {
+			envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+			envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+			envelope.AppendChild(response)
+
+			if _, err := conn.Write(envelope.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (d *fakeDirectory) bind(op *ber.Packet) *ber.Packet {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	dn := op.Children[1].Value.(string)
+	password := op.Children[2].Data.String()
+	d.binds = append(d.binds, dn)
+
+	code := uint16(ldap.LDAPResultInvalidCredentials)
+	for _, entry := range d.entries {
+		if strings.EqualFold(entry.dn, dn) && password != "" && entry.password == password {
+			code = ldap.LDAPResultSuccess
+		}
+	}
+
+	return ldapResult(ldap.ApplicationBindResponse, code)
+}
+
+func (d *fakeDirectory) search(op *ber.Packet) []*ber.Packet {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	base := strings.ToLower(op.Children[0].Value.(string))
+	scope := op.Children[1].Value.(int64)
+	sizeLimit := op.Children[3].Value.(int64)
+	filter := op.Children[6]
+
+	requested := []string{}
+	for _, attribute := range op.Children[7].Children {
+		requested = append(requested, attribute.Value.(string))
+	}
+
+	responses := []*ber.Packet{}
+	found := false
+	for _, entry := range d.entries {
+		dn := strings.ToLower(entry.dn)
+		if dn == base {
+			found = true
+		}
+
+		inScope := dn == base || (scope == ldap.ScopeWholeSubtree && strings.HasSuffix(dn, ","+base))
+		if !inScope || !matchFilter(filter, entry) {
+			continue
+		}
+
+		if sizeLimit > 0 && int64(len(responses)) == sizeLimit {
+			return append(responses, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSizeLimitExceeded))
+		}
+
+		responses = append(responses, searchEntry(entry, requested))
+	}
+
+	if scope == ldap.ScopeBaseObject && !found {
+		return []*ber.Packet{ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultNoSuchObject)}
+	}
+
+	return append(responses, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+}
+
+func matchFilter(filter *ber.Packet, entry fakeDirectoryEntry) bool {
+	values := func(name string) []string {
+		for attribute, values := range entry.attributes {
+			if strings.EqualFold(attribute, name) {
+				return values
+			}
+		}
+
+		return nil
+	}
+
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			if !matchFilter(child, entry) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		return slices.ContainsFunc(filter.Children, func(child *ber.Packet) bool { return matchFilter(child, entry) })
+	case ldap.FilterNot:
+		return !matchFilter(filter.Children[0], entry)
+	case ldap.FilterEqualityMatch:
+		value := filter.Children[1].Data.String()
+		return slices.ContainsFunc(values(filter.Children[0].Data.String()), func(v string) bool { return strings.EqualFold(v, value) })
+	case ldap.FilterPresent:
+		name := filter.Data.String()
+		return strings.EqualFold(name, "objectClass") || len(values(name)) > 0
+	default:
+		return false
+	}
+}
+
+func searchEntry(entry fakeDirectoryEntry, requested []string) *ber.Packet {
+	response := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.dn, ""))
+
+	attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	for name, values := range entry.attributes {
+		if len(requested) > 0 && !slices.ContainsFunc(requested, func(r string) bool { return strings.EqualFold(r, name) }) {
+			continue
+		}
+
+		attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+		attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+		for _, value := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, ""))
+		}
+		attribute.AppendChild(set)
+		attributes.AppendChild(attribute)
+	}
+	response.AppendChild(attributes)
+
+	return response
+}
+
+func ldapResult(tag ber.Tag, code uint16) *ber.Packet {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+
+	return result
+}
+
+const (
+	aliceDN = "uid=alice,ou=people,dc=corp,dc=example,dc=com"
+	adminsDN = "cn=admins,ou=groups,dc=corp,dc=example,dc=com"
+	staffDN = "cn=staff,ou=groups,dc=corp,dc=example,dc=com"
+)
+
+func newCorpDirectory(t *testing.T) *fakeDirectory {
+	return newFakeDirectory(t, []fakeDirectoryEntry{
+		{
+			dn: "cn=sso,ou=services,dc=corp,dc=example,dc=com",
+			password: "service_secret",
+			attributes: map[string][]string{"cn": {"sso"}},
+		},
+		{
+			dn: aliceDN,
+			password: "alice_password",
+			attributes: map[string][]string{
+				"uid": {"alice"},
+				"entryUUID": {"a1b2c3"},
+				"mail": {"alice@corp.example.com"},
+				"displayName": {"Alice Doe"},
+				"memberOf": {adminsDN, staffDN},
+			},
+		},
+		{
+			dn: "uid=mallory,ou=people,dc=corp,dc=example,dc=com",
+			password: "mallory_password",
+			attributes: map[string][]string{
+				"uid": {"mallory"},
+				"entryUUID": {"d4e5f6"},
+				"mail": {"user@example.com"},
+				"cn": {"Mallory"},
+			},
+		},
+		{
+			dn: adminsDN,
+			attributes: map[string][]string{"member": {aliceDN}},
+		},
+		{
+			dn: staffDN,
+			attributes: map[string][]string{"member": {aliceDN, "uid=mallory,ou=people,dc=corp,dc=example,dc=com"}},
+		},
+	})
+}
+
+func newDirectoryLogin(t *testing.T, d *fakeDirectory, provider string) (*core.LoginUseCase, *FakeUserRepository, *FakeSessionRepository) {
+	confs, err := config.LoadIdentityProviders(writeProvidersFile(t, `[`+strings.ReplaceAll(provider, "{url}", d.url())+`]`))
+	require.NoError(t, err)
+	require.Len(t, confs, 1)
+
+	userRepo := &FakeUserRepository{
+		users: []core.User{
+			{
+				ID: "user_id1",
+				Name: "user",
+				Email: "user@example.com",
+				Status: "active",
+			},
+		},
+	}
+	sessionRepo := &FakeSessionRepository{}
+	policies := core.SessionPolicies{
+		Default: core.SessionPolicy{Lifetime: 3600},
+	}
+
+	loginUC := core.NewLoginUseCase(userRepo, infrastructure.NewTokenInterface("secret", jwt.SigningMethodHS256), &FakeHashRepository{}, sessionRepo, &FakeClientRepository{}, policies, infrastructure.NewPendingLinksInterface(), infrastructure.NewLDAPInterface(confs[0]), infrastructure.NewPartialSessionsInterface(), nil, nil, nil)
+
+	return loginUC, userRepo, sessionRepo
+}
+
+const searchingDirectory = `{"name": "corp", "type": "ldap", "url": "{url}", "base_dn": "dc=corp,dc=example,dc=com",
+	"bind_dn": "cn=sso,ou=services,dc=corp,dc=example,dc=com", "bind_password": "service_secret",
+	"group_roles": {"cn=Admins,ou=groups,dc=corp,dc=example,dc=com": "admin", "cn=staff,ou=groups,dc=corp,dc=example,dc=com": "staff"}}`
+
+func TestLDAPLogin(t *testing.T) {
+	d := newCorpDirectory(t)
+	loginUC, userRepo, sessionRepo := newDirectoryLogin(t, d, searchingDirectory)
+
+	token, session, err := loginUC.Execute(t.Context(), core.LoginInput{
+		Provider: "ldap",
+		Username: "alice",
+		Password: "alice_password",
+	})
+	require.NoError(t, err)
+	require.NotEmpty(t, token)
+	require.Equal(t, []string{"pwd"}, session.AuthMethods)
+
+	user, err := userRepo.ByIdentity(t.Context(), "ldap", "a1b2c3", "dc=corp,dc=example,dc=com")
+	require.NoError(t, err)
+	require.NotNil(t, user)
+	require.Equal(t, session.UserID, user.ID)
+	require.Equal(t, "alice@corp.example.com", user.Email)
+	require.Equal(t, "Alice Doe", user.Name)
+	require.Equal(t, []string{"admin", "staff"}, user.Roles)
+
+	// the password is checked by binding as the entry the service account found
+	require.Equal(t, []string{"cn=sso,ou=services,dc=corp,dc=example,dc=com", aliceDN}, d.binds)
+
+	// roles follow the groups at the next login, the account is reused
+	d.setAttribute(aliceDN, "memberOf", []string{staffDN})
+	_, session, err = loginUC.Execute(t.Context(), core.LoginInput{
+		Provider: "ldap",
+		Username: "alice",
+		Password: "alice_password",
+	})
+	require.NoError(t, err)
+	require.Equal(t, user.ID, session.UserID)
+	require.Len(t, userRepo.users, 2)
+	require.Len(t, sessionRepo.sessions, 2)
+
+	user, err = userRepo.ByID(t.Context(), user.ID)
+	require.NoError(t, err)
+	require.Equal(t, []string{"staff"}, user.Roles)
+}
+
+func TestLDAPLoginRejectsCredentials(t *testing.T) {
+	tests := []struct{
+		testName string
+		username string
+		password string
+		err error
+	}{
+		{testName: "wrong password", username: "alice", password: "wrong", err: e.InvalidCredentials},
+		{testName: "unknown user", username: "bob", password: "alice_password", err: e.InvalidCredentials},
+		{testName: "empty password", username: "alice", password: "", err: e.InvalidCredentials},
+		{testName: "filter injection", username: "*", password: "alice_password", err: e.InvalidCredentials},
+		{testName: "existing account with the same email", username: "mallory", password: "mallory_password", err: e.LinkRequired},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			d := newCorpDirectory(t)
+			loginUC, userRepo, sessionRepo := newDirectoryLogin(t, d, searchingDirectory)
+
+			_, _, err := loginUC.Execute(t.Context(), core.LoginInput{
+				Provider: "ldap",
+				Username: test.username,
+				Password: test.password,
+			})
+			require.ErrorIs(t, err, test.err)
+			require.Empty(t, sessionRepo.sessions)
+			require.Len(t, userRepo.users, 1)
+			require.Empty(t, userRepo.users[0].Roles)
+		})
+	}
+}
+
+func TestLDAPLoginDirectBind(t *testing.T) {
+	d := newCorpDirectory(t)
+	loginUC, userRepo, _ := newDirectoryLogin(t, d, `{"name": "corp", "type": "ldap", "url": "{url}", "base_dn": "dc=corp,dc=example,dc=com",
+		"user_dn": "uid={username},ou=people,dc=corp,dc=example,dc=com", "group_base_dn": "ou=groups,dc=corp,dc=example,dc=com",
+		"group_roles": {"cn=admins,ou=groups,dc=corp,dc=example,dc=com": "admin"}}`)
+
+	_, session, err := loginUC.Execute(t.Context(), core.LoginInput{
+		Provider: "ldap",
+		Username: "alice",
+		Password: "alice_password",
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{aliceDN}, d.binds)
+
+	user, err := userRepo.ByID(t.Context(), session.UserID)
+	require.NoError(t, err)
+	require.Equal(t, []string{"admin"}, user.Roles)
+
+	// a dn cannot be smuggled into the template
+	_, _, err = loginUC.Execute(t.Context(), core.LoginInput{
+		Provider: "ldap",
+		Username: "alice,ou=people",
+		Password: "alice_password",
+	})
+	require.ErrorIs(t, err, e.InvalidCredentials)
+}
+
+func TestLDAPLoginWithoutDirectory(t *testing.T) {
+	loginUC := core.NewLoginUseCase(&FakeUserRepository{}, &FakeTokenRepository{}, &FakeHashRepository{}, &FakeSessionRepository{}, &FakeClientRepository{}, core.SessionPolicies{}, infrastructure.NewPendingLinksInterface(), nil, infrastructure.NewPartialSessionsInterface(), nil, nil, nil)
+
+	_, _, err := loginUC.Execute(t.Context(), core.LoginInput{
+		Provider: "ldap",
+		Username: "alice",
+		Password: "alice_password",
+	})
+	require.True(t, errors.Is(err, e.InvalidAuthProvider))
+}
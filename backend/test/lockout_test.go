@@ -0,0 +1,125 @@
+package test
+
+import (
+	"github.com/stretchr/testify/require"
+
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func loginAs(s *pagesServer, email, password string) *httptest.ResponseRecorder {
+	return mfaDo(s, http.MethodPost, "/auth/login?provider=email", `{"email":"`+email+`","password":"`+password+`"}`)
+}
+
+func requireLockedOut(t *testing.T, rec *httptest.ResponseRecorder) {
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+
+	retryAfter, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+	require.NoError(t, err)
+	require.Positive(t, retryAfter)
+
+	var body map[string]any
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	require.Equal(t, "too many failed logins, try again later", body["error"])
+	require.EqualValues(t, retryAfter, body["retry_after"])
+}
+
+func TestLoginBackoffAndLockout(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+
+	// the first failures are not delayed
+	for range 3 {
+		rec := loginAs(s, "user@example.com", "wrong")
+		require.Equal(t, http.StatusUnauthorized, rec.Code)
+	}
+
+	// the next one backs off, even the right password has to wait
+	rec := loginAs(s, "user@example.com", "wrong")
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	requireLockedOut(t, loginAs(s, "user@example.com", "password"))
+
+	// the email is matched case insensitively
+	requireLockedOut(t, loginAs(s, "USER@example.com", "password"))
+
+	s.loginAttempts.expire()
+	rec = loginAs(s, "user@example.com", "wrong")
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	require.True(t, containsAuditAction(s.auditRepo.events, "login.locked_out"))
+
+	// the lockout outlasts the backoff
+	rec = loginAs(s, "user@example.com", "password")
+	requireLockedOut(t, rec)
+	retryAfter, _ := strconv.Atoi(rec.Header().Get("Retry-After"))
+	require.Greater(t, retryAfter, 60)
+}
+
+func TestAdminUnlock(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+
+	for range 4 {
+		loginAs(s, "user@example.com", "wrong")
+		s.loginAttempts.expire()
+	}
+	loginAs(s, "user@example.com", "wrong")
+	requireLockedOut(t, loginAs(s, "user@example.com", "password"))
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/users/user_id1/unlock", nil)
+	rec := s.do(req)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	req = httptest.NewRequest(http.MethodPost, "/admin/users/unknown/unlock", nil)
+	req.Header.Set("Authorization", "Bearer admin_key")
+	rec = s.do(req)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	req = httptest.NewRequest(http.MethodPost, "/admin/users/user_id1/unlock", nil)
+	req.Header.Set("Authorization", "Bearer admin_key")
+	rec = s.do(req)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	require.True(t, containsAuditAction(s.auditRepo.events, "account.unlocked"))
+
+	passwordLogin(t, s)
+}
+
+func TestLoginLockoutOfUnknownAccount(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+
+	for range 4 {
+		rec := loginAs(s, "nobody@example.com", "wrong")
+		require.Equal(t, http.StatusUnauthorized, rec.Code)
+		s.loginAttempts.expire()
+	}
+	loginAs(s, "nobody@example.com", "wrong")
+
+	// a missing account locks out like an existing one
+	requireLockedOut(t, loginAs(s, "nobody@example.com", "wrong"))
+	require.False(t, containsAuditAction(s.auditRepo.events, "login.locked_out"))
+
+	// other accounts are not affected
+	passwordLogin(t, s)
+}
+
+func TestLoginLockoutOfAddress(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+
+	// guesses spread over many accounts are counted for the address
+	for i := range 49 {
+		rec := loginAs(s, "user"+strconv.Itoa(i)+"@example.com", "wrong")
+		require.Equal(t, http.StatusUnauthorized, rec.Code)
+		s.loginAttempts.expire()
+	}
+	loginAs(s, "user49@example.com", "wrong")
+
+	requireLockedOut(t, loginAs(s, "user@example.com", "password"))
+
+	// a login from elsewhere still goes through
+	req := httptest.NewRequest(http.MethodPost, "/auth/login?provider=email", strings.NewReader(`{"email":"user@example.com","password":"password"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.RemoteAddr = "198.51.100.7:1234"
+	rec := s.do(req)
+	require.Equal(t, http.StatusOK, rec.Code)
+}
@@ -46,10 +46,17 @@ func TestLoginByEmailSuccess(t *testing.T) {
 
 	tokenRepo := infrastructure.NewTokenInterface("secret", jwt.SigningMethodHS256)
 	hashRepo := &FakeHashRepository{}
+	sessionRepo := &FakeSessionRepository{}
 
-	sessionExp := 3600
+	clientRepo := &FakeClientRepository{}
+	policies := core.SessionPolicies{
+		Default: core.SessionPolicy{
+			IdleTimeout: 1800,
+			Lifetime: 3600,
+		},
+	}
 
-	loginUC := core.NewLoginUseCase(userRepo, tokenRepo, hashRepo, sessionExp)
+	loginUC := core.NewLoginUseCase(userRepo, tokenRepo, hashRepo, sessionRepo, clientRepo, policies, infrastructure.NewPendingLinksInterface(), nil, infrastructure.NewPartialSessionsInterface(), nil, nil, nil)
 
 	ctx := context.Background()
 
@@ -60,8 +67,10 @@ func TestLoginByEmailSuccess(t *testing.T) {
 		Password: "password",
 	}
 
-	ssoSessionToken, err := loginUC.Execute(ctx, input)
+	ssoSessionToken, session, err := loginUC.Execute(ctx, input)
 
 	require.NoError(t, err)
 	require.NotEmpty(t, ssoSessionToken)
+	require.NotNil(t, session)
+	require.Len(t, sessionRepo.sessions, 1)
 }
@@ -0,0 +1,139 @@
+package test
+
+import (
+	"sso/internal/core"
+	"github.com/stretchr/testify/require"
+
+	"bufio"
+	"io"
+	"net"
+	"net/mail"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSMTP is an in-process mail relay speaking just enough smtp for the mailer, it keeps
+// every message it is handed
+type fakeSMTP struct {
+	listener net.Listener
+
+	mu sync.Mutex
+	mails []core.Mail
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	s := &fakeSMTP{
+		listener: listener,
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *fakeSMTP) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(line string) {
+		io.WriteString(conn, line+"\r\n")
+	}
+
+	reply("220 localhost fake smtp")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		command := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(command, "MAIL FROM:"), strings.HasPrefix(command, "RCPT TO:"), command == "RSET", command == "NOOP":
+			reply("250 ok")
+		case command == "DATA":
+			reply("354 end with a dot")
+
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(line, "."))
+			}
+
+			s.store(data.String())
+			reply("250 queued")
+		case command == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func (s *fakeSMTP) store(data string) {
+	msg, err := mail.ReadMessage(strings.NewReader(data))
+	if err != nil {
+		return
+	}
+
+	to, _ := mail.ParseAddress(msg.Header.Get("To"))
+	body, _ := io.ReadAll(msg.Body)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.mails = append(s.mails, core.Mail{
+		To: to.Address,
+		Subject: msg.Header.Get("Subject"),
+		Text: strings.ReplaceAll(string(body), "\r\n", "\n"),
+	})
+}
+
+// await waits for the relay to be handed n mails for the address, for the flows that mail off the request path
+func (s *fakeSMTP) await(t *testing.T, to string, n int) []core.Mail {
+	require.Eventually(t, func() bool { return len(s.sent(to)) >= n }, 5*time.Second, 10*time.Millisecond)
+
+	return s.sent(to)
+}
+
+// sent returns the mails the relay was handed for the address
+func (s *fakeSMTP) sent(to string) []core.Mail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mails := []core.Mail{}
+	for _, m := range s.mails {
+		if m.To == to {
+			mails = append(mails, m)
+		}
+	}
+
+	return mails
+}
@@ -0,0 +1,302 @@
+package test
+
+import (
+	"sso/internal/core"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/require"
+
+	"encoding/base32"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mfaDo(s *pagesServer, method, path, body string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+
+	return s.do(req, cookies...)
+}
+
+// enrollTOTP enrolls an authenticator for the seeded user with a code of the previous step,
+// later steps are left for the logins of the test
+func enrollTOTP(t *testing.T, s *pagesServer, sessionCookie *http.Cookie) ([]byte, []string) {
+	rec := mfaDo(s, http.MethodPost, "/auth/mfa/totp", "", sessionCookie)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var enrollment core.TOTPEnrollment
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &enrollment))
+
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(enrollment.Secret)
+	require.NoError(t, err)
+
+	code := core.TOTPCode(secret, time.Now().Add(-30*time.Second))
+	rec = mfaDo(s, http.MethodPost, "/auth/mfa/totp/confirm", `{"code":"`+code+`"}`, sessionCookie)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var confirmed struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &confirmed))
+
+	return secret, confirmed.RecoveryCodes
+}
+
+// mfaChallenge signs the seeded user in with the password and returns the token of the second step
+func mfaChallenge(t *testing.T, s *pagesServer) string {
+	rec := mfaDo(s, http.MethodPost, "/auth/login?provider=email", `{"email":"user@example.com","password":"password"}`)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	require.Nil(t, findCookie(rec, "sso_session_token"))
+
+	var body struct {
+		Error string `json:"error"`
+		MFAToken string `json:"mfa_token"`
+		MFAMethods []string `json:"mfa_methods"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	require.Equal(t, "second factor required", body.Error)
+	require.NotEmpty(t, body.MFAToken)
+	require.Contains(t, body.MFAMethods, "totp")
+
+	return body.MFAToken
+}
+
+func containsAuditAction(events []core.AuditEvent, action string) bool {
+	return slices.ContainsFunc(events, func(event core.AuditEvent) bool { return event.Action == action })
+}
+
+func verifyMFA(s *pagesServer, mfaToken, field, code string) *httptest.ResponseRecorder {
+	return mfaDo(s, http.MethodPost, "/auth/mfa/verify", `{"mfa_token":"`+mfaToken+`","`+field+`":"`+code+`"}`)
+}
+
+func TestMFAEnrollmentAndLogin(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+	sessionCookie := passwordLogin(t, s)
+
+	rec := mfaDo(s, http.MethodPost, "/auth/mfa/totp", "", sessionCookie)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var enrollment core.TOTPEnrollment
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &enrollment))
+	require.Regexp(t, regexp.MustCompile(`^[A-Z2-7]{32}$`), enrollment.Secret)
+
+	uri, err := url.Parse(enrollment.URI)
+	require.NoError(t, err)
+	require.Equal(t, "otpauth", uri.Scheme)
+	require.Equal(t, "totp", uri.Host)
+	require.Equal(t, "/sso.test:user@example.com", uri.Path)
+	require.Equal(t, enrollment.Secret, uri.Query().Get("secret"))
+	require.Equal(t, "sso.test", uri.Query().Get("issuer"))
+
+	// a pending secret is no second factor yet
+	rec = mfaDo(s, http.MethodGet, "/auth/mfa", "", sessionCookie)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, `{"totp":false,"recovery_codes":0,"passkeys":0}`, rec.Body.String())
+	passwordLogin(t, s)
+
+	rec = mfaDo(s, http.MethodPost, "/auth/mfa/totp/confirm", `{"code":"000000"}`, sessionCookie)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(enrollment.Secret)
+	require.NoError(t, err)
+	enrolledCode := core.TOTPCode(secret, time.Now().Add(-30*time.Second))
+
+	rec = mfaDo(s, http.MethodPost, "/auth/mfa/totp/confirm", `{"code":"`+enrolledCode+`"}`, sessionCookie)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var confirmed struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &confirmed))
+	require.Len(t, confirmed.RecoveryCodes, 10)
+	require.Regexp(t, regexp.MustCompile(`^[a-z2-7]{5}-[a-z2-7]{5}$`), confirmed.RecoveryCodes[0])
+
+	// the secret is stored encrypted
+	for _, cred := range s.userRepo.credentials {
+		if cred.Type == "totp" {
+			require.NotContains(t, cred.Hash, enrollment.Secret)
+			require.NotEqual(t, string(secret), cred.Hash)
+		}
+	}
+
+	require.Equal(t, http.StatusConflict, mfaDo(s, http.MethodPost, "/auth/mfa/totp", "", sessionCookie).Code)
+
+	rec = mfaDo(s, http.MethodGet, "/auth/mfa", "", sessionCookie)
+	require.JSONEq(t, `{"totp":true,"recovery_codes":10,"passkeys":0}`, rec.Body.String())
+
+	sessions := len(s.sessionRepo.sessions)
+	mfaToken := mfaChallenge(t, s)
+	require.Len(t, s.sessionRepo.sessions, sessions)
+
+	// the code that confirmed the enrollment cannot be used again
+	rec = verifyMFA(s, mfaToken, "code", enrolledCode)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	require.Contains(t, rec.Body.String(), "second factor code is invalid")
+
+	rec = verifyMFA(s, mfaToken, "code", core.TOTPCode(secret, time.Now()))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NotNil(t, findCookie(rec, "sso_session_token"))
+
+	session := s.sessionRepo.sessions[len(s.sessionRepo.sessions)-1]
+	require.Equal(t, []string{"pwd", "otp", "mfa"}, session.AuthMethods)
+
+	// the second step finishes the login once
+	rec = verifyMFA(s, mfaToken, "code", core.TOTPCode(secret, time.Now().Add(30*time.Second)))
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	require.Contains(t, rec.Body.String(), "mfa token is invalid or expired")
+
+	require.True(t, containsAuditAction(s.auditRepo.events, "mfa.totp.enrolled"))
+}
+
+func TestMFARecoveryCodes(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+	_, codes := enrollTOTP(t, s, passwordLogin(t, s))
+
+	// recovery codes are accepted without the dash and in any case
+	typed := strings.ToUpper(strings.ReplaceAll(codes[0], "-", ""))
+	rec := verifyMFA(s, mfaChallenge(t, s), "recovery_code", typed)
+	require.Equal(t, http.StatusOK, rec.Code)
+	sessionCookie := findCookie(rec, "sso_session_token")
+	require.NotNil(t, sessionCookie)
+
+	rec = verifyMFA(s, mfaChallenge(t, s), "recovery_code", codes[0])
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec = mfaDo(s, http.MethodGet, "/auth/mfa", "", sessionCookie)
+	require.JSONEq(t, `{"totp":true,"recovery_codes":9,"passkeys":0}`, rec.Body.String())
+	require.True(t, containsAuditAction(s.auditRepo.events, "mfa.recovery_code.used"))
+
+	// new codes replace every unused one
+	rec = mfaDo(s, http.MethodPost, "/auth/mfa/recovery-codes", `{"recovery_code":"`+codes[1]+`"}`, sessionCookie)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var regenerated struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &regenerated))
+	require.Len(t, regenerated.RecoveryCodes, 10)
+
+	require.Equal(t, http.StatusUnauthorized, verifyMFA(s, mfaChallenge(t, s), "recovery_code", codes[2]).Code)
+	require.Equal(t, http.StatusOK, verifyMFA(s, mfaChallenge(t, s), "recovery_code", regenerated.RecoveryCodes[0]).Code)
+}
+
+func TestMFATooManyAttempts(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+	secret, _ := enrollTOTP(t, s, passwordLogin(t, s))
+
+	mfaToken := mfaChallenge(t, s)
+	for range 5 {
+		// the delays of the lockout are covered by TestMFALockout
+		s.loginAttempts.expire()
+
+		rec := verifyMFA(s, mfaToken, "code", "000000")
+		require.Equal(t, http.StatusUnauthorized, rec.Code)
+		require.Contains(t, rec.Body.String(), "second factor code is invalid")
+	}
+
+	// the login is over, the right code does not revive it
+	rec := verifyMFA(s, mfaToken, "code", core.TOTPCode(secret, time.Now()))
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	require.Contains(t, rec.Body.String(), "mfa token is invalid or expired")
+
+	s.loginAttempts.expire()
+	require.Equal(t, http.StatusOK, verifyMFA(s, mfaChallenge(t, s), "code", core.TOTPCode(secret, time.Now())).Code)
+}
+
+func TestMFALockout(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+	secret, _ := enrollTOTP(t, s, passwordLogin(t, s))
+
+	// a new password login does not forget the wrong codes of the last one, the fourth delays the next
+	for range 4 {
+		rec := verifyMFA(s, mfaChallenge(t, s), "code", "000000")
+		require.Equal(t, http.StatusUnauthorized, rec.Code)
+	}
+	requireLockedOut(t, verifyMFA(s, mfaChallenge(t, s), "code", core.TOTPCode(secret, time.Now())))
+
+	// the fifth wrong code locks the second factor out
+	s.loginAttempts.expire()
+	require.Equal(t, http.StatusUnauthorized, verifyMFA(s, mfaChallenge(t, s), "code", "000000").Code)
+	requireLockedOut(t, verifyMFA(s, mfaChallenge(t, s), "code", core.TOTPCode(secret, time.Now())))
+	require.True(t, containsAuditAction(s.auditRepo.events, "mfa.locked_out"))
+
+	// the right code forgets the wrong ones
+	s.loginAttempts.expire()
+	require.Equal(t, http.StatusOK, verifyMFA(s, mfaChallenge(t, s), "code", core.TOTPCode(secret, time.Now())).Code)
+	require.Equal(t, http.StatusUnauthorized, verifyMFA(s, mfaChallenge(t, s), "code", "000000").Code)
+}
+
+func TestMFADisable(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+	sessionCookie := passwordLogin(t, s)
+	secret, _ := enrollTOTP(t, s, sessionCookie)
+
+	rec := mfaDo(s, http.MethodDelete, "/auth/mfa/totp", `{"code":"000000"}`, sessionCookie)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec = mfaDo(s, http.MethodDelete, "/auth/mfa/totp", `{"code":"`+core.TOTPCode(secret, time.Now())+`"}`, sessionCookie)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+
+	rec = mfaDo(s, http.MethodGet, "/auth/mfa", "", sessionCookie)
+	require.JSONEq(t, `{"totp":false,"recovery_codes":0,"passkeys":0}`, rec.Body.String())
+
+	passwordLogin(t, s)
+
+	rec = mfaDo(s, http.MethodDelete, "/auth/mfa/totp", `{"code":"`+core.TOTPCode(secret, time.Now())+`"}`, sessionCookie)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.True(t, containsAuditAction(s.auditRepo.events, "mfa.totp.disabled"))
+}
+
+var mfaTokenInput = regexp.MustCompile(`name="mfa_token" value="([^"]+)"`)
+
+func TestMFAHostedLogin(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+	secret, _ := enrollTOTP(t, s, passwordLogin(t, s))
+
+	rec := s.do(httptest.NewRequest(http.MethodGet, "/login", nil))
+	csrfCookie := findCookie(rec, "_csrf")
+	require.NotNil(t, csrfCookie)
+	csrf := csrfInput.FindStringSubmatch(rec.Body.String())[1]
+
+	form := url.Values{
+		"_csrf": {csrf},
+		"email": {"user@example.com"},
+		"password": {"password"},
+		"return_to": {"/account"},
+	}
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec = s.do(req, csrfCookie)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Nil(t, findCookie(rec, "sso_session_token"))
+	require.Contains(t, rec.Body.String(), `action="/login/mfa"`)
+
+	match := mfaTokenInput.FindStringSubmatch(rec.Body.String())
+	require.Len(t, match, 2)
+
+	form = url.Values{
+		"_csrf": {csrf},
+		"mfa_token": {match[1]},
+		"code": {"000000"},
+		"return_to": {"/account"},
+	}
+	req = httptest.NewRequest(http.MethodPost, "/login/mfa", strings.NewReader(form.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec = s.do(req, csrfCookie)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	require.Contains(t, rec.Body.String(), "The code is not valid.")
+
+	form.Set("code", core.TOTPCode(secret, time.Now()))
+	req = httptest.NewRequest(http.MethodPost, "/login/mfa", strings.NewReader(form.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec = s.do(req, csrfCookie)
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	require.Equal(t, "/account", rec.Header().Get("Location"))
+	require.NotNil(t, findCookie(rec, "sso_session_token"))
+}
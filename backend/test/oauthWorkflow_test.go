@@ -2,12 +2,16 @@ package test
 
 import (
 	"sso/internal/core"
+	e "sso/internal/core/errors"
 	"sso/internal/infrastructure"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/stretchr/testify/require"
 
 	"context"
 	"crypto/rand"
 	"crypto/rsa"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 )
@@ -48,15 +52,227 @@ func TestOAuthWorkflowSuccess(t *testing.T) {
 	refreshExpiration := 60*60*24
 	authCodeExpiration := 5*60
 
-	oauthWorkflow := core.NewOAuthWorkflow(clientRepo, tokenRepo, keyRepo, codesRepo, accessExpiration, refreshExpiration, authCodeExpiration)
+	consentRepo := &FakeConsentRepository{
+		consents: map[string]bool{"user_id1": true},
+	}
+
+	oauthWorkflow := core.NewOAuthWorkflow(clientRepo, &FakeUserRepository{}, tokenRepo, keyRepo, codesRepo, consentRepo, accessExpiration, refreshExpiration, authCodeExpiration)
+
+	ctx := context.Background()
+	session := &core.Session{
+		ID: "session_id1",
+		UserID: "user_id",
+		CreatedAt: time.Now(),
+	}
+
+	redirect, err := oauthWorkflow.Authorize(ctx, session, core.AuthorizeInput{
+		ClientID: "id1",
+		RedirectURI: "test.client.com",
+	})
+
+	require.NoError(t, err)
+	require.Contains(t, redirect, "code=")
+
+	t.Logf("redirect: %s", redirect)
+}
+
+func TestOAuthWorkflowAuthorizePrompt(t *testing.T) {
+	clientRepo := &FakeClientRepository{
+		clients: []core.Client{
+			{
+				ID: "1",
+				Name: "test1",
+				ClientID: "id1",
+				RedirectURIs: []string{"https://test.client.com/callback"},
+				Status: "active",
+				CreatedAt: time.Now(),
+			},
+		},
+	}
+
+	consentRepo := &FakeConsentRepository{
+		consents: map[string]bool{"user_id1": true},
+	}
+
+	oauthWorkflow := core.NewOAuthWorkflow(clientRepo, &FakeUserRepository{}, &FakeTokenRepository{}, &FakeKeyRepository{}, infrastructure.NewAuthCodesInterface(), consentRepo, 3600, 86400, 300)
+
+	freshSession := &core.Session{
+		ID: "session_id1",
+		UserID: "user_id",
+		CreatedAt: time.Now().Add(-time.Minute),
+	}
+	oldSession := &core.Session{
+		ID: "session_id2",
+		UserID: "user_id",
+		CreatedAt: time.Now().Add(-time.Hour),
+	}
+
+	tests := []struct{
+		testName string
+		session *core.Session
+		input core.AuthorizeInput
+		wantError error
+		wantRedirect string
+	}{
+		{
+			testName: "session issues code",
+			session: freshSession,
+			input: core.AuthorizeInput{State: "xyz"},
+			wantRedirect: "code=",
+		},
+		{
+			testName: "no session requires login",
+			input: core.AuthorizeInput{LoginHint: "user@example.com"},
+			wantError: e.LoginRequired,
+		},
+		{
+			testName: "prompt=none without session redirects with login_required",
+			input: core.AuthorizeInput{Prompt: "none", State: "xyz"},
+			wantRedirect: "error=login_required&state=xyz",
+		},
+		{
+			testName: "prompt=none with session issues code",
+			session: freshSession,
+			input: core.AuthorizeInput{Prompt: "none"},
+			wantRedirect: "code=",
+		},
+		{
+			testName: "prompt=login forces authentication",
+			session: freshSession,
+			input: core.AuthorizeInput{Prompt: "login"},
+			wantError: e.LoginRequired,
+		},
+		{
+			testName: "prompt=select_account asks for account selection",
+			session: freshSession,
+			input: core.AuthorizeInput{Prompt: "select_account"},
+			wantError: e.AccountSelectionRequired,
+		},
+		{
+			testName: "prompt=none cannot be combined",
+			session: freshSession,
+			input: core.AuthorizeInput{Prompt: "none login"},
+			wantError: e.InvalidAuthorizeRequest,
+		},
+		{
+			testName: "max_age satisfied",
+			session: freshSession,
+			input: core.AuthorizeInput{MaxAge: "600"},
+			wantRedirect: "code=",
+		},
+		{
+			testName: "max_age exceeded requires login",
+			session: oldSession,
+			input: core.AuthorizeInput{MaxAge: "600"},
+			wantError: e.LoginRequired,
+		},
+		{
+			testName: "max_age exceeded with prompt=none redirects with login_required",
+			session: oldSession,
+			input: core.AuthorizeInput{MaxAge: "600", Prompt: "none"},
+			wantRedirect: "error=login_required",
+		},
+		{
+			testName: "prompt=consent asks for consent again",
+			session: freshSession,
+			input: core.AuthorizeInput{Prompt: "consent"},
+			wantError: e.ConsentRequired,
+		},
+		{
+			testName: "no consent with prompt=none redirects with consent_required",
+			session: &core.Session{
+				ID: "session_id3",
+				UserID: "other_user",
+				CreatedAt: time.Now(),
+			},
+			input: core.AuthorizeInput{Prompt: "none"},
+			wantRedirect: "error=consent_required",
+		},
+		{
+			testName: "invalid max_age",
+			session: freshSession,
+			input: core.AuthorizeInput{MaxAge: "-1"},
+			wantError: e.InvalidAuthorizeRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			tt.input.ClientID = "id1"
+			tt.input.RedirectURI = "https://test.client.com/callback"
+
+			redirect, err := oauthWorkflow.Authorize(context.Background(), tt.session, tt.input)
+
+			if tt.wantError != nil {
+				require.ErrorIs(t, err, tt.wantError)
+				return
+			}
 
+			require.NoError(t, err)
+			require.True(t, strings.HasPrefix(redirect, "https://test.client.com/callback?"))
+			require.Contains(t, redirect, tt.wantRedirect)
+		})
+	}
+}
+
+func TestOAuthWorkflowRequiresVerifiedEmail(t *testing.T) {
+	clientRepo := &FakeClientRepository{
+		clients: []core.Client{
+			{
+				ID: "id1",
+				Name: "test1",
+				ClientID: "id1",
+				ClientSecret: "secret1",
+				RedirectURIs: []string{"https://test.client.com/callback"},
+				Status: "active",
+				RequireVerifiedEmail: true,
+			},
+		},
+	}
+	userRepo := &FakeUserRepository{
+		users: []core.User{
+			{ID: "verified", Name: "verified", Email: "verified@example.com", EmailVerified: true, Status: "active"},
+			{ID: "unverified", Name: "unverified", Email: "unverified@example.com", Status: "active"},
+		},
+	}
+
+	keyRepo := &FakeKeyRepository{}
+	key, err := keyRepo.Generate("test_key")
+	require.NoError(t, err)
+	require.NoError(t, keyRepo.SavePrivateKey(key))
+
+	consentRepo := &FakeConsentRepository{
+		consents: map[string]bool{"verifiedid1": true, "unverifiedid1": true},
+	}
+
+	oauthWorkflow := core.NewOAuthWorkflow(clientRepo, userRepo, &FakeTokenRepository{}, keyRepo, infrastructure.NewAuthCodesInterface(), consentRepo, 3600, 86400, 300)
 	ctx := context.Background()
-	userID := "user_id"
 
-	authCode, err := oauthWorkflow.Execute(ctx, userID, "id1", "test.client.com")
+	authorize := func(userID string) (string, error) {
+		session := &core.Session{ID: "session_" + userID, UserID: userID, CreatedAt: time.Now()}
 
+		return oauthWorkflow.Authorize(ctx, session, core.AuthorizeInput{
+			ClientID: "id1",
+			RedirectURI: "https://test.client.com/callback",
+		})
+	}
+
+	_, err = authorize("unverified")
+	require.ErrorIs(t, err, e.EmailNotVerified)
+
+	redirect, err := authorize("verified")
 	require.NoError(t, err)
-	require.NotEmpty(t, authCode)
 
-	t.Logf("refresh: %s", authCode)
+	u, err := url.Parse(redirect)
+	require.NoError(t, err)
+
+	accessToken, _, err := oauthWorkflow.ExchangeCode(ctx, u.Query().Get("code"), "id1", "secret1", "https://test.client.com/callback", "verified")
+	require.NoError(t, err)
+
+	claims := &core.Claims{}
+	_, _, err = jwt.NewParser().ParseUnverified(accessToken, claims)
+	require.NoError(t, err)
+	require.Equal(t, "verified@example.com", claims.Email)
+	require.NotNil(t, claims.EmailVerified)
+	require.True(t, *claims.EmailVerified)
 }
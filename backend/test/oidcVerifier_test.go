@@ -0,0 +1,214 @@
+package test
+
+import (
+	"sso/internal/config"
+	"sso/internal/core"
+	e "sso/internal/core/errors"
+	"sso/internal/infrastructure"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func signIDToken(t *testing.T, key *rsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+
+	signed, err := token.SignedString(key)
+	require.NoError(t, err)
+
+	return signed
+}
+
+func publicJWK(key *rsa.PrivateKey, kid string) core.JWK {
+	return core.JWK{
+		Kty: "RSA",
+		Use: "sig",
+		Alg: "RS256",
+		Kid: kid,
+		N: base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+// testProviderConfig is an oidc provider with the default claim mapping that links accounts by verified email
+func testProviderConfig(name string) config.IdentityProviderConfig {
+	linkByEmail := true
+
+	return config.IdentityProviderConfig{
+		Name: name,
+		DisplayName: name,
+		ClientID: "client_id",
+		Claims: config.ClaimMapping{
+			Subject: "sub",
+			Email: "email",
+			EmailVerified: "email_verified",
+			Name: "name",
+		},
+		LinkByEmail: &linkByEmail,
+	}
+}
+
+func googleClaims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss": "https://accounts.google.com",
+		"aud": "client_id",
+		"sub": "google_user_id",
+		"email": "user@example.com",
+		"email_verified": true,
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func TestOIDCVerifier(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	keys := infrastructure.NewStaticKeySource(map[string]*rsa.PublicKey{
+		"kid1": &key.PublicKey,
+	})
+	verifier := infrastructure.NewOIDCVerifierInterface(testProviderConfig("google"), []string{"https://accounts.google.com", "accounts.google.com"}, keys)
+
+	tests := []struct{
+		testName string
+		token func() string
+		wantError error
+	}{
+		{
+			testName: "valid token",
+			token: func() string {
+				return signIDToken(t, key, "kid1", googleClaims())
+			},
+		},
+		{
+			testName: "email_verified as string",
+			token: func() string {
+				claims := googleClaims()
+				claims["email_verified"] = "true"
+				return signIDToken(t, key, "kid1", claims)
+			},
+		},
+		{
+			testName: "signed with unknown key",
+			token: func() string {
+				return signIDToken(t, otherKey, "kid1", googleClaims())
+			},
+			wantError: e.InvalidIDToken,
+		},
+		{
+			testName: "unknown kid",
+			token: func() string {
+				return signIDToken(t, key, "kid2", googleClaims())
+			},
+			wantError: e.InvalidIDToken,
+		},
+		{
+			testName: "wrong audience",
+			token: func() string {
+				claims := googleClaims()
+				claims["aud"] = "another_client"
+				return signIDToken(t, key, "kid1", claims)
+			},
+			wantError: e.InvalidIDToken,
+		},
+		{
+			testName: "wrong issuer",
+			token: func() string {
+				claims := googleClaims()
+				claims["iss"] = "https://evil.example.com"
+				return signIDToken(t, key, "kid1", claims)
+			},
+			wantError: e.InvalidIDToken,
+		},
+		{
+			testName: "expired",
+			token: func() string {
+				claims := googleClaims()
+				claims["exp"] = time.Now().Add(-time.Minute).Unix()
+				return signIDToken(t, key, "kid1", claims)
+			},
+			wantError: e.InvalidIDToken,
+		},
+		{
+			testName: "hs256 is refused",
+			token: func() string {
+				token := jwt.NewWithClaims(jwt.SigningMethodHS256, googleClaims())
+				token.Header["kid"] = "kid1"
+				signed, err := token.SignedString([]byte("secret"))
+				require.NoError(t, err)
+				return signed
+			},
+			wantError: e.InvalidIDToken,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			raw := tt.token()
+			claims, err := verifier.Verify(context.Background(), raw)
+
+			if tt.wantError != nil {
+				require.ErrorIs(t, err, tt.wantError)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, "google", claims["provider"])
+			require.Equal(t, "https://accounts.google.com", claims["issuer"])
+			require.Equal(t, "google_user_id", claims["sub"])
+			require.Equal(t, "user@example.com", claims["email"])
+			require.Equal(t, raw, claims["raw"])
+			require.Equal(t, "true", claims["email_verified"])
+		})
+	}
+
+	// an unverified email is passed on, it is up to the login whether it may be used
+	unverified := googleClaims()
+	unverified["email_verified"] = false
+	claims, err := verifier.Verify(context.Background(), signIDToken(t, key, "kid1", unverified))
+	require.NoError(t, err)
+	require.Equal(t, "false", claims["email_verified"])
+	require.Equal(t, "true", claims["link_by_email"])
+}
+
+func TestRemoteKeySourceCachesJWKS(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		json.NewEncoder(w).Encode(core.JWKS{
+			Keys: []core.JWK{publicJWK(key, "kid1")},
+		})
+	}))
+	defer server.Close()
+
+	keys := infrastructure.NewRemoteKeySource(server.URL, server.Client(), time.Hour)
+	verifier := infrastructure.NewOIDCVerifierInterface(testProviderConfig("google"), []string{"https://accounts.google.com"}, keys)
+
+	for range 3 {
+		_, err := verifier.Verify(context.Background(), signIDToken(t, key, "kid1", googleClaims()))
+		require.NoError(t, err)
+	}
+	require.Equal(t, int32(1), hits.Load())
+
+	// an unknown kid right after a fetch does not trigger another one
+	_, err = verifier.Verify(context.Background(), signIDToken(t, key, "kid2", googleClaims()))
+	require.ErrorIs(t, err, e.InvalidIDToken)
+	require.Equal(t, int32(1), hits.Load())
+}
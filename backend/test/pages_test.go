@@ -0,0 +1,306 @@
+package test
+
+import (
+	"sso/internal/config"
+	"sso/internal/core"
+	"sso/internal/infrastructure"
+	httpserver "sso/internal/infrastructure/http"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+type pagesServer struct {
+	echo *echo.Echo
+	userRepo *FakeUserRepository
+	sessionRepo *FakeSessionRepository
+	auditRepo *FakeAuditRepository
+	groupRepo *FakeGroupRepository
+	scimClientRepo *FakeSCIMClientRepository
+	smtp *fakeSMTP
+	loginAttempts *FakeLoginAttemptsRepository
+	consentRepo *FakeConsentRepository
+}
+
+func newPagesServer(t *testing.T, templatesDir string, providers map[string]core.IFederatedProvider, configure ...func(conf *config.Config)) *pagesServer {
+	conf := &config.Config{
+		SigningKey: "secret",
+		SigningMethod: jwt.SigningMethodHS256,
+		SessionExp: 3600,
+		SessionCookiePath: "/",
+		SessionCookieSameSite: http.SameSiteLaxMode,
+		TemplatesDir: templatesDir,
+		PublicURL: "http://sso.test",
+		AdminAPIKey: "admin_key",
+	}
+	for _, fn := range configure {
+		fn(conf)
+	}
+
+	userRepo := &FakeUserRepository{
+		users: []core.User{
+			{
+				ID: "user_id1",
+				Name: "user",
+				Email: "user@example.com",
+				Status: "active",
+			},
+		},
+		identities: []core.Identity{
+			{
+				ID: "identity_id1",
+				UserID: "user_id1",
+				Type: "email",
+			},
+		},
+		credentials: []core.Credential{
+			{
+				ID: "credential_id1",
+				IdentityID: "identity_id1",
+				Type: "password",
+				Hash: "password_hashed",
+			},
+		},
+	}
+	clientRepo := &FakeClientRepository{
+		clients: []core.Client{
+			{
+				ID: "1",
+				Name: "Test app",
+				ClientID: "id1",
+				RedirectURIs: []string{"https://test.client.com/callback"},
+				Status: "active",
+			},
+			{
+				ID: "2",
+				Name: "Verified app",
+				ClientID: "id2",
+				RedirectURIs: []string{"https://verified.client.com/callback"},
+				Status: "active",
+				RequireVerifiedEmail: true,
+			},
+		},
+	}
+	sessionRepo := &FakeSessionRepository{}
+	tokenRepo := infrastructure.NewTokenInterface(conf.SigningKey, conf.SigningMethod)
+	policies := core.SessionPolicies{
+		Default: core.SessionPolicy{Lifetime: conf.SessionExp},
+	}
+
+	auditRepo := &FakeAuditRepository{}
+	partials := infrastructure.NewPartialSessionsInterface()
+	smtp := newFakeSMTP(t)
+	mailer := infrastructure.NewSMTPMailerInterface(smtp.addr(), "SSO <no-reply@sso.test>", "", "")
+	emailTokens := infrastructure.NewEmailTokensInterface([]byte("secret"))
+	emailOTPUC := core.NewEmailOTPUseCase(userRepo, infrastructure.NewEmailOTPsInterface(), emailTokens, mailer, auditRepo, "http://sso.test/login/email")
+	passwordPolicy := core.NewPasswordPolicy(8, 72, 0, []string{"qwerty123"}, infrastructure.NewBreachedPasswordsInterface(breachedPasswordsDir(t)))
+	webauthnUC := core.NewWebAuthnUseCase(userRepo, infrastructure.NewWebAuthnInterface("sso.test", []string{"http://sso.test"}), infrastructure.NewWebAuthnChallengesInterface(), auditRepo, "sso.test", "SSO test")
+	loginAttempts := &FakeLoginAttemptsRepository{}
+	lockoutPolicies := core.LockoutPolicies{
+		Account: core.LockoutPolicy{FreeFailures: 3, BaseDelay: 1, MaxDelay: 60, MaxFailures: 5, LockoutDuration: 900, Window: 3600},
+		IP: core.LockoutPolicy{FreeFailures: 20, BaseDelay: 1, MaxDelay: 60, MaxFailures: 50, LockoutDuration: 900, Window: 3600},
+	}
+	lockoutUC := core.NewLockoutUseCase(userRepo, loginAttempts, lockoutPolicies, auditRepo)
+	passwordUC := core.NewPasswordUseCase(userRepo, &FakeHashRepository{}, sessionRepo, emailTokens, mailer, auditRepo, "http://sso.test/password/reset", passwordPolicy, lockoutUC)
+	rateLimitUC := core.NewRateLimitUseCase(infrastructure.NewRateLimitsInterface(), core.RateLimits{
+		IP: core.RateLimit{PerMinute: 600, Burst: 100},
+		Client: core.RateLimit{PerMinute: 600, Burst: 20},
+		Account: core.RateLimit{PerMinute: 60, Burst: 10},
+	})
+	links := infrastructure.NewPendingLinksInterface()
+	loginUC := core.NewLoginUseCase(userRepo, tokenRepo, &FakeHashRepository{}, sessionRepo, clientRepo, policies, links, nil, partials, webauthnUC, emailOTPUC, lockoutUC)
+	verificationUC := core.NewEmailVerificationUseCase(userRepo, emailTokens, mailer, auditRepo, "http://sso.test/verify-email")
+	registerUC := core.NewRegisterUseCase(userRepo, tokenRepo, &FakeHashRepository{}, sessionRepo, clientRepo, policies, links, verificationUC, passwordPolicy, partials)
+	consentRepo := &FakeConsentRepository{}
+	oauthWorkflow := core.NewOAuthWorkflow(clientRepo, userRepo, tokenRepo, &FakeKeyRepository{}, infrastructure.NewAuthCodesInterface(), consentRepo, 3600, 86400, 300)
+
+	identityUC := core.NewIdentityUseCase(userRepo, auditRepo)
+	federatedUC := core.NewFederatedLoginUseCase(providers, infrastructure.NewFederationStatesInterface(), loginUC, identityUC, 600)
+
+	keyRepo := &FakeKeyRepository{}
+	key, err := keyRepo.Generate("test_key")
+	require.NoError(t, err)
+	require.NoError(t, keyRepo.SavePrivateKey(key))
+	spRepo := &FakeServiceProviderRepository{
+		providers: []core.ServiceProvider{
+			{
+				ID: "sp1",
+				EntityID: "https://sp.example.com/metadata",
+				Name: "Vendor app",
+				ACSURLs: []string{"https://sp.example.com/acs"},
+				Status: "active",
+			},
+		},
+	}
+	samlWorkflow := core.NewSAMLWorkflow(userRepo, spRepo, keyRepo, infrastructure.NewSAMLInterface(), "http://sso.test/saml/metadata", "http://sso.test/saml/sso", 300)
+
+	groupRepo := &FakeGroupRepository{}
+	scimClientRepo := &FakeSCIMClientRepository{}
+	scimUC := core.NewSCIMUseCase(userRepo, groupRepo, sessionRepo, scimClientRepo, auditRepo)
+
+	cipher, err := infrastructure.NewCipherInterface(make([]byte, 32))
+	require.NoError(t, err)
+	mfaUC := core.NewMFAUseCase(userRepo, &FakeHashRepository{}, cipher, partials, sessionRepo, tokenRepo, auditRepo, "sso.test", webauthnUC, links, lockoutUC)
+
+	e := echo.New()
+	err = httpserver.SetupHandlers(conf, e, zap.NewNop(), core.NewUserUseCase(userRepo), loginUC, registerUC, oauthWorkflow, core.NewJWKSUseCase(&FakeKeyRepository{}), core.NewSessionUseCase(sessionRepo), nil, federatedUC, identityUC, core.NewAuditUseCase(auditRepo), samlWorkflow, scimUC, mfaUC, webauthnUC, emailOTPUC, passwordUC, verificationUC, lockoutUC, rateLimitUC)
+	require.NoError(t, err)
+
+	return &pagesServer{
+		echo: e,
+		userRepo: userRepo,
+		sessionRepo: sessionRepo,
+		auditRepo: auditRepo,
+		groupRepo: groupRepo,
+		scimClientRepo: scimClientRepo,
+		smtp: smtp,
+		loginAttempts: loginAttempts,
+		consentRepo: consentRepo,
+	}
+}
+
+func (s *pagesServer) do(req *http.Request, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+
+	rec := httptest.NewRecorder()
+	s.echo.ServeHTTP(rec, req)
+
+	return rec
+}
+
+func findCookie(rec *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == name {
+			return cookie
+		}
+	}
+
+	return nil
+}
+
+var csrfInput = regexp.MustCompile(`name="_csrf" value="([^"]+)"`)
+
+func TestHostedLoginFlow(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+
+	authorize := "/auth/token?" + url.Values{
+		"client_id": {"id1"},
+		"redirect_uri": {"https://test.client.com/callback"},
+		"state": {"xyz"},
+		"login_hint": {"user@example.com"},
+	}.Encode()
+
+	rec := s.do(httptest.NewRequest(http.MethodGet, authorize, nil))
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+
+	loginURL := rec.Header().Get("Location")
+	require.True(t, strings.HasPrefix(loginURL, "/login?"))
+
+	rec = s.do(httptest.NewRequest(http.MethodGet, loginURL, nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), `value="user@example.com"`)
+
+	csrfCookie := findCookie(rec, "_csrf")
+	require.NotNil(t, csrfCookie)
+	match := csrfInput.FindStringSubmatch(rec.Body.String())
+	require.Len(t, match, 2)
+
+	parsed, err := url.Parse(loginURL)
+	require.NoError(t, err)
+	returnTo := parsed.Query().Get("return_to")
+
+	form := url.Values{
+		"_csrf": {match[1]},
+		"email": {"user@example.com"},
+		"password": {"wrong"},
+		"return_to": {returnTo},
+	}
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec = s.do(req, csrfCookie)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	require.Contains(t, rec.Body.String(), "Invalid email or password.")
+
+	form.Set("password", "password")
+	req = httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec = s.do(req, csrfCookie)
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	require.Equal(t, returnTo, rec.Header().Get("Location"))
+
+	sessionCookie := findCookie(rec, "sso_session_token")
+	require.NotNil(t, sessionCookie)
+	require.True(t, sessionCookie.HttpOnly)
+	require.True(t, sessionCookie.Expires.After(time.Now()))
+
+	// first visit of the client asks for consent
+	rec = s.do(httptest.NewRequest(http.MethodGet, returnTo, nil), sessionCookie)
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	consentURL := rec.Header().Get("Location")
+	require.True(t, strings.HasPrefix(consentURL, "/consent?"))
+
+	rec = s.do(httptest.NewRequest(http.MethodGet, consentURL, nil), sessionCookie, csrfCookie)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "Test app")
+
+	form = url.Values{
+		"_csrf": {match[1]},
+		"return_to": {returnTo},
+		"decision": {"allow"},
+	}
+	req = httptest.NewRequest(http.MethodPost, "/consent", strings.NewReader(form.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec = s.do(req, sessionCookie, csrfCookie)
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	require.Equal(t, returnTo, rec.Header().Get("Location"))
+
+	rec = s.do(httptest.NewRequest(http.MethodGet, returnTo, nil), sessionCookie)
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	require.True(t, strings.HasPrefix(rec.Header().Get("Location"), "https://test.client.com/callback?code="))
+	require.Contains(t, rec.Header().Get("Location"), "state=xyz")
+}
+
+func TestHostedLoginRequiresCSRF(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+
+	form := url.Values{
+		"email": {"user@example.com"},
+		"password": {"password"},
+	}
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec := s.do(req)
+
+	require.NotEqual(t, http.StatusSeeOther, rec.Code)
+	require.Nil(t, findCookie(rec, "sso_session_token"))
+	require.Empty(t, s.sessionRepo.sessions)
+}
+
+func TestHostedPagesTemplateOverride(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "error.html"), []byte(`{{define "error"}}custom: {{.Message}}{{end}}`), 0o644)
+	require.NoError(t, err)
+
+	s := newPagesServer(t, dir, nil)
+
+	rec := s.do(httptest.NewRequest(http.MethodGet, "/consent?return_to=/elsewhere", nil))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Equal(t, "custom: The authorization request is invalid.", rec.Body.String())
+
+	rec = s.do(httptest.NewRequest(http.MethodGet, "/login", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "<form")
+}
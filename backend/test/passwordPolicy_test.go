@@ -0,0 +1,151 @@
+package test
+
+import (
+	"sso/internal/core"
+	e "sso/internal/core/errors"
+	"sso/internal/infrastructure"
+	"github.com/stretchr/testify/require"
+
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// breachedPasswordsDir writes a range file in the Pwned Passwords format listing "breached password"
+func breachedPasswordsDir(t *testing.T) string {
+	dir := t.TempDir()
+
+	sum := sha1.Sum([]byte("breached password"))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	content := "0000000000000000000000000000000000A:3\r\n" + hash[5:] + ":42\r\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, hash[:5]+".txt"), []byte(content), 0o600))
+
+	return dir
+}
+
+func violatedRules(err error) []string {
+	var policyErr *core.PasswordPolicyError
+	if !errors.As(err, &policyErr) {
+		return nil
+	}
+
+	rules := []string{}
+	for _, v := range policyErr.Violations {
+		rules = append(rules, v.Rule)
+	}
+
+	return rules
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	policy := core.NewPasswordPolicy(8, 72, 3, []string{"Correct-Horse-1"}, infrastructure.NewBreachedPasswordsInterface(breachedPasswordsDir(t)))
+
+	tests := []struct{
+		testName string
+		password string
+		wantRules []string
+	}{
+		{
+			testName: "strong password",
+			password: "Tr0ub4dor&3",
+		},
+		{
+			testName: "empty password violates every rule it can",
+			password: "",
+			wantRules: []string{"min_length", "character_classes"},
+		},
+		{
+			testName: "short password with one class",
+			password: "abc",
+			wantRules: []string{"min_length", "character_classes"},
+		},
+		{
+			testName: "length is counted in characters",
+			password: "Пароль1!",
+		},
+		{
+			testName: "too long for bcrypt",
+			password: "Aa1" + strings.Repeat("x", 70),
+			wantRules: []string{"max_length"},
+		},
+		{
+			testName: "blocklist ignores case",
+			password: "correct-horse-1",
+			wantRules: []string{"blocklist"},
+		},
+		{
+			testName: "breached password",
+			password: "breached password",
+			wantRules: []string{"character_classes", "breached"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			err := policy.Check(context.Background(), tt.password)
+
+			if tt.wantRules == nil {
+				require.NoError(t, err)
+				return
+			}
+
+			require.ErrorIs(t, err, e.InvalidPassword)
+			require.Equal(t, tt.wantRules, violatedRules(err))
+		})
+	}
+}
+
+func TestPasswordPolicyMissingRangeFile(t *testing.T) {
+	policy := core.NewPasswordPolicy(8, 72, 0, nil, infrastructure.NewBreachedPasswordsInterface(t.TempDir()))
+
+	require.NoError(t, policy.Check(context.Background(), "breached password"))
+}
+
+func TestPasswordPolicyOnRegistration(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+
+	rec := mfaDo(s, http.MethodPost, "/auth/register?provider=email", `{"name":"new user","email":"new@example.com","password":"breached password"}`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	var body struct {
+		Error string `json:"error"`
+		Violations []core.PasswordViolation `json:"violations"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	require.Equal(t, "password is invalid", body.Error)
+	require.Len(t, body.Violations, 1)
+	require.Equal(t, "breached", body.Violations[0].Rule)
+
+	// nothing was created for the refused password
+	user, err := s.userRepo.ByEmail(context.Background(), "new@example.com")
+	require.NoError(t, err)
+	require.Nil(t, user)
+	require.Empty(t, s.smtp.sent("new@example.com"))
+
+	rec = mfaDo(s, http.MethodPost, "/auth/register?provider=email", `{"name":"new user","email":"new@example.com","password":"QWERTY123"}`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Contains(t, rec.Body.String(), `"rule":"blocklist"`)
+
+	registerByEmail(t, s, "new@example.com")
+}
+
+func TestPasswordPolicyOnChange(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+	current := passwordLogin(t, s)
+
+	rec := changePassword(s, current, `{"current_password":"password","new_password":"short"}`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Contains(t, rec.Body.String(), `"rule":"min_length"`)
+
+	rec = changePassword(s, current, `{"current_password":"password","new_password":"breached password"}`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Contains(t, rec.Body.String(), `"rule":"breached"`)
+}
@@ -0,0 +1,202 @@
+package test
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/require"
+
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var passwordResetLink = regexp.MustCompile(`http://sso\.test/password/reset\?\S+`)
+
+// forgotPassword asks for a reset of the seeded user and returns the token of the mailed link
+func forgotPassword(t *testing.T, s *pagesServer) string {
+	sent := len(s.smtp.sent("user@example.com"))
+
+	rec := mfaDo(s, http.MethodPost, "/auth/password/forgot", `{"email":"user@example.com"}`)
+	require.Equal(t, http.StatusAccepted, rec.Code)
+
+	mails := s.smtp.await(t, "user@example.com", sent+1)
+	require.Len(t, mails, sent+1)
+	require.Equal(t, "Reset your password", mails[sent].Subject)
+
+	link, err := url.Parse(passwordResetLink.FindString(mails[sent].Text))
+	require.NoError(t, err)
+	require.NotEmpty(t, link.Query().Get("token"))
+
+	return link.Query().Get("token")
+}
+
+func TestPasswordReset(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+	sessionCookie := passwordLogin(t, s)
+	token := forgotPassword(t, s)
+
+	rec := mfaDo(s, http.MethodPost, "/auth/password/reset", `{"token":"`+token+`","password":""}`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Contains(t, rec.Body.String(), "password is invalid")
+
+	// the refused password did not use the token up
+	rec = mfaDo(s, http.MethodPost, "/auth/password/reset", `{"token":"`+token+`","password":"new password"}`)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+
+	rec = mfaDo(s, http.MethodPost, "/auth/password/reset", `{"token":"`+token+`","password":"another password"}`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Contains(t, rec.Body.String(), "password reset token is invalid or expired")
+
+	// every session signed in with the old password is over
+	rec = s.do(httptest.NewRequest(http.MethodGet, "/auth/identities", nil), sessionCookie)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	require.Equal(t, http.StatusUnauthorized, mfaDo(s, http.MethodPost, "/auth/login?provider=email", `{"email":"user@example.com","password":"password"}`).Code)
+	require.Equal(t, http.StatusOK, mfaDo(s, http.MethodPost, "/auth/login?provider=email", `{"email":"user@example.com","password":"new password"}`).Code)
+
+	require.True(t, containsAuditAction(s.auditRepo.events, "password.reset_requested"))
+	require.True(t, containsAuditAction(s.auditRepo.events, "password.reset"))
+}
+
+func TestPasswordForgotUnknownAddress(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+
+	rec := mfaDo(s, http.MethodPost, "/auth/password/forgot", `{"email":"nobody@example.com"}`)
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	require.Empty(t, s.smtp.sent("nobody@example.com"))
+}
+
+func TestPasswordForgotFailingMailer(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+	// the relay is gone, mailing the link of the existing account fails
+	s.smtp.listener.Close()
+
+	rec := mfaDo(s, http.MethodPost, "/auth/password/forgot", `{"email":"user@example.com"}`)
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	require.Empty(t, rec.Body.String())
+}
+
+func TestPasswordResetForgedToken(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+	token := forgotPassword(t, s)
+
+	id, _, _ := strings.Cut(token, ".")
+	rec := mfaDo(s, http.MethodPost, "/auth/password/reset", `{"token":"`+id+`.forged","password":"new password"}`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// a login link is no reset token
+	code, link := sendEmailOTP(t, s, "user@example.com")
+	require.NotEmpty(t, code)
+	rec = mfaDo(s, http.MethodPost, "/auth/password/reset", `{"token":"`+link.Query().Get("token")+`","password":"new password"}`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	require.Equal(t, http.StatusNoContent, mfaDo(s, http.MethodPost, "/auth/password/reset", `{"token":"`+token+`","password":"new password"}`).Code)
+}
+
+func TestPasswordResetHostedPages(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+
+	rec := s.do(httptest.NewRequest(http.MethodGet, "/password/forgot", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	csrfCookie := findCookie(rec, "_csrf")
+	csrf := csrfInput.FindStringSubmatch(rec.Body.String())[1]
+
+	form := url.Values{
+		"_csrf": {csrf},
+		"email": {"user@example.com"},
+	}
+	req := httptest.NewRequest(http.MethodPost, "/password/forgot", strings.NewReader(form.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec = s.do(req, csrfCookie)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "we sent it a link")
+
+	mails := s.smtp.await(t, "user@example.com", 1)
+	require.Len(t, mails, 1)
+	link, err := url.Parse(passwordResetLink.FindString(mails[0].Text))
+	require.NoError(t, err)
+
+	rec = s.do(httptest.NewRequest(http.MethodGet, link.RequestURI(), nil), csrfCookie)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), `name="token" value="`+link.Query().Get("token")+`"`)
+
+	form = url.Values{
+		"_csrf": {csrf},
+		"token": {link.Query().Get("token")},
+		"password": {"new password"},
+	}
+	req = httptest.NewRequest(http.MethodPost, "/password/reset", strings.NewReader(form.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec = s.do(req, csrfCookie)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "Your password was changed")
+
+	req = httptest.NewRequest(http.MethodPost, "/password/reset", strings.NewReader(form.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec = s.do(req, csrfCookie)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Contains(t, rec.Body.String(), "The reset link is not valid or has expired")
+}
+
+func changePassword(s *pagesServer, sessionCookie *http.Cookie, body string) *httptest.ResponseRecorder {
+	return mfaDo(s, http.MethodPost, "/auth/password/change", body, sessionCookie)
+}
+
+func TestPasswordChange(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+	current := passwordLogin(t, s)
+	other := passwordLogin(t, s)
+
+	rec := changePassword(s, current, `{"current_password":"wrong","new_password":"new password"}`)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec = changePassword(s, current, `{"current_password":"password","new_password":""}`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Contains(t, rec.Body.String(), "password is invalid")
+	require.Empty(t, s.smtp.sent("user@example.com"))
+
+	rec = changePassword(s, current, `{"current_password":"password","new_password":"new password","sign_out_others":true}`)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+
+	// the session the change was made from stays signed in, the others are out
+	require.Equal(t, http.StatusOK, s.do(httptest.NewRequest(http.MethodGet, "/auth/identities", nil), current).Code)
+	require.Equal(t, http.StatusUnauthorized, s.do(httptest.NewRequest(http.MethodGet, "/auth/identities", nil), other).Code)
+
+	mails := s.smtp.sent("user@example.com")
+	require.Len(t, mails, 1)
+	require.Equal(t, "Your password was changed", mails[0].Subject)
+
+	require.Equal(t, http.StatusUnauthorized, mfaDo(s, http.MethodPost, "/auth/login?provider=email", `{"email":"user@example.com","password":"password"}`).Code)
+	other = findCookie(mfaDo(s, http.MethodPost, "/auth/login?provider=email", `{"email":"user@example.com","password":"new password"}`), "sso_session_token")
+	require.NotNil(t, other)
+
+	// other sessions are kept unless asked
+	rec = changePassword(s, current, `{"current_password":"new password","new_password":"newer password"}`)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	require.Equal(t, http.StatusOK, s.do(httptest.NewRequest(http.MethodGet, "/auth/identities", nil), other).Code)
+	require.Len(t, s.smtp.sent("user@example.com"), 2)
+
+	require.True(t, containsAuditAction(s.auditRepo.events, "password.changed"))
+}
+
+func TestPasswordChangeLimitsGuesses(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+	sessionCookie := passwordLogin(t, s)
+
+	for range 4 {
+		rec := changePassword(s, sessionCookie, `{"current_password":"wrong","new_password":"new password"}`)
+		require.Equal(t, http.StatusUnauthorized, rec.Code)
+	}
+
+	// the guesses back off like failed logins, even the right password waits
+	rec := changePassword(s, sessionCookie, `{"current_password":"password","new_password":"new password"}`)
+	requireLockedOut(t, rec)
+
+	// and they count towards the lockout of the account
+	s.loginAttempts.expire()
+	rec = changePassword(s, sessionCookie, `{"current_password":"wrong","new_password":"new password"}`)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	requireLockedOut(t, loginAs(s, "user@example.com", "password"))
+}
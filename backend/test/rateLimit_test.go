@@ -0,0 +1,140 @@
+package test
+
+import (
+	"sso/internal/infrastructure"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/require"
+
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func requireRateLimited(t *testing.T, rec *httptest.ResponseRecorder) {
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+
+	retryAfter, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+	require.NoError(t, err)
+	require.Positive(t, retryAfter)
+
+	var body map[string]any
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	require.Equal(t, "too many requests, try again later", body["error"])
+	require.EqualValues(t, retryAfter, body["retry_after"])
+}
+
+func TestRateLimitsInterface(t *testing.T) {
+	limits := infrastructure.NewRateLimitsInterface()
+
+	for range 3 {
+		wait, err := limits.Take(t.Context(), "ip:192.0.2.1", 60, 3)
+		require.NoError(t, err)
+		require.Zero(t, wait)
+	}
+
+	// an empty bucket refills a token a second
+	wait, err := limits.Take(t.Context(), "ip:192.0.2.1", 60, 3)
+	require.NoError(t, err)
+	require.Greater(t, wait, 900*time.Millisecond)
+	require.LessOrEqual(t, wait, time.Second)
+
+	// a refused request does not take the next token
+	wait, err = limits.Take(t.Context(), "ip:192.0.2.1", 60, 3)
+	require.NoError(t, err)
+	require.LessOrEqual(t, wait, time.Second)
+
+	wait, err = limits.Take(t.Context(), "ip:198.51.100.7", 60, 3)
+	require.NoError(t, err)
+	require.Zero(t, wait)
+}
+
+func TestRateLimitByAccount(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+
+	for range 10 {
+		rec := mfaDo(s, http.MethodPost, "/auth/password/forgot", `{"email":"user@example.com"}`)
+		require.Equal(t, http.StatusAccepted, rec.Code)
+	}
+	// the handler still read the body
+	s.smtp.await(t, "user@example.com", 1)
+
+	requireRateLimited(t, mfaDo(s, http.MethodPost, "/auth/password/forgot", `{"email":"USER@example.com"}`))
+	// the bucket of the account is shared by the login
+	requireRateLimited(t, loginAs(s, "user@example.com", "password"))
+
+	rec := mfaDo(s, http.MethodPost, "/auth/password/forgot", `{"email":"nobody@example.com"}`)
+	require.Equal(t, http.StatusAccepted, rec.Code)
+}
+
+func TestRateLimitByAccountOnPages(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+
+	rec := s.do(httptest.NewRequest(http.MethodGet, "/password/forgot", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	csrfCookie := findCookie(rec, "_csrf")
+	csrf := csrfInput.FindStringSubmatch(rec.Body.String())[1]
+
+	forgot := func() *httptest.ResponseRecorder {
+		form := url.Values{
+			"_csrf": {csrf},
+			"email": {"user@example.com"},
+		}
+		req := httptest.NewRequest(http.MethodPost, "/password/forgot", strings.NewReader(form.Encode()))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+
+		return s.do(req, csrfCookie)
+	}
+
+	for range 10 {
+		require.Equal(t, http.StatusOK, forgot().Code)
+	}
+
+	// the browser gets the error page, not the json of the api
+	rec = forgot()
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+	require.Contains(t, rec.Header().Get(echo.HeaderContentType), echo.MIMETextHTML)
+	require.Contains(t, rec.Body.String(), "Too many requests, please try again later.")
+
+	retryAfter, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+	require.NoError(t, err)
+	require.Positive(t, retryAfter)
+}
+
+func TestRateLimitByClient(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+
+	for range 20 {
+		rec := s.do(httptest.NewRequest(http.MethodGet, "/auth/token?client_id=client_1", nil))
+		require.NotEqual(t, http.StatusTooManyRequests, rec.Code)
+	}
+
+	requireRateLimited(t, s.do(httptest.NewRequest(http.MethodGet, "/auth/token?client_id=client_1", nil)))
+
+	rec := s.do(httptest.NewRequest(http.MethodGet, "/auth/token?client_id=client_2", nil))
+	require.NotEqual(t, http.StatusTooManyRequests, rec.Code)
+}
+
+func TestRateLimitByIP(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+
+	for range 100 {
+		rec := mfaDo(s, http.MethodPost, "/auth/password/reset", `{"token":"invalid","password":"new password"}`)
+		require.Equal(t, http.StatusBadRequest, rec.Code)
+	}
+
+	requireRateLimited(t, mfaDo(s, http.MethodPost, "/auth/register", `{"name":"new","email":"new@example.com","password":"new password"}`))
+	// wrong second factor codes are refused before they are checked
+	requireRateLimited(t, verifyMFA(s, "invalid", "code", "000000"))
+	requireRateLimited(t, mfaDo(s, http.MethodPost, "/auth/mfa/webauthn/options", `{"mfa_token":"invalid"}`))
+
+	// other addresses have their own bucket
+	req := httptest.NewRequest(http.MethodPost, "/auth/password/reset", strings.NewReader(`{"token":"invalid","password":"new password"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.RemoteAddr = "198.51.100.7:1234"
+	require.Equal(t, http.StatusBadRequest, s.do(req).Code)
+}
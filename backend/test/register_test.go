@@ -3,6 +3,7 @@ package test
 import (
 	"context"
 	"sso/internal/core"
+	e "sso/internal/core/errors"
 	"sso/internal/infrastructure"
 	"testing"
 
@@ -17,10 +18,17 @@ func TestRegisterByEmailSuccess(t *testing.T) {
 
 	tokenRepo := infrastructure.NewTokenInterface("secret", jwt.SigningMethodHS256)
 	hashRepo := &FakeHashRepository{}
+	sessionRepo := &FakeSessionRepository{}
 
-	sessionExp := 3600
+	clientRepo := &FakeClientRepository{}
+	policies := core.SessionPolicies{
+		Default: core.SessionPolicy{
+			IdleTimeout: 1800,
+			Lifetime: 3600,
+		},
+	}
 
-	registerUC := core.NewRegisterUseCase(userRepo, tokenRepo, hashRepo, sessionExp)
+	registerUC := core.NewRegisterUseCase(userRepo, tokenRepo, hashRepo, sessionRepo, clientRepo, policies, infrastructure.NewPendingLinksInterface(), nil, core.NewPasswordPolicy(8, 72, 0, nil, nil), infrastructure.NewPartialSessionsInterface())
 
 	ctx := context.Background()
 	input := core.RegisterInput{
@@ -31,12 +39,97 @@ func TestRegisterByEmailSuccess(t *testing.T) {
 		Password: "password",
 	}
 
-	ssoSessionToken, err := registerUC.Execute(ctx, input)
+	ssoSessionToken, session, err := registerUC.Execute(ctx, input)
 
 	require.NoError(t, err)
 	require.NotEmpty(t, ssoSessionToken)
+	require.NotNil(t, session)
+	require.Len(t, sessionRepo.sessions, 1)
 
 	require.Len(t, userRepo.users, 1)
 	require.Len(t, userRepo.identities, 1)
 	require.Len(t, userRepo.credentials, 1)
 }
+
+// linkedUser is a user whose github identity is linked already, registering with it signs them in
+func linkedUser(status string) *FakeUserRepository {
+	return &FakeUserRepository{
+		users: []core.User{
+			{
+				ID: "user_id1",
+				Name: "user",
+				Email: "user@example.com",
+				Status: status,
+			},
+		},
+		identities: []core.Identity{
+			{
+				ID: "identity_id1",
+				UserID: "user_id1",
+				Type: "github",
+				ExternalID: "github_id1",
+				Issuer: "github.com",
+			},
+		},
+	}
+}
+
+func registerByOAuth(registerUC *core.RegisterUseCase) (string, *core.Session, error) {
+	return registerUC.Execute(context.Background(), core.RegisterInput{
+		Provider: "oauth",
+
+		ExternalID: "github_id1",
+		Issuer: "github.com",
+		Token: map[string]string{
+			"provider": "github",
+			"email": "user@example.com",
+			"email_verified": "true",
+		},
+	})
+}
+
+func TestRegisterByOAuthBlockedUser(t *testing.T) {
+	for _, status := range []string{"blocked", "deleted"} {
+		t.Run(status, func(t *testing.T) {
+			userRepo := linkedUser(status)
+			sessionRepo := &FakeSessionRepository{}
+
+			registerUC := core.NewRegisterUseCase(userRepo, infrastructure.NewTokenInterface("secret", jwt.SigningMethodHS256), &FakeHashRepository{}, sessionRepo, &FakeClientRepository{}, core.SessionPolicies{}, infrastructure.NewPendingLinksInterface(), nil, core.NewPasswordPolicy(8, 72, 0, nil, nil), infrastructure.NewPartialSessionsInterface())
+
+			token, session, err := registerByOAuth(registerUC)
+			require.ErrorIs(t, err, e.UserCannotBeLoggedIn)
+			require.Empty(t, token)
+			require.Nil(t, session)
+			require.Empty(t, sessionRepo.sessions)
+		})
+	}
+}
+
+func TestRegisterByOAuthRequiresSecondFactor(t *testing.T) {
+	userRepo := linkedUser("active")
+	userRepo.credentials = []core.Credential{
+		{
+			ID: "credential_id1",
+			UserID: "user_id1",
+			Type: "totp",
+			Status: "active",
+		},
+	}
+	sessionRepo := &FakeSessionRepository{}
+	partials := infrastructure.NewPartialSessionsInterface()
+
+	registerUC := core.NewRegisterUseCase(userRepo, infrastructure.NewTokenInterface("secret", jwt.SigningMethodHS256), &FakeHashRepository{}, sessionRepo, &FakeClientRepository{}, core.SessionPolicies{}, infrastructure.NewPendingLinksInterface(), nil, core.NewPasswordPolicy(8, 72, 0, nil, nil), partials)
+
+	token, session, err := registerByOAuth(registerUC)
+
+	var mfaErr *core.MFARequiredError
+	require.ErrorAs(t, err, &mfaErr)
+	require.Equal(t, []string{"totp"}, mfaErr.Methods)
+	require.Empty(t, token)
+	require.Nil(t, session)
+	require.Empty(t, sessionRepo.sessions)
+
+	partial, err := partials.Get(mfaErr.MFAToken)
+	require.NoError(t, err)
+	require.Equal(t, "user_id1", partial.UserID)
+}
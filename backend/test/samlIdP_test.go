@@ -0,0 +1,185 @@
+package test
+
+import (
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/stretchr/testify/require"
+
+	"bytes"
+	"compress/flate"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var samlResponseInput = regexp.MustCompile(`name="SAMLResponse" value="([^"]+)"`)
+
+func authnRequest(id, issuer, acsURL string, extra string) string {
+	return fmt.Sprintf(`<samlp:AuthnRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="%s" Version="2.0" IssueInstant="%s" Destination="http://sso.test/saml/sso" AssertionConsumerServiceURL="%s" ProtocolBinding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" %s><saml:Issuer>%s</saml:Issuer></samlp:AuthnRequest>`,
+		id, time.Now().UTC().Format(time.RFC3339), acsURL, extra, issuer)
+}
+
+func deflateRequest(t *testing.T, request string) string {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	require.NoError(t, err)
+	_, err = w.Write([]byte(request))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+// samlCertificate reads the signing certificate from the identity provider metadata
+func samlCertificate(t *testing.T, s *pagesServer) *x509.Certificate {
+	rec := s.do(httptest.NewRequest(http.MethodGet, "/saml/metadata", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	doc := etree.NewDocument()
+	require.NoError(t, doc.ReadFromBytes(rec.Body.Bytes()))
+	require.Equal(t, "http://sso.test/saml/metadata", doc.Root().SelectAttrValue("entityID", ""))
+	require.NotNil(t, doc.FindElement("//SingleSignOnService[@Location='http://sso.test/saml/sso']"))
+
+	certEl := doc.FindElement("//X509Certificate")
+	require.NotNil(t, certEl)
+	der, err := base64.StdEncoding.DecodeString(certEl.Text())
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return cert
+}
+
+// samlResponse extracts the response from the auto-submitting form and verifies its signatures
+func samlResponse(t *testing.T, rec *httptest.ResponseRecorder, cert *x509.Certificate) *etree.Element {
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), `action="https://sp.example.com/acs"`)
+
+	match := samlResponseInput.FindStringSubmatch(rec.Body.String())
+	require.Len(t, match, 2)
+	raw, err := base64.StdEncoding.DecodeString(html.UnescapeString(match[1]))
+	require.NoError(t, err)
+
+	doc := etree.NewDocument()
+	require.NoError(t, doc.ReadFromBytes(raw))
+
+	validator := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{
+		Roots: []*x509.Certificate{cert},
+	})
+
+	response, err := validator.Validate(doc.Root())
+	require.NoError(t, err)
+
+	if assertion := response.FindElement("./Assertion"); assertion != nil {
+		_, err = validator.Validate(assertion)
+		require.NoError(t, err)
+	}
+
+	return response
+}
+
+func TestSAMLIdentityProvider(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+	cert := samlCertificate(t, s)
+
+	sso := "/saml/sso?" + url.Values{
+		"SAMLRequest": {deflateRequest(t, authnRequest("_req1", "https://sp.example.com/metadata", "https://sp.example.com/acs", ""))},
+		"RelayState": {"relay"},
+	}.Encode()
+
+	rec := s.do(httptest.NewRequest(http.MethodGet, sso, nil))
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	loginURL, err := url.Parse(rec.Header().Get("Location"))
+	require.NoError(t, err)
+	require.Equal(t, "/login", loginURL.Path)
+	returnTo := loginURL.Query().Get("return_to")
+	require.True(t, strings.HasPrefix(returnTo, "/saml/sso?"))
+
+	sessionCookie := passwordLogin(t, s)
+
+	rec = s.do(httptest.NewRequest(http.MethodGet, returnTo, nil), sessionCookie)
+	require.Contains(t, rec.Body.String(), `name="RelayState" value="relay"`)
+	response := samlResponse(t, rec, cert)
+
+	require.Equal(t, "_req1", response.SelectAttrValue("InResponseTo", ""))
+	require.Equal(t, "https://sp.example.com/acs", response.SelectAttrValue("Destination", ""))
+	require.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:Success", response.FindElement("./Status/StatusCode").SelectAttrValue("Value", ""))
+
+	assertion := response.FindElement("./Assertion")
+	require.NotNil(t, assertion)
+	require.Equal(t, "http://sso.test/saml/metadata", assertion.FindElement("./Issuer").Text())
+	require.Equal(t, "user@example.com", assertion.FindElement("./Subject/NameID").Text())
+	require.Equal(t, "https://sp.example.com/metadata", assertion.FindElement("./Conditions/AudienceRestriction/Audience").Text())
+	require.Equal(t, "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport", assertion.FindElement("./AuthnStatement/AuthnContext/AuthnContextClassRef").Text())
+	require.Equal(t, "user_id1", assertion.FindElement("./AttributeStatement/Attribute[@Name='uid']/AttributeValue").Text())
+	require.Equal(t, "user", assertion.FindElement("./AttributeStatement/Attribute[@Name='name']/AttributeValue").Text())
+
+	// the HTTP-POST binding answers from the same session
+	form := url.Values{
+		"SAMLRequest": {base64.StdEncoding.EncodeToString([]byte(authnRequest("_req2", "https://sp.example.com/metadata", "https://sp.example.com/acs", "")))},
+	}
+	req := httptest.NewRequest(http.MethodPost, "/saml/sso", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	response = samlResponse(t, s.do(req, sessionCookie), cert)
+	require.Equal(t, "_req2", response.SelectAttrValue("InResponseTo", ""))
+
+	// a cross site post arrives without the session cookie and is retried as a navigation
+	req = httptest.NewRequest(http.MethodPost, "/saml/sso", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = s.do(req)
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	rec = s.do(httptest.NewRequest(http.MethodGet, rec.Header().Get("Location"), nil), sessionCookie)
+	response = samlResponse(t, rec, cert)
+	require.Equal(t, "_req2", response.SelectAttrValue("InResponseTo", ""))
+}
+
+func TestSAMLIdentityProviderRejectsRequests(t *testing.T) {
+	tests := []struct{
+		testName string
+		request string
+	}{
+		{
+			testName: "unknown service provider",
+			request: authnRequest("_req1", "https://other.example.com/metadata", "https://sp.example.com/acs", ""),
+		},
+		{
+			testName: "unregistered acs url",
+			request: authnRequest("_req1", "https://sp.example.com/metadata", "https://attacker.example.com/acs", ""),
+		},
+		{
+			testName: "not a saml request",
+			request: `<html></html>`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			s := newPagesServer(t, "", nil)
+			sessionCookie := passwordLogin(t, s)
+
+			rec := s.do(httptest.NewRequest(http.MethodGet, "/saml/sso?"+url.Values{"SAMLRequest": {deflateRequest(t, test.request)}}.Encode(), nil), sessionCookie)
+			require.Equal(t, http.StatusBadRequest, rec.Code)
+			require.NotContains(t, rec.Body.String(), "SAMLResponse")
+		})
+	}
+}
+
+func TestSAMLIdentityProviderPassive(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+	cert := samlCertificate(t, s)
+
+	request := authnRequest("_req1", "https://sp.example.com/metadata", "https://sp.example.com/acs", `IsPassive="true"`)
+	rec := s.do(httptest.NewRequest(http.MethodGet, "/saml/sso?"+url.Values{"SAMLRequest": {deflateRequest(t, request)}}.Encode(), nil))
+
+	response := samlResponse(t, rec, cert)
+	require.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:NoPassive", response.FindElement("./Status/StatusCode/StatusCode").SelectAttrValue("Value", ""))
+	require.Nil(t, response.FindElement("./Assertion"))
+}
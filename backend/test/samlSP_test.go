@@ -0,0 +1,267 @@
+package test
+
+import (
+	"sso/internal/config"
+	"sso/internal/core"
+	"sso/internal/infrastructure"
+	"github.com/stretchr/testify/require"
+
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	samlSPEntityID = "http://sso.test/saml/sp"
+	samlSPACS = "http://sso.test/auth/federated/corp/callback"
+)
+
+// fakeSAMLIdP is a corporate identity provider built from the SAML encoder of the sso itself,
+// it serves its metadata and signs the responses a test asks for
+type fakeSAMLIdP struct {
+	server *httptest.Server
+	saml *infrastructure.SAMLInterface
+	key core.PrivateKey
+}
+
+func newFakeSAMLIdP(t *testing.T) *fakeSAMLIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	idp := &fakeSAMLIdP{
+		saml: infrastructure.NewSAMLInterface(),
+		key: core.PrivateKey{Name: "corp_key", Value: *key},
+	}
+
+	idp.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		metadata, err := idp.saml.Metadata(idp.entityID(), idp.server.URL+"/sso", []core.PrivateKey{idp.key})
+		require.NoError(t, err)
+		w.Write(metadata)
+	}))
+	t.Cleanup(idp.server.Close)
+
+	return idp
+}
+
+func (idp *fakeSAMLIdP) entityID() string {
+	return idp.server.URL + "/metadata"
+}
+
+func (idp *fakeSAMLIdP) providers(t *testing.T) map[string]core.IFederatedProvider {
+	confs, err := config.LoadIdentityProviders(writeProvidersFile(t, `[
+		{"name": "corp", "type": "saml", "display_name": "Corp", "client_id": "`+samlSPEntityID+`", "redirect_url": "`+samlSPACS+`", "metadata_url": "`+idp.server.URL+`/metadata", "claims": {"name": "displayName"}}
+	]`))
+	require.NoError(t, err)
+
+	providers, verifier, err := infrastructure.NewIdentityProviders(t.Context(), confs, idp.server.Client())
+	require.NoError(t, err)
+	require.Nil(t, verifier)
+
+	return providers
+}
+
+// respond answers an authentication request for nameID, change may break the response before it is signed
+func (idp *fakeSAMLIdP) respond(t *testing.T, request *core.AuthnRequest, nameID string, change func(*core.SAMLResponse)) string {
+	now := time.Now().UTC()
+	response := &core.SAMLResponse{
+		ID: "_response",
+		InResponseTo: request.ID,
+		Issuer: idp.entityID(),
+		Destination: request.ACSURL,
+		IssueInstant: now,
+		Status: core.SAMLStatusSuccess,
+		Assertion: &core.Assertion{
+			ID: "_assertion",
+			Issuer: idp.entityID(),
+			IssueInstant: now,
+			NameID: nameID,
+			NameIDFormat: core.NameIDFormatEmail,
+			Recipient: request.ACSURL,
+			InResponseTo: request.ID,
+			Audience: request.Issuer,
+			NotBefore: now.Add(-time.Minute),
+			NotOnOrAfter: now.Add(5*time.Minute),
+			AuthnInstant: now,
+			AuthnContext: "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport",
+			SessionIndex: "session",
+			Attributes: map[string][]string{"displayName": {"Corp User"}},
+		},
+	}
+	if change != nil {
+		change(response)
+	}
+
+	encoded, err := idp.saml.SignResponse(response, idp.key)
+	require.NoError(t, err)
+
+	return encoded
+}
+
+// startSAMLLogin runs the start endpoint and returns the authentication request sent to the identity
+// provider, the relay state and the state binding cookie
+func startSAMLLogin(t *testing.T, s *pagesServer, idp *fakeSAMLIdP) (*core.AuthnRequest, string, *http.Cookie) {
+	rec := s.do(httptest.NewRequest(http.MethodGet, "/auth/federated/corp/start?return_to=/account", nil))
+	require.Equal(t, http.StatusFound, rec.Code)
+
+	stateCookie := findCookie(rec, "sso_federation_state")
+	require.NotNil(t, stateCookie)
+
+	location, err := url.Parse(rec.Header().Get("Location"))
+	require.NoError(t, err)
+	require.Equal(t, idp.server.URL+"/sso", location.Scheme+"://"+location.Host+location.Path)
+	require.Equal(t, stateCookie.Value, location.Query().Get("RelayState"))
+
+	request, err := infrastructure.NewSAMLInterface().ParseAuthnRequest(location.Query().Get("SAMLRequest"))
+	require.NoError(t, err)
+	require.Equal(t, samlSPEntityID, request.Issuer)
+	require.Equal(t, samlSPACS, request.ACSURL)
+
+	return request, location.Query().Get("RelayState"), stateCookie
+}
+
+func postSAMLResponse(s *pagesServer, response, relayState string, resubmitted bool, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	form := url.Values{
+		"SAMLResponse": {response},
+		"RelayState": {relayState},
+	}
+	if resubmitted {
+		form.Set("resubmitted", "true")
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/federated/corp/callback", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return s.do(req, cookies...)
+}
+
+func TestSAMLFederatedLogin(t *testing.T) {
+	idp := newFakeSAMLIdP(t)
+	s := newPagesServer(t, "", idp.providers(t))
+
+	rec := s.do(httptest.NewRequest(http.MethodGet, "/login", nil))
+	require.Contains(t, rec.Body.String(), "Sign in with Corp")
+
+	request, relayState, stateCookie := startSAMLLogin(t, s, idp)
+	response := idp.respond(t, request, "employee@corp.example.com", nil)
+
+	// the cross site post from the identity provider comes without the state cookie
+	rec = postSAMLResponse(s, response, relayState, false)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), `action="/auth/federated/corp/callback"`)
+	require.Contains(t, rec.Body.String(), `name="resubmitted" value="true"`)
+	match := samlResponseInput.FindStringSubmatch(rec.Body.String())
+	require.Len(t, match, 2)
+	require.Equal(t, response, html.UnescapeString(match[1]))
+
+	rec = postSAMLResponse(s, response, relayState, true, stateCookie)
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	require.Equal(t, "/account", rec.Header().Get("Location"))
+	require.NotNil(t, findCookie(rec, "sso_session_token"))
+
+	user, err := s.userRepo.ByIdentity(t.Context(), "saml", "employee@corp.example.com", idp.entityID())
+	require.NoError(t, err)
+	require.NotNil(t, user)
+	require.Equal(t, "employee@corp.example.com", user.Email)
+	require.Equal(t, "Corp User", user.Name)
+
+	// the response is bound to a single login
+	rec = postSAMLResponse(s, response, relayState, true, stateCookie)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestSAMLFederatedLoginRejectsResponses(t *testing.T) {
+	tests := []struct{
+		testName string
+		response func(t *testing.T, idp *fakeSAMLIdP, request *core.AuthnRequest) string
+	}{
+		{
+			testName: "another audience",
+			response: func(t *testing.T, idp *fakeSAMLIdP, request *core.AuthnRequest) string {
+				return idp.respond(t, request, "employee@corp.example.com", func(response *core.SAMLResponse) {
+					response.Assertion.Audience = "https://other.example.com"
+				})
+			},
+		},
+		{
+			testName: "expired assertion",
+			response: func(t *testing.T, idp *fakeSAMLIdP, request *core.AuthnRequest) string {
+				return idp.respond(t, request, "employee@corp.example.com", func(response *core.SAMLResponse) {
+					response.Assertion.NotBefore = time.Now().Add(-time.Hour)
+					response.Assertion.NotOnOrAfter = time.Now().Add(-30*time.Minute)
+				})
+			},
+		},
+		{
+			testName: "response to another request",
+			response: func(t *testing.T, idp *fakeSAMLIdP, request *core.AuthnRequest) string {
+				return idp.respond(t, request, "employee@corp.example.com", func(response *core.SAMLResponse) {
+					response.InResponseTo = "_other"
+					response.Assertion.InResponseTo = "_other"
+				})
+			},
+		},
+		{
+			testName: "another recipient",
+			response: func(t *testing.T, idp *fakeSAMLIdP, request *core.AuthnRequest) string {
+				return idp.respond(t, request, "employee@corp.example.com", func(response *core.SAMLResponse) {
+					response.Assertion.Recipient = "https://other.example.com/acs"
+				})
+			},
+		},
+		{
+			testName: "name id changed after signing",
+			response: func(t *testing.T, idp *fakeSAMLIdP, request *core.AuthnRequest) string {
+				encoded := idp.respond(t, request, "employee@corp.example.com", nil)
+				raw, err := base64.StdEncoding.DecodeString(encoded)
+				require.NoError(t, err)
+				tampered := strings.Replace(string(raw), "employee@corp.example.com", "ceo@corp.example.com", 1)
+
+				return base64.StdEncoding.EncodeToString([]byte(tampered))
+			},
+		},
+		{
+			testName: "signed by another key",
+			response: func(t *testing.T, idp *fakeSAMLIdP, request *core.AuthnRequest) string {
+				return newFakeSAMLIdP(t).respond(t, request, "employee@corp.example.com", func(response *core.SAMLResponse) {
+					response.Issuer = idp.entityID()
+					response.Assertion.Issuer = idp.entityID()
+				})
+			},
+		},
+		{
+			testName: "login refused",
+			response: func(t *testing.T, idp *fakeSAMLIdP, request *core.AuthnRequest) string {
+				return idp.respond(t, request, "", func(response *core.SAMLResponse) {
+					response.Status = core.SAMLStatusResponder
+					response.Assertion = nil
+				})
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			idp := newFakeSAMLIdP(t)
+			s := newPagesServer(t, "", idp.providers(t))
+
+			request, relayState, stateCookie := startSAMLLogin(t, s, idp)
+
+			rec := postSAMLResponse(s, test.response(t, idp, request), relayState, true, stateCookie)
+			require.Equal(t, http.StatusUnauthorized, rec.Code)
+			require.Nil(t, findCookie(rec, "sso_session_token"))
+
+			for _, email := range []string{"employee@corp.example.com", "ceo@corp.example.com"} {
+				user, err := s.userRepo.ByEmail(t.Context(), email)
+				require.NoError(t, err)
+				require.Nil(t, user)
+			}
+		})
+	}
+}
@@ -0,0 +1,356 @@
+package test
+
+import (
+	"sso/internal/core"
+	e "sso/internal/core/errors"
+	"github.com/stretchr/testify/require"
+
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// scimToken registers a provisioning client through the admin api and returns its bearer token
+func scimToken(t *testing.T, s *pagesServer) string {
+	req := httptest.NewRequest(http.MethodPost, "/admin/scim/clients", strings.NewReader(`{"name":"directory sync"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer admin_key")
+
+	rec := s.do(req)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	require.NotContains(t, rec.Body.String(), "token_hash")
+
+	var body struct {
+		Client core.SCIMClient `json:"client"`
+		Token string `json:"token"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	require.NotEmpty(t, body.Client.ID)
+	require.NotEmpty(t, body.Token)
+
+	return body.Token
+}
+
+func scimDo(s *pagesServer, token, method, path, body string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/scim+json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+
+	return s.do(req)
+}
+
+func scimBody(t *testing.T, rec *httptest.ResponseRecorder) map[string]any {
+	var body map[string]any
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+
+	return body
+}
+
+// scimErrorType checks the error format and returns its scimType
+func scimErrorType(t *testing.T, rec *httptest.ResponseRecorder, status int) string {
+	require.Equal(t, status, rec.Code, rec.Body.String())
+	require.Equal(t, "application/scim+json", rec.Header().Get("Content-Type"))
+
+	body := scimBody(t, rec)
+	require.Equal(t, []any{"urn:ietf:params:scim:api:messages:2.0:Error"}, body["schemas"])
+
+	scimType, _ := body["scimType"].(string)
+	return scimType
+}
+
+func TestSCIMAuthentication(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+
+	rec := scimDo(s, "", http.MethodGet, "/scim/v2/Users", "")
+	scimErrorType(t, rec, http.StatusUnauthorized)
+
+	rec = scimDo(s, "unknown", http.MethodGet, "/scim/v2/Users", "")
+	scimErrorType(t, rec, http.StatusUnauthorized)
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/scim/clients", strings.NewReader(`{"name":"directory sync"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer wrong")
+	require.Equal(t, http.StatusUnauthorized, s.do(req).Code)
+
+	token := scimToken(t, s)
+	// only a hash of the token is stored
+	require.NotEqual(t, token, s.scimClientRepo.clients[0].TokenHash)
+	require.Len(t, s.scimClientRepo.clients[0].TokenHash, 64)
+
+	rec = scimDo(s, token, http.MethodGet, "/scim/v2/Users", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, float64(1), scimBody(t, rec)["totalResults"])
+
+	rec = scimDo(s, token, http.MethodGet, "/scim/v2/ServiceProviderConfig", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	req = httptest.NewRequest(http.MethodDelete, "/admin/scim/clients/"+s.scimClientRepo.clients[0].ID, nil)
+	req.Header.Set("Authorization", "Bearer admin_key")
+	require.Equal(t, http.StatusNoContent, s.do(req).Code)
+
+	rec = scimDo(s, token, http.MethodGet, "/scim/v2/Users", "")
+	scimErrorType(t, rec, http.StatusUnauthorized)
+
+	req = httptest.NewRequest(http.MethodDelete, "/admin/scim/clients/unknown", nil)
+	req.Header.Set("Authorization", "Bearer admin_key")
+	require.Equal(t, http.StatusNotFound, s.do(req).Code)
+}
+
+func TestSCIMUserLifecycle(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+	token := scimToken(t, s)
+
+	rec := scimDo(s, token, http.MethodPost, "/scim/v2/Users", `{
+		"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"],
+		"userName": "new@example.com",
+		"externalId": "ext-1",
+		"name": {"formatted": "Newcomer", "givenName": "New"},
+		"emails": [{"value": "new@example.com", "primary": true}],
+		"active": true
+	}`)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	require.Equal(t, `W/"1"`, rec.Header().Get("ETag"))
+
+	created := scimBody(t, rec)
+	id := created["id"].(string)
+	require.Equal(t, "http://sso.test/scim/v2/Users/"+id, rec.Header().Get("Location"))
+	require.Equal(t, "Newcomer", created["displayName"])
+	require.Equal(t, "ext-1", created["externalId"])
+	require.Equal(t, true, created["active"])
+
+	user, err := s.userRepo.ByID(t.Context(), id)
+	require.NoError(t, err)
+	require.Equal(t, "new@example.com", user.Email)
+	require.Equal(t, "active", user.Status)
+
+	rec = scimDo(s, token, http.MethodPost, "/scim/v2/Users", `{"userName": "new@example.com"}`)
+	require.Equal(t, "uniqueness", scimErrorType(t, rec, http.StatusConflict))
+
+	rec = scimDo(s, token, http.MethodPost, "/scim/v2/Users", `{"userName": "not an email"}`)
+	require.Equal(t, "invalidValue", scimErrorType(t, rec, http.StatusBadRequest))
+
+	rec = scimDo(s, token, http.MethodPost, "/scim/v2/Users", `{"userName":`)
+	require.Equal(t, "invalidSyntax", scimErrorType(t, rec, http.StatusBadRequest))
+
+	rec = scimDo(s, token, http.MethodGet, "/scim/v2/Users/"+id, "", "If-None-Match", `W/"1"`)
+	require.Equal(t, http.StatusNotModified, rec.Code)
+
+	rec = scimDo(s, token, http.MethodGet, "/scim/v2/Users?filter="+url.QueryEscape(`userName eq "NEW@example.com"`), "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	list := scimBody(t, rec)
+	require.Equal(t, float64(1), list["totalResults"])
+	require.Equal(t, id, list["Resources"].([]any)[0].(map[string]any)["id"])
+
+	rec = scimDo(s, token, http.MethodGet, "/scim/v2/Users?filter="+url.QueryEscape(`password eq "x"`), "")
+	require.Equal(t, "invalidFilter", scimErrorType(t, rec, http.StatusBadRequest))
+
+	rec = scimDo(s, token, http.MethodPut, "/scim/v2/Users/"+id, `{"userName": "renamed@example.com", "displayName": "Renamed", "externalId": "ext-1"}`, "If-Match", `W/"1"`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Equal(t, `W/"2"`, rec.Header().Get("ETag"))
+	require.Equal(t, "renamed@example.com", scimBody(t, rec)["userName"])
+
+	// the first version is gone
+	rec = scimDo(s, token, http.MethodPatch, "/scim/v2/Users/"+id, `{"Operations": [{"op": "replace", "path": "displayName", "value": "Stale"}]}`, "If-Match", `W/"1"`)
+	scimErrorType(t, rec, http.StatusPreconditionFailed)
+
+	rec = scimDo(s, token, http.MethodPatch, "/scim/v2/Users/"+id, `{"Operations": [{"op": "Replace", "value": {"name": {"formatted": "Patched"}, "title": "ignored"}}]}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Equal(t, "Patched", scimBody(t, rec)["displayName"])
+
+	rec = scimDo(s, token, http.MethodPatch, "/scim/v2/Users/"+id, `{"Operations": [{"op": "remove", "path": "userName"}]}`)
+	require.Equal(t, "invalidPath", scimErrorType(t, rec, http.StatusBadRequest))
+
+	rec = scimDo(s, token, http.MethodDelete, "/scim/v2/Users/"+id, "")
+	require.Equal(t, http.StatusNoContent, rec.Code)
+
+	user, err = s.userRepo.ByID(t.Context(), id)
+	require.NoError(t, err)
+	require.Equal(t, "deleted", user.Status)
+
+	rec = scimDo(s, token, http.MethodGet, "/scim/v2/Users/"+id, "")
+	scimErrorType(t, rec, http.StatusNotFound)
+
+	rec = scimDo(s, token, http.MethodGet, "/scim/v2/Users", "")
+	require.Equal(t, float64(1), scimBody(t, rec)["totalResults"])
+
+	events, err := s.auditRepo.ByUser(t.Context(), id, 10)
+	require.NoError(t, err)
+	require.Len(t, events, 4)
+	require.Equal(t, "scim.user.deleted", events[0].Action)
+	require.Equal(t, "scim.user.provisioned", events[3].Action)
+	require.Equal(t, s.scimClientRepo.clients[0].ID, events[3].Details["scim_client_id"])
+}
+
+func TestSCIMDeactivationEndsSessions(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+	token := scimToken(t, s)
+
+	sessionCookie := passwordLogin(t, s)
+
+	rec := scimDo(s, token, http.MethodPatch, "/scim/v2/Users/user_id1", `{
+		"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+		"Operations": [{"op": "replace", "path": "active", "value": "False"}]
+	}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Equal(t, false, scimBody(t, rec)["active"])
+
+	user, err := s.userRepo.ByID(t.Context(), "user_id1")
+	require.NoError(t, err)
+	require.Equal(t, "blocked", user.Status)
+
+	require.Equal(t, http.StatusUnauthorized, s.do(httptest.NewRequest(http.MethodGet, "/auth/sessions", nil), sessionCookie).Code)
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/login?provider=email", strings.NewReader(`{"email":"user@example.com","password":"password"}`))
+	req.Header.Set("Content-Type", "application/json")
+	require.NotEqual(t, http.StatusOK, s.do(req).Code)
+
+	rec = scimDo(s, token, http.MethodGet, "/scim/v2/Users?filter="+url.QueryEscape("active eq false"), "")
+	require.Equal(t, float64(1), scimBody(t, rec)["totalResults"])
+
+	rec = scimDo(s, token, http.MethodPatch, "/scim/v2/Users/user_id1", `{"Operations": [{"op": "replace", "value": {"active": true}}]}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	passwordLogin(t, s)
+
+	events, err := s.auditRepo.ByUser(t.Context(), "user_id1", 10)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	require.Equal(t, "scim.user.reactivated", events[0].Action)
+	require.Equal(t, "scim.user.deactivated", events[1].Action)
+}
+
+func TestSCIMListPagination(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+	token := scimToken(t, s)
+
+	for _, name := range []string{"a", "b", "c"} {
+		rec := scimDo(s, token, http.MethodPost, "/scim/v2/Users", `{"userName": "`+name+`@example.com"}`)
+		require.Equal(t, http.StatusCreated, rec.Code)
+	}
+
+	rec := scimDo(s, token, http.MethodGet, "/scim/v2/Users?startIndex=2&count=2", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	list := scimBody(t, rec)
+	require.Equal(t, float64(4), list["totalResults"])
+	require.Equal(t, float64(2), list["itemsPerPage"])
+	require.Equal(t, float64(2), list["startIndex"])
+	resources := list["Resources"].([]any)
+	require.Equal(t, "a@example.com", resources[0].(map[string]any)["userName"])
+	require.Equal(t, "b@example.com", resources[1].(map[string]any)["userName"])
+
+	rec = scimDo(s, token, http.MethodGet, "/scim/v2/Users?startIndex=0&count=0", "")
+	list = scimBody(t, rec)
+	require.Equal(t, float64(4), list["totalResults"])
+	require.Equal(t, float64(1), list["startIndex"])
+	require.Empty(t, list["Resources"])
+
+	rec = scimDo(s, token, http.MethodGet, "/scim/v2/Users?filter="+url.QueryEscape(`userName sw "a" or userName sw "c"`), "")
+	require.Equal(t, float64(2), scimBody(t, rec)["totalResults"])
+
+	rec = scimDo(s, token, http.MethodGet, "/scim/v2/Users?count=many", "")
+	require.Equal(t, "invalidValue", scimErrorType(t, rec, http.StatusBadRequest))
+}
+
+func TestSCIMGroups(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+	token := scimToken(t, s)
+
+	rec := scimDo(s, token, http.MethodPost, "/scim/v2/Users", `{"userName": "member@example.com"}`)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	memberID := scimBody(t, rec)["id"].(string)
+
+	rec = scimDo(s, token, http.MethodPost, "/scim/v2/Groups", `{"displayName": "Engineering", "members": [{"value": "unknown"}]}`)
+	require.Equal(t, "invalidValue", scimErrorType(t, rec, http.StatusBadRequest))
+
+	rec = scimDo(s, token, http.MethodPost, "/scim/v2/Groups", `{"displayName": "Engineering", "members": [{"value": "user_id1"}]}`)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	group := scimBody(t, rec)
+	groupID := group["id"].(string)
+	require.Equal(t, "http://sso.test/scim/v2/Groups/"+groupID, rec.Header().Get("Location"))
+	require.Len(t, group["members"], 1)
+
+	rec = scimDo(s, token, http.MethodPost, "/scim/v2/Groups", `{"displayName": "Engineering"}`)
+	require.Equal(t, "uniqueness", scimErrorType(t, rec, http.StatusConflict))
+
+	rec = scimDo(s, token, http.MethodPatch, "/scim/v2/Groups/"+groupID, `{"Operations": [{"op": "add", "path": "members", "value": [{"value": "`+memberID+`"}, {"value": "user_id1"}]}]}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Len(t, scimBody(t, rec)["members"], 2)
+
+	rec = scimDo(s, token, http.MethodPatch, "/scim/v2/Groups/"+groupID, `{"Operations": [{"op": "remove", "path": "members[value eq \"user_id1\"]"}]}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Equal(t, `W/"3"`, rec.Header().Get("ETag"))
+
+	stored, err := s.groupRepo.ByID(t.Context(), groupID)
+	require.NoError(t, err)
+	require.Equal(t, []string{memberID}, stored.Members)
+
+	rec = scimDo(s, token, http.MethodGet, "/scim/v2/Groups?filter="+url.QueryEscape(`members eq "`+memberID+`"`), "")
+	require.Equal(t, float64(1), scimBody(t, rec)["totalResults"])
+
+	rec = scimDo(s, token, http.MethodGet, "/scim/v2/Groups?filter="+url.QueryEscape(`displayName co "sales"`), "")
+	require.Equal(t, float64(0), scimBody(t, rec)["totalResults"])
+
+	// a deleted user leaves its groups
+	rec = scimDo(s, token, http.MethodDelete, "/scim/v2/Users/"+memberID, "")
+	require.Equal(t, http.StatusNoContent, rec.Code)
+
+	stored, err = s.groupRepo.ByID(t.Context(), groupID)
+	require.NoError(t, err)
+	require.Empty(t, stored.Members)
+
+	rec = scimDo(s, token, http.MethodDelete, "/scim/v2/Groups/"+groupID, "", "If-Match", `W/"1"`)
+	scimErrorType(t, rec, http.StatusPreconditionFailed)
+
+	rec = scimDo(s, token, http.MethodDelete, "/scim/v2/Groups/"+groupID, "", "If-Match", "*")
+	require.Equal(t, http.StatusNoContent, rec.Code)
+
+	rec = scimDo(s, token, http.MethodGet, "/scim/v2/Groups/"+groupID, "")
+	scimErrorType(t, rec, http.StatusNotFound)
+}
+
+func TestParseSCIMFilter(t *testing.T) {
+	user := &core.User{ID: "id1", Name: "Barbara Jensen", Email: "bjensen@example.com", Status: "active", ExternalID: "ext"}
+	value := func(attribute string) any { return core.UserFilterValue(user, attribute) }
+
+	matches := map[string]bool{
+		`userName eq "BJensen@example.com"`: true,
+		`urn:ietf:params:scim:schemas:core:2.0:User:userName sw "bjensen"`: true,
+		`emails.value ew "@example.org"`: false,
+		`displayName co "jens" and active eq true`: true,
+		`not (active eq true) or externalId pr`: true,
+		`(id eq "id2" or id eq "id1") and not (displayName eq "x")`: true,
+		`active eq "true"`: false,
+		`meta.created gt "2020-01-01T00:00:00Z"`: false,
+		`userName EQ "bjensen@example.com" AND externalId ne "ext"`: false,
+	}
+	for raw, expected := range matches {
+		filter, err := core.ParseFilter(raw, core.UserFilterAttributes)
+		require.NoError(t, err, raw)
+		require.Equal(t, expected, filter.Match(value), raw)
+	}
+
+	invalid := []string{
+		``,
+		`userName`,
+		`userName eq`,
+		`userName like "b"`,
+		`password eq "x"`,
+		`emails[type eq "work"]`,
+		`(userName eq "a"`,
+		`userName eq "unterminated`,
+		`not userName eq "a"`,
+		`userName eq "a" extra`,
+		`userName eq bare`,
+	}
+	for _, raw := range invalid {
+		_, err := core.ParseFilter(raw, core.UserFilterAttributes)
+		require.ErrorIs(t, err, e.InvalidFilter, raw)
+	}
+}
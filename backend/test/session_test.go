@@ -0,0 +1,234 @@
+package test
+
+import (
+	"sso/internal/core"
+	"sso/internal/infrastructure"
+	e "sso/internal/core/errors"
+	"github.com/stretchr/testify/require"
+
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSessionValidateAndRevoke(t *testing.T) {
+	now := time.Now()
+
+	sessionRepo := &FakeSessionRepository{
+		sessions: []core.Session{
+			{
+				ID: "session_id1",
+				UserID: "user_id1",
+				CreatedAt: now,
+				LastSeenAt: now.Add(-time.Hour),
+				ExpiresAt: now.Add(time.Hour),
+			},
+			{
+				ID: "session_id2",
+				UserID: "user_id1",
+				CreatedAt: now,
+				LastSeenAt: now,
+				ExpiresAt: now.Add(time.Hour),
+			},
+			{
+				ID: "session_id3",
+				UserID: "user_id2",
+				CreatedAt: now,
+				LastSeenAt: now,
+				ExpiresAt: now.Add(time.Hour),
+			},
+		},
+	}
+
+	sessionUC := core.NewSessionUseCase(sessionRepo)
+	ctx := context.Background()
+
+	session, err := sessionUC.Validate(ctx, "session_id1", "user_id1")
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now(), session.LastSeenAt, time.Second)
+	require.WithinDuration(t, time.Now(), sessionRepo.sessions[0].LastSeenAt, time.Second)
+
+	_, err = sessionUC.Validate(ctx, "session_id3", "user_id1")
+	require.ErrorIs(t, err, e.SessionNotFound)
+
+	_, err = sessionUC.Validate(ctx, "", "user_id1")
+	require.ErrorIs(t, err, e.SessionNotFound)
+
+	err = sessionUC.Revoke(ctx, "user_id1", "session_id3")
+	require.ErrorIs(t, err, e.SessionNotFound)
+
+	err = sessionUC.Revoke(ctx, "user_id1", "session_id1")
+	require.NoError(t, err)
+
+	_, err = sessionUC.Validate(ctx, "session_id1", "user_id1")
+	require.ErrorIs(t, err, e.SessionInactive)
+
+	sessions, err := sessionUC.List(ctx, "user_id1")
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	require.Equal(t, "session_id2", sessions[0].ID)
+
+	err = sessionUC.RevokeAll(ctx, "user_id1")
+	require.NoError(t, err)
+
+	sessions, err = sessionUC.List(ctx, "user_id1")
+	require.NoError(t, err)
+	require.Empty(t, sessions)
+
+	_, err = sessionUC.Validate(ctx, "session_id3", "user_id2")
+	require.NoError(t, err)
+}
+
+func TestSessionExpired(t *testing.T) {
+	now := time.Now()
+
+	sessionRepo := &FakeSessionRepository{
+		sessions: []core.Session{
+			{
+				ID: "session_id1",
+				UserID: "user_id1",
+				CreatedAt: now.Add(-2*time.Hour),
+				LastSeenAt: now.Add(-2*time.Hour),
+				ExpiresAt: now.Add(-time.Hour),
+			},
+		},
+	}
+
+	sessionUC := core.NewSessionUseCase(sessionRepo)
+
+	_, err := sessionUC.Validate(context.Background(), "session_id1", "user_id1")
+	require.ErrorIs(t, err, e.SessionInactive)
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	now := time.Now()
+
+	sessionRepo := &FakeSessionRepository{
+		sessions: []core.Session{
+			{
+				ID: "session_id1",
+				UserID: "user_id1",
+				CreatedAt: now.Add(-time.Hour),
+				LastSeenAt: now.Add(-31*time.Minute),
+				ExpiresAt: now.Add(time.Hour),
+				IdleTimeout: 30*60,
+			},
+			{
+				ID: "session_id2",
+				UserID: "user_id1",
+				CreatedAt: now.Add(-time.Hour),
+				LastSeenAt: now.Add(-29*time.Minute),
+				ExpiresAt: now.Add(time.Hour),
+				IdleTimeout: 30*60,
+			},
+		},
+	}
+
+	sessionUC := core.NewSessionUseCase(sessionRepo)
+	ctx := context.Background()
+
+	_, err := sessionUC.Validate(ctx, "session_id1", "user_id1")
+	require.ErrorIs(t, err, e.SessionInactive)
+
+	session, err := sessionUC.Validate(ctx, "session_id2", "user_id1")
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now().Add(30*time.Minute), session.IdleExpiresAt(), time.Second)
+}
+
+func TestLoginSessionPolicies(t *testing.T) {
+	userRepo := &FakeUserRepository{
+		users: []core.User{
+			{
+				ID: "user_id1",
+				Name: "1",
+				Email: "email@example.com",
+				Status: "active",
+				Identities: []core.Identity{
+					{
+						ID: "identity_id1",
+						Type: "email",
+						Credentials: []core.Credential{
+							{
+								Type: "password",
+								Hash: "password_hashed",
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	clientRepo := &FakeClientRepository{
+		clients: []core.Client{
+			{
+				ID: "1",
+				ClientID: "strict",
+				Status: "active",
+				SessionPolicy: &core.SessionPolicy{
+					IdleTimeout: 60,
+					Lifetime: 600,
+				},
+			},
+		},
+	}
+
+	policies := core.SessionPolicies{
+		Default: core.SessionPolicy{
+			IdleTimeout: 1800,
+			Lifetime: 3600,
+		},
+		RememberMe: core.SessionPolicy{
+			IdleTimeout: 7*24*3600,
+			Lifetime: 30*24*3600,
+		},
+	}
+
+	tests := []struct{
+		testName string
+		clientID string
+		rememberMe bool
+		wantPolicy core.SessionPolicy
+	}{
+		{
+			testName: "default policy",
+			wantPolicy: policies.Default,
+		},
+		{
+			testName: "remember me picks the longer policy",
+			rememberMe: true,
+			wantPolicy: policies.RememberMe,
+		},
+		{
+			testName: "client overrides the default policy",
+			clientID: "strict",
+			wantPolicy: *clientRepo.clients[0].SessionPolicy,
+		},
+		{
+			testName: "client without remember me override falls back to the server policy",
+			clientID: "strict",
+			rememberMe: true,
+			wantPolicy: policies.RememberMe,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			sessionRepo := &FakeSessionRepository{}
+			loginUC := core.NewLoginUseCase(userRepo, &FakeTokenRepository{}, &FakeHashRepository{}, sessionRepo, clientRepo, policies, infrastructure.NewPendingLinksInterface(), nil, infrastructure.NewPartialSessionsInterface(), nil, nil, nil)
+
+			_, session, err := loginUC.Execute(context.Background(), core.LoginInput{
+				Provider: "email",
+				Email: "email@example.com",
+				Password: "password",
+				ClientID: tt.clientID,
+				RememberMe: tt.rememberMe,
+			})
+
+			require.NoError(t, err)
+			require.Equal(t, tt.rememberMe, session.RememberMe)
+			require.Equal(t, tt.wantPolicy.IdleTimeout, session.IdleTimeout)
+			require.WithinDuration(t, time.Now().Add(time.Duration(tt.wantPolicy.Lifetime)*time.Second), session.ExpiresAt, time.Second)
+		})
+	}
+}
@@ -0,0 +1,315 @@
+package test
+
+import (
+	"sso/internal/core"
+	e "sso/internal/core/errors"
+	"sso/internal/infrastructure"
+	"github.com/stretchr/testify/require"
+
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+)
+
+// withResponseField replaces a field of the response member of a credential
+func withResponseField(t *testing.T, credential, field string, value []byte) string {
+	var decoded map[string]any
+	require.NoError(t, json.Unmarshal([]byte(credential), &decoded))
+
+	decoded["response"].(map[string]any)[field] = base64.RawURLEncoding.EncodeToString(value)
+
+	encoded, err := json.Marshal(decoded)
+	require.NoError(t, err)
+
+	return string(encoded)
+}
+
+func responseField(t *testing.T, credential, field string) []byte {
+	var decoded struct {
+		Response map[string]string `json:"response"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(credential), &decoded))
+
+	value, err := base64.RawURLEncoding.DecodeString(decoded.Response[field])
+	require.NoError(t, err)
+
+	return value
+}
+
+func TestWebAuthnInterfaceRegistration(t *testing.T) {
+	webauthn := infrastructure.NewWebAuthnInterface("sso.test", []string{"http://sso.test"})
+
+	noneAttestation := func(authData []byte) []byte {
+		return cbor([]any{"fmt", "none", "attStmt", []any{}, "authData", authData})
+	}
+
+	a := newSoftAuthenticator(t)
+	registration, err := webauthn.ParseRegistration([]byte(a.attestation("challenge", noneAttestation(a.attestedAuthData(t, 0x01|0x04|0x40)))))
+	require.NoError(t, err)
+	require.Equal(t, "challenge", registration.Challenge)
+	require.Equal(t, a.id(), registration.CredentialID)
+	require.Equal(t, a.coseKey(t), registration.PublicKey)
+	require.EqualValues(t, 1, registration.SignCount)
+
+	tests := []struct{
+		testName string
+		response func(a *softAuthenticator) string
+	}{
+		{
+			testName: "origin of another site",
+			response: func(a *softAuthenticator) string {
+				a.origin = "http://evil.test"
+				return a.attestation("challenge", noneAttestation(a.attestedAuthData(t, 0x01|0x04|0x40)))
+			},
+		},
+		{
+			testName: "rp id hash of another relying party",
+			response: func(a *softAuthenticator) string {
+				a.rpID = "evil.test"
+				return a.attestation("challenge", noneAttestation(a.attestedAuthData(t, 0x01|0x04|0x40)))
+			},
+		},
+		{
+			testName: "user not present",
+			response: func(a *softAuthenticator) string {
+				return a.attestation("challenge", noneAttestation(a.attestedAuthData(t, 0x04|0x40)))
+			},
+		},
+		{
+			testName: "no attested credential",
+			response: func(a *softAuthenticator) string {
+				return a.attestation("challenge", noneAttestation(a.authData(0x01|0x04)))
+			},
+		},
+		{
+			testName: "authenticator data too short",
+			response: func(a *softAuthenticator) string {
+				return a.attestation("challenge", noneAttestation(a.authData(0x01|0x04|0x40)[:36]))
+			},
+		},
+		{
+			testName: "credential id longer than the data",
+			response: func(a *softAuthenticator) string {
+				authData := append(a.authData(0x01|0x04|0x40), make([]byte, 16)...)
+				authData = binary.BigEndian.AppendUint16(authData, 1024)
+				authData = append(authData, a.credentialID...)
+				return a.attestation("challenge", noneAttestation(authData))
+			},
+		},
+		{
+			testName: "truncated cose key",
+			response: func(a *softAuthenticator) string {
+				authData := a.attestedAuthData(t, 0x01|0x04|0x40)
+				return a.attestation("challenge", noneAttestation(authData[:len(authData)-10]))
+			},
+		},
+		{
+			testName: "cose key on another curve",
+			response: func(a *softAuthenticator) string {
+				authData := append(a.authData(0x01|0x04|0x40), make([]byte, 16)...)
+				authData = binary.BigEndian.AppendUint16(authData, uint16(len(a.credentialID)))
+				authData = append(authData, a.credentialID...)
+				authData = append(authData, cbor([]any{1, 2, 3, -7, -1, 2, -2, make([]byte, 48), -3, make([]byte, 48)})...)
+				return a.attestation("challenge", noneAttestation(authData))
+			},
+		},
+		{
+			testName: "attested credential of another authenticator",
+			response: func(a *softAuthenticator) string {
+				return a.attestation("challenge", noneAttestation(newSoftAuthenticator(t).attestedAuthData(t, 0x01|0x04|0x40)))
+			},
+		},
+		{
+			testName: "unsupported attestation format",
+			response: func(a *softAuthenticator) string {
+				return a.attestation("challenge", cbor([]any{"fmt", "tpm", "attStmt", []any{}, "authData", a.attestedAuthData(t, 0x01|0x04|0x40)}))
+			},
+		},
+		{
+			testName: "packed self attestation with a wrong signature",
+			response: func(a *softAuthenticator) string {
+				statement := []any{"alg", -7, "sig", []byte{0x30, 0x00}}
+				return a.attestation("challenge", cbor([]any{"fmt", "packed", "attStmt", statement, "authData", a.attestedAuthData(t, 0x01|0x04|0x40)}))
+			},
+		},
+		{
+			testName: "truncated cbor",
+			response: func(a *softAuthenticator) string {
+				attestation := noneAttestation(a.attestedAuthData(t, 0x01|0x04|0x40))
+				return a.attestation("challenge", attestation[:len(attestation)/2])
+			},
+		},
+		{
+			testName: "cbor that is not a map",
+			response: func(a *softAuthenticator) string {
+				return a.attestation("challenge", []byte{0x82, 0x01, 0x02})
+			},
+		},
+		{
+			testName: "empty cbor",
+			response: func(a *softAuthenticator) string {
+				return a.attestation("challenge", nil)
+			},
+		},
+		{
+			testName: "indefinite cbor length",
+			response: func(a *softAuthenticator) string {
+				return a.attestation("challenge", []byte{0xbf, 0x63, 'f', 'm', 't', 0x64, 'n', 'o', 'n', 'e', 0xff})
+			},
+		},
+		{
+			testName: "cbor array longer than the data",
+			response: func(a *softAuthenticator) string {
+				return a.attestation("challenge", []byte{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+			},
+		},
+		{
+			testName: "cbor string longer than the data",
+			response: func(a *softAuthenticator) string {
+				return a.attestation("challenge", []byte{0xa1, 0x63, 'f', 'm', 't', 0x7a, 0x00, 0x01, 0x00, 0x00, 'n'})
+			},
+		},
+		{
+			testName: "cbor nested too deep",
+			response: func(a *softAuthenticator) string {
+				return a.attestation("challenge", append(bytes.Repeat([]byte{0x81}, 32), 0x01))
+			},
+		},
+		{
+			testName: "cbor map with a byte string key",
+			response: func(a *softAuthenticator) string {
+				return a.attestation("challenge", []byte{0xa1, 0x41, 0x00, 0x01})
+			},
+		},
+		{
+			testName: "cbor integer out of range",
+			response: func(a *softAuthenticator) string {
+				return a.attestation("challenge", []byte{0xa1, 0x63, 'f', 'm', 't', 0x1b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+			},
+		},
+		{
+			testName: "assertion instead of an attestation",
+			response: func(a *softAuthenticator) string {
+				return a.get(t, core.CredentialRequestOptions{Challenge: "challenge"}, 0x01|0x04)
+			},
+		},
+		{
+			testName: "not a public key credential",
+			response: func(a *softAuthenticator) string {
+				return `{"id":"` + a.id() + `","rawId":"` + a.id() + `","type":"password"}`
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			registration, err := webauthn.ParseRegistration([]byte(test.response(newSoftAuthenticator(t))))
+			require.ErrorIs(t, err, e.InvalidWebAuthnResponse)
+			require.Nil(t, registration)
+		})
+	}
+}
+
+func TestWebAuthnInterfaceAssertion(t *testing.T) {
+	webauthn := infrastructure.NewWebAuthnInterface("sso.test", []string{"http://sso.test"})
+	options := core.CredentialRequestOptions{Challenge: "challenge"}
+
+	a := newSoftAuthenticator(t)
+	assertion, err := webauthn.ParseAssertion([]byte(a.get(t, options, 0x01|0x04)))
+	require.NoError(t, err)
+	require.Equal(t, "challenge", assertion.Challenge)
+	require.Equal(t, a.id(), assertion.CredentialID)
+	require.True(t, assertion.UserVerified)
+	require.EqualValues(t, 1, assertion.SignCount)
+	require.NoError(t, webauthn.VerifyAssertion(assertion, a.coseKey(t)))
+
+	assertion, err = webauthn.ParseAssertion([]byte(a.get(t, options, 0x01)))
+	require.NoError(t, err)
+	require.False(t, assertion.UserVerified)
+	require.EqualValues(t, 2, assertion.SignCount)
+
+	t.Run("refused responses", func(t *testing.T) {
+		tests := []struct{
+			testName string
+			response func(a *softAuthenticator) string
+		}{
+			{
+				testName: "origin of another site",
+				response: func(a *softAuthenticator) string {
+					a.origin = "http://evil.test"
+					return a.get(t, options, 0x01|0x04)
+				},
+			},
+			{
+				testName: "rp id hash of another relying party",
+				response: func(a *softAuthenticator) string {
+					a.rpID = "evil.test"
+					return a.get(t, options, 0x01|0x04)
+				},
+			},
+			{
+				testName: "user not present",
+				response: func(a *softAuthenticator) string {
+					return a.get(t, options, 0x04)
+				},
+			},
+			{
+				testName: "authenticator data too short",
+				response: func(a *softAuthenticator) string {
+					return withResponseField(t, a.get(t, options, 0x01|0x04), "authenticatorData", a.authData(0x01|0x04)[:36])
+				},
+			},
+			{
+				testName: "client data that is not json",
+				response: func(a *softAuthenticator) string {
+					return withResponseField(t, a.get(t, options, 0x01|0x04), "clientDataJSON", []byte("{"))
+				},
+			},
+			{
+				testName: "client data without a challenge",
+				response: func(a *softAuthenticator) string {
+					return withResponseField(t, a.get(t, options, 0x01|0x04), "clientDataJSON", a.clientData("webauthn.get", ""))
+				},
+			},
+			{
+				testName: "attestation instead of an assertion",
+				response: func(a *softAuthenticator) string {
+					return a.attestation("challenge", cbor([]any{"fmt", "none", "attStmt", []any{}, "authData", a.attestedAuthData(t, 0x01|0x04|0x40)}))
+				},
+			},
+		}
+
+		for _, test := range tests {
+			t.Run(test.testName, func(t *testing.T) {
+				assertion, err := webauthn.ParseAssertion([]byte(test.response(newSoftAuthenticator(t))))
+				require.ErrorIs(t, err, e.InvalidWebAuthnResponse)
+				require.Nil(t, assertion)
+			})
+		}
+	})
+
+	t.Run("signature of another key", func(t *testing.T) {
+		assertion, err := webauthn.ParseAssertion([]byte(a.get(t, options, 0x01|0x04)))
+		require.NoError(t, err)
+		require.ErrorIs(t, webauthn.VerifyAssertion(assertion, newSoftAuthenticator(t).coseKey(t)), e.InvalidWebAuthnResponse)
+	})
+
+	t.Run("authenticator data changed after signing", func(t *testing.T) {
+		response := a.get(t, options, 0x01|0x04)
+		authData := responseField(t, response, "authenticatorData")
+		// the user verified flag is dropped, the data still parses
+		authData[32] = 0x01
+
+		assertion, err := webauthn.ParseAssertion([]byte(withResponseField(t, response, "authenticatorData", authData)))
+		require.NoError(t, err)
+		require.ErrorIs(t, webauthn.VerifyAssertion(assertion, a.coseKey(t)), e.InvalidWebAuthnResponse)
+	})
+
+	t.Run("malformed public key", func(t *testing.T) {
+		assertion, err := webauthn.ParseAssertion([]byte(a.get(t, options, 0x01|0x04)))
+		require.NoError(t, err)
+		require.ErrorIs(t, webauthn.VerifyAssertion(assertion, a.coseKey(t)[:20]), e.InvalidWebAuthnResponse)
+	})
+}
@@ -0,0 +1,381 @@
+package test
+
+import (
+	"sso/internal/core"
+	"github.com/stretchr/testify/require"
+
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+// cborHead encodes the major type and argument of a CBOR data item
+func cborHead(major byte, arg uint64) []byte {
+	switch {
+	case arg < 24:
+		return []byte{major<<5 | byte(arg)}
+	case arg < 1<<8:
+		return []byte{major<<5 | 24, byte(arg)}
+	case arg < 1<<16:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(arg))
+	default:
+		return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(arg))
+	}
+}
+
+// cbor encodes the few types authenticators send, map entries are given as key, value pairs
+// so their order is kept
+func cbor(value any) []byte {
+	switch v := value.(type) {
+	case int:
+		if v < 0 {
+			return cborHead(1, uint64(-1-v))
+		}
+		return cborHead(0, uint64(v))
+	case []byte:
+		return append(cborHead(2, uint64(len(v))), v...)
+	case string:
+		return append(cborHead(3, uint64(len(v))), v...)
+	case []any:
+		encoded := cborHead(5, uint64(len(v)/2))
+		for _, item := range v {
+			encoded = append(encoded, cbor(item)...)
+		}
+		return encoded
+	}
+
+	panic("cbor type is not supported")
+}
+
+// softAuthenticator is a passkey authenticator holding one ES256 credential
+type softAuthenticator struct {
+	key *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle string
+	counter uint32
+	origin string
+	rpID string
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	credentialID := make([]byte, 16)
+	_, err = rand.Read(credentialID)
+	require.NoError(t, err)
+
+	return &softAuthenticator{
+		key: key,
+		credentialID: credentialID,
+		origin: "http://sso.test",
+		rpID: "sso.test",
+	}
+}
+
+func (a *softAuthenticator) id() string {
+	return base64.RawURLEncoding.EncodeToString(a.credentialID)
+}
+
+func (a *softAuthenticator) clientData(ctype, challenge string) []byte {
+	data, _ := json.Marshal(map[string]any{
+		"type": ctype,
+		"challenge": challenge,
+		"origin": a.origin,
+	})
+
+	return data
+}
+
+func (a *softAuthenticator) authData(flags byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	a.counter++
+
+	return binary.BigEndian.AppendUint32(append(rpIDHash[:], flags), a.counter)
+}
+
+// create answers the options of a registration with an attestation of the none format
+func (a *softAuthenticator) create(t *testing.T, options core.CredentialCreationOptions) string {
+	a.userHandle = options.User.ID
+
+	return a.attestation(options.Challenge, cbor([]any{"fmt", "none", "attStmt", []any{}, "authData", a.attestedAuthData(t, 0x01|0x04|0x40)}))
+}
+
+// coseKey is the public key of the credential in its COSE form
+func (a *softAuthenticator) coseKey(t *testing.T) []byte {
+	point, err := a.key.PublicKey.Bytes()
+	require.NoError(t, err)
+
+	return cbor([]any{1, 2, 3, -7, -1, 1, -2, point[1:33], -3, point[33:]})
+}
+
+// attestedAuthData is authenticator data with the attested credential, flags are its flags
+func (a *softAuthenticator) attestedAuthData(t *testing.T, flags byte) []byte {
+	authData := a.authData(flags)
+	authData = append(authData, make([]byte, 16)...)
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(a.credentialID)))
+	authData = append(authData, a.credentialID...)
+
+	return append(authData, a.coseKey(t)...)
+}
+
+// attestation is a registration response carrying the attestation object as given
+func (a *softAuthenticator) attestation(challenge string, attestationObject []byte) string {
+	response, _ := json.Marshal(map[string]any{
+		"id": a.id(),
+		"rawId": a.id(),
+		"type": "public-key",
+		"response": map[string]any{
+			"clientDataJSON": base64.RawURLEncoding.EncodeToString(a.clientData("webauthn.create", challenge)),
+			"attestationObject": base64.RawURLEncoding.EncodeToString(attestationObject),
+			"transports": []string{"internal"},
+		},
+	})
+
+	return string(response)
+}
+
+// get answers the options of an authentication, flags are the ones of the authenticator data
+func (a *softAuthenticator) get(t *testing.T, options core.CredentialRequestOptions, flags byte) string {
+	clientData := a.clientData("webauthn.get", options.Challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	authData := a.authData(flags)
+
+	digest := sha256.Sum256(append(authData, clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	require.NoError(t, err)
+
+	response, _ := json.Marshal(map[string]any{
+		"id": a.id(),
+		"rawId": a.id(),
+		"type": "public-key",
+		"response": map[string]any{
+			"clientDataJSON": base64.RawURLEncoding.EncodeToString(clientData),
+			"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+			"signature": base64.RawURLEncoding.EncodeToString(signature),
+			"userHandle": a.userHandle,
+		},
+	})
+
+	return string(response)
+}
+
+func registerPasskey(t *testing.T, s *pagesServer, sessionCookie *http.Cookie, authenticator *softAuthenticator) core.Passkey {
+	rec := mfaDo(s, http.MethodPost, "/auth/webauthn/register/options", "", sessionCookie)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var options core.CredentialCreationOptions
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &options))
+
+	rec = mfaDo(s, http.MethodPost, "/auth/webauthn/register", authenticator.create(t, options), sessionCookie)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	var passkey core.Passkey
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &passkey))
+
+	return passkey
+}
+
+func passkeyLoginOptions(t *testing.T, s *pagesServer, body string) core.CredentialRequestOptions {
+	rec := mfaDo(s, http.MethodPost, "/auth/webauthn/login/options", body)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var options core.CredentialRequestOptions
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &options))
+
+	return options
+}
+
+func passkeyLogin(s *pagesServer, assertion string) *httptest.ResponseRecorder {
+	return mfaDo(s, http.MethodPost, "/auth/login?provider=webauthn", `{"credential":`+assertion+`}`)
+}
+
+func TestWebAuthnRegistration(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+	sessionCookie := passwordLogin(t, s)
+	authenticator := newSoftAuthenticator(t)
+
+	rec := mfaDo(s, http.MethodPost, "/auth/webauthn/register/options", "", sessionCookie)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var options core.CredentialCreationOptions
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &options))
+	require.Equal(t, "sso.test", options.RP.ID)
+	require.Equal(t, "user@example.com", options.User.Name)
+	require.NotEmpty(t, options.User.ID)
+	require.Empty(t, options.ExcludeCredentials)
+
+	// a response made for another site is refused
+	authenticator.origin = "http://evil.test"
+	rec = mfaDo(s, http.MethodPost, "/auth/webauthn/register", authenticator.create(t, options), sessionCookie)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	require.Contains(t, rec.Body.String(), "webauthn response is invalid")
+
+	authenticator.origin = "http://sso.test"
+	passkey := registerPasskey(t, s, sessionCookie, authenticator)
+	require.Equal(t, authenticator.id(), passkey.CredentialID)
+	require.Equal(t, []string{"internal"}, passkey.Transports)
+
+	rec = mfaDo(s, http.MethodGet, "/auth/webauthn/credentials", "", sessionCookie)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var list struct {
+		Passkeys []core.Passkey `json:"passkeys"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &list))
+	require.Len(t, list.Passkeys, 1)
+
+	// the next registration keeps the user handle and excludes the registered authenticator
+	rec = mfaDo(s, http.MethodPost, "/auth/webauthn/register/options", "", sessionCookie)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &options))
+	require.Equal(t, authenticator.userHandle, options.User.ID)
+	require.Len(t, options.ExcludeCredentials, 1)
+	require.Equal(t, authenticator.id(), options.ExcludeCredentials[0].ID)
+
+	require.True(t, containsAuditAction(s.auditRepo.events, "webauthn.registered"))
+}
+
+func TestWebAuthnPasswordlessLogin(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+	authenticator := newSoftAuthenticator(t)
+	registerPasskey(t, s, passwordLogin(t, s), authenticator)
+
+	// discoverable login, the authenticator names the account
+	options := passkeyLoginOptions(t, s, `{}`)
+	require.Equal(t, "sso.test", options.RPID)
+	require.Equal(t, "required", options.UserVerification)
+	require.Empty(t, options.AllowCredentials)
+
+	assertion := authenticator.get(t, options, 0x01|0x04)
+	rec := passkeyLogin(s, assertion)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NotNil(t, findCookie(rec, "sso_session_token"))
+
+	session := s.sessionRepo.sessions[len(s.sessionRepo.sessions)-1]
+	require.Equal(t, []string{"hwk", "mfa"}, session.AuthMethods)
+
+	// a challenge is answered once
+	rec = passkeyLogin(s, assertion)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// with an email the passkeys of the account are allowed
+	options = passkeyLoginOptions(t, s, `{"email":"user@example.com"}`)
+	require.Len(t, options.AllowCredentials, 1)
+	require.Equal(t, authenticator.id(), options.AllowCredentials[0].ID)
+
+	// a passkey alone signs in only when the user was verified
+	rec = passkeyLogin(s, authenticator.get(t, options, 0x01))
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// an unknown email is answered like a discoverable login
+	options = passkeyLoginOptions(t, s, `{"email":"nobody@example.com"}`)
+	require.Empty(t, options.AllowCredentials)
+}
+
+func TestWebAuthnSignCounter(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+	authenticator := newSoftAuthenticator(t)
+	registerPasskey(t, s, passwordLogin(t, s), authenticator)
+
+	require.Equal(t, http.StatusOK, passkeyLogin(s, authenticator.get(t, passkeyLoginOptions(t, s, `{}`), 0x01|0x04)).Code)
+
+	// a clone of the authenticator signs with a counter that was already seen
+	authenticator.counter -= 2
+	rec := passkeyLogin(s, authenticator.get(t, passkeyLoginOptions(t, s, `{}`), 0x01|0x04))
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	require.Contains(t, rec.Body.String(), "webauthn response is invalid")
+
+	// the last counter seen does not count up either
+	authenticator.counter = 1
+	rec = passkeyLogin(s, authenticator.get(t, passkeyLoginOptions(t, s, `{}`), 0x01|0x04))
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// refused assertions leave the counter where it was
+	require.Equal(t, http.StatusOK, passkeyLogin(s, authenticator.get(t, passkeyLoginOptions(t, s, `{}`), 0x01|0x04)).Code)
+}
+
+func TestWebAuthnSecondFactor(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+	authenticator := newSoftAuthenticator(t)
+	sessionCookie := passwordLogin(t, s)
+	registerPasskey(t, s, sessionCookie, authenticator)
+
+	rec := mfaDo(s, http.MethodGet, "/auth/mfa", "", sessionCookie)
+	require.JSONEq(t, `{"totp":false,"recovery_codes":0,"passkeys":1}`, rec.Body.String())
+
+	rec = mfaDo(s, http.MethodPost, "/auth/login?provider=email", `{"email":"user@example.com","password":"password"}`)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	var challenge struct {
+		MFAToken string `json:"mfa_token"`
+		MFAMethods []string `json:"mfa_methods"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &challenge))
+	require.Equal(t, []string{"webauthn"}, challenge.MFAMethods)
+
+	rec = mfaDo(s, http.MethodPost, "/auth/mfa/webauthn/options", `{"mfa_token":"`+challenge.MFAToken+`"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var options core.CredentialRequestOptions
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &options))
+	require.Len(t, options.AllowCredentials, 1)
+
+	// an assertion of the passwordless login does not answer the second step
+	rec = mfaDo(s, http.MethodPost, "/auth/mfa/verify", `{"mfa_token":"`+challenge.MFAToken+`","webauthn":`+authenticator.get(t, passkeyLoginOptions(t, s, `{}`), 0x01|0x04)+`}`)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	require.Contains(t, rec.Body.String(), "second factor code is invalid")
+
+	// presence is enough next to the password
+	rec = mfaDo(s, http.MethodPost, "/auth/mfa/verify", `{"mfa_token":"`+challenge.MFAToken+`","webauthn":`+authenticator.get(t, options, 0x01)+`}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NotNil(t, findCookie(rec, "sso_session_token"))
+
+	session := s.sessionRepo.sessions[len(s.sessionRepo.sessions)-1]
+	require.Equal(t, []string{"pwd", "hwk", "mfa"}, session.AuthMethods)
+}
+
+func TestWebAuthnRemove(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+	sessionCookie := passwordLogin(t, s)
+	first := registerPasskey(t, s, sessionCookie, newSoftAuthenticator(t))
+	second := registerPasskey(t, s, sessionCookie, newSoftAuthenticator(t))
+
+	require.Equal(t, http.StatusNotFound, mfaDo(s, http.MethodDelete, "/auth/webauthn/credentials/unknown", "", sessionCookie).Code)
+
+	require.Equal(t, http.StatusNoContent, mfaDo(s, http.MethodDelete, "/auth/webauthn/credentials/"+first.ID, "", sessionCookie).Code)
+	require.Len(t, listIdentities(t, s, sessionCookie), 2)
+
+	// the last passkey takes the webauthn identity with it
+	require.Equal(t, http.StatusNoContent, mfaDo(s, http.MethodDelete, "/auth/webauthn/credentials/"+second.ID, "", sessionCookie).Code)
+	require.Len(t, listIdentities(t, s, sessionCookie), 1)
+
+	rec := mfaDo(s, http.MethodGet, "/auth/mfa", "", sessionCookie)
+	require.JSONEq(t, `{"totp":false,"recovery_codes":0,"passkeys":0}`, rec.Body.String())
+	passwordLogin(t, s)
+
+	require.True(t, containsAuditAction(s.auditRepo.events, "webauthn.removed"))
+}
+
+func TestWebAuthnRemoveLastLoginMethod(t *testing.T) {
+	s := newPagesServer(t, "", nil)
+	sessionCookie := passwordLogin(t, s)
+	passkey := registerPasskey(t, s, sessionCookie, newSoftAuthenticator(t))
+
+	// the email identity is left without a password, the passkey is all the user signs in with
+	s.userRepo.credentials = slices.DeleteFunc(s.userRepo.credentials, func(cred core.Credential) bool { return cred.Type == "password" })
+
+	rec := mfaDo(s, http.MethodDelete, "/auth/webauthn/credentials/"+passkey.ID, "", sessionCookie)
+	require.Equal(t, http.StatusConflict, rec.Code)
+	require.Len(t, listIdentities(t, s, sessionCookie), 2)
+
+	rec = mfaDo(s, http.MethodGet, "/auth/mfa", "", sessionCookie)
+	require.JSONEq(t, `{"totp":false,"recovery_codes":0,"passkeys":1}`, rec.Body.String())
+}